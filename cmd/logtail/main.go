@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"errors"
 	"flag"
+	"github.com/akkeris/logtrain/internal/config"
 	"github.com/akkeris/logtrain/internal/debug"
 	"github.com/akkeris/logtrain/internal/storage"
+	"github.com/akkeris/logtrain/pkg/input"
 	"github.com/akkeris/logtrain/pkg/input/syslogtcp"
 	"github.com/akkeris/logtrain/pkg/input/syslogtls"
 	"github.com/akkeris/logtrain/pkg/input/syslogudp"
@@ -32,6 +34,7 @@ var options struct {
 	CPUProfile string
 	MemProfile string
 	KubeConfig string
+	Config     string
 }
 
 type httpServer struct {
@@ -40,7 +43,7 @@ type httpServer struct {
 }
 
 type tailsRequest struct {
-	Hostname string `hostname`
+	Hostname string `json:"hostname"`
 }
 
 type activeTail struct {
@@ -54,7 +57,7 @@ var activeTails map[string]activeTail
 var activeTailsMutex *sync.Mutex
 
 func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
-	term := make(chan os.Signal)
+	term := make(chan os.Signal, 1)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 	for {
 		select {
@@ -83,80 +86,48 @@ func init() {
 	flag.StringVar(&options.CPUProfile, "cpuprofile", "", "write cpu profile to file")
 	flag.StringVar(&options.MemProfile, "memprofile", "", "write mem profile to file")
 	flag.StringVar(&options.KubeConfig, "kube-config", "", "specify the kube config path to be used")
+	flag.StringVar(&options.Config, "config", "", "specify the configuration file to be used (or set CONFIG_FILE)")
 	flag.Parse()
 	prometheus.MustRegister(prometheus.NewBuildInfoCollector())
 }
 
-func getOsOrDefault(key string, def string) string {
-	val := os.Getenv(key)
-	if val == "" {
-		return def
+// configPath returns the configuration file set with -config or CONFIG_FILE, if neither
+// is set logtail is configured with environment variables.
+func configPath() string {
+	if options.Config != "" {
+		return options.Config
 	}
-	return val
+	return os.Getenv("CONFIG_FILE")
 }
 
-func addInputsToRouter(router *router.Router, server *httpServer) error {
-	var addedInput = false
-
-	// Check to see if syslog over tcp will be used.
-	if os.Getenv("SYSLOG_TCP") == "true" {
-		handle, err := syslogtcp.Create("0.0.0.0:" + getOsOrDefault("SYSLOG_TCP_PORT", "9002"))
-		if err != nil {
-			return err
+func addInputsToRouter(router *router.Router, c *config.Config) error {
+	for _, in := range c.Inputs {
+		var handle input.Input
+		var port string
+		var err error
+		switch in.Type {
+		case "syslogtcp":
+			port = in.Get("port", "9002")
+			handle, err = syslogtcp.Create("0.0.0.0:" + port)
+		case "syslogudp":
+			port = in.Get("port", "9003")
+			handle, err = syslogudp.Create("0.0.0.0:" + port)
+		case "syslogtls":
+			port = in.Get("port", "9004")
+			handle, err = syslogtls.Create(in.Get("server_name", ""), in.Get("key_pem", ""), in.Get("cert_pem", ""), in.Get("ca_pem", ""), "0.0.0.0:"+port)
+		default:
+			err = errors.New("logtail does not support the input " + in.Type)
 		}
-		if err := handle.Dial(); err != nil {
-			return err
-		}
-		if err := router.AddInput(handle, "syslogtcp"); err != nil {
-			return err
-		}
-		addedInput = true
-		log.Printf("[main] Added syslog over tcp on port %s \n", getOsOrDefault("SYSLOG_TCP_PORT", "9002"))
-	}
-
-	// Check to see if syslog over udp will be used.
-	if os.Getenv("SYSLOG_UDP") == "true" {
-		handle, err := syslogudp.Create("0.0.0.0:" + getOsOrDefault("SYSLOG_UDP_PORT", "9003"))
 		if err != nil {
 			return err
 		}
 		if err := handle.Dial(); err != nil {
 			return err
 		}
-		if err := router.AddInput(handle, "syslogudp"); err != nil {
+		if err := router.AddInput(handle, in.ID); err != nil {
 			return err
 		}
-		addedInput = true
-		log.Printf("[main] Added syslog over udp on port %s \n", getOsOrDefault("SYSLOG_UDP_PORT", "9003"))
-	}
-
-	// Check to see if syslog over tls will be used.
-	if os.Getenv("SYSLOG_TLS") == "true" {
-		if os.Getenv("SYSLOG_TLS_CERT_PEM") == "" {
-			return errors.New("the syslog tls environment variable SYSLOG_TLS_CERT_PEM was not found")
-		}
-		if os.Getenv("SYSLOG_TLS_KEY_PEM") == "" {
-			return errors.New("the syslog tls environment variable SYSLOG_TLS_KEY_PEM was not found")
-		}
-		if os.Getenv("SYSLOG_TLS_SERVER_NAME") == "" {
-			return errors.New("the syslog tls environment variable SYSLOG_TLS_SERVER_NAME was not found")
-		}
-		handle, err := syslogtls.Create(os.Getenv("SYSLOG_TLS_SERVER_NAME"), os.Getenv("SYSLOG_TLS_KEY_PEM"), os.Getenv("SYSLOG_TLS_CERT_PEM"), os.Getenv("SYSLOG_TLS_CA_PEM"), "0.0.0.0:"+getOsOrDefault("SYSLOG_TLS_PORT", "9004"))
-		if err != nil {
-			return err
-		}
-		if err := handle.Dial(); err != nil {
-			return err
-		}
-		if err := router.AddInput(handle, "syslogtls"); err != nil {
-			return err
-		}
-		addedInput = true
-		log.Printf("[main] Added syslog over tcp+tls on port %s \n", getOsOrDefault("SYSLOG_TLS_PORT", "9004"))
-	}
-
-	if !addedInput {
-		return errors.New("no data inputs were found")
+		log.Printf("[main] Added %s on port %s \n", in.ID, port)
 	}
 	return nil
 }
@@ -189,17 +160,22 @@ func createHTTPServer(port string) *httpServer {
 	return service
 }
 
-func getTailsEndpoint() string {
-	if os.Getenv("NAME") == "" || os.Getenv("NAMESPACE") == "" {
-		return ""
-	}
-	if os.Getenv("SYSLOG_TLS") == "true" {
-		return "syslog+tls://" + os.Getenv("NAME") + "." + os.Getenv("NAMESPACE") + ":" + getOsOrDefault("SYSLOG_TCP_PORT", "9004")
-	} else if os.Getenv("SYSLOG_TCP") == "true" {
-		return "syslog+tcp://" + os.Getenv("NAME") + "." + os.Getenv("NAMESPACE") + ":" + getOsOrDefault("SYSLOG_TLS_PORT", "9002")
-	} else {
-		return "syslog+udp://" + os.Getenv("NAME") + "." + os.Getenv("NAMESPACE") + ":" + getOsOrDefault("SYSLOG_UDP_PORT", "9003")
+// getTailsEndpoint returns the endpoint logtrain sends tailed logs to, syslog over tls is
+// preferred over tcp and then udp.
+func getTailsEndpoint(c *config.Config) string {
+	host := c.Logtail.Name + "." + c.Logtail.Namespace
+	for _, endpoint := range []struct{ input, schema, port string }{
+		{"syslogtls", "syslog+tls://", "9004"},
+		{"syslogtcp", "syslog+tcp://", "9002"},
+		{"syslogudp", "syslog+udp://", "9003"},
+	} {
+		for _, in := range c.Inputs {
+			if in.Type == endpoint.input {
+				return endpoint.schema + host + ":" + in.Get("port", endpoint.port)
+			}
+		}
 	}
+	return ""
 }
 
 func runSweepTails() {
@@ -226,6 +202,15 @@ func runSweepTails() {
 }
 
 func runWithContext(ctx context.Context) error {
+	c, err := config.Load(configPath())
+	if err != nil {
+		return err
+	}
+	if err := c.ValidateLogtail(); err != nil {
+		return err
+	}
+	debug.SetDebug(c.Debug)
+
 	go runSweepTails() // collect expired tails and remove them from the map.
 
 	if options.CPUProfile != "" {
@@ -236,8 +221,8 @@ func runWithContext(ctx context.Context) error {
 		rpprof.StartCPUProfile(f)
 		defer rpprof.StopCPUProfile()
 	}
-	httpServer := createHTTPServer(getOsOrDefault("HTTP_PORT", "9000"))
-	if os.Getenv("PROFILE") == "true" {
+	httpServer := createHTTPServer(c.HTTPPort)
+	if c.Profile {
 		httpServer.mux.HandleFunc("/debug/pprof/", http.HandlerFunc(pprof.Index))
 		httpServer.mux.HandleFunc("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
 		httpServer.mux.HandleFunc("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
@@ -248,11 +233,11 @@ func runWithContext(ctx context.Context) error {
 		httpServer.mux.HandleFunc("/debug/pprof/goroutine", pprof.Handler("goroutine").ServeHTTP)
 		httpServer.mux.HandleFunc("/debug/pprof/mutex", pprof.Handler("mutex").ServeHTTP)
 		httpServer.mux.HandleFunc("/metrics", promhttp.Handler().ServeHTTP)
-	} else if os.Getenv("METRICS") == "true" {
+	} else if c.Metrics {
 		httpServer.mux.HandleFunc("/metrics", promhttp.Handler().ServeHTTP)
 	}
 
-	dss, err := storage.FindDataSources(os.Getenv("KUBERNETES_DATASOURCE") == "true", options.KubeConfig, os.Getenv("POSTGRES") == "true", os.Getenv("DATABASE_URL"))
+	dss, err := storage.FindDataSources(c.DataSources.Kubernetes, options.KubeConfig, c.Akkeris, c.DataSources.Postgres, c.DataSources.DatabaseURL)
 	if err != nil {
 		return err
 	}
@@ -274,7 +259,7 @@ func runWithContext(ctx context.Context) error {
 		return err
 	}
 
-	tailsEndpoint := getTailsEndpoint()
+	tailsEndpoint := getTailsEndpoint(c)
 	for _, route := range routes {
 		if route.Endpoint == tailsEndpoint {
 			if err := dssw[0].EmitRemoveRoute(route); err != nil {
@@ -293,7 +278,7 @@ func runWithContext(ctx context.Context) error {
 	}
 
 	// Add listeners to router
-	if err := addInputsToRouter(router, httpServer); err != nil {
+	if err := addInputsToRouter(router, c); err != nil {
 		return err
 	}
 	
@@ -322,9 +307,9 @@ func runWithContext(ctx context.Context) error {
 		}
 		activeTailsMutex.Unlock()
 
-		var url = "http://" + os.Getenv("NAME") + "." + os.Getenv("NAMESPACE") + "/tails/" + uid.String()
-		if os.Getenv("LOGTAIL_HOST_SUFFIX") != "" {
-			url = "https://" + os.Getenv("NAME") + os.Getenv("LOGTAIL_HOST_SUFFIX") + "/tails/" + uid.String()
+		var url = "http://" + c.Logtail.Name + "." + c.Logtail.Namespace + "/tails/" + uid.String()
+		if c.Logtail.HostSuffix != "" {
+			url = "https://" + c.Logtail.Name + c.Logtail.HostSuffix + "/tails/" + uid.String()
 		}
 
 		w.WriteHeader(http.StatusCreated)
@@ -467,9 +452,6 @@ func run() error {
 
 func main() {
 	log.Printf("[main] Starting\n")
-	if getTailsEndpoint() == "" {
-		log.Fatalf("[main] required value NAME and NAMESPACE was not set.")
-	}
 	if err := run(); err != nil && err != context.Canceled && err != context.DeadlineExceeded {
 		debug.Fatalf("%s\n", err.Error())
 	}
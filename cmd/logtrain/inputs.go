@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"github.com/akkeris/logtrain/internal/config"
+	"github.com/akkeris/logtrain/internal/storage"
+	"github.com/akkeris/logtrain/pkg/input"
+	envoy "github.com/akkeris/logtrain/pkg/input/envoy"
+	"github.com/akkeris/logtrain/pkg/input/file"
+	"github.com/akkeris/logtrain/pkg/input/forward"
+	http_events "github.com/akkeris/logtrain/pkg/input/http"
+	kube "github.com/akkeris/logtrain/pkg/input/kubernetes"
+	"github.com/akkeris/logtrain/pkg/input/multiline"
+	"github.com/akkeris/logtrain/pkg/input/otlp"
+	"github.com/akkeris/logtrain/pkg/input/sysloghttp"
+	"github.com/akkeris/logtrain/pkg/input/syslogtcp"
+	"github.com/akkeris/logtrain/pkg/input/syslogtls"
+	"github.com/akkeris/logtrain/pkg/input/syslogudp"
+	"github.com/akkeris/logtrain/pkg/router"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// runningInput is an input created from its configuration, inputs received over the
+// http server also have the path and handler they are served on.
+type runningInput struct {
+	config      config.Input
+	input       input.Input
+	path        string
+	handler     http.HandlerFunc
+	description string
+}
+
+// inputSet keeps the inputs added to the router in sync with the configuration.
+type inputSet struct {
+	unattributed uint64 // unattributed envoy entries of inputs that were removed
+	mutex        sync.Mutex
+	router       *router.Router
+	server       *httpServer
+	settings     *config.Config // the settings inputs are created with, changes require a restart
+	running      map[string]*runningInput
+	register     sync.Once
+}
+
+// withMultiline wraps the input so lines are joined if the multiline_start or multiline_continuation
+// options are set, otherwise the input is returned as is.
+func withMultiline(in input.Input, c config.Input) (input.Input, error) {
+	if c.Get("multiline_start", "") == "" && c.Get("multiline_continuation", "") == "" {
+		return in, nil
+	}
+	var conf multiline.Config
+	var err error
+	if c.Get("multiline_start", "") != "" {
+		if conf.Start, err = regexp.Compile(c.Get("multiline_start", "")); err != nil {
+			return nil, err
+		}
+	}
+	if c.Get("multiline_continuation", "") != "" {
+		if conf.Continuation, err = regexp.Compile(c.Get("multiline_continuation", "")); err != nil {
+			return nil, err
+		}
+	}
+	if c.Get("multiline_max_lines", "") != "" {
+		if conf.MaxLines, err = strconv.Atoi(c.Get("multiline_max_lines", "")); err != nil {
+			return nil, err
+		}
+	}
+	if c.Get("multiline_max_wait", "") != "" {
+		if conf.MaxWait, err = time.ParseDuration(c.Get("multiline_max_wait", "")); err != nil {
+			return nil, err
+		}
+	}
+	return multiline.Create(in, conf)
+}
+
+func split(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// createInput creates (but does not dial) the input described by the configuration, the
+// configuration has been validated so required options are set.
+func createInput(c config.Input, settings *config.Config) (*runningInput, error) {
+	switch c.Type {
+	case "envoy":
+		in, err := envoy.Create(":"+c.Get("port", "9001"), envoy.Config{
+			Fields:       split(c.Get("fields", "")),
+			TCPFields:    split(c.Get("tcp_fields", "")),
+			Format:       c.Get("format", ""),
+			Hostname:     c.Get("hostname", ""),
+			Unattributed: c.Get("unattributed_hostname", ""),
+			Akkeris:      settings.Akkeris,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &runningInput{input: in, description: "envoy on port " + c.Get("port", "9001")}, nil
+	case "otlp":
+		in, err := otlp.Create(":"+c.Get("port", "4317"), otlp.Mapping{
+			Hostname: c.Get("hostname", ""),
+			Tag:      c.Get("tag", ""),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &runningInput{input: in, path: c.Get("http_path", "/v1/logs"), handler: in.HandlerFunc, description: "otlp on port " + c.Get("port", "4317") + " and http path " + c.Get("http_path", "/v1/logs")}, nil
+	case "forward":
+		in, err := forward.Create("0.0.0.0:"+c.Get("port", "24224"), forward.Mapping{
+			Hostname: c.Get("hostname", ""),
+			Tag:      c.Get("tag", ""),
+			Message:  c.Get("message_key", ""),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &runningInput{input: in, description: "fluent forward on port " + c.Get("port", "24224")}, nil
+	case "http":
+		in, err := http_events.Create()
+		if err != nil {
+			return nil, err
+		}
+		return &runningInput{input: in, path: c.Get("path", "/events"), handler: in.HandlerFunc, description: "http endpoint " + c.Get("path", "/events") + " for JSON syslog payloads"}, nil
+	case "sysloghttp":
+		in, err := sysloghttp.Create()
+		if err != nil {
+			return nil, err
+		}
+		return &runningInput{input: in, path: c.Get("path", "/syslog"), handler: in.HandlerFunc, description: "syslog over http on path " + c.Get("path", "/syslog")}, nil
+	case "syslogtcp":
+		in, err := syslogtcp.Create("0.0.0.0:" + c.Get("port", "9002"))
+		if err != nil {
+			return nil, err
+		}
+		return &runningInput{input: in, description: "syslog over tcp on port " + c.Get("port", "9002")}, nil
+	case "syslogudp":
+		in, err := syslogudp.Create("0.0.0.0:" + c.Get("port", "9003"))
+		if err != nil {
+			return nil, err
+		}
+		return &runningInput{input: in, description: "syslog over udp on port " + c.Get("port", "9003")}, nil
+	case "syslogtls":
+		in, err := syslogtls.Create(c.Get("server_name", ""), c.Get("key_pem", ""), c.Get("cert_pem", ""), c.Get("ca_pem", ""), "0.0.0.0:"+c.Get("port", "9004"))
+		if err != nil {
+			return nil, err
+		}
+		return &runningInput{input: in, description: "syslog over tcp+tls on port " + c.Get("port", "9004")}, nil
+	case "kubernetes":
+		k8sClient, err := storage.GetKubernetesClient(options.KubeConfig)
+		if err != nil {
+			return nil, err
+		}
+		k8sInput, err := kube.Create(c.Get("log_path", ""), c.Get("positions_path", ""), k8sClient, settings.Akkeris, settings.JSONParser)
+		if err != nil {
+			return nil, err
+		}
+		in, err := withMultiline(k8sInput, c)
+		if err != nil {
+			return nil, err
+		}
+		return &runningInput{input: in, description: "kubernetes file watcher"}, nil
+	case "file":
+		fileInput, err := file.Create(split(c.Get("patterns", "")), c.Get("hostname", ""), c.Get("tag", ""), c.Get("positions_path", ""))
+		if err != nil {
+			return nil, err
+		}
+		in, err := withMultiline(fileInput, c)
+		if err != nil {
+			return nil, err
+		}
+		return &runningInput{input: in, description: "file watcher for " + c.Get("patterns", "")}, nil
+	}
+	return nil, errors.New("Unknown input type " + c.Type)
+}
+
+func createInputSet(router *router.Router, server *httpServer, settings *config.Config) *inputSet {
+	return &inputSet{
+		router:   router,
+		server:   server,
+		settings: settings,
+		running:  make(map[string]*runningInput),
+	}
+}
+
+// envoyUnattributed sums the unattributed entries of the envoy inputs, including those removed.
+func (set *inputSet) envoyUnattributed() float64 {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	total := atomic.LoadUint64(&set.unattributed)
+	for _, r := range set.running {
+		if in, ok := r.input.(*envoy.EnvoyAlsServer); ok {
+			total += in.Unattributed()
+		}
+	}
+	return float64(total)
+}
+
+func (set *inputSet) remove(id string) {
+	r := set.running[id]
+	if err := set.router.RemoveInput(id); err != nil {
+		log.Printf("[main] Unable to remove input %s: %s\n", id, err.Error())
+	}
+	if r.path != "" {
+		set.server.unhandle(r.path)
+	}
+	if in, ok := r.input.(*envoy.EnvoyAlsServer); ok {
+		atomic.AddUint64(&set.unattributed, in.Unattributed())
+	}
+	if err := r.input.Close(); err != nil {
+		log.Printf("[main] Unable to close input %s: %s\n", id, err.Error())
+	}
+	delete(set.running, id)
+	log.Printf("[main] Removed %s (%s)\n", r.description, id)
+}
+
+func (set *inputSet) add(c config.Input) error {
+	r, err := createInput(c, set.settings)
+	if err != nil {
+		return err
+	}
+	r.config = c
+	if err := r.input.Dial(); err != nil {
+		return err
+	}
+	if r.path != "" {
+		set.server.handle(r.path, r.handler)
+	}
+	if err := set.router.AddInput(r.input, c.ID); err != nil {
+		if r.path != "" {
+			set.server.unhandle(r.path)
+		}
+		r.input.Close()
+		return err
+	}
+	if _, ok := r.input.(*envoy.EnvoyAlsServer); ok {
+		set.register.Do(func() {
+			prometheus.MustRegister(prometheus.NewCounterFunc(
+				prometheus.CounterOpts{
+					Name: "logtrain_envoy_unattributed",
+					Help: "The amount of envoy access log entries that could not be attributed to a hostname.",
+				},
+				set.envoyUnattributed,
+			))
+		})
+	}
+	set.running[c.ID] = r
+	log.Printf("[main] Added %s (%s)\n", r.description, c.ID)
+	return nil
+}
+
+// apply diffs the configured inputs against the running inputs, inputs that were removed or
+// changed are removed from the router and closed, then new or changed inputs are dialed and
+// added. Inputs that did not change keep running untouched. If a changed input can not be added
+// its previous configuration is restored, every input is attempted and the errors are returned
+// together with the inputs that are running.
+func (set *inputSet) apply(inputs []config.Input) error {
+	if len(inputs) == 0 {
+		return errors.New("No data inputs were found.")
+	}
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	configured := make(map[string]config.Input)
+	for _, c := range inputs {
+		configured[c.ID] = c
+	}
+	previous := make(map[string]config.Input)
+	for id, r := range set.running {
+		if c, ok := configured[id]; !ok || !reflect.DeepEqual(c, r.config) {
+			if ok {
+				previous[id] = r.config
+			}
+			set.remove(id)
+		}
+	}
+	failures := make([]string, 0)
+	for _, c := range inputs {
+		if _, ok := set.running[c.ID]; ok {
+			continue
+		}
+		if err := set.add(c); err != nil {
+			failures = append(failures, "Unable to add input "+c.ID+": "+err.Error())
+			if old, ok := previous[c.ID]; ok {
+				if err := set.add(old); err != nil {
+					failures = append(failures, "Unable to restore input "+c.ID+": "+err.Error())
+				} else {
+					log.Printf("[main] Restored the previous configuration of %s\n", c.ID)
+				}
+			}
+		}
+	}
+	if len(failures) > 0 {
+		running := make([]string, 0, len(set.running))
+		for id := range set.running {
+			running = append(running, id)
+		}
+		sort.Strings(running)
+		return errors.New(strings.Join(failures, ", ") + " (running inputs: " + strings.Join(running, ", ") + ")")
+	}
+	return nil
+}
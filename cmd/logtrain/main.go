@@ -1,27 +1,29 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"flag"
+	"github.com/akkeris/logtrain/internal/config"
 	"github.com/akkeris/logtrain/internal/debug"
 	"github.com/akkeris/logtrain/internal/storage"
-	envoy "github.com/akkeris/logtrain/pkg/input/envoy"
-	http_events "github.com/akkeris/logtrain/pkg/input/http"
-	kube "github.com/akkeris/logtrain/pkg/input/kubernetes"
-	"github.com/akkeris/logtrain/pkg/input/sysloghttp"
-	"github.com/akkeris/logtrain/pkg/input/syslogtcp"
-	"github.com/akkeris/logtrain/pkg/input/syslogtls"
-	"github.com/akkeris/logtrain/pkg/input/syslogudp"
+	"github.com/akkeris/logtrain/pkg/api"
+	"github.com/akkeris/logtrain/pkg/processor"
 	"github.com/akkeris/logtrain/pkg/router"
+	"github.com/fsnotify/fsnotify"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"reflect"
 	rpprof "runtime/pprof"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -30,6 +32,7 @@ var options struct {
 	CpuProfile string
 	MemProfile string
 	KubeConfig string
+	Config     string
 }
 
 var (
@@ -65,6 +68,22 @@ var (
 		},
 		[]string{"syslog"},
 	)
+	syslogQueuedBytes = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       "logtrain_syslog_queued_bytes",
+			Help:       "The size of the packets waiting in a drain's disk buffer.",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		},
+		[]string{"syslog"},
+	)
+	syslogEvicted = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       "logtrain_syslog_evicted",
+			Help:       "The amount of packets removed from a drain's disk buffer before being sent because it was full.",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		},
+		[]string{"syslog"},
+	)
 	syslogDeadPackets = prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
 			Name:       "logtrain_syslog_deadpackets",
@@ -73,15 +92,60 @@ var (
 		},
 		[]string{"service"},
 	)
+	syslogDropped = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       "logtrain_syslog_dropped",
+			Help:       "The amount of packets dropped by reason (no_route, buffer_full, failed_to_connect, paused).",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		},
+		[]string{"reason", "host", "syslog"},
+	)
+	syslogRedactions = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       "logtrain_redactions",
+			Help:       "The amount of values masked by redact processors.",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		},
+		[]string{"host"},
+	)
 )
 
 type httpServer struct {
-	mux    *http.ServeMux
-	server *http.Server
+	mux      *http.ServeMux
+	server   *http.Server
+	mutex    sync.Mutex
+	handlers map[string]http.HandlerFunc
+}
+
+// handle serves the handler on the path, a path is only registered on the mux once
+// so inputs removed on a reload can be added on it again.
+func (s *httpServer) handle(path string, handler http.HandlerFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.handlers[path]; !ok {
+		s.mux.HandleFunc(path, func(response http.ResponseWriter, req *http.Request) {
+			s.mutex.Lock()
+			h := s.handlers[path]
+			s.mutex.Unlock()
+			if h == nil {
+				http.NotFound(response, req)
+				return
+			}
+			h(response, req)
+		})
+	}
+	s.handlers[path] = handler
+}
+
+// unhandle stops serving the path, requests to it are answered with a 404
+func (s *httpServer) unhandle(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handlers[path] = nil
 }
 
 func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
-	term := make(chan os.Signal)
+	term := make(chan os.Signal, 1)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 	for {
 		select {
@@ -110,173 +174,47 @@ func init() {
 	flag.StringVar(&options.CpuProfile, "cpuprofile", "", "write cpu profile to file")
 	flag.StringVar(&options.MemProfile, "memprofile", "", "write mem profile to file")
 	flag.StringVar(&options.KubeConfig, "kube-config", "", "specify the kube config path to be used")
+	flag.StringVar(&options.Config, "config", "", "specify the configuration file to be used (or set CONFIG_FILE)")
 	flag.Parse()
 	prometheus.MustRegister(syslogErrors)
 	prometheus.MustRegister(syslogSent)
 	prometheus.MustRegister(syslogPressure)
 	prometheus.MustRegister(syslogConnections)
+	prometheus.MustRegister(syslogQueuedBytes)
+	prometheus.MustRegister(syslogEvicted)
 	prometheus.MustRegister(syslogDeadPackets)
+	prometheus.MustRegister(syslogDropped)
+	prometheus.MustRegister(syslogRedactions)
 	prometheus.MustRegister(prometheus.NewBuildInfoCollector())
 }
 
-func createRouter(ds []storage.DataSource) (*router.Router, error) {
+func createRouter(ds []storage.DataSource, c *config.Config) (*router.Router, error) {
 	r, err := router.NewRouter(ds, true, 40 /* max connections */)
 	if err != nil {
 		return nil, err
 	}
-	if err := r.Dial(); err != nil {
-		return nil, err
-	}
-	return r, nil
-}
-
-func getOsOrDefault(key string, def string) string {
-	val := os.Getenv(key)
-	if val == "" {
-		return def
-	}
-	return val
-}
-
-func addInputsToRouter(router *router.Router, server *httpServer) error {
-	var addedInput = false
-	// Check to see if we should add istio/envoy inputs
-	if os.Getenv("ENVOY") == "true" {
-		address := ":"
-		if os.Getenv("ENVOY_PORT") != "" {
-			address = address + os.Getenv("ENVOY_PORT")
-		} else {
-			address = address + "9001"
-		}
-		in, err := envoy.Create(address)
-		if err != nil {
-			return err
-		}
-		if err := in.Dial(); err != nil {
-			return err
-		}
-		if err := router.AddInput(in, "istio+envoy"); err != nil {
-			return err
-		}
-		addedInput = true
-		log.Printf("[main] Added envoy on port %s\n", getOsOrDefault("ENVOY_PORT", "9001"))
-	}
-
-	// Check to see if http events will be used as an input
-	if os.Getenv("HTTP_EVENTS") == "true" {
-		handle, err := http_events.Create()
-		if err != nil {
-			return err
-		}
-		if err := handle.Dial(); err != nil {
-			return err
-		}
-		server.mux.HandleFunc(getOsOrDefault("HTTP_EVENTS_PATH", "/events"), handle.HandlerFunc)
-		if err := router.AddInput(handle, "http"); err != nil {
-			return err
-		}
-		addedInput = true
-		log.Printf("[main] Added http endpoint %s for JSON syslog payloads\n", getOsOrDefault("HTTP_EVENTS_PATH", "/events"))
-	}
-
-	// Check to see if syslog over http will be used as an input
-	if os.Getenv("HTTP_SYSLOG") == "true" {
-		handle, err := sysloghttp.Create()
-		if err != nil {
-			return err
-		}
-		if err := handle.Dial(); err != nil {
-			return err
-		}
-		server.mux.HandleFunc(getOsOrDefault("HTTP_SYSLOG_PATH", "/syslog"), handle.HandlerFunc)
-		if err := router.AddInput(handle, "sysloghttp"); err != nil {
-			return err
-		}
-		addedInput = true
-		log.Printf("[main] Added syslog over http on path %s \n", getOsOrDefault("HTTP_SYSLOG_PATH", "/syslog"))
-	}
-
-	// Check to see if syslog over tcp will be used.
-	if os.Getenv("SYSLOG_TCP") == "true" {
-		handle, err := syslogtcp.Create("0.0.0.0:" + getOsOrDefault("SYSLOG_TCP_PORT", "9002"))
-		if err != nil {
-			return err
-		}
-		if err := handle.Dial(); err != nil {
-			return err
-		}
-		if err := router.AddInput(handle, "syslogtcp"); err != nil {
-			return err
-		}
-		addedInput = true
-		log.Printf("[main] Added syslog over tcp on port %s \n", getOsOrDefault("SYSLOG_TCP_PORT", "9002"))
-	}
-
-	// Check to see if syslog over udp will be used.
-	if os.Getenv("SYSLOG_UDP") == "true" {
-		handle, err := syslogudp.Create("0.0.0.0:" + getOsOrDefault("SYSLOG_UDP_PORT", "9003"))
+	r.SetOutputOptions(c.OutputOptions())
+	if len(c.Processors) != 0 {
+		chain, err := processor.CreateChain(c.Processors)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if err := handle.Dial(); err != nil {
-			return err
-		}
-		if err := router.AddInput(handle, "syslogudp"); err != nil {
-			return err
-		}
-		addedInput = true
-		log.Printf("[main] Added syslog over udp on port %s \n", getOsOrDefault("SYSLOG_UDP_PORT", "9003"))
+		r.SetProcessors(chain)
 	}
-
-	// Check to see if syslog over tls will be used.
-	if os.Getenv("SYSLOG_TLS") == "true" {
-		if os.Getenv("SYSLOG_TLS_CERT_PEM") == "" {
-			return errors.New("The syslog tls environment variable SYSLOG_TLS_CERT_PEM was not found.")
-		}
-		if os.Getenv("SYSLOG_TLS_KEY_PEM") == "" {
-			return errors.New("The syslog tls environment variable SYSLOG_TLS_KEY_PEM was not found.")
-		}
-		if os.Getenv("SYSLOG_TLS_SERVER_NAME") == "" {
-			return errors.New("The syslog tls environment variable SYSLOG_TLS_SERVER_NAME was not found.")
+	if c.DrainBuffer.Path != "" {
+		if err := r.SetDrainBuffer(c.DrainBuffer.Path, c.DrainBuffer.MaxBytes); err != nil {
+			return nil, err
 		}
-		handle, err := syslogtls.Create(os.Getenv("SYSLOG_TLS_SERVER_NAME"), os.Getenv("SYSLOG_TLS_KEY_PEM"), os.Getenv("SYSLOG_TLS_CERT_PEM"), os.Getenv("SYSLOG_TLS_CA_PEM"), "0.0.0.0:"+getOsOrDefault("SYSLOG_TLS_PORT", "9004"))
-		if err != nil {
-			return err
-		}
-		if err := handle.Dial(); err != nil {
-			return err
-		}
-		if err := router.AddInput(handle, "syslogtls"); err != nil {
-			return err
-		}
-		addedInput = true
-		log.Printf("[main] Added syslog over tcp+tls on port %s \n", getOsOrDefault("SYSLOG_TLS_PORT", "9004"))
 	}
-
-	// Check to see if we should add kubernetes as an input
-	if os.Getenv("KUBERNETES") == "true" {
-		k8sClient, err := storage.GetKubernetesClient(options.KubeConfig)
-		if err != nil {
-			return err
+	if c.DeadLetter != "" {
+		if err := r.SetDeadLetter(c.DeadLetter); err != nil {
+			return nil, err
 		}
-		in, err := kube.Create(os.Getenv("KUBERNETES_LOG_PATH"), k8sClient)
-		if err != nil {
-			return err
-		}
-		if err := in.Dial(); err != nil {
-			return err
-		}
-		if err := router.AddInput(in, "kubernetes"); err != nil {
-			return err
-		}
-		addedInput = true
-		log.Printf("[main] Added kubernetes file watcher\n")
 	}
-
-	if !addedInput {
-		return errors.New("No data inputs were found.")
+	if err := r.Dial(); err != nil {
+		return nil, err
 	}
-	return nil
+	return r, nil
 }
 
 func prometheusMetricsLoop(router *router.Router) {
@@ -290,10 +228,18 @@ func prometheusMetricsLoop(router *router.Router) {
 				syslogPressure.WithLabelValues(endpoint).Observe(metric.Pressure)
 				syslogErrors.WithLabelValues(endpoint).Observe(float64(metric.Errors))
 				syslogSent.WithLabelValues(endpoint).Observe(float64(metric.Sent))
+				syslogQueuedBytes.WithLabelValues(endpoint).Observe(float64(metric.QueuedBytes))
+				syslogEvicted.WithLabelValues(endpoint).Observe(float64(metric.Evicted))
 
 				// TODO: sanitize endpoint.
 			}
 			syslogDeadPackets.WithLabelValues("uniform").Observe(float64(router.DeadPackets()))
+			for drop, count := range router.Drops() {
+				syslogDropped.WithLabelValues(drop.Reason, drop.Hostname, drop.Endpoint).Observe(float64(count))
+			}
+			for host, count := range router.Redactions() {
+				syslogRedactions.WithLabelValues(host).Observe(float64(count))
+			}
 			router.ResetMetrics()
 		}
 	}
@@ -302,7 +248,8 @@ func prometheusMetricsLoop(router *router.Router) {
 func createHttpServer(port string) *httpServer {
 	mux := http.NewServeMux()
 	return &httpServer{
-		mux: mux,
+		mux:      mux,
+		handlers: make(map[string]http.HandlerFunc),
 		server: &http.Server{
 			Addr:           ":" + port,
 			Handler:        mux,
@@ -313,7 +260,92 @@ func createHttpServer(port string) *httpServer {
 	}
 }
 
+// configPath returns the configuration file set with -config or CONFIG_FILE, if neither
+// is set logtrain is configured with environment variables.
+func configPath() string {
+	if options.Config != "" {
+		return options.Config
+	}
+	return os.Getenv("CONFIG_FILE")
+}
+
+// reload reads the configuration file again and applies its inputs and processors to the running
+// router, the configuration that is running afterwards is returned.
+func reload(path string, router *router.Router, inputs *inputSet, running *config.Config) *config.Config {
+	c, err := config.Load(path)
+	if err != nil {
+		log.Printf("[main] Unable to reload the configuration: %s\n", err.Error())
+		return running
+	}
+	settings, runningSettings := *c, *running
+	settings.Inputs, settings.Processors, runningSettings.Inputs, runningSettings.Processors = nil, nil, nil, nil
+	if !reflect.DeepEqual(settings, runningSettings) {
+		log.Printf("[main] Changes to settings other than inputs and processors require a restart and were not applied\n")
+	}
+	if !reflect.DeepEqual(c.Processors, running.Processors) {
+		chain, err := processor.CreateChain(c.Processors)
+		if err != nil {
+			log.Printf("[main] Unable to reload the processors: %s\n", err.Error())
+		} else {
+			router.SetProcessors(chain)
+			log.Printf("[main] Reloaded %d processors\n", len(chain))
+		}
+	}
+	if err := inputs.apply(c.Inputs); err != nil {
+		log.Printf("[main] Unable to reload the inputs: %s\n", err.Error())
+	}
+	return c
+}
+
+// watchConfig reloads the configuration file on a SIGHUP or when its contents change, the
+// directory is watched rather than the file as a mounted configmap is updated by swapping a symlink.
+func watchConfig(ctx context.Context, path string, router *router.Router, inputs *inputSet, running *config.Config) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer watcher.Close()
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				log.Printf("[main] Received SIGHUP, reloading %s\n", path)
+				running = reload(path, router, inputs, running)
+			case <-watcher.Events:
+				changed, err := ioutil.ReadFile(path)
+				if err != nil || bytes.Equal(changed, contents) {
+					continue
+				}
+				contents = changed
+				log.Printf("[main] The configuration %s changed, reloading\n", path)
+				running = reload(path, router, inputs, running)
+			case err := <-watcher.Errors:
+				log.Printf("[main] Error watching the configuration %s: %s\n", path, err.Error())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
 func runWithContext(ctx context.Context) error {
+	c, err := config.Load(configPath())
+	if err != nil {
+		return err
+	}
+	debug.SetDebug(c.Debug)
 	if options.CpuProfile != "" {
 		f, err := os.Create(options.CpuProfile)
 		if err != nil {
@@ -322,8 +354,8 @@ func runWithContext(ctx context.Context) error {
 		rpprof.StartCPUProfile(f)
 		defer rpprof.StopCPUProfile()
 	}
-	httpServer := createHttpServer(getOsOrDefault("HTTP_PORT", "9000"))
-	if os.Getenv("PROFILE") == "true" {
+	httpServer := createHttpServer(c.HTTPPort)
+	if c.Profile {
 		httpServer.mux.HandleFunc("/debug/pprof/", http.HandlerFunc(pprof.Index))
 		httpServer.mux.HandleFunc("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
 		httpServer.mux.HandleFunc("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
@@ -334,26 +366,40 @@ func runWithContext(ctx context.Context) error {
 		httpServer.mux.HandleFunc("/debug/pprof/goroutine", pprof.Handler("goroutine").ServeHTTP)
 		httpServer.mux.HandleFunc("/debug/pprof/mutex", pprof.Handler("mutex").ServeHTTP)
 		httpServer.mux.HandleFunc("/metrics", promhttp.Handler().ServeHTTP)
-	} else if os.Getenv("METRICS") == "true" {
+	} else if c.Metrics {
 		httpServer.mux.HandleFunc("/metrics", promhttp.Handler().ServeHTTP)
 	}
 
 	go httpServer.server.ListenAndServe()
 
-	ds, err := storage.FindDataSources(os.Getenv("KUBERNETES_DATASOURCE") == "true", options.KubeConfig, os.Getenv("POSTGRES") == "true", os.Getenv("DATABASE_URL"))
+	ds, err := storage.FindDataSources(c.DataSources.Kubernetes, options.KubeConfig, c.Akkeris, c.DataSources.Postgres, c.DataSources.DatabaseURL)
 	if err != nil {
 		return err
 	}
 	if len(ds) == 0 {
 		return errors.New("No data sources were defined, either kubernetes or postgresql are required.")
 	}
-	router, err := createRouter(ds)
+	router, err := createRouter(ds, c)
 	if err != nil {
 		return err
 	}
-	if err := addInputsToRouter(router, httpServer); err != nil {
+	if c.APIToken != "" {
+		admin, err := api.Create(router, c.APIToken)
+		if err != nil {
+			return err
+		}
+		admin.Register(httpServer.mux)
+		log.Printf("[main] Added api on port %s\n", c.HTTPPort)
+	}
+	inputs := createInputSet(router, httpServer, c)
+	if err := inputs.apply(c.Inputs); err != nil {
 		return err
 	}
+	if configPath() != "" {
+		if err := watchConfig(ctx, configPath(), router, inputs, c); err != nil {
+			return err
+		}
+	}
 	prometheusMetricsLoop(router) // This never returns
 	return nil
 }
@@ -3,11 +3,13 @@ module github.com/akkeris/logtrain
 go 1.14
 
 require (
+	github.com/Shopify/sarama v1.27.2
 	github.com/VividCortex/godaemon v0.0.0-20201030185937-6073f6ce8f76 // indirect
 	github.com/aws/aws-sdk-go v1.35.7
-	github.com/envoyproxy/go-control-plane v0.9.7
+	github.com/envoyproxy/go-control-plane v0.9.9-0.20201210154907-fd9021fe5dad
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/golang/protobuf v1.4.3
+	github.com/golang/snappy v0.0.1
 	github.com/google/uuid v1.1.2
 	github.com/howbazaar/loggo v0.0.0-20160511211902-0e0537f18a29 // indirect
 	github.com/influxdata/tail v1.0.0
@@ -26,9 +28,12 @@ require (
 	github.com/trevorlinton/go-tail v0.0.1
 	github.com/trevorlinton/remote_syslog2 v0.19.13
 	github.com/valyala/fastjson v1.6.3
+	github.com/vmihailenco/msgpack/v5 v5.0.0
+	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c
+	go.opentelemetry.io/proto/otlp v0.7.0
 	golang.org/x/sys v0.0.0-20201110211018-35f3e6cf4a65 // indirect
 	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e // indirect
-	google.golang.org/grpc v1.33.2
+	google.golang.org/grpc v1.36.0
 	google.golang.org/protobuf v1.25.0
 	gopkg.in/mcuadros/go-syslog.v2 v2.3.0
 	k8s.io/api v0.17.0
@@ -36,4 +41,5 @@ require (
 	k8s.io/client-go v0.17.0
 	k8s.io/klog v1.0.0 // indirect
 	k8s.io/utils v0.0.0-20201027101359-01387209bb0d // indirect
+	sigs.k8s.io/yaml v1.1.0
 )
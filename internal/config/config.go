@@ -0,0 +1,364 @@
+package config
+
+import (
+	"errors"
+	"github.com/akkeris/logtrain/pkg/output"
+	"github.com/akkeris/logtrain/pkg/processor"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Input describes an input of logtrain. Its options are the environment variables of the input
+// without the prefix and in lower case, e.g. SYSLOG_TCP_PORT is the port option of a syslogtcp input.
+// The id must be unique and defaults to the type.
+type Input struct {
+	ID      string            `json:"id,omitempty"`
+	Type    string            `json:"type"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// DataSources describes where routes are read from.
+type DataSources struct {
+	Kubernetes  bool   `json:"kubernetes,omitempty"`
+	Postgres    bool   `json:"postgres,omitempty"`
+	DatabaseURL string `json:"database_url,omitempty"`
+}
+
+// DrainBuffer describes the disk buffer given to drains, drains have no buffer if the path is empty.
+type DrainBuffer struct {
+	Path     string `json:"path,omitempty"`
+	MaxBytes int64  `json:"max_bytes,omitempty"`
+}
+
+// Logtail describes where logtail is reached, by logtrain at name.namespace and by clients
+// at name followed by the host suffix if it's set.
+type Logtail struct {
+	Name       string `json:"name,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	HostSuffix string `json:"host_suffix,omitempty"`
+}
+
+// Config is the configuration of logtrain and logtail.
+type Config struct {
+	HTTPPort    string      `json:"http_port,omitempty"`
+	Metrics     bool        `json:"metrics,omitempty"`
+	Profile     bool        `json:"profile,omitempty"`
+	Debug       bool        `json:"debug,omitempty"`
+	Akkeris     bool        `json:"akkeris,omitempty"`
+	Node        string      `json:"node,omitempty"`
+	JSONParser  string      `json:"json_parser,omitempty"`
+	APIToken    string      `json:"api_token,omitempty"`
+	DeadLetter  string      `json:"dead_letter,omitempty"`
+	DrainBuffer DrainBuffer `json:"drain_buffer"`
+	Processors  []string    `json:"processors,omitempty"`
+	DataSources DataSources `json:"datasources"`
+	Inputs      []Input     `json:"inputs"`
+	Logtail     Logtail     `json:"logtail"`
+}
+
+type inputType struct {
+	prefix   string // the prefix of the environment variables for the input
+	id       string // the id of the input when it's added from environment variables
+	options  []string
+	required []string
+}
+
+// setting is a setting that may be overridden by an environment variable, the value is a *string, *bool or *int64
+type setting struct {
+	env   string
+	value interface{}
+}
+
+var multilineOptions = []string{"multiline_start", "multiline_continuation", "multiline_max_lines", "multiline_max_wait"}
+
+var inputTypes = map[string]inputType{
+	"envoy":      {prefix: "ENVOY", id: "istio+envoy", options: []string{"port", "fields", "tcp_fields", "format", "hostname", "unattributed_hostname"}},
+	"otlp":       {prefix: "OTLP", id: "otlp", options: []string{"port", "http_path", "hostname", "tag"}},
+	"forward":    {prefix: "FORWARD", id: "forward", options: []string{"port", "hostname", "tag", "message_key"}},
+	"http":       {prefix: "HTTP_EVENTS", id: "http", options: []string{"path"}},
+	"sysloghttp": {prefix: "HTTP_SYSLOG", id: "sysloghttp", options: []string{"path"}},
+	"syslogtcp":  {prefix: "SYSLOG_TCP", id: "syslogtcp", options: []string{"port"}},
+	"syslogudp":  {prefix: "SYSLOG_UDP", id: "syslogudp", options: []string{"port"}},
+	"syslogtls":  {prefix: "SYSLOG_TLS", id: "syslogtls", options: []string{"port", "server_name", "key_pem", "cert_pem", "ca_pem"}, required: []string{"server_name", "key_pem", "cert_pem"}},
+	"kubernetes": {prefix: "KUBERNETES", id: "kubernetes", options: append([]string{"log_path", "positions_path"}, multilineOptions...)},
+	"file":       {prefix: "FILE", id: "file", options: append([]string{"patterns", "hostname", "tag", "positions_path"}, multilineOptions...), required: []string{"patterns"}},
+}
+
+// logtailInputTypes are the inputs logtail can receive logs on
+var logtailInputTypes = []string{"syslogtcp", "syslogudp", "syslogtls"}
+
+// InputTypes returns the types of inputs that can be configured
+func InputTypes() []string {
+	types := make([]string, 0, len(inputTypes))
+	for t := range inputTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Get returns the option or the default if it's not set
+func (in Input) Get(option string, def string) string {
+	if value, ok := in.Options[option]; ok && value != "" {
+		return value
+	}
+	return def
+}
+
+// env returns the environment variable that overrides the option
+func (in Input) env(option string) string {
+	return inputTypes[in.Type].prefix + "_" + strings.ToUpper(option)
+}
+
+func validPort(port string) bool {
+	p, err := strconv.Atoi(port)
+	return err == nil && p > 0 && p < 65536
+}
+
+// Validate checks the input has a known type, known options and its required options
+func (in Input) Validate() error {
+	t, ok := inputTypes[in.Type]
+	if !ok {
+		return errors.New("input " + in.ID + " has an unknown type " + in.Type + ", expected one of " + strings.Join(InputTypes(), ", "))
+	}
+	for option := range in.Options {
+		var found = false
+		for _, o := range t.options {
+			if o == option {
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("input " + in.ID + " has an unknown option " + option + ", expected one of " + strings.Join(t.options, ", "))
+		}
+	}
+	for _, option := range t.required {
+		if in.Get(option, "") == "" {
+			return errors.New("input " + in.ID + " requires the option " + option + " (" + in.env(option) + ")")
+		}
+	}
+	if in.Get("port", "") != "" && !validPort(in.Get("port", "")) {
+		return errors.New("input " + in.ID + " has an invalid port " + in.Get("port", "") + " (" + in.env("port") + ")")
+	}
+	for _, option := range []string{"multiline_start", "multiline_continuation"} {
+		if _, err := regexp.Compile(in.Get(option, "")); err != nil {
+			return errors.New("input " + in.ID + " has an invalid " + option + " (" + in.env(option) + "): " + err.Error())
+		}
+	}
+	if value := in.Get("multiline_max_lines", ""); value != "" {
+		if _, err := strconv.Atoi(value); err != nil {
+			return errors.New("input " + in.ID + " has an invalid multiline_max_lines (" + in.env("multiline_max_lines") + "), expected a number")
+		}
+	}
+	if value := in.Get("multiline_max_wait", ""); value != "" {
+		if _, err := time.ParseDuration(value); err != nil {
+			return errors.New("input " + in.ID + " has an invalid multiline_max_wait (" + in.env("multiline_max_wait") + "), expected a duration such as 1s")
+		}
+	}
+	return nil
+}
+
+// Validate checks the settings, inputs and processors. Inputs without an id are given their type
+// as an id and settings that are not set are given their defaults.
+func (c *Config) Validate() error {
+	if c.HTTPPort == "" {
+		c.HTTPPort = "9000"
+	}
+	if c.DrainBuffer.MaxBytes == 0 {
+		c.DrainBuffer.MaxBytes = 104857600
+	}
+	if !validPort(c.HTTPPort) {
+		return errors.New("the http_port (HTTP_PORT) " + c.HTTPPort + " is not a valid port")
+	}
+	if c.JSONParser != "" && c.JSONParser != "standard" && c.JSONParser != "fast" && c.JSONParser != "iterator" {
+		return errors.New("the json_parser (JSON_PARSER) " + c.JSONParser + " is unknown, expected standard, fast or iterator")
+	}
+	if c.DrainBuffer.MaxBytes < 0 {
+		return errors.New("the drain_buffer max_bytes (DRAIN_BUFFER_MAX_BYTES) must be more than 0")
+	}
+	if c.DeadLetter != "" {
+		if err := output.TestEndpoint(c.DeadLetter); err != nil {
+			return errors.New("the dead_letter (DEAD_LETTER) " + c.DeadLetter + " is not a valid endpoint: " + err.Error())
+		}
+	}
+	ids := make(map[string]bool)
+	for i := range c.Inputs {
+		if c.Inputs[i].ID == "" {
+			c.Inputs[i].ID = c.Inputs[i].Type
+		}
+		if err := c.Inputs[i].Validate(); err != nil {
+			return err
+		}
+		if ids[c.Inputs[i].ID] {
+			return errors.New("the input id " + c.Inputs[i].ID + " is used more than once")
+		}
+		ids[c.Inputs[i].ID] = true
+	}
+	if _, err := processor.CreateChain(c.Processors); err != nil {
+		return errors.New("the processors (PROCESSORS) are invalid: " + err.Error())
+	}
+	if c.DataSources.Postgres && c.DataSources.DatabaseURL == "" {
+		return errors.New("the postgres datasource requires a database_url (DATABASE_URL)")
+	}
+	return nil
+}
+
+// ValidateLogtail checks the configuration can be used by logtail, which requires a name and
+// namespace and only receives logs over syslog.
+func (c *Config) ValidateLogtail() error {
+	if c.Logtail.Name == "" || c.Logtail.Namespace == "" {
+		return errors.New("logtail requires a name (NAME) and namespace (NAMESPACE)")
+	}
+	if len(c.Inputs) == 0 {
+		return errors.New("logtail requires a " + strings.Join(logtailInputTypes, ", ") + " input")
+	}
+	for _, in := range c.Inputs {
+		var found = false
+		for _, t := range logtailInputTypes {
+			if in.Type == t {
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("logtail does not support the input " + in.ID + ", expected one of " + strings.Join(logtailInputTypes, ", "))
+		}
+	}
+	return nil
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"HTTP_PORT", &c.HTTPPort},
+		{"METRICS", &c.Metrics},
+		{"PROFILE", &c.Profile},
+		{"DEBUG", &c.Debug},
+		{"AKKERIS", &c.Akkeris},
+		{"NODE", &c.Node},
+		{"JSON_PARSER", &c.JSONParser},
+		{"API_TOKEN", &c.APIToken},
+		{"DEAD_LETTER", &c.DeadLetter},
+		{"DRAIN_BUFFER_PATH", &c.DrainBuffer.Path},
+		{"DRAIN_BUFFER_MAX_BYTES", &c.DrainBuffer.MaxBytes},
+		{"KUBERNETES_DATASOURCE", &c.DataSources.Kubernetes},
+		{"POSTGRES", &c.DataSources.Postgres},
+		{"DATABASE_URL", &c.DataSources.DatabaseURL},
+		{"NAME", &c.Logtail.Name},
+		{"NAMESPACE", &c.Logtail.Namespace},
+		{"LOGTAIL_HOST_SUFFIX", &c.Logtail.HostSuffix},
+	}
+}
+
+// overrideFromEnv overrides the configuration with the environment variables that are set. An input
+// is added if its prefix is true (e.g. SYSLOG_TCP=true) and no input of its type is configured, or
+// removed if it's false. The options of the first input of a type are overridden by the variables
+// starting with its prefix (e.g. SYSLOG_TCP_PORT).
+func (c *Config) overrideFromEnv() error {
+	for _, s := range c.settings() {
+		value := os.Getenv(s.env)
+		if value == "" {
+			continue
+		}
+		switch v := s.value.(type) {
+		case *string:
+			*v = value
+		case *bool:
+			*v = value == "true"
+		case *int64:
+			i, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errors.New("the environment variable " + s.env + " must be a number")
+			}
+			*v = i
+		}
+	}
+	if os.Getenv("PROCESSORS") != "" {
+		c.Processors = strings.Split(os.Getenv("PROCESSORS"), ";")
+	}
+	for _, name := range InputTypes() {
+		t := inputTypes[name]
+		if os.Getenv(t.prefix) == "false" {
+			inputs := make([]Input, 0)
+			for _, in := range c.Inputs {
+				if in.Type != name {
+					inputs = append(inputs, in)
+				}
+			}
+			c.Inputs = inputs
+			continue
+		}
+		index := -1
+		for i, in := range c.Inputs {
+			if in.Type == name {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			if os.Getenv(t.prefix) != "true" {
+				continue
+			}
+			c.Inputs = append(c.Inputs, Input{ID: t.id, Type: name, Options: make(map[string]string)})
+			index = len(c.Inputs) - 1
+		}
+		for _, option := range t.options {
+			if value := os.Getenv(c.Inputs[index].env(option)); value != "" {
+				if c.Inputs[index].Options == nil {
+					c.Inputs[index].Options = make(map[string]string)
+				}
+				c.Inputs[index].Options[option] = value
+			}
+		}
+	}
+	return nil
+}
+
+// Parse reads and validates a yaml (or json) configuration, environment variables are not used.
+func Parse(data []byte) (*Config, error) {
+	var c Config
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Load reads the configuration file at path (if path is set), overrides it with any environment
+// variables that are set and validates it.
+func Load(path string) (*Config, error) {
+	var c Config
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, &c); err != nil {
+			return nil, errors.New("invalid configuration in " + path + ": " + err.Error())
+		}
+	}
+	if err := c.overrideFromEnv(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		if path != "" {
+			return nil, errors.New("invalid configuration in " + path + ": " + err.Error())
+		}
+		return nil, errors.New("invalid configuration: " + err.Error())
+	}
+	return &c, nil
+}
+
+// OutputOptions returns the options given to every output
+func (c *Config) OutputOptions() output.Options {
+	return output.Options{
+		Node:    c.Node,
+		Akkeris: c.Akkeris,
+	}
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+	Convey("Ensure a yaml configuration is parsed and ids default to the type", t, func() {
+		c, err := Parse([]byte(`
+processors:
+  - drop:healthz
+datasources:
+  kubernetes: true
+inputs:
+  - type: syslogtcp
+    options:
+      port: "9010"
+  - id: audit
+    type: file
+    options:
+      patterns: /var/log/audit/*.log
+      multiline_start: ^\d
+`))
+		So(err, ShouldBeNil)
+		So(c.Processors, ShouldResemble, []string{"drop:healthz"})
+		So(c.DataSources, ShouldResemble, DataSources{Kubernetes: true})
+		So(len(c.Inputs), ShouldEqual, 2)
+		So(c.Inputs[0].ID, ShouldEqual, "syslogtcp")
+		So(c.Inputs[0].Get("port", "9002"), ShouldEqual, "9010")
+		So(c.Inputs[1].ID, ShouldEqual, "audit")
+		So(c.Inputs[1].Get("hostname", "default"), ShouldEqual, "default")
+	})
+	Convey("Ensure a json configuration is parsed", t, func() {
+		c, err := Parse([]byte(`{"inputs":[{"type":"http","options":{"path":"/logs"}}]}`))
+		So(err, ShouldBeNil)
+		So(c.Inputs, ShouldResemble, []Input{Input{ID: "http", Type: "http", Options: map[string]string{"path": "/logs"}}})
+	})
+	Convey("Ensure invalid configurations are rejected", t, func() {
+		_, err := Parse([]byte(`inputs: [{type: nope}]`))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "unknown type nope")
+		_, err = Parse([]byte(`inputs: [{type: syslogudp, options: {path: /nope}}]`))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "unknown option path")
+		_, err = Parse([]byte(`inputs: [{type: syslogudp}, {type: syslogudp}]`))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "more than once")
+		_, err = Parse([]byte(`inputs: [{type: syslogudp, port: 9003}]`))
+		So(err, ShouldNotBeNil)
+		_, err = Parse([]byte(`processors: ["tag:("]`))
+		So(err, ShouldNotBeNil)
+		_, err = Parse([]byte(`datasources: {postgres: true}`))
+		So(err, ShouldNotBeNil)
+		_, err = Parse([]byte(`inputs: [{type: syslogtls, options: {server_name: logs, key_pem: key}}]`))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "requires the option cert_pem (SYSLOG_TLS_CERT_PEM)")
+		_, err = Parse([]byte(`inputs: [{type: syslogtcp, options: {port: abc}}]`))
+		So(err, ShouldNotBeNil)
+		_, err = Parse([]byte(`inputs: [{type: file, options: {patterns: /a, multiline_start: "("}}]`))
+		So(err, ShouldNotBeNil)
+		_, err = Parse([]byte(`json_parser: quick`))
+		So(err, ShouldNotBeNil)
+		_, err = Parse([]byte(`http_port: "99999"`))
+		So(err, ShouldNotBeNil)
+		_, err = Parse([]byte(`dead_letter: nope://`))
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Ensure settings are given their defaults", t, func() {
+		c, err := Parse([]byte(`akkeris: true`))
+		So(err, ShouldBeNil)
+		So(c.HTTPPort, ShouldEqual, "9000")
+		So(c.DrainBuffer.MaxBytes, ShouldEqual, 104857600)
+		So(c.OutputOptions().Akkeris, ShouldEqual, true)
+	})
+	Convey("Ensure environment variables override the configuration file", t, func() {
+		file, err := ioutil.TempFile("", "logtrain-config")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(file.Name())
+		if _, err := file.Write([]byte("http_port: \"9100\"\njson_parser: fast\ninputs:\n  - type: syslogudp\n  - type: file\n    options:\n      patterns: /a\n")); err != nil {
+			log.Fatal(err)
+		}
+		file.Close()
+		os.Setenv("HTTP_PORT", "9200")
+		os.Setenv("AKKERIS", "true")
+		os.Setenv("DRAIN_BUFFER_MAX_BYTES", "1024")
+		os.Setenv("SYSLOG_UDP_PORT", "9300")
+		os.Setenv("FILE", "false")
+		os.Setenv("HTTP_EVENTS", "true")
+		defer os.Unsetenv("HTTP_PORT")
+		defer os.Unsetenv("AKKERIS")
+		defer os.Unsetenv("DRAIN_BUFFER_MAX_BYTES")
+		defer os.Unsetenv("SYSLOG_UDP_PORT")
+		defer os.Unsetenv("FILE")
+		defer os.Unsetenv("HTTP_EVENTS")
+		c, err := Load(file.Name())
+		So(err, ShouldBeNil)
+		So(c.HTTPPort, ShouldEqual, "9200")
+		So(c.JSONParser, ShouldEqual, "fast")
+		So(c.Akkeris, ShouldEqual, true)
+		So(c.DrainBuffer.MaxBytes, ShouldEqual, 1024)
+		So(c.Inputs, ShouldResemble, []Input{
+			Input{ID: "syslogudp", Type: "syslogudp", Options: map[string]string{"port": "9300"}},
+			Input{ID: "http", Type: "http", Options: map[string]string{}},
+		})
+		os.Setenv("DRAIN_BUFFER_MAX_BYTES", "lots")
+		_, err = Load(file.Name())
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "DRAIN_BUFFER_MAX_BYTES")
+	})
+	Convey("Ensure logtail configurations are validated", t, func() {
+		c, err := Parse([]byte(`{"logtail":{"name":"logtail","namespace":"akkeris-system"},"inputs":[{"type":"syslogtcp"}]}`))
+		So(err, ShouldBeNil)
+		So(c.ValidateLogtail(), ShouldBeNil)
+		c.Logtail.Namespace = ""
+		So(c.ValidateLogtail(), ShouldNotBeNil)
+		c, err = Parse([]byte(`{"logtail":{"name":"logtail","namespace":"akkeris-system"},"inputs":[{"type":"http"}]}`))
+		So(err, ShouldBeNil)
+		So(c.ValidateLogtail(), ShouldNotBeNil)
+	})
+	Convey("Ensure a configuration file is loaded", t, func() {
+		file, err := ioutil.TempFile("", "logtrain-config")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(file.Name())
+		if _, err := file.Write([]byte("inputs:\n  - type: syslogudp\n")); err != nil {
+			log.Fatal(err)
+		}
+		file.Close()
+		c, err := Load(file.Name())
+		So(err, ShouldBeNil)
+		So(c.Inputs[0].Type, ShouldEqual, "syslogudp")
+		_, err = Load(file.Name() + ".missing")
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Ensure the configuration is read from environment variables", t, func() {
+		os.Setenv("SYSLOG_TCP", "true")
+		os.Setenv("SYSLOG_TCP_PORT", "9011")
+		os.Setenv("ENVOY", "true")
+		os.Setenv("PROCESSORS", "prefix:a;prefix:b")
+		defer os.Unsetenv("SYSLOG_TCP")
+		defer os.Unsetenv("SYSLOG_TCP_PORT")
+		defer os.Unsetenv("ENVOY")
+		defer os.Unsetenv("PROCESSORS")
+		c, err := Load("")
+		So(err, ShouldBeNil)
+		So(c.Processors, ShouldResemble, []string{"prefix:a", "prefix:b"})
+		So(c.Inputs, ShouldResemble, []Input{
+			Input{ID: "istio+envoy", Type: "envoy", Options: map[string]string{}},
+			Input{ID: "syslogtcp", Type: "syslogtcp", Options: map[string]string{"port": "9011"}},
+		})
+	})
+}
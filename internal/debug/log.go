@@ -28,3 +28,14 @@ func init() {
 	Debugf = LoggerDebug.Printf
 	Fatalf = loggerInfo.Fatalf
 }
+
+// SetDebug enables or disables debug logging, by default it's enabled if DEBUG is true.
+func SetDebug(enabled bool) {
+	if enabled {
+		LoggerDebug.SetOutput(os.Stdout)
+		LoggerDebug.SetPrefix("DEBUG: ")
+	} else {
+		LoggerDebug.SetOutput(ioutil.Discard)
+		LoggerDebug.SetPrefix("")
+	}
+}
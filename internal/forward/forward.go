@@ -0,0 +1,67 @@
+package forward
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"time"
+)
+
+// EventTime is the fluent forward protocol's time with nanoseconds, it's sent as the
+// msgpack extension type 0 with the seconds and nanoseconds as big endian 32 bit integers.
+// See https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1#eventtime-ext-format
+type EventTime struct {
+	time.Time
+}
+
+func init() {
+	msgpack.RegisterExt(0, (*EventTime)(nil))
+}
+
+// MarshalMsgpack writes the event time's extension data
+func (t *EventTime) MarshalMsgpack() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+	return b, nil
+}
+
+// UnmarshalMsgpack reads the event time's extension data
+func (t *EventTime) UnmarshalMsgpack(b []byte) error {
+	if len(b) != 8 {
+		return errors.New("invalid event time, expected 8 bytes")
+	}
+	t.Time = time.Unix(int64(binary.BigEndian.Uint32(b)), int64(binary.BigEndian.Uint32(b[4:])))
+	return nil
+}
+
+// Time returns the time of an entry, which may be an event time or the seconds since the epoch.
+func Time(value interface{}) (time.Time, error) {
+	switch t := value.(type) {
+	case *EventTime:
+		return t.Time, nil
+	case EventTime:
+		return t.Time, nil
+	case int8:
+		return time.Unix(int64(t), 0), nil
+	case int16:
+		return time.Unix(int64(t), 0), nil
+	case int32:
+		return time.Unix(int64(t), 0), nil
+	case int64:
+		return time.Unix(t, 0), nil
+	case uint8:
+		return time.Unix(int64(t), 0), nil
+	case uint16:
+		return time.Unix(int64(t), 0), nil
+	case uint32:
+		return time.Unix(int64(t), 0), nil
+	case uint64:
+		return time.Unix(int64(t), 0), nil
+	case float32:
+		return time.Unix(0, int64(float64(t)*float64(time.Second))), nil
+	case float64:
+		return time.Unix(0, int64(t*float64(time.Second))), nil
+	}
+	return time.Time{}, errors.New("invalid time in entry")
+}
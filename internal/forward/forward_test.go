@@ -0,0 +1,31 @@
+package forward
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/vmihailenco/msgpack/v5"
+	"testing"
+	"time"
+)
+
+func TestEventTime(t *testing.T) {
+	Convey("Ensure event times are written as the msgpack extension", t, func() {
+		data, err := msgpack.Marshal(&EventTime{Time: time.Unix(1600000000, 250000000)})
+		So(err, ShouldBeNil)
+		So(data, ShouldResemble, []byte{0xd7, 0x00, 0x5f, 0x5e, 0x10, 0x00, 0x0e, 0xe6, 0xb2, 0x80})
+		var value interface{}
+		So(msgpack.Unmarshal(data, &value), ShouldBeNil)
+		result, err := Time(value)
+		So(err, ShouldBeNil)
+		So(result.UnixNano(), ShouldEqual, 1600000000250000000)
+	})
+	Convey("Ensure integer and float times are read", t, func() {
+		result, err := Time(uint32(1600000000))
+		So(err, ShouldBeNil)
+		So(result.Unix(), ShouldEqual, 1600000000)
+		result, err = Time(1600000000.5)
+		So(err, ShouldBeNil)
+		So(result.UnixNano(), ShouldEqual, 1600000000500000000)
+		_, err = Time("now")
+		So(err, ShouldNotBeNil)
+	})
+}
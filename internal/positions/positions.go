@@ -0,0 +1,133 @@
+package positions
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// Position describes how far into a file (identified by its inode) we've read.
+type Position struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// Positions is a small on-disk database of read offsets keyed by file path and inode,
+// it allows inputs that tail files to resume where they left off after a restart.
+type Positions struct {
+	path    string
+	entries map[string]Position
+	mutex   *sync.Mutex
+}
+
+// Inode returns the inode of the file info, or 0 if it cannot be determined.
+func Inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
+// Resume returns the offset to start reading the file from, the boolean returned
+// is false if we have no record of the file (the caller should choose where to start).
+//
+// If the recorded inode no longer matches, the path was rotated and replaced with a
+// new file which is read from the beginning. If the file was renamed, the position is
+// found through its inode so a rotated file is not read again. If the file is smaller
+// than the recorded offset, it was truncated and is read from the beginning.
+func (p *Positions) Resume(file string, info os.FileInfo) (int64, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	inode := Inode(info)
+	pos, ok := p.entries[file]
+	if !ok || pos.Inode != inode {
+		var found = false
+		for _, e := range p.entries {
+			if inode != 0 && e.Inode == inode {
+				pos = e
+				found = true
+			}
+		}
+		if !found && ok {
+			return 0, true
+		} else if !found {
+			return 0, false
+		}
+	}
+	if pos.Offset > info.Size() {
+		return 0, true
+	}
+	return pos.Offset, true
+}
+
+// Get returns the recorded position for a file.
+func (p *Positions) Get(file string) (Position, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pos, ok := p.entries[file]
+	return pos, ok
+}
+
+// Set records the position of a file, it is not persisted until Save is called.
+func (p *Positions) Set(file string, pos Position) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.entries[file] = pos
+}
+
+// Remove removes the recorded position of a file.
+func (p *Positions) Remove(file string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.entries, file)
+}
+
+// Save writes the positions to disk, the file is replaced atomically so a crash
+// while saving does not corrupt the previous positions.
+func (p *Positions) Save() error {
+	p.mutex.Lock()
+	data, err := json.Marshal(p.entries)
+	p.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
+
+// Open loads the positions database at path, if it does not exist an empty one is returned.
+func Open(path string) (*Positions, error) {
+	p := Positions{
+		path:    path,
+		entries: make(map[string]Position),
+		mutex:   &sync.Mutex{},
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && os.IsNotExist(err) {
+		return &p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &p.entries); err != nil {
+		return nil, err
+	}
+	if p.entries == nil {
+		p.entries = make(map[string]Position)
+	}
+	return &p, nil
+}
@@ -0,0 +1,93 @@
+package positions
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestPositions(t *testing.T) {
+	if err := os.RemoveAll("/tmp/positions_test"); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Mkdir("/tmp/positions_test", 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile("/tmp/positions_test/a.log", []byte("line one\nline two\n"), 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	Convey("Ensure we can open a positions file that does not exist", t, func() {
+		p, err := Open("/tmp/positions_test/positions.json")
+		So(err, ShouldBeNil)
+		So(p, ShouldNotBeNil)
+		_, ok := p.Get("/tmp/positions_test/a.log")
+		So(ok, ShouldEqual, false)
+	})
+	Convey("Ensure positions are saved and loaded", t, func() {
+		info, err := os.Stat("/tmp/positions_test/a.log")
+		So(err, ShouldBeNil)
+		p, err := Open("/tmp/positions_test/positions.json")
+		So(err, ShouldBeNil)
+		p.Set("/tmp/positions_test/a.log", Position{Inode: Inode(info), Offset: 9})
+		So(p.Save(), ShouldBeNil)
+		p, err = Open("/tmp/positions_test/positions.json")
+		So(err, ShouldBeNil)
+		pos, ok := p.Get("/tmp/positions_test/a.log")
+		So(ok, ShouldEqual, true)
+		So(pos.Offset, ShouldEqual, 9)
+		So(pos.Inode, ShouldEqual, Inode(info))
+		offset, ok := p.Resume("/tmp/positions_test/a.log", info)
+		So(ok, ShouldEqual, true)
+		So(offset, ShouldEqual, 9)
+	})
+	Convey("Ensure a renamed file resumes by its inode", t, func() {
+		p, err := Open("/tmp/positions_test/positions.json")
+		So(err, ShouldBeNil)
+		So(os.Rename("/tmp/positions_test/a.log", "/tmp/positions_test/a.log.1"), ShouldBeNil)
+		info, err := os.Stat("/tmp/positions_test/a.log.1")
+		So(err, ShouldBeNil)
+		offset, ok := p.Resume("/tmp/positions_test/a.log.1", info)
+		So(ok, ShouldEqual, true)
+		So(offset, ShouldEqual, 9)
+	})
+	Convey("Ensure a rotated file is read from the beginning", t, func() {
+		p, err := Open("/tmp/positions_test/positions.json")
+		So(err, ShouldBeNil)
+		So(ioutil.WriteFile("/tmp/positions_test/a.log", []byte("new line\n"), 0644), ShouldBeNil)
+		info, err := os.Stat("/tmp/positions_test/a.log")
+		So(err, ShouldBeNil)
+		offset, ok := p.Resume("/tmp/positions_test/a.log", info)
+		So(ok, ShouldEqual, true)
+		So(offset, ShouldEqual, 0)
+	})
+	Convey("Ensure a truncated file is read from the beginning", t, func() {
+		p, err := Open("/tmp/positions_test/positions.json")
+		So(err, ShouldBeNil)
+		So(os.Truncate("/tmp/positions_test/a.log.1", 0), ShouldBeNil)
+		info, err := os.Stat("/tmp/positions_test/a.log.1")
+		So(err, ShouldBeNil)
+		offset, ok := p.Resume("/tmp/positions_test/a.log.1", info)
+		So(ok, ShouldEqual, true)
+		So(offset, ShouldEqual, 0)
+	})
+	Convey("Ensure unknown files are not resumed and can be removed", t, func() {
+		p, err := Open("/tmp/positions_test/positions.json")
+		So(err, ShouldBeNil)
+		info, err := os.Stat("/tmp/positions_test/positions.json")
+		So(err, ShouldBeNil)
+		_, ok := p.Resume("/tmp/positions_test/positions.json", info)
+		So(ok, ShouldEqual, false)
+		p.Remove("/tmp/positions_test/a.log")
+		_, ok = p.Get("/tmp/positions_test/a.log")
+		So(ok, ShouldEqual, false)
+	})
+	Convey("Ensure a corrupted positions file returns an error", t, func() {
+		So(ioutil.WriteFile("/tmp/positions_test/corrupt.json", []byte("{"), 0644), ShouldBeNil)
+		_, err := Open("/tmp/positions_test/corrupt.json")
+		So(err, ShouldNotBeNil)
+		os.RemoveAll("/tmp/positions_test")
+	})
+}
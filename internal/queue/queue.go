@@ -0,0 +1,337 @@
+package queue
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/akkeris/logtrain/internal/debug"
+	"github.com/trevorlinton/remote_syslog2/syslog"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// segmentsPerQueue is roughly how many segment files a full queue is split into, evicting
+// removes a whole segment so this is also roughly how much of the queue is evicted at once.
+const segmentsPerQueue = 8
+const segmentSuffix = ".seg"
+const cursorFile = "cursor.json"
+
+// maxRecordSize protects against reading garbage lengths from a corrupted segment.
+const maxRecordSize = 64 * 1024 * 1024
+
+type segment struct {
+	id      uint64
+	size    int64
+	records int
+}
+
+type cursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Records int    `json:"records"`
+}
+
+// Queue is a first-in first-out queue of packets on disk. Packets are appended to segment
+// files, once the queue is larger than its maximum size the oldest segment is removed.
+// The read position is saved when the queue is closed, if the process stops without closing
+// the queue packets in the oldest segment may be read again.
+type Queue struct {
+	dir         string
+	maxBytes    int64
+	segmentSize int64
+	segments    []segment
+	writer      *os.File
+	reader      *os.File
+	readOffset  int64
+	readRecords int
+	peekSize    int64 // the size of the record returned by Peek, 0 if it was removed
+	evicted     uint64
+	ready       chan struct{}
+	mutex       *sync.Mutex
+	closed      bool
+}
+
+func (q *Queue) path(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+// Bytes returns the size of the packets waiting to be read.
+func (q *Queue) Bytes() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.bytes()
+}
+
+func (q *Queue) bytes() int64 {
+	var size int64 = 0
+	for _, s := range q.segments {
+		size += s.size
+	}
+	return size - q.readOffset
+}
+
+// Evicted returns how many packets were removed before they were read because the queue was full.
+func (q *Queue) Evicted() uint64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.evicted
+}
+
+// ResetEvicted sets the amount of evicted packets to zero.
+func (q *Queue) ResetEvicted() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.evicted = 0
+}
+
+// Ready returns a channel that receives when packets are pushed on to the queue.
+func (q *Queue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+func (q *Queue) roll() error {
+	var id uint64 = 0
+	if len(q.segments) > 0 {
+		id = q.segments[len(q.segments)-1].id + 1
+	}
+	if q.writer != nil {
+		if err := q.writer.Close(); err != nil {
+			return err
+		}
+		q.writer = nil
+	}
+	writer, err := os.OpenFile(q.path(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	q.writer = writer
+	q.segments = append(q.segments, segment{id: id})
+	return nil
+}
+
+// removeHead removes the oldest segment, the packets not yet read in it are counted as evicted.
+func (q *Queue) removeHead(evicted bool) {
+	head := q.segments[0]
+	if q.reader != nil {
+		q.reader.Close()
+		q.reader = nil
+	}
+	if len(q.segments) == 1 && q.writer != nil {
+		q.writer.Close()
+		q.writer = nil
+	}
+	if evicted {
+		q.evicted += uint64(head.records - q.readRecords)
+	}
+	if err := os.Remove(q.path(head.id)); err != nil {
+		debug.Errorf("[queue] Unable to remove segment %s: %s\n", q.path(head.id), err.Error())
+	}
+	q.segments = q.segments[1:]
+	q.readOffset = 0
+	q.readRecords = 0
+	q.peekSize = 0
+}
+
+// Push appends the packet to the queue.
+func (q *Queue) Push(packet syslog.Packet) error {
+	data, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[4:], data)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return errors.New("the queue is closed")
+	}
+	if q.writer == nil || q.segments[len(q.segments)-1].size >= q.segmentSize {
+		if err := q.roll(); err != nil {
+			return err
+		}
+	}
+	n, err := q.writer.Write(record)
+	q.segments[len(q.segments)-1].size += int64(n)
+	if err != nil {
+		return err
+	}
+	q.segments[len(q.segments)-1].records++
+	for q.bytes() > q.maxBytes && len(q.segments) > 1 {
+		q.removeHead(true)
+	}
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func readRecord(r io.Reader) (syslog.Packet, int64, error) {
+	var packet syslog.Packet
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return packet, 0, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxRecordSize {
+		return packet, 0, errors.New("record is too large, the segment may be corrupted")
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return packet, 0, err
+	}
+	if err := json.Unmarshal(data, &packet); err != nil {
+		return packet, 0, err
+	}
+	return packet, int64(4 + size), nil
+}
+
+// Peek returns the oldest packet without removing it, the boolean returned is false if the queue is empty.
+func (q *Queue) Peek() (syslog.Packet, bool, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return syslog.Packet{}, false, errors.New("the queue is closed")
+	}
+	for len(q.segments) > 0 {
+		head := q.segments[0]
+		if q.readOffset >= head.size {
+			if len(q.segments) == 1 {
+				if head.size > 0 {
+					// everything has been read, start over with an empty segment.
+					q.removeHead(false)
+				}
+				return syslog.Packet{}, false, nil
+			}
+			q.removeHead(false)
+			continue
+		}
+		if q.reader == nil {
+			reader, err := os.Open(q.path(head.id))
+			if err != nil {
+				q.removeHead(true)
+				return syslog.Packet{}, false, err
+			}
+			q.reader = reader
+		}
+		if _, err := q.reader.Seek(q.readOffset, io.SeekStart); err != nil {
+			return syslog.Packet{}, false, err
+		}
+		packet, size, err := readRecord(q.reader)
+		if err != nil {
+			// the rest of the segment cannot be read, skip it.
+			q.removeHead(true)
+			return syslog.Packet{}, false, err
+		}
+		q.peekSize = size
+		return packet, true, nil
+	}
+	return syslog.Packet{}, false, nil
+}
+
+// Next removes the oldest packet, it should be called once the packet returned from Peek was handled.
+func (q *Queue) Next() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.peekSize > 0 {
+		q.readOffset += q.peekSize
+		q.readRecords++
+		q.peekSize = 0
+	}
+}
+
+// Close closes the queue and saves the read position.
+func (q *Queue) Close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return errors.New("the queue is already closed")
+	}
+	q.closed = true
+	if q.reader != nil {
+		q.reader.Close()
+	}
+	if q.writer != nil {
+		q.writer.Close()
+	}
+	if len(q.segments) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(cursor{Segment: q.segments[0].id, Offset: q.readOffset, Records: q.readRecords})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(q.dir, cursorFile), data, 0644)
+}
+
+// Open opens (or creates) the queue in the directory, packets left from a previous queue
+// in the directory are read first.
+func Open(dir string, maxBytes int64) (*Queue, error) {
+	if maxBytes < 1 {
+		return nil, errors.New("the maximum size of the queue must be more than 0")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	q := Queue{
+		dir:         dir,
+		maxBytes:    maxBytes,
+		segmentSize: maxBytes / segmentsPerQueue,
+		segments:    make([]segment, 0),
+		ready:       make(chan struct{}, 1),
+		mutex:       &sync.Mutex{},
+	}
+	if q.segmentSize < 1 {
+		q.segmentSize = 1
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s := segment{id: id}
+		f, err := os.Open(q.path(id))
+		if err != nil {
+			return nil, err
+		}
+		for {
+			_, size, err := readRecord(f)
+			if err != nil {
+				break
+			}
+			s.size += size
+			s.records++
+		}
+		f.Close()
+		q.segments = append(q.segments, s)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i].id < q.segments[j].id })
+	if data, err := ioutil.ReadFile(filepath.Join(dir, cursorFile)); err == nil {
+		var c cursor
+		if err := json.Unmarshal(data, &c); err == nil && len(q.segments) > 0 && q.segments[0].id == c.Segment && c.Offset <= q.segments[0].size {
+			q.readOffset = c.Offset
+			q.readRecords = c.Records
+		}
+		os.Remove(filepath.Join(dir, cursorFile))
+	}
+	if q.bytes() > 0 {
+		q.ready <- struct{}{}
+	}
+	return &q, nil
+}
@@ -0,0 +1,157 @@
+package queue
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/trevorlinton/remote_syslog2/syslog"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func packet(i int) syslog.Packet {
+	return syslog.Packet{
+		Severity: syslog.SevInfo,
+		Facility: syslog.LogUser,
+		Hostname: "app.default",
+		Tag:      "web",
+		Time:     time.Date(2020, 1, 1, 0, 0, i, 0, time.UTC),
+		Message:  fmt.Sprintf("message %d", i),
+	}
+}
+
+func pop(q *Queue) (syslog.Packet, bool) {
+	p, ok, err := q.Peek()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if ok {
+		q.Next()
+	}
+	return p, ok
+}
+
+func TestQueue(t *testing.T) {
+	if err := os.RemoveAll("/tmp/queue_test"); err != nil {
+		log.Fatal(err)
+	}
+
+	Convey("Ensure the queue requires a size", t, func() {
+		_, err := Open("/tmp/queue_test/invalid", 0)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Ensure packets are read in the order they were pushed", t, func() {
+		q, err := Open("/tmp/queue_test/order", 1024*1024)
+		So(err, ShouldBeNil)
+		_, ok := pop(q)
+		So(ok, ShouldEqual, false)
+		So(q.Bytes(), ShouldEqual, 0)
+		for i := 0; i < 10; i++ {
+			So(q.Push(packet(i)), ShouldBeNil)
+		}
+		So(q.Bytes(), ShouldBeGreaterThan, 0)
+		select {
+		case <-q.Ready():
+		default:
+			So(false, ShouldEqual, true)
+		}
+		p, ok, err := q.Peek()
+		So(err, ShouldBeNil)
+		So(ok, ShouldEqual, true)
+		So(p.Message, ShouldEqual, "message 0")
+		p, ok = pop(q)
+		So(ok, ShouldEqual, true)
+		So(p, ShouldResemble, packet(0))
+		for i := 1; i < 10; i++ {
+			p, ok := pop(q)
+			So(ok, ShouldEqual, true)
+			So(p.Message, ShouldEqual, fmt.Sprintf("message %d", i))
+		}
+		_, ok = pop(q)
+		So(ok, ShouldEqual, false)
+		So(q.Bytes(), ShouldEqual, 0)
+		So(q.Close(), ShouldBeNil)
+		So(q.Close(), ShouldNotBeNil)
+		So(q.Push(packet(0)), ShouldNotBeNil)
+	})
+	Convey("Ensure the oldest packets are evicted when the queue is full", t, func() {
+		q, err := Open("/tmp/queue_test/evict", 2048)
+		So(err, ShouldBeNil)
+		for i := 0; i < 100; i++ {
+			So(q.Push(packet(i)), ShouldBeNil)
+		}
+		So(q.Bytes(), ShouldBeLessThanOrEqualTo, 2048)
+		So(q.Evicted(), ShouldBeGreaterThan, 0)
+		files, err := ioutil.ReadDir("/tmp/queue_test/evict")
+		So(err, ShouldBeNil)
+		So(len(files), ShouldBeLessThanOrEqualTo, segmentsPerQueue+1)
+		p, ok := pop(q)
+		So(ok, ShouldEqual, true)
+		So(p.Message, ShouldEqual, fmt.Sprintf("message %d", q.Evicted()))
+		last := p
+		for {
+			p, ok := pop(q)
+			if !ok {
+				break
+			}
+			last = p
+		}
+		So(last.Message, ShouldEqual, "message 99")
+		q.ResetEvicted()
+		So(q.Evicted(), ShouldEqual, 0)
+		So(q.Close(), ShouldBeNil)
+	})
+	Convey("Ensure packets are replayed after the queue is reopened", t, func() {
+		q, err := Open("/tmp/queue_test/replay", 1024*1024)
+		So(err, ShouldBeNil)
+		for i := 0; i < 5; i++ {
+			So(q.Push(packet(i)), ShouldBeNil)
+		}
+		p, ok := pop(q)
+		So(ok, ShouldEqual, true)
+		So(p.Message, ShouldEqual, "message 0")
+		So(q.Close(), ShouldBeNil)
+
+		q, err = Open("/tmp/queue_test/replay", 1024*1024)
+		So(err, ShouldBeNil)
+		select {
+		case <-q.Ready():
+		default:
+			So(false, ShouldEqual, true)
+		}
+		So(q.Push(packet(5)), ShouldBeNil)
+		for i := 1; i < 6; i++ {
+			p, ok := pop(q)
+			So(ok, ShouldEqual, true)
+			So(p.Message, ShouldEqual, fmt.Sprintf("message %d", i))
+		}
+		_, ok = pop(q)
+		So(ok, ShouldEqual, false)
+		So(q.Close(), ShouldBeNil)
+	})
+	Convey("Ensure a corrupted segment is skipped", t, func() {
+		q, err := Open("/tmp/queue_test/corrupt", 1024*1024)
+		So(err, ShouldBeNil)
+		So(q.Push(packet(0)), ShouldBeNil)
+		So(q.Close(), ShouldBeNil)
+		f, err := os.OpenFile(q.path(0), os.O_APPEND|os.O_WRONLY, 0644)
+		So(err, ShouldBeNil)
+		_, err = f.Write([]byte{0, 0, 0, 50, '{'})
+		So(err, ShouldBeNil)
+		So(f.Close(), ShouldBeNil)
+
+		q, err = Open("/tmp/queue_test/corrupt", 1024*1024)
+		So(err, ShouldBeNil)
+		So(q.Push(packet(1)), ShouldBeNil)
+		p, ok := pop(q)
+		So(ok, ShouldEqual, true)
+		So(p.Message, ShouldEqual, "message 0")
+		p, ok = pop(q)
+		So(ok, ShouldEqual, true)
+		So(p.Message, ShouldEqual, "message 1")
+		So(q.Close(), ShouldBeNil)
+		os.RemoveAll("/tmp/queue_test")
+	})
+}
@@ -3,9 +3,9 @@ package storage
 import (
 	"errors"
 	"github.com/akkeris/logtrain/internal/debug"
+	"strings"
 )
 
-// TODO: Support regex in the hostname.
 // TODO: Add datasource that's a configmap.
 // TODO: Add a command line data source
 
@@ -20,16 +20,54 @@ type DataSource interface {
 	Close() error
 }
 
-// LogRoute describes a structure for routes from Hostname -> Endpoint
+// LogRoute describes a structure for routes from Hostname -> Endpoint, the hostname
+// may also be a glob (*.payments) or a regular expression surrounded by slashes (/^api-.*-prod$/).
+// If Tag is set only packets with a matching tag are routed, see MatchesTag. Packets may further
+// be filtered by a minimum Severity (a name such as err or warn) and regular expressions the
+// message must (Include) or must not (Exclude) match, empty filters match everything. Processors
+// are specs of processors (see processor.Create) applied in order to packets sent through the route.
 type LogRoute struct {
 	Endpoint      string
 	Hostname      string
 	Tag           string
+	Severity      string
+	Include       string
+	Exclude       string
+	Processors    []string
 	failedToWrite int
 }
 
+// MatchesTag returns true if packets with the tag should be sent through this route. An empty
+// route tag matches everything, a tag ending in * matches any tag starting with what precedes
+// it (web.* matches web.1234) otherwise the tag must match exactly.
+func (route LogRoute) MatchesTag(tag string) bool {
+	if route.Tag == "" {
+		return true
+	}
+	if strings.HasSuffix(route.Tag, "*") {
+		return strings.HasPrefix(tag, strings.TrimSuffix(route.Tag, "*"))
+	}
+	return route.Tag == tag
+}
+
+// SameRoute returns true if both routes send the same hostname, tag and filters to the same endpoint
+// with the same processors.
+func SameRoute(a LogRoute, b LogRoute) bool {
+	if a.Endpoint != b.Endpoint || a.Hostname != b.Hostname || a.Tag != b.Tag ||
+		a.Severity != b.Severity || a.Include != b.Include || a.Exclude != b.Exclude ||
+		len(a.Processors) != len(b.Processors) {
+		return false
+	}
+	for i := range a.Processors {
+		if a.Processors[i] != b.Processors[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // FindDataSources finds what datasources may be availabl and returns instantiated objects
-func FindDataSources(useKubernetes bool, kubeConfig string, usePostgres bool, databaseURL string) ([]DataSource, error) {
+func FindDataSources(useKubernetes bool, kubeConfig string, useAkkeris bool, usePostgres bool, databaseURL string) ([]DataSource, error) {
 	ds := make([]DataSource, 0)
 
 	if useKubernetes {
@@ -38,7 +76,7 @@ func FindDataSources(useKubernetes bool, kubeConfig string, usePostgres bool, da
 			debug.Errorf("Could not get kubernetes client [%s]: %s\n", kubeConfig, err.Error())
 			return nil, err
 		}
-		kds, err := CreateKubernetesDataSource(k8sClient, true)
+		kds, err := CreateKubernetesDataSource(k8sClient, true, useAkkeris)
 		if err != nil {
 			return nil, err
 		}
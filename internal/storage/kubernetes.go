@@ -13,9 +13,10 @@ import (
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
-	"os"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 )
 
 const AkkerisAppLabelKey = "akkeris.io/app-name"
@@ -105,9 +106,9 @@ func (kds *KubernetesDataSource) EmitNewRoute(route LogRoute) error {
 	if err == nil {
 		annotations := deployment.GetAnnotations()
 		if annotations[DrainAnnotationKey] == "" {
-			annotations[DrainAnnotationKey] = route.Endpoint
+			annotations[DrainAnnotationKey] = formatDrain(route)
 		} else {
-			annotations[DrainAnnotationKey] = annotations[DrainAnnotationKey] + ";" + route.Endpoint
+			annotations[DrainAnnotationKey] = annotations[DrainAnnotationKey] + ";" + formatDrain(route)
 		}
 		deployment.SetAnnotations(annotations)
 		if _, err = kds.kube.AppsV1().Deployments(namespace).Update(deployment); err != nil {
@@ -120,9 +121,9 @@ func (kds *KubernetesDataSource) EmitNewRoute(route LogRoute) error {
 	if err == nil {
 		annotations := daemonset.GetAnnotations()
 		if annotations[DrainAnnotationKey] == "" {
-			annotations[DrainAnnotationKey] = route.Endpoint
+			annotations[DrainAnnotationKey] = formatDrain(route)
 		} else {
-			annotations[DrainAnnotationKey] = annotations[DrainAnnotationKey] + ";" + route.Endpoint
+			annotations[DrainAnnotationKey] = annotations[DrainAnnotationKey] + ";" + formatDrain(route)
 		}
 		daemonset.SetAnnotations(annotations)
 		if _, err = kds.kube.AppsV1().DaemonSets(namespace).Update(daemonset); err != nil {
@@ -135,9 +136,9 @@ func (kds *KubernetesDataSource) EmitNewRoute(route LogRoute) error {
 	if err == nil {
 		annotations := statefulset.GetAnnotations()
 		if annotations[DrainAnnotationKey] == "" {
-			annotations[DrainAnnotationKey] = route.Endpoint
+			annotations[DrainAnnotationKey] = formatDrain(route)
 		} else {
-			annotations[DrainAnnotationKey] = annotations[DrainAnnotationKey] + ";" + route.Endpoint
+			annotations[DrainAnnotationKey] = annotations[DrainAnnotationKey] + ";" + formatDrain(route)
 		}
 		statefulset.SetAnnotations(annotations)
 		if _, err = kds.kube.AppsV1().StatefulSets(namespace).Update(statefulset); err != nil {
@@ -158,10 +159,10 @@ func (kds *KubernetesDataSource) EmitRemoveRoute(route LogRoute) error {
 	deployment, err := kds.kube.AppsV1().Deployments(namespace).Get(name, meta.GetOptions{})
 	if err == nil {
 		annotations := deployment.GetAnnotations()
-		drains := strings.Split(annotations[DrainAnnotationKey], ";")
+		drains := splitDrains(annotations[DrainAnnotationKey])
 		newdrs := make([]string, 0)
 		for _, drain := range drains {
-			if strings.TrimSpace(strings.ToLower(route.Endpoint)) != strings.TrimSpace(strings.ToLower(drain)) {
+			if !sameDrain(route, drain) {
 				newdrs = append(newdrs, drain)
 			}
 		}
@@ -176,10 +177,10 @@ func (kds *KubernetesDataSource) EmitRemoveRoute(route LogRoute) error {
 	daemonset, err := kds.kube.AppsV1().DaemonSets(namespace).Get(name, meta.GetOptions{})
 	if err == nil {
 		annotations := daemonset.GetAnnotations()
-		drains := strings.Split(annotations[DrainAnnotationKey], ";")
+		drains := splitDrains(annotations[DrainAnnotationKey])
 		newdrs := make([]string, 0)
 		for _, drain := range drains {
-			if strings.TrimSpace(strings.ToLower(route.Endpoint)) != strings.TrimSpace(strings.ToLower(drain)) {
+			if !sameDrain(route, drain) {
 				newdrs = append(newdrs, drain)
 			}
 		}
@@ -194,10 +195,10 @@ func (kds *KubernetesDataSource) EmitRemoveRoute(route LogRoute) error {
 	statefulset, err := kds.kube.AppsV1().StatefulSets(namespace).Get(name, meta.GetOptions{})
 	if err == nil {
 		annotations := statefulset.GetAnnotations()
-		drains := strings.Split(annotations[DrainAnnotationKey], ";")
+		drains := splitDrains(annotations[DrainAnnotationKey])
 		newdrs := make([]string, 0)
 		for _, drain := range drains {
-			if strings.TrimSpace(strings.ToLower(route.Endpoint)) != strings.TrimSpace(strings.ToLower(drain)) {
+			if !sameDrain(route, drain) {
 				newdrs = append(newdrs, drain)
 			}
 		}
@@ -228,25 +229,142 @@ func (kds *KubernetesDataSource) Close() error {
 	return nil
 }
 
-func (kds *KubernetesDataSource) addRoute(host string, drain string) {
-	debug.Debugf("[kubernetes] adding route %s->%s\n", host, drain)
+// splitUnquoted splits the text wherever separator is true, except within quoted option values.
+// A value is quoted when it starts with a double quote right after the equals sign, within the
+// quotes a backslash escapes the next character.
+func splitUnquoted(text string, separator func(rune) bool) []string {
+	parts := make([]string, 0)
+	var part strings.Builder
+	var previous rune
+	quoted, escaped := false, false
+	for _, r := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case quoted && r == '"':
+			quoted = false
+		case !quoted && r == '"' && previous == '=':
+			quoted = true
+		case !quoted && separator(r):
+			parts = append(parts, part.String())
+			part.Reset()
+			previous = r
+			continue
+		}
+		part.WriteRune(r)
+		previous = r
+	}
+	return append(parts, part.String())
+}
+
+// splitDrains splits the drains annotation into its semicolon delimited drains
+func splitDrains(annotation string) []string {
+	return splitUnquoted(annotation, func(r rune) bool { return r == ';' })
+}
+
+// quoteOption quotes the option value if it could not otherwise be told apart from the
+// options or drains around it.
+func quoteOption(value string) string {
+	if strings.IndexFunc(value, unicode.IsSpace) != -1 || strings.ContainsAny(value, ";\"") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// parseDrain parses a single drain from the drains annotation, a drain is the endpoint
+// optionally followed by space separated options, e.g. "syslog+tls://host:514 tag=web.* severity=err".
+// Option values with spaces or semicolons are double quoted, e.g. include="GET /users".
+func parseDrain(host string, drain string) LogRoute {
 	route := LogRoute{
-		Endpoint: strings.TrimSpace(drain),
 		Hostname: host,
 	}
+	fields := make([]string, 0)
+	for _, field := range splitUnquoted(drain, unicode.IsSpace) {
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		return route
+	}
+	route.Endpoint = fields[0]
+	for _, option := range fields[1:] {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			debug.Errorf("[kubernetes/datasource] ignoring invalid drain option %s for %s\n", option, host)
+			continue
+		}
+		value := parts[1]
+		if strings.HasPrefix(value, "\"") {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				debug.Errorf("[kubernetes/datasource] ignoring invalid quoted drain option %s for %s\n", option, host)
+				continue
+			}
+			value = unquoted
+		}
+		switch strings.ToLower(parts[0]) {
+		case "tag":
+			route.Tag = value
+		case "severity":
+			route.Severity = value
+		case "include":
+			route.Include = value
+		case "exclude":
+			route.Exclude = value
+		case "processor":
+			route.Processors = append(route.Processors, value)
+		default:
+			debug.Errorf("[kubernetes/datasource] ignoring unknown drain option %s for %s\n", option, host)
+		}
+	}
+	return route
+}
+
+// formatDrain is the inverse of parseDrain
+func formatDrain(route LogRoute) string {
+	drain := route.Endpoint
+	if route.Tag != "" {
+		drain = drain + " tag=" + quoteOption(route.Tag)
+	}
+	if route.Severity != "" {
+		drain = drain + " severity=" + quoteOption(route.Severity)
+	}
+	if route.Include != "" {
+		drain = drain + " include=" + quoteOption(route.Include)
+	}
+	if route.Exclude != "" {
+		drain = drain + " exclude=" + quoteOption(route.Exclude)
+	}
+	for _, processor := range route.Processors {
+		drain = drain + " processor=" + quoteOption(processor)
+	}
+	return drain
+}
+
+// sameDrain returns true if the drain from the annotation is the same endpoint and options as the route
+func sameDrain(route LogRoute, drain string) bool {
+	r := parseDrain(route.Hostname, drain)
+	r.Endpoint = strings.ToLower(r.Endpoint)
+	route.Endpoint = strings.ToLower(strings.TrimSpace(route.Endpoint))
+	return SameRoute(r, route)
+}
+
+func (kds *KubernetesDataSource) addRoute(host string, drain string) {
+	debug.Debugf("[kubernetes] adding route %s->%s\n", host, drain)
+	route := parseDrain(host, drain)
 	kds.routes = append(kds.routes, route)
 	kds.add <- route
 }
 
 func (kds *KubernetesDataSource) removeRoute(host string, drain string) {
 	debug.Debugf("[kubernetes] removing route %s->%s\n", host, drain)
-	route := LogRoute{
-		Endpoint: strings.TrimSpace(drain),
-		Hostname: host,
-	}
+	route := parseDrain(host, drain)
 	newRoutes := make([]LogRoute, 0)
 	for _, r := range kds.routes {
-		if route.Endpoint != r.Endpoint && route.Hostname != r.Hostname {
+		if !SameRoute(r, route) {
 			newRoutes = append(newRoutes, r)
 		}
 	}
@@ -257,7 +375,7 @@ func (kds *KubernetesDataSource) removeRoute(host string, drain string) {
 func (kds *KubernetesDataSource) addRouteFromObj(obj interface{}) {
 	if kobj, ok := obj.(meta.Object); ok {
 		if annotation, ok := kobj.GetAnnotations()[DrainAnnotationKey]; ok {
-			drains := strings.Split(annotation, ";")
+			drains := splitDrains(annotation)
 			host := GetHostNameFromTLO(kds.kube, kobj, kds.useAkkerisHosts)
 			for _, drain := range drains {
 				kds.addRoute(host, drain)
@@ -269,7 +387,7 @@ func (kds *KubernetesDataSource) addRouteFromObj(obj interface{}) {
 func (kds *KubernetesDataSource) removeRouteFromObj(obj interface{}) {
 	if kobj, ok := obj.(meta.Object); ok {
 		if annotation, ok := kobj.GetAnnotations()[DrainAnnotationKey]; ok {
-			drains := strings.Split(annotation, ";")
+			drains := splitDrains(annotation)
 			host := GetHostNameFromTLO(kds.kube, kobj, kds.useAkkerisHosts)
 			for _, drain := range drains {
 				kds.removeRoute(host, drain)
@@ -285,8 +403,8 @@ func (kds *KubernetesDataSource) reviewUpdateFromObj(oldObj interface{}, newObj
 				if annotationOld, ok := kOldObj.GetAnnotations()[DrainAnnotationKey]; ok && annotationOld != "" {
 					if annotationNew != annotationOld {
 						// Drains updated
-						oldDrains := strings.Split(annotationOld, ";")
-						newDrains := strings.Split(annotationNew, ";")
+						oldDrains := splitDrains(annotationOld)
+						newDrains := splitDrains(annotationNew)
 						for _, dOld := range oldDrains {
 							dOld = strings.TrimSpace(dOld)
 							var found = false
@@ -354,12 +472,9 @@ func hasAccessTo(kube kubernetes.Interface, verb, group, resource string) bool {
 	return result.Status.Allowed
 }
 
-// CreateKubernetesDataSource creates a new kubernetes data source from a kube client
-func CreateKubernetesDataSource(kube kubernetes.Interface, checkPermissions bool) (*KubernetesDataSource, error) {
-	useAkkeris := false
-	if os.Getenv("AKKERIS") == "true" {
-		useAkkeris = true
-	}
+// CreateKubernetesDataSource creates a new kubernetes data source from a kube client, if useAkkeris
+// is set hostnames are derived the way akkeris names apps ({name}-{namespace}).
+func CreateKubernetesDataSource(kube kubernetes.Interface, checkPermissions bool, useAkkeris bool) (*KubernetesDataSource, error) {
 	rest := kube.CoreV1().RESTClient()
 	kds := KubernetesDataSource{
 		useAkkerisHosts: useAkkeris,
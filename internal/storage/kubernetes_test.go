@@ -19,7 +19,7 @@ func TestKubernetesDataSource(t *testing.T) {
 	 * to mimick these callbacks as the fake client does not fully
 	 * support all of the watcher functionality.
 	 */
-	ds, err := CreateKubernetesDataSource(kube, false)
+	ds, err := CreateKubernetesDataSource(kube, false, false)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
@@ -61,6 +61,48 @@ users:
 		So(part1, ShouldEqual, "test")
 		So(part2, ShouldEqual, "foo-fee")
 	})
+	Convey("Test parsing drains with options", t, func() {
+		route := parseDrain("test.foo", " syslog://localhost:123 ")
+		So(route.Endpoint, ShouldEqual, "syslog://localhost:123")
+		So(route.Hostname, ShouldEqual, "test.foo")
+		So(route.Tag, ShouldEqual, "")
+		route = parseDrain("test.foo", "syslog://localhost:123 tag=web.*")
+		So(route.Endpoint, ShouldEqual, "syslog://localhost:123")
+		So(route.Tag, ShouldEqual, "web.*")
+		So(formatDrain(route), ShouldEqual, "syslog://localhost:123 tag=web.*")
+		So(sameDrain(route, " syslog://LOCALHOST:123  tag=web.* "), ShouldEqual, true)
+		So(sameDrain(route, "syslog://localhost:123"), ShouldEqual, false)
+		route = parseDrain("test.foo", "https://pager.example.com/ severity=err include=^GET exclude=/healthz unknown=1")
+		So(route.Endpoint, ShouldEqual, "https://pager.example.com/")
+		So(route.Severity, ShouldEqual, "err")
+		So(route.Include, ShouldEqual, "^GET")
+		So(route.Exclude, ShouldEqual, "/healthz")
+		So(formatDrain(route), ShouldEqual, "https://pager.example.com/ severity=err include=^GET exclude=/healthz")
+		So(sameDrain(route, "https://pager.example.com/ severity=err"), ShouldEqual, false)
+		route = parseDrain("test.foo", "syslog://localhost:123 processor=drop:healthz processor=prefix:[web]")
+		So(route.Processors, ShouldResemble, []string{"drop:healthz", "prefix:[web]"})
+		So(formatDrain(route), ShouldEqual, "syslog://localhost:123 processor=drop:healthz processor=prefix:[web]")
+		So(sameDrain(route, "syslog://localhost:123 processor=prefix:[web] processor=drop:healthz"), ShouldEqual, false)
+	})
+	Convey("Test drain options with spaces, semicolons and quotes round trip", t, func() {
+		route := LogRoute{
+			Endpoint:   "syslog://localhost:123",
+			Hostname:   "test.foo",
+			Tag:        "web.*",
+			Include:    `^GET /users;\s"x"`,
+			Exclude:    "a\\b",
+			Processors: []string{"prefix:[web] ", "replace:a;b"},
+		}
+		drain := formatDrain(route)
+		So(drain, ShouldEqual, `syslog://localhost:123 tag=web.* include="^GET /users;\\s\"x\"" exclude=a\b processor="prefix:[web] " processor="replace:a;b"`)
+		So(parseDrain("test.foo", drain), ShouldResemble, route)
+		drains := splitDrains(drain + ";https://pager.example.com/ severity=err")
+		So(len(drains), ShouldEqual, 2)
+		So(parseDrain("test.foo", drains[0]), ShouldResemble, route)
+		So(parseDrain("test.foo", drains[1]).Severity, ShouldEqual, "err")
+		So(sameDrain(route, drains[0]), ShouldEqual, true)
+		So(parseDrain("test.foo", `syslog://localhost:123 include="unterminated`).Include, ShouldEqual, "")
+	})
 	Convey("Test Get hostname from TLO", t, func() {
 		e := apps.Deployment{}
 		e.SetName("alamotest2112")
@@ -38,7 +38,7 @@ func (dataSource *MemoryDataSource) EmitNewRoute(route LogRoute) error {
 func (dataSource *MemoryDataSource) EmitRemoveRoute(route LogRoute) error {
 	newRoutes := make([]LogRoute, 0)
 	for _, r := range dataSource.routes {
-		if r.Endpoint != route.Endpoint || r.Hostname != r.Hostname {
+		if !SameRoute(r, route) {
 			newRoutes = append(newRoutes, r)
 		}
 	}
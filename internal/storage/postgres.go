@@ -6,6 +6,7 @@ import (
 	"errors"
 	"github.com/akkeris/logtrain/internal/debug"
 	"github.com/lib/pq"
+	"sync"
 	"time"
 )
 
@@ -19,11 +20,16 @@ type Listener interface {
 }
 
 type drainEntry struct {
-	Drain    string `json:"drain"`
-	Hostname string `json:"hostname"`
-	Endpoint string `json:"endpoint"`
-	Created  string `json:"created"`
-	Updated  string `json:"updated"`
+	Drain      string   `json:"drain"`
+	Hostname   string   `json:"hostname"`
+	Endpoint   string   `json:"endpoint"`
+	Tag        string   `json:"tag"`
+	Severity   string   `json:"severity"`
+	Include    string   `json:"include"`
+	Exclude    string   `json:"exclude"`
+	Processors []string `json:"processors"`
+	Created    string   `json:"created"`
+	Updated    string   `json:"updated"`
 }
 
 type drainEntryUpdate struct {
@@ -45,6 +51,12 @@ begin
 		updated timestamptz
 	);
 
+	alter table drains add column if not exists tag text not null default '';
+	alter table drains add column if not exists severity text not null default '';
+	alter table drains add column if not exists include text not null default '';
+	alter table drains add column if not exists exclude text not null default '';
+	alter table drains add column if not exists processors text[] not null default '{}';
+
 	create or replace function notify_drains_insert()
 	  returns trigger AS $$
 	declare
@@ -102,6 +114,7 @@ type PostgresDataSource struct {
 	add      chan LogRoute
 	remove   chan LogRoute
 	routes   []LogRoute
+	mutex    sync.Mutex
 	db       *sql.DB
 	closed   bool
 }
@@ -114,8 +127,31 @@ func (pds *PostgresDataSource) RemoveRoute() chan LogRoute {
 	return pds.remove
 }
 
+// GetAllRoutes returns the routes in the drains table, kept current by the change notifications.
 func (pds *PostgresDataSource) GetAllRoutes() ([]LogRoute, error) {
-	return pds.routes, nil
+	pds.mutex.Lock()
+	defer pds.mutex.Unlock()
+	return append([]LogRoute{}, pds.routes...), nil
+}
+
+func (pds *PostgresDataSource) addRoute(route LogRoute) {
+	pds.mutex.Lock()
+	pds.routes = append(pds.routes, route)
+	pds.mutex.Unlock()
+	pds.add <- route
+}
+
+func (pds *PostgresDataSource) removeRoute(route LogRoute) {
+	pds.mutex.Lock()
+	newRoutes := make([]LogRoute, 0)
+	for _, r := range pds.routes {
+		if !SameRoute(r, route) {
+			newRoutes = append(newRoutes, r)
+		}
+	}
+	pds.routes = newRoutes
+	pds.mutex.Unlock()
+	pds.remove <- route
 }
 
 // EmitNewRoute always returns an error as this datasource is not currently writable.
@@ -123,7 +159,8 @@ func (pds *PostgresDataSource) EmitNewRoute(route LogRoute) error {
 	if pds.closed {
 		return errors.New("datasource is closed")
 	}
-	if _, err := pds.db.Exec("insert into drains (hostname, endpoint, tag) values ($1, $2, $3)", route.Hostname, route.Endpoint, route.Tag); err != nil {
+	if _, err := pds.db.Exec("insert into drains (hostname, endpoint, tag, severity, include, exclude, processors) values ($1, $2, $3, $4, $5, $6, $7)",
+		route.Hostname, route.Endpoint, route.Tag, route.Severity, route.Include, route.Exclude, pq.Array(append([]string{}, route.Processors...))); err != nil {
 		return err
 	}
 	return nil
@@ -134,7 +171,8 @@ func (pds *PostgresDataSource) EmitRemoveRoute(route LogRoute) error {
 	if pds.closed {
 		return errors.New("datasource is closed")
 	}
-	if _, err := pds.db.Exec("delete drains where hostname = $1 and endpoint = $2 and tag = $3", route.Hostname, route.Endpoint, route.Tag); err != nil {
+	if _, err := pds.db.Exec("delete from drains where hostname = $1 and endpoint = $2 and tag = $3 and severity = $4 and include = $5 and exclude = $6 and processors = $7",
+		route.Hostname, route.Endpoint, route.Tag, route.Severity, route.Include, route.Exclude, pq.Array(append([]string{}, route.Processors...))); err != nil {
 		return err
 	}
 	return nil
@@ -157,34 +195,34 @@ func (pds *PostgresDataSource) Close() error {
 	return nil
 }
 
+func (d drainEntry) route() LogRoute {
+	return LogRoute{
+		Endpoint:   d.Endpoint,
+		Hostname:   d.Hostname,
+		Tag:        d.Tag,
+		Severity:   d.Severity,
+		Include:    d.Include,
+		Exclude:    d.Exclude,
+		Processors: d.Processors,
+	}
+}
+
 func (pds *PostgresDataSource) processChange(n *pq.Notification) {
 	if n.Channel == "drains.insert" {
 		var d drainEntry
 		if err := json.Unmarshal([]byte(n.Extra), &d); err != nil {
 			debug.Errorf("Failed to unmarshal insert notification from postgres: %s\n", err.Error())
 		} else {
-			pds.add <- LogRoute{
-				Endpoint: d.Endpoint,
-				Hostname: d.Hostname,
-				Tag:      "",
-			}
+			pds.addRoute(d.route())
 		}
 	} else if n.Channel == "drains.update" {
 		var d drainEntryUpdate
 		if err := json.Unmarshal([]byte(n.Extra), &d); err != nil {
 			debug.Errorf("Failed to unmarshal insert notification from postgres: %s\n", err.Error())
 		} else {
-			if d.Old.Endpoint != d.New.Endpoint || d.Old.Hostname != d.New.Hostname {
-				pds.remove <- LogRoute{
-					Endpoint: d.Old.Endpoint,
-					Hostname: d.Old.Hostname,
-					Tag:      "",
-				}
-				pds.add <- LogRoute{
-					Endpoint: d.New.Endpoint,
-					Hostname: d.New.Hostname,
-					Tag:      "",
-				}
+			if !SameRoute(d.Old.route(), d.New.route()) {
+				pds.removeRoute(d.Old.route())
+				pds.addRoute(d.New.route())
 			}
 		}
 	} else if n.Channel == "drains.delete" {
@@ -192,11 +230,7 @@ func (pds *PostgresDataSource) processChange(n *pq.Notification) {
 		if err := json.Unmarshal([]byte(n.Extra), &d); err != nil {
 			debug.Errorf("Failed to unmarshal delete notification from postgres: %s\n", err.Error())
 		} else {
-			pds.remove <- LogRoute{
-				Endpoint: d.Endpoint,
-				Hostname: d.Hostname,
-				Tag:      "",
-			}
+			pds.removeRoute(d.route())
 		}
 	}
 }
@@ -213,7 +247,7 @@ func (pds *PostgresDataSource) listenForChanges() {
 }
 
 func CreatePostgresDataSource(db *sql.DB, listener Listener, init bool) (*PostgresDataSource, error) {
-	pds := PostgresDataSource{
+	pds := &PostgresDataSource{
 		listener: listener,
 		add:      make(chan LogRoute, 1),
 		remove:   make(chan LogRoute, 1),
@@ -226,7 +260,7 @@ func CreatePostgresDataSource(db *sql.DB, listener Listener, init bool) (*Postgr
 		if _, err := db.Exec(creationScript); err != nil {
 			return nil, err
 		}
-		rows, err := db.Query("select drain, hostname, endpoint from drains")
+		rows, err := db.Query("select endpoint, hostname, tag, severity, include, exclude, processors from drains")
 		if err != nil {
 			return nil, err
 		}
@@ -234,10 +268,10 @@ func CreatePostgresDataSource(db *sql.DB, listener Listener, init bool) (*Postgr
 
 		for rows.Next() {
 			var logroute LogRoute
-			if err := rows.Scan(&logroute.Endpoint, &logroute.Hostname); err != nil {
+			if err := rows.Scan(&logroute.Endpoint, &logroute.Hostname, &logroute.Tag, &logroute.Severity, &logroute.Include, &logroute.Exclude, pq.Array(&logroute.Processors)); err != nil {
 				return nil, err
 			}
-			pds.add <- logroute
+			pds.routes = append(pds.routes, logroute)
 		}
 	}
 
@@ -253,8 +287,9 @@ func CreatePostgresDataSource(db *sql.DB, listener Listener, init bool) (*Postgr
 
 	go pds.listenForChanges()
 
-	return &pds, nil
+	return pds, nil
 }
+
 // CreatePostgresDataSourceWithURL creates a postgres datasource from a database url.
 func CreatePostgresDataSourceWithURL(databaseURL string) (*PostgresDataSource, error) {
 	db, err := sql.Open("postgres", databaseURL)
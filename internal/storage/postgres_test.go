@@ -56,6 +56,10 @@ func TestPostgresDataSource(t *testing.T) {
 		case <-time.NewTimer(time.Second * 5).C:
 			log.Fatal("This should not have been called (add).")
 		}
+		routes, err := ds.GetAllRoutes()
+		So(err, ShouldBeNil)
+		So(len(routes), ShouldEqual, 1)
+		So(routes[0].Endpoint, ShouldEqual, "syslog://localhost:123")
 	})
 	Convey("testing updating a route", t, func() {
 		listener.notification <- &pq.Notification{
@@ -79,6 +83,10 @@ func TestPostgresDataSource(t *testing.T) {
 		case <-time.NewTimer(time.Second * 5).C:
 			log.Fatal("This should not have been called (add).")
 		}
+		routes, err := ds.GetAllRoutes()
+		So(err, ShouldBeNil)
+		So(len(routes), ShouldEqual, 1)
+		So(routes[0].Endpoint, ShouldEqual, "syslog://localhost:124")
 	})
 	Convey("testing removing a route", t, func() {
 		listener.notification <- &pq.Notification{
@@ -95,6 +103,46 @@ func TestPostgresDataSource(t *testing.T) {
 			log.Fatal("This should not have been called (remove on removing).")
 		}
 	})
+	Convey("testing updating the tag of a route", t, func() {
+		listener.notification <- &pq.Notification{
+			BePid:   0,
+			Channel: "drains.update",
+			Extra:   `{"old":{"drain":"ff6aca6c-2c5e-4220-a961-261bca5ff1e4","hostname":"alamotest2115.default","endpoint":"syslog://localhost:124","tag":"","created":"2020-11-03T11:35:50.330592-07:00","updated":"2020-11-03T11:35:50.330592-07:00"}, "new":{"drain":"ff6aca6c-2c5e-4220-a961-261bca5ff1e4","hostname":"alamotest2115.default","endpoint":"syslog://localhost:124","tag":"web.*","created":"2020-11-03T11:35:50.330592-07:00","updated":"2020-11-03T11:35:50.330592-07:00"}}`,
+		}
+		select {
+		case route := <-ds.RemoveRoute():
+			So(route.Endpoint, ShouldEqual, "syslog://localhost:124")
+			So(route.Tag, ShouldEqual, "")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("This should not have been called (remove on tag update).")
+		}
+		select {
+		case route := <-ds.AddRoute():
+			So(route.Endpoint, ShouldEqual, "syslog://localhost:124")
+			So(route.Tag, ShouldEqual, "web.*")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("This should not have been called (add on tag update).")
+		}
+		routes, err := ds.GetAllRoutes()
+		So(err, ShouldBeNil)
+		So(len(routes), ShouldEqual, 1)
+		So(routes[0].Tag, ShouldEqual, "web.*")
+	})
+	Convey("testing deleting a route removes it from GetAllRoutes", t, func() {
+		listener.notification <- &pq.Notification{
+			BePid:   0,
+			Channel: "drains.delete",
+			Extra:   `{"drain":"ff6aca6c-2c5e-4220-a961-261bca5ff1e4","hostname":"alamotest2115.default","endpoint":"syslog://localhost:124","tag":"web.*","created":"2020-11-03T11:35:50.330592-07:00","updated":"2020-11-03T11:35:50.330592-07:00"}`,
+		}
+		select {
+		case <-ds.RemoveRoute():
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("This should not have been called (remove on delete).")
+		}
+		routes, err := ds.GetAllRoutes()
+		So(err, ShouldBeNil)
+		So(len(routes), ShouldEqual, 0)
+	})
 	Convey("testing no-op on a route and test GetAllRoutes", t, func() {
 		listener.notification <- &pq.Notification{
 			BePid:   0,
@@ -0,0 +1,343 @@
+package tailer
+
+import (
+	"errors"
+	"github.com/akkeris/logtrain/internal/debug"
+	"github.com/akkeris/logtrain/internal/positions"
+	"github.com/akkeris/logtrain/pkg/input/multiline"
+	"github.com/influxdata/tail"
+	"github.com/trevorlinton/remote_syslog2/syslog"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// positionsSyncInterval is how often read offsets are written to the positions file.
+const positionsSyncInterval = time.Second * 10
+
+// ErrClosed is returned when a file is followed after the tailer was closed.
+var ErrClosed = errors.New("the tailer is closed")
+
+// Parser turns a line read from a file into a packet, the boolean returned is false if the
+// line did not produce a packet (e.g. it could not be parsed or is part of a longer message).
+// Each followed file has its own parser so it may keep state between lines.
+type Parser func(text string, t time.Time) (syslog.Packet, bool)
+
+type follower struct {
+	errors uint32
+	joiner *multiline.Joiner // nil unless lines are joined
+	offset int64             // the offset after the last line that was sent (or skipped), accessed atomically
+	parse  Parser
+	stop   chan struct{}
+	tail   *tail.Tail
+}
+
+// Tailer follows files and sends the packets parsed from their lines on a channel, the
+// read offset of each file is kept in a positions file (if one is given) so restarts resume
+// where they left off. It's shared by the inputs that tail files.
+type Tailer struct {
+	closed    bool
+	followers map[string]*follower
+	join      *multiline.Config
+	mutex     sync.Mutex
+	name      string
+	packets   chan syslog.Packet
+	positions *positions.Positions
+	stop      chan struct{}
+	wait      sync.WaitGroup
+}
+
+// Start begins periodically saving the read offsets if there is a positions file.
+func (t *Tailer) Start() {
+	if t.positions == nil {
+		return
+	}
+	t.wait.Add(1)
+	go t.positionsLoop()
+}
+
+// Join joins the lines of each file into messages, it must be called before any file is followed.
+func (t *Tailer) Join(config multiline.Config) {
+	t.mutex.Lock()
+	t.join = &config
+	t.mutex.Unlock()
+}
+
+// Follow begins tailing the file from whence, unless a position is recorded for it in which
+// case it resumes from there. Files that are already followed are left alone.
+func (t *Tailer) Follow(file string, whence int, parse Parser) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errors.New("cannot tail a directory")
+	}
+	// Create and write events can arrive back to back for a new file, the lock is held
+	// until the follower is in place so we do not end up with two emitting the same lines.
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	if _, ok := t.followers[file]; ok {
+		return nil
+	}
+	config := tail.Config{
+		Follow: true,
+		Location: &tail.SeekInfo{
+			Offset: 0,
+			Whence: whence,
+		},
+		ReOpen: true,
+		Logger: debug.LoggerDebug,
+	}
+	var start int64
+	if whence == io.SeekEnd {
+		start = info.Size()
+	}
+	if t.positions != nil {
+		if offset, ok := t.positions.Resume(file, info); ok {
+			config.Location.Offset = offset
+			config.Location.Whence = io.SeekStart
+			start = offset
+		}
+	}
+	var joiner *multiline.Joiner
+	if t.join != nil {
+		if joiner, err = multiline.CreateJoiner(*t.join); err != nil {
+			return err
+		}
+	}
+	proc, err := tail.TailFile(file, config)
+	if err != nil {
+		return err
+	}
+	f := &follower{
+		joiner: joiner,
+		offset: start,
+		parse:  parse,
+		stop:   make(chan struct{}),
+		tail:   proc,
+	}
+	t.followers[file] = f
+	t.wait.Add(1)
+	go t.follow(file, f)
+	return nil
+}
+
+// Following returns true if the file is being followed.
+func (t *Tailer) Following(file string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, ok := t.followers[file]
+	return ok
+}
+
+// Remove stops following the file and forgets its position.
+func (t *Tailer) Remove(file string) {
+	t.mutex.Lock()
+	f, ok := t.followers[file]
+	delete(t.followers, file)
+	t.mutex.Unlock()
+	if !ok {
+		return
+	}
+	close(f.stop)
+	if t.positions != nil {
+		t.positions.Remove(file)
+	}
+	debug.Debugf("[%s] Stopped following %s\n", t.name, file)
+}
+
+// Close stops following every file and waits until nothing more is sent on the packets
+// channel, the positions are saved one last time.
+func (t *Tailer) Close() error {
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return ErrClosed
+	}
+	t.closed = true
+	t.mutex.Unlock()
+	close(t.stop)
+	t.wait.Wait()
+	if t.positions != nil {
+		t.syncPositions()
+	}
+	return nil
+}
+
+// syncPositions records the offset of the last line each follower sent and saves it to
+// disk, lines still waiting to be joined are read again after a restart.
+func (t *Tailer) syncPositions() {
+	t.mutex.Lock()
+	for file, f := range t.followers {
+		offset := atomic.LoadInt64(&f.offset)
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		t.positions.Set(file, positions.Position{
+			Inode:  positions.Inode(info),
+			Offset: offset,
+		})
+	}
+	t.mutex.Unlock()
+	if err := t.positions.Save(); err != nil {
+		debug.Errorf("[%s]: Unable to save positions: %s\n", t.name, err.Error())
+	}
+}
+
+func (t *Tailer) positionsLoop() {
+	defer t.wait.Done()
+	ticker := time.NewTicker(positionsSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.syncPositions()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// send waits until the packets are read or the follower is stopped, it returns false if
+// the follower was stopped.
+func (t *Tailer) send(f *follower, packets []syslog.Packet) bool {
+	for _, packet := range packets {
+		select {
+		case t.packets <- packet:
+		case <-f.stop:
+			return false
+		case <-t.stop:
+			return false
+		}
+	}
+	return true
+}
+
+// flush sends the message the follower is joining lines for if it can be sent right away,
+// it returns false if the message could not be sent.
+func (t *Tailer) flush(f *follower) bool {
+	if f.joiner == nil {
+		return true
+	}
+	for _, packet := range f.joiner.Flush() {
+		select {
+		case t.packets <- packet:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// pending returns true if the follower holds lines waiting for the rest of their message.
+func (f *follower) pending() bool {
+	return f.joiner != nil && f.joiner.Pending()
+}
+
+// add returns the packets that are ready to be sent once the packet is added.
+func (f *follower) add(packet syslog.Packet) []syslog.Packet {
+	if f.joiner == nil {
+		return []syslog.Packet{packet}
+	}
+	return f.joiner.Add(packet, time.Now())
+}
+
+func (t *Tailer) follow(file string, f *follower) {
+	defer t.wait.Done()
+	var expire <-chan time.Time
+	if f.joiner != nil {
+		ticker := time.NewTicker(f.joiner.Interval())
+		defer ticker.Stop()
+		expire = ticker.C
+	}
+	// read is the offset after the last line received, held is where the message
+	// the joiner is holding lines for begins.
+	read, held := atomic.LoadInt64(&f.offset), int64(0)
+	defer func() {
+		if t.flush(f) {
+			atomic.StoreInt64(&f.offset, read)
+		}
+		f.tail.Kill(nil)
+		// the tail may be waiting to hand over a line, read until it closes the lines.
+		for range f.tail.Lines {
+		}
+		f.tail.Wait()
+		f.tail.Cleanup()
+	}()
+	for {
+		select {
+		case line, ok := <-f.tail.Lines:
+			if !ok {
+				debug.Debugf("[%s]: Watcher was closed on %s\n", t.name, file)
+				return
+			}
+			if line.Err != nil {
+				// track errors with the lines, but don't report anything, one
+				// corrupted file should not make the entire input look broken.
+				debug.Errorf("[%s]: Error following file %s: %s", t.name, file, line.Err.Error())
+				f.errors++
+				continue
+			}
+			if offset, err := f.tail.Tell(); err == nil && offset < read {
+				// the file was truncated or replaced and is read again from the start.
+				read = 0
+			}
+			start := read
+			read += int64(len(line.Text)) + 1
+			if packet, ok := f.parse(line.Text, line.Time); ok {
+				pending := f.pending()
+				ready := f.add(packet)
+				if !t.send(f, ready) {
+					return
+				}
+				if f.pending() && (!pending || len(ready) > 0) {
+					held = start
+				}
+			}
+			if f.pending() {
+				atomic.StoreInt64(&f.offset, held)
+			} else {
+				atomic.StoreInt64(&f.offset, read)
+			}
+		case now := <-expire:
+			if f.joiner.Expired(now) {
+				if !t.send(f, f.joiner.Flush()) {
+					return
+				}
+				atomic.StoreInt64(&f.offset, read)
+			}
+		case <-f.stop:
+			debug.Infof("[%s]: Received message to stop watcher for %s.", t.name, file)
+			return
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Create creates a tailer sending packets on the channel, name is used in log messages. If
+// positionsPath is set the read offset of each file is kept there.
+func Create(name string, packets chan syslog.Packet, positionsPath string) (*Tailer, error) {
+	var pos *positions.Positions
+	if positionsPath != "" {
+		p, err := positions.Open(positionsPath)
+		if err != nil {
+			return nil, err
+		}
+		pos = p
+	}
+	return &Tailer{
+		followers: make(map[string]*follower),
+		name:      name,
+		packets:   packets,
+		positions: pos,
+		stop:      make(chan struct{}),
+	}, nil
+}
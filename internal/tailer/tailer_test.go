@@ -0,0 +1,142 @@
+package tailer
+
+import (
+	"github.com/akkeris/logtrain/internal/positions"
+	"github.com/akkeris/logtrain/pkg/input/multiline"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/trevorlinton/remote_syslog2/syslog"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parser(hostname string) Parser {
+	return func(text string, t time.Time) (syslog.Packet, bool) {
+		if strings.HasPrefix(text, "#") {
+			return syslog.Packet{}, false
+		}
+		return syslog.Packet{Hostname: hostname, Message: text, Time: t}, true
+	}
+}
+
+func TestTailer(t *testing.T) {
+	if err := os.RemoveAll("/tmp/tailer_test"); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll("/tmp/tailer_test", 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile("/tmp/tailer_test/a.log", []byte("# comment\nfirst\nsecond\n"), 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	Convey("Ensure lines are parsed into packets and positions are saved on close", t, func() {
+		packets := make(chan syslog.Packet, 10)
+		tailer, err := Create("tailer", packets, "/tmp/tailer_test/positions.json")
+		So(err, ShouldBeNil)
+		tailer.Start()
+		So(tailer.Follow("/tmp/tailer_test", io.SeekStart, parser("a")), ShouldNotBeNil)
+		So(tailer.Follow("/tmp/tailer_test/a.log", io.SeekStart, parser("a")), ShouldBeNil)
+		So(tailer.Follow("/tmp/tailer_test/a.log", io.SeekStart, parser("b")), ShouldBeNil)
+		So(tailer.Following("/tmp/tailer_test/a.log"), ShouldEqual, true)
+		for _, expected := range []string{"first", "second"} {
+			select {
+			case packet := <-packets:
+				So(packet.Message, ShouldEqual, expected)
+				So(packet.Hostname, ShouldEqual, "a")
+			case <-time.NewTimer(time.Second * 2).C:
+				So(false, ShouldEqual, true)
+			}
+		}
+		So(tailer.Close(), ShouldBeNil)
+		So(tailer.Close(), ShouldEqual, ErrClosed)
+		So(tailer.Follow("/tmp/tailer_test/a.log", io.SeekStart, parser("a")), ShouldEqual, ErrClosed)
+		pos, err := positions.Open("/tmp/tailer_test/positions.json")
+		So(err, ShouldBeNil)
+		p, ok := pos.Get("/tmp/tailer_test/a.log")
+		So(ok, ShouldEqual, true)
+		So(p.Offset, ShouldEqual, len("# comment\nfirst\nsecond\n"))
+	})
+	Convey("Ensure close does not wait on packets nobody reads", t, func() {
+		if err := ioutil.WriteFile("/tmp/tailer_test/b.log", []byte(strings.Repeat("line\n", 10)), 0644); err != nil {
+			log.Fatal(err)
+		}
+		packets := make(chan syslog.Packet)
+		tailer, err := Create("tailer", packets, "")
+		So(err, ShouldBeNil)
+		So(tailer.Follow("/tmp/tailer_test/b.log", io.SeekStart, parser("b")), ShouldBeNil)
+		<-packets
+		closed := make(chan error, 1)
+		go func() { closed <- tailer.Close() }()
+		select {
+		case err := <-closed:
+			So(err, ShouldBeNil)
+		case <-time.NewTimer(time.Second * 2).C:
+			So(false, ShouldEqual, true)
+		}
+	})
+	Convey("Ensure lines are joined per file even if the files share a hostname", t, func() {
+		if err := ioutil.WriteFile("/tmp/tailer_test/c.log", []byte("ERROR c\n  c1\n  c2\n"), 0644); err != nil {
+			log.Fatal(err)
+		}
+		if err := ioutil.WriteFile("/tmp/tailer_test/d.log", []byte("ERROR d\n  d1\n"), 0644); err != nil {
+			log.Fatal(err)
+		}
+		packets := make(chan syslog.Packet, 10)
+		tailer, err := Create("tailer", packets, "")
+		So(err, ShouldBeNil)
+		tailer.Join(multiline.Config{Start: regexp.MustCompile(`^\S`), MaxWait: time.Millisecond * 100})
+		So(tailer.Follow("/tmp/tailer_test/c.log", io.SeekStart, parser("app")), ShouldBeNil)
+		So(tailer.Follow("/tmp/tailer_test/d.log", io.SeekStart, parser("app")), ShouldBeNil)
+		messages := make([]string, 0)
+		for len(messages) < 2 {
+			select {
+			case packet := <-packets:
+				messages = append(messages, packet.Message)
+			case <-time.NewTimer(time.Second * 2).C:
+				So(false, ShouldEqual, true)
+			}
+		}
+		So(messages, ShouldContain, "ERROR c\n  c1\n  c2")
+		So(messages, ShouldContain, "ERROR d\n  d1")
+		So(tailer.Close(), ShouldBeNil)
+	})
+	Convey("Ensure lines that were not sent are not recorded as read on close", t, func() {
+		if err := ioutil.WriteFile("/tmp/tailer_test/e.log", []byte("first\nERROR e\n  e1\n"), 0644); err != nil {
+			log.Fatal(err)
+		}
+		packets := make(chan syslog.Packet)
+		tailer, err := Create("tailer", packets, "/tmp/tailer_test/positions.json")
+		So(err, ShouldBeNil)
+		tailer.Join(multiline.Config{Start: regexp.MustCompile(`^\S`), MaxWait: time.Minute})
+		So(tailer.Follow("/tmp/tailer_test/e.log", io.SeekStart, parser("app")), ShouldBeNil)
+		select {
+		case packet := <-packets:
+			So(packet.Message, ShouldEqual, "first")
+		case <-time.NewTimer(time.Second * 2).C:
+			So(false, ShouldEqual, true)
+		}
+		<-time.NewTimer(time.Millisecond * 100).C
+		So(tailer.Close(), ShouldBeNil)
+		pos, err := positions.Open("/tmp/tailer_test/positions.json")
+		So(err, ShouldBeNil)
+		p, ok := pos.Get("/tmp/tailer_test/e.log")
+		So(ok, ShouldEqual, true)
+		So(p.Offset, ShouldEqual, len("first\n"))
+	})
+	Convey("Ensure a removed file is no longer followed", t, func() {
+		packets := make(chan syslog.Packet, 10)
+		tailer, err := Create("tailer", packets, "")
+		So(err, ShouldBeNil)
+		So(tailer.Follow("/tmp/tailer_test/b.log", io.SeekEnd, parser("b")), ShouldBeNil)
+		tailer.Remove("/tmp/tailer_test/b.log")
+		So(tailer.Following("/tmp/tailer_test/b.log"), ShouldEqual, false)
+		So(tailer.Close(), ShouldBeNil)
+		os.RemoveAll("/tmp/tailer_test")
+	})
+}
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/akkeris/logtrain/internal/debug"
+	"github.com/akkeris/logtrain/internal/storage"
+	"github.com/akkeris/logtrain/pkg/router"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Route is a route from a hostname to an endpoint as it's read and written by the api.
+type Route struct {
+	Hostname   string   `json:"hostname"`
+	Endpoint   string   `json:"endpoint"`
+	Tag        string   `json:"tag,omitempty"`
+	Severity   string   `json:"severity,omitempty"`
+	Include    string   `json:"include,omitempty"`
+	Exclude    string   `json:"exclude,omitempty"`
+	Processors []string `json:"processors,omitempty"`
+}
+
+// Drain is an open drain and its metrics.
+type Drain struct {
+	Endpoint       string  `json:"endpoint"`
+	MaxConnections uint32  `json:"max_connections"`
+	Connections    uint32  `json:"connections"`
+	Pressure       float64 `json:"pressure"`
+	Sent           uint32  `json:"sent"`
+	Errors         uint32  `json:"errors"`
+	QueuedBytes    int64   `json:"queued_bytes"`
+	Evicted        uint64  `json:"evicted"`
+}
+
+// Input is an input added to the router and the amount of packets received from it.
+type Input struct {
+	ID      string `json:"id"`
+	Packets uint64 `json:"packets"`
+}
+
+// API inspects and manages the routes, drains and inputs of a router over http.
+type API struct {
+	router *router.Router
+	token  string
+}
+
+func (r Route) logRoute() storage.LogRoute {
+	return storage.LogRoute{
+		Hostname:   r.Hostname,
+		Endpoint:   r.Endpoint,
+		Tag:        r.Tag,
+		Severity:   r.Severity,
+		Include:    r.Include,
+		Exclude:    r.Exclude,
+		Processors: r.Processors,
+	}
+}
+
+func fromLogRoute(r storage.LogRoute) Route {
+	return Route{
+		Hostname:   r.Hostname,
+		Endpoint:   r.Endpoint,
+		Tag:        r.Tag,
+		Severity:   r.Severity,
+		Include:    r.Include,
+		Exclude:    r.Exclude,
+		Processors: r.Processors,
+	}
+}
+
+func respond(response http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data = []byte("{\"error\":\"" + http.StatusText(status) + "\"}")
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	response.Write(data)
+}
+
+func respondError(response http.ResponseWriter, status int, err error) {
+	respond(response, status, map[string]string{"error": err.Error()})
+}
+
+// authorized checks the bearer token in the authorization header
+func (api *API) authorized(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(api.token)) == 1
+}
+
+func (api *API) handle(methods []string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(response http.ResponseWriter, req *http.Request) {
+		if !api.authorized(req) {
+			response.Header().Set("WWW-Authenticate", "Bearer")
+			respondError(response, http.StatusUnauthorized, errors.New("a valid bearer token is required"))
+			return
+		}
+		for _, method := range methods {
+			if req.Method == method {
+				handler(response, req)
+				return
+			}
+		}
+		response.Header().Set("Allow", strings.Join(methods, ", "))
+		respondError(response, http.StatusMethodNotAllowed, errors.New("the method "+req.Method+" is not allowed"))
+	}
+}
+
+func decode(req *http.Request, value interface{}) error {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	defer req.Body.Close()
+	return json.Unmarshal(data, value)
+}
+
+func hasRoute(ds storage.DataSource, route storage.LogRoute) (bool, error) {
+	routes, err := ds.GetAllRoutes()
+	if err != nil {
+		return false, err
+	}
+	for _, r := range routes {
+		if storage.SameRoute(r, route) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (api *API) routes(response http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		routes := make([]Route, 0)
+		for _, r := range api.router.Routes() {
+			routes = append(routes, fromLogRoute(r))
+		}
+		respond(response, http.StatusOK, routes)
+		return
+	}
+	var route Route
+	if err := decode(req, &route); err != nil {
+		respondError(response, http.StatusBadRequest, err)
+		return
+	}
+	if req.Method == http.MethodPost {
+		api.addRoute(response, route.logRoute())
+	} else {
+		api.removeRoute(response, route.logRoute())
+	}
+}
+
+// addRoute adds the route to the first writable datasource
+func (api *API) addRoute(response http.ResponseWriter, route storage.LogRoute) {
+	if err := router.ValidateRoute(route); err != nil {
+		respondError(response, http.StatusUnprocessableEntity, err)
+		return
+	}
+	for _, ds := range api.router.DataSources() {
+		if exists, err := hasRoute(ds, route); err != nil {
+			respondError(response, http.StatusInternalServerError, err)
+			return
+		} else if exists {
+			respondError(response, http.StatusConflict, errors.New("the route already exists"))
+			return
+		}
+	}
+	for _, ds := range api.router.DataSources() {
+		if ds.Writable() {
+			if err := ds.EmitNewRoute(route); err != nil {
+				respondError(response, http.StatusInternalServerError, err)
+				return
+			}
+			debug.Infof("[api] Added route %s->%s\n", route.Hostname, route.Endpoint)
+			respond(response, http.StatusCreated, fromLogRoute(route))
+			return
+		}
+	}
+	respondError(response, http.StatusMethodNotAllowed, errors.New("none of the datasources are writable"))
+}
+
+// removeRoute removes the route from every writable datasource that has it
+func (api *API) removeRoute(response http.ResponseWriter, route storage.LogRoute) {
+	var found, removed = false, false
+	for _, ds := range api.router.DataSources() {
+		exists, err := hasRoute(ds, route)
+		if err != nil {
+			respondError(response, http.StatusInternalServerError, err)
+			return
+		}
+		if !exists {
+			continue
+		}
+		found = true
+		if ds.Writable() {
+			if err := ds.EmitRemoveRoute(route); err != nil {
+				respondError(response, http.StatusInternalServerError, err)
+				return
+			}
+			removed = true
+		}
+	}
+	if !found {
+		respondError(response, http.StatusNotFound, errors.New("the route does not exist"))
+	} else if !removed {
+		respondError(response, http.StatusMethodNotAllowed, errors.New("the route is only in datasources that are not writable"))
+	} else {
+		debug.Infof("[api] Removed route %s->%s\n", route.Hostname, route.Endpoint)
+		respond(response, http.StatusOK, fromLogRoute(route))
+	}
+}
+
+func (api *API) drains(response http.ResponseWriter, req *http.Request) {
+	drains := make([]Drain, 0)
+	for endpoint, metric := range api.router.Drains() {
+		drains = append(drains, Drain{
+			Endpoint:       endpoint,
+			MaxConnections: metric.MaxConnections,
+			Connections:    metric.Connections,
+			Pressure:       metric.Pressure,
+			Sent:           metric.Sent,
+			Errors:         metric.Errors,
+			QueuedBytes:    metric.QueuedBytes,
+			Evicted:        metric.Evicted,
+		})
+	}
+	sort.Slice(drains, func(i, j int) bool { return drains[i].Endpoint < drains[j].Endpoint })
+	respond(response, http.StatusOK, drains)
+}
+
+// drainAction closes or reopens the drain to the endpoint in the request body
+func (api *API) drainAction(action func(endpoint string) error) func(http.ResponseWriter, *http.Request) {
+	return func(response http.ResponseWriter, req *http.Request) {
+		var drain Drain
+		if err := decode(req, &drain); err != nil {
+			respondError(response, http.StatusBadRequest, err)
+			return
+		}
+		if _, ok := api.router.Drains()[drain.Endpoint]; !ok {
+			respondError(response, http.StatusNotFound, errors.New("there is no open drain to "+drain.Endpoint))
+			return
+		}
+		if err := action(drain.Endpoint); err != nil {
+			respondError(response, http.StatusInternalServerError, err)
+			return
+		}
+		respond(response, http.StatusOK, map[string]string{"endpoint": drain.Endpoint})
+	}
+}
+
+func (api *API) inputs(response http.ResponseWriter, req *http.Request) {
+	inputs := make([]Input, 0)
+	for id, packets := range api.router.Inputs() {
+		inputs = append(inputs, Input{ID: id, Packets: packets})
+	}
+	sort.Slice(inputs, func(i, j int) bool { return inputs[i].ID < inputs[j].ID })
+	respond(response, http.StatusOK, inputs)
+}
+
+// Register adds the api to the mux under /api/
+func (api *API) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/routes", api.handle([]string{http.MethodGet, http.MethodPost, http.MethodDelete}, api.routes))
+	mux.HandleFunc("/api/drains", api.handle([]string{http.MethodGet}, api.drains))
+	mux.HandleFunc("/api/drains/close", api.handle([]string{http.MethodPost}, api.drainAction(api.router.CloseDrain)))
+	mux.HandleFunc("/api/drains/reopen", api.handle([]string{http.MethodPost}, api.drainAction(api.router.ReopenDrain)))
+	mux.HandleFunc("/api/inputs", api.handle([]string{http.MethodGet}, api.inputs))
+}
+
+// Create creates an api for the router, requests must have the token as a bearer token.
+func Create(r *router.Router, token string) (*API, error) {
+	if r == nil {
+		return nil, errors.New("a router is required")
+	}
+	if token == "" {
+		return nil, errors.New("a token is required")
+	}
+	return &API{
+		router: r,
+		token:  token,
+	}, nil
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/akkeris/logtrain/internal/storage"
+	"github.com/akkeris/logtrain/pkg/router"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/trevorlinton/remote_syslog2/syslog"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeInput struct {
+	packets chan syslog.Packet
+}
+
+func (fi *fakeInput) Close() error {
+	return nil
+}
+
+func (fi *fakeInput) Dial() error {
+	return nil
+}
+
+func (fi *fakeInput) Errors() chan error {
+	return make(chan error)
+}
+
+func (fi *fakeInput) Packets() chan syslog.Packet {
+	return fi.packets
+}
+
+func (fi *fakeInput) Pools() bool {
+	return true
+}
+
+func request(method string, url string, token string, body interface{}, value interface{}) int {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer resp.Body.Close()
+	if value != nil {
+		if err := json.NewDecoder(resp.Body).Decode(value); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// listen receives lines sent to a syslog tcp endpoint
+func listen(received chan string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					received <- scanner.Text()
+				}
+			}(conn)
+		}
+	}()
+	return listener
+}
+
+func TestAPI(t *testing.T) {
+	received := make(chan string, 10)
+	listener := listen(received)
+	defer listener.Close()
+	endpoint := "syslog+tcp://" + listener.Addr().String()
+	route := storage.LogRoute{Hostname: "app.space", Endpoint: endpoint}
+	ds := storage.CreateMemoryDataSource()
+	ds.EmitNewRoute(route)
+	r, err := router.NewRouter([]storage.DataSource{ds}, true, 1)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	input := fakeInput{packets: make(chan syslog.Packet, 1)}
+	if err := r.AddInput(&input, "fake"); err != nil {
+		log.Fatalln(err)
+	}
+	if err := r.Dial(); err != nil {
+		log.Fatalln(err)
+	}
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	Convey("Ensure the api requires a router and token", t, func() {
+		_, err := Create(nil, "token")
+		So(err, ShouldNotBeNil)
+		_, err = Create(r, "")
+		So(err, ShouldNotBeNil)
+		api, err := Create(r, "token")
+		So(err, ShouldBeNil)
+		api.Register(mux)
+	})
+	Convey("Ensure requests without the bearer token are rejected", t, func() {
+		So(request(http.MethodGet, server.URL+"/api/routes", "", nil, nil), ShouldEqual, http.StatusUnauthorized)
+		So(request(http.MethodGet, server.URL+"/api/routes", "wrong", nil, nil), ShouldEqual, http.StatusUnauthorized)
+		So(request(http.MethodPut, server.URL+"/api/routes", "token", nil, nil), ShouldEqual, http.StatusMethodNotAllowed)
+	})
+	Convey("Ensure routes can be listed, added and removed", t, func() {
+		var routes []Route
+		So(request(http.MethodGet, server.URL+"/api/routes", "token", nil, &routes), ShouldEqual, http.StatusOK)
+		So(routes, ShouldResemble, []Route{Route{Hostname: "app.space", Endpoint: endpoint}})
+
+		added := Route{Hostname: "*.space", Endpoint: endpoint, Severity: "err"}
+		So(request(http.MethodPost, server.URL+"/api/routes", "token", Route{Hostname: "app.space", Endpoint: "nope://"}, nil), ShouldEqual, http.StatusUnprocessableEntity)
+		So(request(http.MethodPost, server.URL+"/api/routes", "token", added, nil), ShouldEqual, http.StatusCreated)
+		So(request(http.MethodPost, server.URL+"/api/routes", "token", added, nil), ShouldEqual, http.StatusConflict)
+		for i := 0; i < 50 && len(r.Routes()) < 2; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		So(request(http.MethodGet, server.URL+"/api/routes", "token", nil, &routes), ShouldEqual, http.StatusOK)
+		So(routes, ShouldResemble, []Route{added, Route{Hostname: "app.space", Endpoint: endpoint}})
+
+		So(request(http.MethodDelete, server.URL+"/api/routes", "token", added, nil), ShouldEqual, http.StatusOK)
+		So(request(http.MethodDelete, server.URL+"/api/routes", "token", added, nil), ShouldEqual, http.StatusNotFound)
+		for i := 0; i < 50 && len(r.Routes()) > 1; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		So(len(r.Routes()), ShouldEqual, 1)
+	})
+	Convey("Ensure drains and inputs can be listed, closed and reopened", t, func() {
+		var drains []Drain
+		So(request(http.MethodGet, server.URL+"/api/drains", "token", nil, &drains), ShouldEqual, http.StatusOK)
+		So(drains, ShouldBeEmpty)
+		So(request(http.MethodPost, server.URL+"/api/drains/close", "token", Drain{Endpoint: endpoint}, nil), ShouldEqual, http.StatusNotFound)
+
+		input.packets <- syslog.Packet{Hostname: "app.space", Message: "hello", Time: time.Now()}
+		select {
+		case line := <-received:
+			So(line, ShouldContainSubstring, "hello")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive the packet")
+		}
+		So(request(http.MethodGet, server.URL+"/api/drains", "token", nil, &drains), ShouldEqual, http.StatusOK)
+		So(len(drains), ShouldEqual, 1)
+		So(drains[0].Endpoint, ShouldEqual, endpoint)
+		So(drains[0].MaxConnections, ShouldEqual, 1)
+
+		var inputs []Input
+		So(request(http.MethodGet, server.URL+"/api/inputs", "token", nil, &inputs), ShouldEqual, http.StatusOK)
+		So(inputs, ShouldResemble, []Input{Input{ID: "fake", Packets: 1}})
+
+		So(request(http.MethodPost, server.URL+"/api/drains/reopen", "token", Drain{Endpoint: endpoint}, nil), ShouldEqual, http.StatusOK)
+		So(r.Drains(), ShouldContainKey, endpoint)
+		So(request(http.MethodPost, server.URL+"/api/drains/close", "token", Drain{Endpoint: endpoint}, nil), ShouldEqual, http.StatusOK)
+		So(r.Drains(), ShouldBeEmpty)
+	})
+	Convey("Ensure we clean up the api router", t, func() {
+		So(r.Close(), ShouldBeNil)
+	})
+}
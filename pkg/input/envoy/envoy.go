@@ -4,96 +4,177 @@ import (
 	"errors"
 	"fmt"
 	"github.com/akkeris/logtrain/internal/debug"
-	v2data "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v2"
+	v3data "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
 	v2 "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v2"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
 	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	syslog "github.com/trevorlinton/remote_syslog2/syslog"
 	"google.golang.org/grpc"
 	"io"
 	"net"
-	"os"
-	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// Config sets how envoy access log entries are written and which hostname they're sent as.
+type Config struct {
+	Fields       []string // the fields to write for http requests, defaults to DefaultFields
+	TCPFields    []string // the fields to write for tcp connections, defaults to DefaultTCPFields
+	Format       string   // keyvalue or json, defaults to keyvalue
+	Hostname     string   // cluster, authority or peer, defaults to cluster
+	Unattributed string   // the hostname of entries that can't be attributed, defaults to unknown
+	Akkeris      bool     // name hosts {name}-{namespace} with the akkeris/router tag as akkeris does
+}
+
 // Envoy ALS Server structure.
 type EnvoyAlsServer struct {
-	address   string
-	marshaler jsonpb.Marshaler
-	server    *grpc.Server
-	errors    chan error
-	packets   chan syslog.Packet
+	unattributed uint64 // accessed atomically, must be first for 64 bit alignment
+	address      string
+	config       Config
+	fields       []namedField
+	tcpFields    []namedField
+	layout       layoutWriter
+	hostTemplate string
+	tag          string
+	marshaler    jsonpb.Marshaler
+	server       *grpc.Server
+	errors       chan error
+	packets      chan syslog.Packet
+}
+
+// envoyAlsServerV3 serves the v3 access log service, envoy and istio versions after 1.7 only send v3.
+type envoyAlsServerV3 struct {
+	*EnvoyAlsServer
 }
 
 var _ v2.AccessLogServiceServer = &EnvoyAlsServer{}
-var hostTemplate = "{name}.{namespace}"
-var tag = "envoy"
+var _ v3.AccessLogServiceServer = &envoyAlsServerV3{}
 
 func stringMilliseconds(d time.Duration) string {
 	return fmt.Sprintf("%.2fms", d.Seconds()*1000)
 }
 
-// For more information on the HTTPAccessLogEntry structure see,
-// https://github.com/envoyproxy/go-control-plane/blob/master/envoy/data/accesslog/v2/accesslog.pb.go
-func layout(envoyMsg *v2data.HTTPAccessLogEntry) string {
-	var code uint32 = 0
-	if envoyMsg.CommonProperties.ResponseFlags != nil && envoyMsg.CommonProperties.ResponseFlags.DownstreamConnectionTermination {
-		code = 499
+// Close closes the envoy handler
+func (s *EnvoyAlsServer) Close() error {
+	s.server.Stop()
+	close(s.packets)
+	close(s.errors)
+	return nil
+}
+
+// toV3 converts a v2 access log entry to v3, the v3 api is wire compatible with v2 (fields
+// that were removed are reserved) so the entry is converted by re-encoding it.
+func toV3(entry proto.Message, v3entry proto.Message) error {
+	data, err := proto.Marshal(entry)
+	if err != nil {
+		return err
 	}
+	return proto.Unmarshal(data, v3entry)
+}
+
+func fromTemplate(template string, name string, namespace string) string {
+	return strings.Replace(strings.Replace(template, "{name}", name, 1), "{namespace}", namespace, 1)
+}
 
-	if envoyMsg.Response.ResponseCode != nil {
-		code = envoyMsg.Response.ResponseCode.GetValue()
+// fromCluster finds the name and namespace from an istio cluster name, e.g. outbound|80||name.namespace.svc.cluster.local,
+// inbound and passthrough clusters can't be attributed.
+func fromCluster(cluster string, template string) (string, bool) {
+	c := strings.Split(cluster, "|")
+	if len(c) < 4 {
+		return "", false
+	}
+	d := strings.Split(c[3], ".")
+	if len(d) < 2 || d[0] == "" || d[1] == "" {
+		return "", false
 	}
+	return fromTemplate(template, d[0], d[1]), true
+}
 
-	var tls string = ""
-	if envoyMsg.CommonProperties.GetTlsProperties() != nil {
-		tls = "tls=" + envoyMsg.CommonProperties.GetTlsProperties().TlsVersion.String() + " "
+// fromAuthority uses the host of the authority (or host) header without the port.
+func fromAuthority(authority string) (string, bool) {
+	if host, _, err := net.SplitHostPort(authority); err == nil {
+		authority = host
 	}
+	return authority, authority != ""
+}
 
-	var origin string = ""
-	if envoyMsg.CommonProperties.GetTlsProperties() != nil {
-		origin = "origin=https://" + envoyMsg.CommonProperties.GetTlsProperties().TlsSniHostname + envoyMsg.Request.OriginalPath + " "
+// fromPeer finds the service account and namespace from the spiffe id of the downstream peer's
+// certificate, e.g. spiffe://cluster.local/ns/namespace/sa/name
+func fromPeer(tls *v3data.TLSProperties, template string) (string, bool) {
+	for _, san := range tls.GetPeerCertificateProperties().GetSubjectAltName() {
+		if !strings.HasPrefix(san.GetUri(), "spiffe://") {
+			continue
+		}
+		var name, namespace string
+		path := strings.Split(strings.TrimPrefix(san.GetUri(), "spiffe://"), "/")
+		for i := 1; i+1 < len(path); i += 2 {
+			if path[i] == "ns" {
+				namespace = path[i+1]
+			} else if path[i] == "sa" {
+				name = path[i+1]
+			}
+		}
+		if name != "" && namespace != "" {
+			return fromTemplate(template, name, namespace), true
+		}
 	}
+	return "", false
+}
 
-	// TODO: Add https://github.com/envoyproxy/go-control-plane/blob/master/envoy/data/accesslog/v2/accesslog.pb.go#L652
+// hostname finds the hostname of an entry with the configured strategy, entries that can't be
+// attributed are counted and sent with the unattributed hostname.
+func (s *EnvoyAlsServer) hostname(common *v3data.AccessLogCommon, authority string) string {
+	var hostname string
+	var ok bool
+	switch s.config.Hostname {
+	case "authority":
+		hostname, ok = fromAuthority(authority)
+	case "peer":
+		hostname, ok = fromPeer(common.GetTlsProperties(), s.hostTemplate)
+	default:
+		hostname, ok = fromCluster(common.GetUpstreamCluster(), s.hostTemplate)
+	}
+	if !ok {
+		atomic.AddUint64(&s.unattributed, 1)
+		debug.Debugf("[envoy] Unable to attribute access log entry for cluster %s\n", common.GetUpstreamCluster())
+		return s.config.Unattributed
+	}
+	return hostname
+}
 
-	ttlutxbyte, err := ptypes.Duration(envoyMsg.CommonProperties.TimeToLastUpstreamTxByte)
+func (s *EnvoyAlsServer) send(entry logEntry, hostname string, fields []namedField) {
+	t, err := ptypes.Timestamp(entry.GetCommonProperties().GetStartTime())
 	if err != nil {
-		ttlutxbyte = time.Millisecond
+		t = time.Now()
 	}
-	ttlurxbyte, err := ptypes.Duration(envoyMsg.CommonProperties.TimeToLastUpstreamRxByte)
-	if err != nil {
-		ttlurxbyte = time.Millisecond
+	s.packets <- syslog.Packet{
+		Severity: syslog.SevInfo,
+		Facility: 0,
+		Hostname: hostname,
+		Time:     t,
+		Tag:      s.tag,
+		Message:  s.layout(values(fields, entry)),
 	}
-	ttldtxbyte, err := ptypes.Duration(envoyMsg.CommonProperties.TimeToLastDownstreamTxByte)
-	if err != nil {
-		ttldtxbyte = time.Millisecond
-	}
-	return "bytes=" + strconv.Itoa(int(envoyMsg.Request.RequestHeadersBytes+envoyMsg.Request.RequestBodyBytes+envoyMsg.Response.ResponseHeadersBytes+envoyMsg.Response.ResponseBodyBytes)) + " " +
-		"request_size=" + strconv.Itoa(int(envoyMsg.Request.RequestHeadersBytes+envoyMsg.Request.RequestBodyBytes)) + " " +
-		"response_size=" + strconv.Itoa(int(envoyMsg.Response.ResponseHeadersBytes+envoyMsg.Response.ResponseBodyBytes)) + " " +
-		"method=" + envoyMsg.Request.RequestMethod.String() + " " +
-		"request_id=" + envoyMsg.Request.RequestId + " " +
-		"fwd=" + envoyMsg.Request.ForwardedFor + " " +
-		"authority=" + envoyMsg.Request.Authority + " " +
-		origin +
-		"protocol=" + strings.ToLower(envoyMsg.ProtocolVersion.String()) + " " +
-		tls +
-		"status=" + strconv.Itoa(int(code)) + " " +
-		"connect=" + stringMilliseconds(ttlutxbyte) + " " +
-		"service=" + stringMilliseconds(ttlurxbyte) + " " +
-		"total=" + stringMilliseconds(ttldtxbyte) + " " +
-		"path=" + envoyMsg.Request.Path
 }
 
-// Close closes the envoy handler
-func (s *EnvoyAlsServer) Close() error {
-	s.server.Stop()
-	close(s.packets)
-	close(s.errors)
-	return nil
+// receive sends a packet for the http access log entry
+func (s *EnvoyAlsServer) receive(entry *v3data.HTTPAccessLogEntry) {
+	s.send(entry, s.hostname(entry.GetCommonProperties(), entry.GetRequest().GetAuthority()), s.fields)
+}
+
+// receiveTCP sends a packet for the tcp access log entry, the sni of the connection is used as
+// its authority.
+func (s *EnvoyAlsServer) receiveTCP(entry *v3data.TCPAccessLogEntry) {
+	common := entry.GetCommonProperties()
+	s.send(entry, s.hostname(common, common.GetTlsProperties().GetTlsSniHostname()), s.tcpFields)
+}
+
+// Unattributed returns how many access log entries could not be attributed to a hostname
+func (s *EnvoyAlsServer) Unattributed() uint64 {
+	return atomic.LoadUint64(&s.unattributed)
 }
 
 // StreamAccessLogs is part of the interface called by the GRPC library from envoy
@@ -113,25 +194,47 @@ func (s *EnvoyAlsServer) StreamAccessLogs(stream v2.AccessLogService_StreamAcces
 		switch entries := in.LogEntries.(type) {
 		case *v2.StreamAccessLogsMessage_HttpLogs:
 			for _, entry := range entries.HttpLogs.LogEntry {
-				c := strings.Split(entry.CommonProperties.UpstreamCluster, "|")
-				if len(c) > 3 {
-					d := strings.Split(c[3], ".")
-					name := d[0]
-					namespace := d[1]
-					hostname := strings.Replace(strings.Replace(hostTemplate, "{name}", name, 1), "{namespace}", namespace, 1)
-					t, err := ptypes.Timestamp(entry.CommonProperties.StartTime)
-					if err != nil {
-						t = time.Now()
-					}
-					s.packets <- syslog.Packet{
-						Severity: 0,
-						Facility: 0,
-						Hostname: hostname,
-						Time:     t,
-						Tag:      tag,
-						Message:  layout(entry),
-					}
+				var v3entry v3data.HTTPAccessLogEntry
+				if err := toV3(entry, &v3entry); err != nil {
+					debug.Infof("Failed to convert istio access log: %s\n", err.Error())
+					continue
 				}
+				s.receive(&v3entry)
+			}
+		case *v2.StreamAccessLogsMessage_TcpLogs:
+			for _, entry := range entries.TcpLogs.LogEntry {
+				var v3entry v3data.TCPAccessLogEntry
+				if err := toV3(entry, &v3entry); err != nil {
+					debug.Infof("Failed to convert istio tcp access log: %s\n", err.Error())
+					continue
+				}
+				s.receiveTCP(&v3entry)
+			}
+		}
+	}
+}
+
+// StreamAccessLogs is part of the v3 interface called by the GRPC library from envoy
+func (s *envoyAlsServerV3) StreamAccessLogs(stream v3.AccessLogService_StreamAccessLogsServer) error {
+	debug.Infof("[envoy] Started envoy v3 access log stream\n")
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			debug.Infof("[envoy] Stopped envoy v3 access log stream\n")
+			return nil
+		}
+		if err != nil {
+			debug.Infof("Failed to recieve istio access logs: %s\n", err.Error())
+			return err
+		}
+		switch entries := in.LogEntries.(type) {
+		case *v3.StreamAccessLogsMessage_HttpLogs:
+			for _, entry := range entries.HttpLogs.LogEntry {
+				s.receive(entry)
+			}
+		case *v3.StreamAccessLogsMessage_TcpLogs:
+			for _, entry := range entries.TcpLogs.LogEntry {
+				s.receiveTCP(entry)
 			}
 		}
 	}
@@ -159,6 +262,7 @@ func (s *EnvoyAlsServer) Dial() error {
 	}
 	s.server = grpc.NewServer()
 	v2.RegisterAccessLogServiceServer(s.server, s)
+	v3.RegisterAccessLogServiceServer(s.server, &envoyAlsServerV3{s})
 	l, err := net.Listen("tcp", s.address)
 	if err != nil {
 		return err
@@ -168,18 +272,54 @@ func (s *EnvoyAlsServer) Dial() error {
 }
 
 // Create creates an envoy input handler.
-func Create(address string) (*EnvoyAlsServer, error) {
+func Create(address string, config Config) (*EnvoyAlsServer, error) {
 	if address == "" {
 		address = ":9001"
 	}
-	if os.Getenv("AKKERIS") == "true" {
-		hostTemplate = "{name}-{namespace}"
-		tag = "akkeris/router"
+	if len(config.Fields) == 0 {
+		config.Fields = DefaultFields
+	}
+	fields, err := compileFields(config.Fields, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.TCPFields) == 0 {
+		config.TCPFields = DefaultTCPFields
+	}
+	tcpFields, err := compileFields(config.TCPFields, true)
+	if err != nil {
+		return nil, err
+	}
+	if config.Format == "" {
+		config.Format = "keyvalue"
+	}
+	layout, ok := layouts[config.Format]
+	if !ok {
+		return nil, errors.New("unknown envoy access log format " + config.Format + ", expected keyvalue or json")
+	}
+	if config.Hostname == "" {
+		config.Hostname = "cluster"
+	}
+	if config.Hostname != "cluster" && config.Hostname != "authority" && config.Hostname != "peer" {
+		return nil, errors.New("unknown envoy hostname strategy " + config.Hostname + ", expected cluster, authority or peer")
+	}
+	if config.Unattributed == "" {
+		config.Unattributed = "unknown"
+	}
+	hostTemplate, tag := "{name}.{namespace}", "envoy"
+	if config.Akkeris {
+		hostTemplate, tag = "{name}-{namespace}", "akkeris/router"
 	}
 	return &EnvoyAlsServer{
-		address: address,
-		server:  nil,
-		packets: make(chan syslog.Packet, 100),
-		errors:  make(chan error, 1),
+		address:      address,
+		config:       config,
+		fields:       fields,
+		tcpFields:    tcpFields,
+		layout:       layout,
+		hostTemplate: hostTemplate,
+		tag:          tag,
+		server:       nil,
+		packets:      make(chan syslog.Packet, 100),
+		errors:       make(chan error, 1),
 	}, nil
 }
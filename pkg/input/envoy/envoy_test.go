@@ -3,8 +3,11 @@ package envoy
 import (
 	"context"
 	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	v3core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	v2data "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v2"
+	v3data "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
 	v2 "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v2"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
 	"github.com/golang/protobuf/ptypes"
 	. "github.com/smartystreets/goconvey/convey"
 	grpc "google.golang.org/grpc"
@@ -15,11 +18,22 @@ import (
 	"time"
 )
 
+func socketAddress(address string, port uint32) *v3core.Address {
+	return &v3core.Address{
+		Address: &v3core.Address_SocketAddress{
+			SocketAddress: &v3core.SocketAddress{
+				Address:       address,
+				PortSpecifier: &v3core.SocketAddress_PortValue{PortValue: port},
+			},
+		},
+	}
+}
+
 func TestEnvoyGrpcInput(t *testing.T) {
 	var envoy *EnvoyAlsServer = nil
 	var err error
 	Convey("Ensure we can start the envoy server", t, func() {
-		envoy, err = Create(":9001")
+		envoy, err = Create(":9001", Config{})
 		So(envoy, ShouldNotBeNil)
 		So(err, ShouldBeNil)
 		So(envoy.Dial(), ShouldBeNil)
@@ -89,7 +103,7 @@ func TestEnvoyGrpcInput(t *testing.T) {
 		So(err, ShouldEqual, io.EOF)
 		select {
 		case message := <-envoy.Packets():
-			So(message.Severity, ShouldEqual, 0)
+			So(message.Severity, ShouldEqual, 6)
 			So(message.Facility, ShouldEqual, 0)
 			So(message.Hostname, ShouldEqual, "name.namespace")
 			So(message.Tag, ShouldEqual, "envoy")
@@ -101,7 +115,236 @@ func TestEnvoyGrpcInput(t *testing.T) {
 		}
 	})
 
+	Convey("Ensure we can receive logs from envoy with the v3 api", t, func() {
+		grpcConn, err := grpc.Dial("localhost:9001", grpc.WithInsecure())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer grpcConn.Close()
+		client, err := v3.NewAccessLogServiceClient(grpcConn).StreamAccessLogs(context.TODO())
+		So(client, ShouldNotBeNil)
+		So(err, ShouldBeNil)
+		message := &v3.StreamAccessLogsMessage{
+			Identifier: &v3.StreamAccessLogsMessage_Identifier{
+				Node:    &v3core.Node{},
+				LogName: "test",
+			},
+			LogEntries: &v3.StreamAccessLogsMessage_HttpLogs{
+				HttpLogs: &v3.StreamAccessLogsMessage_HTTPAccessLogEntries{
+					LogEntry: []*v3data.HTTPAccessLogEntry{
+						&v3data.HTTPAccessLogEntry{
+							CommonProperties: &v3data.AccessLogCommon{
+								TimeToLastUpstreamTxByte:   ptypes.DurationProto(time.Second),
+								TimeToLastUpstreamRxByte:   ptypes.DurationProto(time.Second),
+								TimeToLastDownstreamTxByte: ptypes.DurationProto(time.Second),
+								UpstreamCluster:            "outbound|80||name.namespace.svc.cluster.local",
+							},
+							ProtocolVersion: v3data.HTTPAccessLogEntry_HTTP11,
+							Request: &v3data.HTTPRequestProperties{
+								Path:          "/fee",
+								RequestMethod: v3core.RequestMethod_GET,
+								Authority:     "authority",
+								RequestId:     "x-request-id",
+							},
+							Response: &v3data.HTTPResponseProperties{
+								ResponseCode: &wrapperspb.UInt32Value{
+									Value: 404,
+								},
+								ResponseBodyBytes: 10,
+							},
+						},
+					},
+				},
+			},
+		}
+		if err := client.Send(message); err != nil {
+			log.Fatal(err)
+		}
+		_, err = client.CloseAndRecv()
+		So(err, ShouldEqual, io.EOF)
+		select {
+		case message := <-envoy.Packets():
+			So(message.Hostname, ShouldEqual, "name.namespace")
+			So(message.Tag, ShouldEqual, "envoy")
+			So(message.Message, ShouldEqual, "bytes=10 request_size=0 response_size=10 method=GET request_id=x-request-id fwd= authority=authority protocol=http11 status=404 connect=1000.00ms service=1000.00ms total=1000.00ms path=/fee")
+		case <-envoy.Errors():
+			log.Fatal("This shouldnt have been reached (error path).")
+		default:
+			log.Fatal("This shouldnt have been reached.")
+		}
+	})
+
+	Convey("Ensure we can receive tcp logs from envoy", t, func() {
+		grpcConn, err := grpc.Dial("localhost:9001", grpc.WithInsecure())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer grpcConn.Close()
+		client, err := v3.NewAccessLogServiceClient(grpcConn).StreamAccessLogs(context.TODO())
+		So(err, ShouldBeNil)
+		message := &v3.StreamAccessLogsMessage{
+			LogEntries: &v3.StreamAccessLogsMessage_TcpLogs{
+				TcpLogs: &v3.StreamAccessLogsMessage_TCPAccessLogEntries{
+					LogEntry: []*v3data.TCPAccessLogEntry{
+						&v3data.TCPAccessLogEntry{
+							CommonProperties: &v3data.AccessLogCommon{
+								TimeToLastRxByte:           ptypes.DurationProto(time.Second),
+								TimeToLastDownstreamTxByte: ptypes.DurationProto(time.Second * 2),
+								UpstreamCluster:            "outbound|5432||db.namespace.svc.cluster.local",
+								DownstreamRemoteAddress:    socketAddress("10.0.0.1", 51000),
+								UpstreamRemoteAddress:      socketAddress("10.0.0.2", 5432),
+								ResponseFlags:              &v3data.ResponseFlags{UpstreamConnectionTermination: true},
+							},
+							ConnectionProperties: &v3data.ConnectionProperties{
+								ReceivedBytes: 100,
+								SentBytes:     2000,
+							},
+						},
+					},
+				},
+			},
+		}
+		So(client.Send(message), ShouldBeNil)
+		_, err = client.CloseAndRecv()
+		So(err, ShouldEqual, io.EOF)
+		select {
+		case message := <-envoy.Packets():
+			So(message.Hostname, ShouldEqual, "db.namespace")
+			So(message.Tag, ShouldEqual, "envoy")
+			So(message.Message, ShouldEqual, "bytes=2100 received_bytes=100 sent_bytes=2000 duration=2000.00ms downstream_address=10.0.0.1:51000 upstream_host=10.0.0.2:5432 upstream_cluster=outbound|5432||db.namespace.svc.cluster.local response_flags=UC termination=upstream")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive the tcp access log")
+		}
+
+		// tcp logs from the v2 api
+		v2client, err := v2.NewAccessLogServiceClient(grpcConn).StreamAccessLogs(context.TODO())
+		So(err, ShouldBeNil)
+		v2message := &v2.StreamAccessLogsMessage{
+			LogEntries: &v2.StreamAccessLogsMessage_TcpLogs{
+				TcpLogs: &v2.StreamAccessLogsMessage_TCPAccessLogEntries{
+					LogEntry: []*v2data.TCPAccessLogEntry{
+						&v2data.TCPAccessLogEntry{
+							CommonProperties:     &v2data.AccessLogCommon{UpstreamCluster: "outbound|6379||redis.namespace.svc.cluster.local"},
+							ConnectionProperties: &v2data.ConnectionProperties{ReceivedBytes: 10, SentBytes: 20},
+						},
+					},
+				},
+			},
+		}
+		So(v2client.Send(v2message), ShouldBeNil)
+		_, err = v2client.CloseAndRecv()
+		So(err, ShouldEqual, io.EOF)
+		select {
+		case message := <-envoy.Packets():
+			So(message.Hostname, ShouldEqual, "redis.namespace")
+			So(message.Message, ShouldStartWith, "bytes=30 received_bytes=10 sent_bytes=20 duration=0.00ms")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive the v2 tcp access log")
+		}
+	})
+
+	Convey("Ensure entries that can't be attributed are counted and not dropped", t, func() {
+		grpcConn, err := grpc.Dial("localhost:9001", grpc.WithInsecure())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer grpcConn.Close()
+		client, err := v3.NewAccessLogServiceClient(grpcConn).StreamAccessLogs(context.TODO())
+		So(err, ShouldBeNil)
+		entries := make([]*v3data.HTTPAccessLogEntry, 0)
+		for _, cluster := range []string{"PassthroughCluster", "inbound|8080||", "outbound|80||name"} {
+			entries = append(entries, &v3data.HTTPAccessLogEntry{
+				CommonProperties: &v3data.AccessLogCommon{UpstreamCluster: cluster},
+				Request:          &v3data.HTTPRequestProperties{Path: "/"},
+			})
+		}
+		message := &v3.StreamAccessLogsMessage{
+			LogEntries: &v3.StreamAccessLogsMessage_HttpLogs{
+				HttpLogs: &v3.StreamAccessLogsMessage_HTTPAccessLogEntries{LogEntry: entries},
+			},
+		}
+		So(client.Send(message), ShouldBeNil)
+		_, err = client.CloseAndRecv()
+		So(err, ShouldEqual, io.EOF)
+		for range entries {
+			select {
+			case message := <-envoy.Packets():
+				So(message.Hostname, ShouldEqual, "unknown")
+			case <-time.NewTimer(time.Second * 5).C:
+				log.Fatal("Did not receive the unattributed entry")
+			}
+		}
+		So(envoy.Unattributed(), ShouldEqual, 3)
+	})
+
 	Convey("Ensure we can shutdown the envoy service", t, func() {
 		So(envoy.Close(), ShouldBeNil)
 	})
 }
+
+func TestEnvoyLayout(t *testing.T) {
+	entry := &v3data.HTTPAccessLogEntry{
+		CommonProperties: &v3data.AccessLogCommon{
+			TimeToLastDownstreamTxByte: ptypes.DurationProto(time.Millisecond * 15),
+			UpstreamCluster:            "PassthroughCluster",
+			ResponseFlags:              &v3data.ResponseFlags{NoHealthyUpstream: true, UpstreamRetryLimitExceeded: true},
+			TlsProperties: &v3data.TLSProperties{
+				PeerCertificateProperties: &v3data.TLSProperties_CertificateProperties{
+					SubjectAltName: []*v3data.TLSProperties_CertificateProperties_SubjectAltName{
+						&v3data.TLSProperties_CertificateProperties_SubjectAltName{
+							San: &v3data.TLSProperties_CertificateProperties_SubjectAltName_Uri{Uri: "spiffe://cluster.local/ns/namespace/sa/name"},
+						},
+					},
+				},
+			},
+		},
+		Request: &v3data.HTTPRequestProperties{
+			Authority:      "www.example.com:443",
+			Path:           "/fee",
+			UserAgent:      "curl/7.64.1 (x86_64)",
+			RequestHeaders: map[string]string{"x-tenant": "acme"},
+		},
+		Response: &v3data.HTTPResponseProperties{
+			ResponseCode:    &wrapperspb.UInt32Value{Value: 503},
+			ResponseHeaders: map[string]string{"content-type": "text/plain"},
+		},
+	}
+	Convey("Ensure the envoy configuration is validated", t, func() {
+		_, err := Create(":0", Config{Fields: []string{"status", "nope"}})
+		So(err, ShouldNotBeNil)
+		_, err = Create(":0", Config{Format: "xml"})
+		So(err, ShouldNotBeNil)
+		_, err = Create(":0", Config{Hostname: "sni"})
+		So(err, ShouldNotBeNil)
+		_, err = Create(":0", Config{TCPFields: []string{"bytes", "method"}})
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Ensure fields, headers and response flags can be written as key values", t, func() {
+		s, err := Create(":0", Config{Fields: []string{"status", "total", "user_agent", "response_flags", "request_header.X-Tenant", "response_header.content-type", "request_header.missing"}})
+		So(err, ShouldBeNil)
+		So(s.layout(values(s.fields, entry)), ShouldEqual, `status=503 total=15.00ms user_agent="curl/7.64.1 (x86_64)" response_flags=UH,URX request_header.X-Tenant=acme response_header.content-type=text/plain`)
+	})
+	Convey("Ensure fields can be written as json", t, func() {
+		s, err := Create(":0", Config{Fields: []string{"status", "total", "path", "tls", "response_flags"}, Format: "json"})
+		So(err, ShouldBeNil)
+		So(s.layout(values(s.fields, entry)), ShouldEqual, `{"status":503,"total":15.00,"path":"/fee","tls":"VERSION_UNSPECIFIED","response_flags":"UH,URX"}`)
+	})
+	Convey("Ensure the hostname can be found from the authority or downstream peer", t, func() {
+		s, err := Create(":0", Config{Hostname: "authority"})
+		So(err, ShouldBeNil)
+		So(s.hostname(entry.CommonProperties, entry.Request.Authority), ShouldEqual, "www.example.com")
+		s, err = Create(":0", Config{Hostname: "peer"})
+		So(err, ShouldBeNil)
+		So(s.hostname(entry.CommonProperties, entry.Request.Authority), ShouldEqual, "name.namespace")
+		s, err = Create(":0", Config{Unattributed: "mesh.unknown"})
+		So(err, ShouldBeNil)
+		So(s.hostname(entry.CommonProperties, entry.Request.Authority), ShouldEqual, "mesh.unknown")
+		So(s.Unattributed(), ShouldEqual, 1)
+	})
+	Convey("Ensure akkeris hostnames and tags are used", t, func() {
+		s, err := Create(":0", Config{Hostname: "peer", Akkeris: true})
+		So(err, ShouldBeNil)
+		So(s.hostname(entry.CommonProperties, entry.Request.Authority), ShouldEqual, "name-namespace")
+		So(s.tag, ShouldEqual, "akkeris/router")
+	})
+}
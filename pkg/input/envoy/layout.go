@@ -0,0 +1,393 @@
+package envoy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	v3core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3data "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultFields are the fields written for each http access log entry when none are configured.
+var DefaultFields = []string{"bytes", "request_size", "response_size", "method", "request_id", "fwd", "authority", "origin", "protocol", "tls", "status", "connect", "service", "total", "path"}
+
+// DefaultTCPFields are the fields written for each tcp access log entry when none are configured.
+var DefaultTCPFields = []string{"bytes", "received_bytes", "sent_bytes", "duration", "downstream_address", "upstream_host", "upstream_cluster", "tls", "response_flags", "termination", "upstream_failure_reason"}
+
+// logEntry is an http or tcp access log entry
+type logEntry interface {
+	GetCommonProperties() *v3data.AccessLogCommon
+}
+
+// field returns the value of a field in the access log entry, ok is false if the field
+// should be left out of the layout (e.g. tls when the request was not over tls).
+type field func(entry logEntry) (value interface{}, ok bool)
+
+type commonField func(common *v3data.AccessLogCommon) (interface{}, bool)
+type httpField func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool)
+type tcpField func(entry *v3data.TCPAccessLogEntry) (interface{}, bool)
+
+type namedField struct {
+	name  string
+	value field
+}
+
+// layoutWriter writes the fields of an access log entry in key=value or json format.
+type layoutWriter func(fields []namedValue) string
+
+type namedValue struct {
+	name  string
+	value interface{}
+}
+
+var httpFields = map[string]httpField{
+	"bytes": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		return requestSize(entry) + responseSize(entry), true
+	},
+	"request_size": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		return requestSize(entry), true
+	},
+	"response_size": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		return responseSize(entry), true
+	},
+	"method": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		return entry.GetRequest().GetRequestMethod().String(), true
+	},
+	"request_id": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		return entry.GetRequest().GetRequestId(), true
+	},
+	"fwd": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		return entry.GetRequest().GetForwardedFor(), true
+	},
+	"authority": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		return entry.GetRequest().GetAuthority(), true
+	},
+	"origin": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		tls := entry.GetCommonProperties().GetTlsProperties()
+		if tls == nil {
+			return nil, false
+		}
+		return "https://" + tls.GetTlsSniHostname() + entry.GetRequest().GetOriginalPath(), true
+	},
+	"protocol": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		return strings.ToLower(entry.GetProtocolVersion().String()), true
+	},
+	"status": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		var code uint32 = 0
+		if entry.GetCommonProperties().GetResponseFlags().GetDownstreamConnectionTermination() {
+			code = 499
+		}
+		if entry.GetResponse().GetResponseCode() != nil {
+			code = entry.GetResponse().GetResponseCode().GetValue()
+		}
+		return int64(code), true
+	},
+	"connect": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		return duration(entry.GetCommonProperties().GetTimeToLastUpstreamTxByte()), true
+	},
+	"service": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		return duration(entry.GetCommonProperties().GetTimeToLastUpstreamRxByte()), true
+	},
+	"total": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		return duration(entry.GetCommonProperties().GetTimeToLastDownstreamTxByte()), true
+	},
+	"path": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		return entry.GetRequest().GetPath(), true
+	},
+	"scheme": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		return entry.GetRequest().GetScheme(), true
+	},
+	"user_agent": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		return entry.GetRequest().GetUserAgent(), true
+	},
+	"referer": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		return entry.GetRequest().GetReferer(), true
+	},
+	"response_code_details": func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+		details := entry.GetResponse().GetResponseCodeDetails()
+		return details, details != ""
+	},
+}
+
+// Fields that are in both http and tcp access log entries
+var commonFields = map[string]commonField{
+	"tls": func(common *v3data.AccessLogCommon) (interface{}, bool) {
+		if common.GetTlsProperties() == nil {
+			return nil, false
+		}
+		return common.GetTlsProperties().GetTlsVersion().String(), true
+	},
+	"route_name": func(common *v3data.AccessLogCommon) (interface{}, bool) {
+		return common.GetRouteName(), true
+	},
+	"upstream_cluster": func(common *v3data.AccessLogCommon) (interface{}, bool) {
+		return common.GetUpstreamCluster(), true
+	},
+	"upstream_host": func(common *v3data.AccessLogCommon) (interface{}, bool) {
+		return address(common.GetUpstreamRemoteAddress()), true
+	},
+	"downstream_address": func(common *v3data.AccessLogCommon) (interface{}, bool) {
+		return address(common.GetDownstreamRemoteAddress()), true
+	},
+	"start_time": func(common *v3data.AccessLogCommon) (interface{}, bool) {
+		t, err := ptypes.Timestamp(common.GetStartTime())
+		if err != nil {
+			return nil, false
+		}
+		return t.UTC().Format(time.RFC3339Nano), true
+	},
+	"response_flags": func(common *v3data.AccessLogCommon) (interface{}, bool) {
+		flags := responseFlags(common.GetResponseFlags())
+		return flags, flags != ""
+	},
+	"termination": func(common *v3data.AccessLogCommon) (interface{}, bool) {
+		termination := termination(common.GetResponseFlags())
+		return termination, termination != ""
+	},
+	"upstream_failure_reason": func(common *v3data.AccessLogCommon) (interface{}, bool) {
+		reason := common.GetUpstreamTransportFailureReason()
+		return reason, reason != ""
+	},
+}
+
+var tcpFields = map[string]tcpField{
+	"bytes": func(entry *v3data.TCPAccessLogEntry) (interface{}, bool) {
+		return int64(entry.GetConnectionProperties().GetReceivedBytes() + entry.GetConnectionProperties().GetSentBytes()), true
+	},
+	"received_bytes": func(entry *v3data.TCPAccessLogEntry) (interface{}, bool) {
+		return int64(entry.GetConnectionProperties().GetReceivedBytes()), true
+	},
+	"sent_bytes": func(entry *v3data.TCPAccessLogEntry) (interface{}, bool) {
+		return int64(entry.GetConnectionProperties().GetSentBytes()), true
+	},
+	"duration": func(entry *v3data.TCPAccessLogEntry) (interface{}, bool) {
+		return connectionDuration(entry.GetCommonProperties()), true
+	},
+}
+
+// Fields for the headers logged by envoy (see additional_request_headers_to_log and
+// additional_response_headers_to_log in the http grpc access log config), e.g. request_header.x-forwarded-proto
+const requestHeaderPrefix = "request_header."
+const responseHeaderPrefix = "response_header."
+
+func headerField(name string) (httpField, bool) {
+	if strings.HasPrefix(name, requestHeaderPrefix) && len(name) > len(requestHeaderPrefix) {
+		header := strings.ToLower(strings.TrimPrefix(name, requestHeaderPrefix))
+		return func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+			value, ok := entry.GetRequest().GetRequestHeaders()[header]
+			return value, ok
+		}, true
+	}
+	if strings.HasPrefix(name, responseHeaderPrefix) && len(name) > len(responseHeaderPrefix) {
+		header := strings.ToLower(strings.TrimPrefix(name, responseHeaderPrefix))
+		return func(entry *v3data.HTTPAccessLogEntry) (interface{}, bool) {
+			value, ok := entry.GetResponse().GetResponseHeaders()[header]
+			return value, ok
+		}, true
+	}
+	return nil, false
+}
+
+// compileFields looks up the http (or tcp) fields by name, an error is returned for unknown fields.
+func compileFields(names []string, tcp bool) ([]namedField, error) {
+	fields := make([]namedField, 0)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		var value field
+		if f, ok := commonFields[name]; ok {
+			value = func(entry logEntry) (interface{}, bool) {
+				return f(entry.GetCommonProperties())
+			}
+		} else if f, ok := tcpFields[name]; ok && tcp {
+			value = func(entry logEntry) (interface{}, bool) {
+				return f(entry.(*v3data.TCPAccessLogEntry))
+			}
+		} else if f, ok := httpFields[name]; ok && !tcp {
+			value = func(entry logEntry) (interface{}, bool) {
+				return f(entry.(*v3data.HTTPAccessLogEntry))
+			}
+		} else if f, ok := headerField(name); ok && !tcp {
+			value = func(entry logEntry) (interface{}, bool) {
+				return f(entry.(*v3data.HTTPAccessLogEntry))
+			}
+		} else {
+			return nil, errors.New("unknown envoy access log field " + name)
+		}
+		fields = append(fields, namedField{name: name, value: value})
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("at least one envoy access log field must be specified")
+	}
+	return fields, nil
+}
+
+func requestSize(entry *v3data.HTTPAccessLogEntry) int64 {
+	return int64(entry.GetRequest().GetRequestHeadersBytes() + entry.GetRequest().GetRequestBodyBytes())
+}
+
+func responseSize(entry *v3data.HTTPAccessLogEntry) int64 {
+	return int64(entry.GetResponse().GetResponseHeadersBytes() + entry.GetResponse().GetResponseBodyBytes())
+}
+
+func address(a *v3core.Address) string {
+	socket := a.GetSocketAddress()
+	if socket == nil {
+		return a.GetPipe().GetPath()
+	}
+	if socket.GetPortValue() == 0 {
+		return socket.GetAddress()
+	}
+	return socket.GetAddress() + ":" + strconv.Itoa(int(socket.GetPortValue()))
+}
+
+// responseFlags writes the response flags with the same short codes as envoy's %RESPONSE_FLAGS%
+func responseFlags(flags *v3data.ResponseFlags) string {
+	if flags == nil {
+		return ""
+	}
+	codes := make([]string, 0)
+	for _, flag := range []struct {
+		code string
+		set  bool
+	}{
+		{"LH", flags.GetFailedLocalHealthcheck()},
+		{"UH", flags.GetNoHealthyUpstream()},
+		{"UT", flags.GetUpstreamRequestTimeout()},
+		{"LR", flags.GetLocalReset()},
+		{"UR", flags.GetUpstreamRemoteReset()},
+		{"UF", flags.GetUpstreamConnectionFailure()},
+		{"UC", flags.GetUpstreamConnectionTermination()},
+		{"UO", flags.GetUpstreamOverflow()},
+		{"NR", flags.GetNoRouteFound()},
+		{"DI", flags.GetDelayInjected()},
+		{"FI", flags.GetFaultInjected()},
+		{"RL", flags.GetRateLimited()},
+		{"UAEX", flags.GetUnauthorizedDetails() != nil},
+		{"RLSE", flags.GetRateLimitServiceError()},
+		{"DC", flags.GetDownstreamConnectionTermination()},
+		{"URX", flags.GetUpstreamRetryLimitExceeded()},
+		{"SI", flags.GetStreamIdleTimeout()},
+		{"IH", flags.GetInvalidEnvoyRequestHeaders()},
+		{"DPE", flags.GetDownstreamProtocolError()},
+		{"UMSDR", flags.GetUpstreamMaxStreamDurationReached()},
+		{"RFCF", flags.GetResponseFromCacheFilter()},
+		{"NFCF", flags.GetNoFilterConfigFound()},
+		{"DT", flags.GetDurationTimeout()},
+	} {
+		if flag.set {
+			codes = append(codes, flag.code)
+		}
+	}
+	return strings.Join(codes, ",")
+}
+
+// termination describes which side closed (or reset) the connection from the response flags
+func termination(flags *v3data.ResponseFlags) string {
+	switch {
+	case flags.GetDownstreamConnectionTermination():
+		return "downstream"
+	case flags.GetUpstreamConnectionTermination():
+		return "upstream"
+	case flags.GetUpstreamRemoteReset():
+		return "upstream_reset"
+	case flags.GetLocalReset():
+		return "local_reset"
+	case flags.GetUpstreamConnectionFailure():
+		return "upstream_connect_failure"
+	case flags.GetStreamIdleTimeout():
+		return "idle_timeout"
+	case flags.GetDurationTimeout():
+		return "duration_timeout"
+	}
+	return ""
+}
+
+// connectionDuration is the time from the start of the connection until the last byte was sent or received
+func connectionDuration(common *v3data.AccessLogCommon) time.Duration {
+	var longest time.Duration
+	for _, d := range []*durationpb.Duration{common.GetTimeToLastRxByte(), common.GetTimeToLastUpstreamRxByte(), common.GetTimeToLastDownstreamTxByte()} {
+		if value, err := ptypes.Duration(d); err == nil && value > longest {
+			longest = value
+		}
+	}
+	return longest
+}
+
+func values(fields []namedField, entry logEntry) []namedValue {
+	values := make([]namedValue, 0, len(fields))
+	for _, f := range fields {
+		if value, ok := f.value(entry); ok {
+			values = append(values, namedValue{name: f.name, value: value})
+		}
+	}
+	return values
+}
+
+// keyValueLayout writes the fields as name=value separated by spaces, values with spaces or
+// quotes are quoted.
+func keyValueLayout(values []namedValue) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		var value string
+		switch t := v.value.(type) {
+		case string:
+			value = t
+			if strings.ContainsAny(value, " \"") {
+				value = strconv.Quote(value)
+			}
+		case int64:
+			value = strconv.FormatInt(t, 10)
+		case time.Duration:
+			value = stringMilliseconds(t)
+		}
+		parts = append(parts, v.name+"="+value)
+	}
+	return strings.Join(parts, " ")
+}
+
+// jsonLayout writes the fields as a json object in the order they were configured, durations
+// are written in milliseconds.
+func jsonLayout(values []namedValue) string {
+	var buffer bytes.Buffer
+	buffer.WriteString("{")
+	for i, v := range values {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		name, _ := json.Marshal(v.name)
+		buffer.Write(name)
+		buffer.WriteString(":")
+		switch t := v.value.(type) {
+		case string:
+			value, _ := json.Marshal(t)
+			buffer.Write(value)
+		case int64:
+			buffer.WriteString(strconv.FormatInt(t, 10))
+		case time.Duration:
+			buffer.WriteString(strconv.FormatFloat(t.Seconds()*1000, 'f', 2, 64))
+		}
+	}
+	buffer.WriteString("}")
+	return buffer.String()
+}
+
+var layouts = map[string]layoutWriter{
+	"keyvalue": keyValueLayout,
+	"json":     jsonLayout,
+}
+
+func duration(d *durationpb.Duration) time.Duration {
+	value, err := ptypes.Duration(d)
+	if err != nil {
+		return time.Millisecond
+	}
+	return value
+}
@@ -0,0 +1,325 @@
+package file
+
+import (
+	"errors"
+	"github.com/akkeris/logtrain/internal/debug"
+	"github.com/akkeris/logtrain/internal/tailer"
+	"github.com/akkeris/logtrain/pkg/input/multiline"
+	"github.com/fsnotify/fsnotify"
+	"github.com/trevorlinton/remote_syslog2/syslog"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHostnameTemplate is used when no hostname template is given.
+const DefaultHostnameTemplate = "{hostname}"
+
+// DefaultTagTemplate is used when no tag template is given.
+const DefaultTagTemplate = "{name}"
+
+// File is an input that tails plain text files matching one or more glob patterns.
+type File struct {
+	errors           chan error
+	hostname         string
+	hostnameTemplate string
+	packets          chan syslog.Packet
+	patterns         []string
+	stop             chan struct{}
+	tagTemplate      string
+	tailer           *tailer.Tailer
+	wait             sync.WaitGroup
+	watcher          *fsnotify.Watcher
+}
+
+// expand replaces the placeholders in a template with values derived from the file path:
+//
+//	{hostname} - the hostname of this machine
+//	{path}     - the full path of the file (/var/log/nginx/access.log)
+//	{dir}      - the name of the directory the file is in (nginx)
+//	{file}     - the file name (access.log)
+//	{name}     - the file name without its extension (access)
+//	{ext}      - the extension of the file without the dot (log)
+func expand(template string, file string, hostname string) string {
+	base := filepath.Base(file)
+	ext := filepath.Ext(base)
+	return strings.NewReplacer(
+		"{hostname}", hostname,
+		"{path}", file,
+		"{dir}", filepath.Base(filepath.Dir(file)),
+		"{file}", base,
+		"{name}", strings.TrimSuffix(base, ext),
+		"{ext}", strings.TrimPrefix(ext, "."),
+	).Replace(template)
+}
+
+func (handler *File) matches(file string) bool {
+	for _, pattern := range handler.patterns {
+		if ok, err := filepath.Match(pattern, file); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// directoryPatterns returns the directory part of a pattern, and if it has glob
+// characters each of its parents up until one without, so new directories that
+// could match the pattern can be watched for.
+func directoryPatterns(pattern string) []string {
+	dir := filepath.Dir(pattern)
+	dirs := []string{dir}
+	for strings.ContainsAny(dir, "*?[\\") && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+func (handler *File) directories() []string {
+	dirs := make([]string, 0)
+	for _, pattern := range handler.patterns {
+		for _, dirPattern := range directoryPatterns(pattern) {
+			matches, err := filepath.Glob(dirPattern)
+			if err != nil {
+				debug.Errorf("[file/input]: Error listing directories for %s: %s\n", pattern, err.Error())
+				continue
+			}
+			for _, dir := range matches {
+				if info, err := os.Stat(dir); err == nil && info.IsDir() {
+					dirs = append(dirs, dir)
+				}
+			}
+		}
+	}
+	return dirs
+}
+
+func (handler *File) isDirectoryOfPattern(dir string) bool {
+	for _, pattern := range handler.patterns {
+		for _, dirPattern := range directoryPatterns(pattern) {
+			if ok, err := filepath.Match(dirPattern, dir); err == nil && ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addDirectory watches a new directory and starts following any matching files
+// that were created before the watch was in place.
+func (handler *File) addDirectory(dir string) {
+	if err := handler.watcher.Add(dir); err != nil {
+		debug.Errorf("[file/input]: Cannot add [%s] path to file watcher: %s\n", dir, err.Error())
+		return
+	}
+	for _, pattern := range handler.patterns {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if strings.HasPrefix(file, dir+string(filepath.Separator)) {
+				handler.goAdd(file, io.SeekStart)
+			}
+		}
+	}
+}
+
+// Close stops following the files, it waits for lines being sent before the packets
+// channel is closed.
+func (handler *File) Close() error {
+	debug.Infof("[file/input]: Close was called\n")
+	close(handler.stop)
+	if handler.watcher != nil {
+		handler.watcher.Close()
+	}
+	handler.wait.Wait()
+	handler.tailer.Close()
+	close(handler.packets)
+	close(handler.errors)
+	debug.Infof("[file/input]: Closed\n")
+	return nil
+}
+
+// Dial starts watching the files that match the patterns
+func (handler *File) Dial() error {
+	if handler.watcher != nil {
+		return errors.New("dial may only be called once")
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	for _, dir := range handler.directories() {
+		if err := watcher.Add(dir); err != nil {
+			debug.Errorf("[file/input]: Cannot add [%s] path to file watcher: %s\n", dir, err.Error())
+			watcher.Close()
+			return err
+		}
+	}
+	existing := make([]string, 0)
+	for _, pattern := range handler.patterns {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			watcher.Close()
+			return err
+		}
+		existing = append(existing, files...)
+	}
+	handler.watcher = watcher
+	for _, file := range existing {
+		// Seek the end of files that existed before we started, unless
+		// we have a position recorded for the file.
+		if err := handler.add(file, io.SeekEnd); err != nil {
+			debug.Errorf("[file/input]: Error watching file: %s, due to: %s\n", file, err.Error())
+		}
+	}
+	handler.wait.Add(1)
+	go handler.watcherEventLoop()
+	handler.tailer.Start()
+	return nil
+}
+
+// Errors returns a channel that sends errors occuring from input
+func (handler *File) Errors() chan error {
+	return handler.errors
+}
+
+// Packets returns a channel that sends incoming packets from input
+func (handler *File) Packets() chan syslog.Packet {
+	return handler.packets
+}
+
+// Pools returns whether this input pools or not.
+func (handler *File) Pools() bool {
+	return true
+}
+
+// JoinLines joins the lines of each file, it's called by multiline.Create.
+func (handler *File) JoinLines(config multiline.Config) {
+	handler.tailer.Join(config)
+}
+
+func (handler *File) error(err error) {
+	select {
+	case <-handler.stop:
+	case handler.errors <- err:
+	default:
+	}
+}
+
+func (handler *File) add(file string, ioSeek int) error {
+	hostname := expand(handler.hostnameTemplate, file, handler.hostname)
+	tag := expand(handler.tagTemplate, file, handler.hostname)
+	err := handler.tailer.Follow(file, ioSeek, func(text string, t time.Time) (syslog.Packet, bool) {
+		return syslog.Packet{
+			Severity: syslog.SevInfo,
+			Facility: 0,
+			Time:     t,
+			Hostname: hostname,
+			Tag:      tag,
+			Message:  text,
+		}, true
+	})
+	if err == tailer.ErrClosed {
+		return nil
+	} else if err != nil {
+		handler.error(err)
+		return err
+	}
+	debug.Infof("[file/input] Watching: %s (%s/%s)\n", file, hostname, tag)
+	return nil
+}
+
+// goAdd follows the file in the background, Close waits for it to finish.
+func (handler *File) goAdd(file string, ioSeek int) {
+	handler.wait.Add(1)
+	go func() {
+		defer handler.wait.Done()
+		handler.add(file, ioSeek)
+	}()
+}
+
+func (handler *File) watcherEventLoop() {
+	defer handler.wait.Done()
+	for {
+		select {
+		case event, ok := <-handler.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Create == fsnotify.Create {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() && handler.isDirectoryOfPattern(event.Name) {
+					debug.Debugf("[file/input] Watcher loop saw a new directory: %s\n", event.Name)
+					handler.addDirectory(event.Name)
+				} else if handler.matches(event.Name) {
+					debug.Debugf("[file/input] Watcher loop saw a new create event: %s\n", event.Name)
+					handler.goAdd(event.Name, io.SeekStart)
+				}
+			} else if event.Op&fsnotify.Write == fsnotify.Write && handler.matches(event.Name) && !handler.tailer.Following(event.Name) {
+				debug.Debugf("[file/input] Watcher loop saw a write event for a new file: %s\n", event.Name)
+				handler.goAdd(event.Name, io.SeekStart)
+			} else if event.Op&fsnotify.Remove == fsnotify.Remove {
+				handler.tailer.Remove(event.Name)
+			}
+		case err, ok := <-handler.watcher.Errors:
+			if !ok {
+				return
+			}
+			debug.Debugf("[file/input] Watcher loop encountered an error: %s\n", err.Error())
+			handler.error(err)
+		}
+	}
+}
+
+// Create creates a new input that tails the files matching the glob patterns (e.g. /var/log/nginx/*.log).
+// The hostname and tag of each file are derived from the path through the templates, see expand.
+// If positionsPath is set the read offset of each file is kept there so restarts resume where they
+// left off.
+func Create(patterns []string, hostnameTemplate string, tagTemplate string, positionsPath string) (*File, error) {
+	if len(patterns) == 0 {
+		return nil, errors.New("at least one file pattern is required")
+	}
+	cleaned := make([]string, 0)
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errors.New("invalid file pattern " + pattern + ": " + err.Error())
+		}
+		cleaned = append(cleaned, filepath.Clean(pattern))
+	}
+	if len(cleaned) == 0 {
+		return nil, errors.New("at least one file pattern is required")
+	}
+	if hostnameTemplate == "" {
+		hostnameTemplate = DefaultHostnameTemplate
+	}
+	if tagTemplate == "" {
+		tagTemplate = DefaultTagTemplate
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	packets := make(chan syslog.Packet, 100)
+	t, err := tailer.Create("file/input", packets, positionsPath)
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		errors:           make(chan error, 1),
+		hostname:         hostname,
+		hostnameTemplate: hostnameTemplate,
+		packets:          packets,
+		patterns:         cleaned,
+		stop:             make(chan struct{}),
+		tagTemplate:      tagTemplate,
+		tailer:           t,
+	}, nil
+}
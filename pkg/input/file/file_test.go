@@ -0,0 +1,112 @@
+package file
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/trevorlinton/remote_syslog2/syslog"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func write(f *os.File, content string) error {
+	if _, err := f.Write([]byte(content)); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// create writes the file somewhere else and moves it into place, so the content is
+// already there when the input sees the file.
+func create(path string, content string) error {
+	if err := ioutil.WriteFile("/tmp/file_test/.tmp", []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename("/tmp/file_test/.tmp", path)
+}
+
+func TestFileInput(t *testing.T) {
+	if err := os.RemoveAll("/tmp/file_test"); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll("/tmp/file_test/nginx", 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	Convey("Ensure invalid patterns are rejected", t, func() {
+		_, err := Create([]string{}, "", "", "")
+		So(err, ShouldNotBeNil)
+		_, err = Create([]string{" "}, "", "", "")
+		So(err, ShouldNotBeNil)
+		_, err = Create([]string{"/tmp/file_test/[.log"}, "", "", "")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Ensure templates are expanded from the path", t, func() {
+		So(expand("{hostname}", "/var/log/nginx/access.log", "server1"), ShouldEqual, "server1")
+		So(expand("{dir}.{hostname}", "/var/log/nginx/access.log", "server1"), ShouldEqual, "nginx.server1")
+		So(expand("{name}", "/var/log/nginx/access.log", "server1"), ShouldEqual, "access")
+		So(expand("{file}", "/var/log/nginx/access.log", "server1"), ShouldEqual, "access.log")
+		So(expand("{ext}", "/var/log/nginx/access.log", "server1"), ShouldEqual, "log")
+		So(expand("{path}", "/var/log/nginx/access.log", "server1"), ShouldEqual, "/var/log/nginx/access.log")
+	})
+
+	handler, err := Create([]string{"/tmp/file_test/*/*.log"}, "{dir}.example.com", "{name}", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	Convey("Ensure nothing blows up on the handler stubs", t, func() {
+		So(handler.Dial(), ShouldBeNil)
+		So(handler.Dial(), ShouldNotBeNil)
+		So(handler.Pools(), ShouldEqual, true)
+	})
+	Convey("Ensure we can receive lines from new files", t, func() {
+		So(create("/tmp/file_test/nginx/ignored.txt", "ignored\n"), ShouldBeNil)
+		So(create("/tmp/file_test/nginx/access.log", "GET / 200\n"), ShouldBeNil)
+		select {
+		case message := <-handler.Packets():
+			So(message.Message, ShouldEqual, "GET / 200")
+			So(message.Hostname, ShouldEqual, "nginx.example.com")
+			So(message.Tag, ShouldEqual, "access")
+			So(message.Severity, ShouldEqual, syslog.SevInfo)
+		case err := <-handler.Errors():
+			log.Fatal(err)
+		case <-time.NewTimer(time.Second * 2).C:
+			So(false, ShouldEqual, true)
+		}
+		// give the follower time to start watching for changes once it has read to the end.
+		<-time.NewTimer(time.Millisecond * 250).C
+		f, err := os.OpenFile("/tmp/file_test/nginx/access.log", os.O_APPEND|os.O_WRONLY, 0644)
+		So(err, ShouldBeNil)
+		So(write(f, "GET /foo 404\n"), ShouldBeNil)
+		So(f.Close(), ShouldBeNil)
+		select {
+		case message := <-handler.Packets():
+			So(message.Message, ShouldEqual, "GET /foo 404")
+		case <-time.NewTimer(time.Second * 2).C:
+			So(false, ShouldEqual, true)
+		}
+	})
+	Convey("Ensure we pick up files in new directories", t, func() {
+		So(os.Mkdir("/tmp/file_test/app", 0755), ShouldBeNil)
+		<-time.NewTimer(time.Millisecond * 100).C
+		So(create("/tmp/file_test/app/error.log", "oops\n"), ShouldBeNil)
+		select {
+		case message := <-handler.Packets():
+			So(message.Message, ShouldEqual, "oops")
+			So(message.Hostname, ShouldEqual, "app.example.com")
+			So(message.Tag, ShouldEqual, "error")
+		case <-time.NewTimer(time.Second * 2).C:
+			So(false, ShouldEqual, true)
+		}
+	})
+	Convey("Ensure we can close the input", t, func() {
+		So(handler.Close(), ShouldBeNil)
+		os.RemoveAll("/tmp/file_test")
+	})
+}
@@ -0,0 +1,422 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"github.com/akkeris/logtrain/internal/debug"
+	"github.com/akkeris/logtrain/internal/forward"
+	syslog "github.com/trevorlinton/remote_syslog2/syslog"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mapping sets how the hostname, tag and message of a log are taken from fluent events. The
+// hostname and tag are templates where {tag} is replaced with the fluent tag and {name} is
+// replaced with the value of the field name in the record. The message is the field of the
+// record holding the message, if empty the log or message field is used or if the record has
+// neither the whole record is written as json.
+type Mapping struct {
+	Hostname string
+	Tag      string
+	Message  string
+}
+
+// HandlerForward receives logs over the fluent forward protocol (fluentd and fluent bit's
+// forward output), it supports the message, forward, packed forward and compressed packed
+// forward modes and acknowledges chunks when asked to.
+type HandlerForward struct {
+	address  string
+	mapping  Mapping
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	mutex    sync.Mutex
+	wait     sync.WaitGroup
+	errors   chan error
+	packets  chan syslog.Packet
+	stop     chan struct{}
+}
+
+type entry struct {
+	time   time.Time
+	record map[string]interface{}
+}
+
+// DefaultMapping uses the fluent tag as the hostname and the ident field as the tag.
+var DefaultMapping = Mapping{Hostname: "{tag}", Tag: "{ident}"}
+
+var fieldTemplate = regexp.MustCompile(`\{([^{}]+)\}`)
+
+var severities = map[string]int{"emerg": 0, "alert": 1, "crit": 2, "err": 3, "warn": 4, "notice": 5, "info": 6, "debug": 7}
+
+// Create a new fluent forward input
+func Create(address string, mapping Mapping) (*HandlerForward, error) {
+	if mapping.Hostname == "" {
+		mapping.Hostname = DefaultMapping.Hostname
+	}
+	if mapping.Tag == "" {
+		mapping.Tag = DefaultMapping.Tag
+	}
+	return &HandlerForward{
+		address: address,
+		mapping: mapping,
+		conns:   make(map[net.Conn]struct{}),
+		errors:  make(chan error, 1),
+		packets: make(chan syslog.Packet, 100),
+		stop:    make(chan struct{}),
+	}, nil
+}
+
+// Dial starts listening for connections
+func (handler *HandlerForward) Dial() error {
+	if handler.listener != nil {
+		return errors.New("dial may only be called once")
+	}
+	listener, err := net.Listen("tcp", handler.address)
+	if err != nil {
+		return err
+	}
+	handler.listener = listener
+	go handler.accept()
+	return nil
+}
+
+// Close stops listening and closes any open connections
+func (handler *HandlerForward) Close() error {
+	close(handler.stop)
+	if handler.listener != nil {
+		handler.listener.Close()
+	}
+	handler.mutex.Lock()
+	for conn := range handler.conns {
+		conn.Close()
+	}
+	handler.mutex.Unlock()
+	handler.wait.Wait()
+	close(handler.packets)
+	close(handler.errors)
+	return nil
+}
+
+// Errors returns a channel that sends errors occuring from input
+func (handler *HandlerForward) Errors() chan error {
+	return handler.errors
+}
+
+// Packets returns a channel that sends incoming packets from input
+func (handler *HandlerForward) Packets() chan syslog.Packet {
+	return handler.packets
+}
+
+// Pools returns whether this input pools or not.
+func (handler *HandlerForward) Pools() bool {
+	return true
+}
+
+func (handler *HandlerForward) error(err error) {
+	select {
+	case <-handler.stop:
+	case handler.errors <- err:
+	default:
+	}
+}
+
+func (handler *HandlerForward) accept() {
+	for {
+		conn, err := handler.listener.Accept()
+		if err != nil {
+			select {
+			case <-handler.stop:
+				return
+			default:
+			}
+			handler.error(err)
+			return
+		}
+		handler.mutex.Lock()
+		handler.conns[conn] = struct{}{}
+		handler.wait.Add(1)
+		handler.mutex.Unlock()
+		go handler.read(conn)
+	}
+}
+
+func (handler *HandlerForward) read(conn net.Conn) {
+	defer handler.wait.Done()
+	defer func() {
+		handler.mutex.Lock()
+		delete(handler.conns, conn)
+		handler.mutex.Unlock()
+		conn.Close()
+	}()
+	debug.Debugf("[forward] Accepted connection from %s\n", conn.RemoteAddr().String())
+	decoder := msgpack.NewDecoder(bufio.NewReader(conn))
+	encoder := msgpack.NewEncoder(conn)
+	for {
+		tag, entries, options, err := decode(decoder)
+		if err != nil {
+			if err != io.EOF {
+				handler.error(err)
+			}
+			return
+		}
+		for _, e := range entries {
+			select {
+			case handler.packets <- handler.packet(tag, e):
+			case <-handler.stop:
+				return
+			}
+		}
+		if chunk, ok := options["chunk"]; ok {
+			if err := encoder.Encode(map[string]interface{}{"ack": chunk}); err != nil {
+				handler.error(err)
+				return
+			}
+		}
+	}
+}
+
+func decodeEntry(decoder *msgpack.Decoder) (entry, error) {
+	length, err := decoder.DecodeArrayLen()
+	if err != nil {
+		return entry{}, err
+	}
+	if length != 2 {
+		return entry{}, errors.New("invalid entry, expected an array of the time and record")
+	}
+	value, err := decoder.DecodeInterface()
+	if err != nil {
+		return entry{}, err
+	}
+	t, err := forward.Time(value)
+	if err != nil {
+		return entry{}, err
+	}
+	record, err := decoder.DecodeMap()
+	if err != nil {
+		return entry{}, err
+	}
+	return entry{time: t, record: record}, nil
+}
+
+// decode reads one message, the mode is determined by the second item of the message,
+// an array of entries (forward), a string of packed entries (packed forward) or a time (message).
+func decode(decoder *msgpack.Decoder) (string, []entry, map[string]interface{}, error) {
+	length, err := decoder.DecodeArrayLen()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if length < 2 || length > 4 {
+		return "", nil, nil, errors.New("invalid forward message, expected an array of 2 to 4 items")
+	}
+	tag, err := decoder.DecodeString()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	code, err := decoder.PeekCode()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var entries []entry
+	var packed []byte
+	remaining := length - 2
+	if msgpcode.IsFixedArray(code) || code == msgpcode.Array16 || code == msgpcode.Array32 {
+		count, err := decoder.DecodeArrayLen()
+		if err != nil {
+			return "", nil, nil, err
+		}
+		entries = make([]entry, 0, count)
+		for i := 0; i < count; i++ {
+			e, err := decodeEntry(decoder)
+			if err != nil {
+				return "", nil, nil, err
+			}
+			entries = append(entries, e)
+		}
+	} else if msgpcode.IsString(code) || msgpcode.IsBin(code) {
+		if packed, err = decoder.DecodeBytes(); err != nil {
+			return "", nil, nil, err
+		}
+	} else {
+		value, err := decoder.DecodeInterface()
+		if err != nil {
+			return "", nil, nil, err
+		}
+		t, err := forward.Time(value)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if remaining < 1 {
+			return "", nil, nil, errors.New("invalid forward message, expected a record")
+		}
+		record, err := decoder.DecodeMap()
+		if err != nil {
+			return "", nil, nil, err
+		}
+		entries = []entry{{time: t, record: record}}
+		remaining--
+	}
+	var options map[string]interface{}
+	if remaining > 0 {
+		if options, err = decoder.DecodeMap(); err != nil {
+			return "", nil, nil, err
+		}
+	}
+	if packed != nil {
+		if entries, err = unpack(packed, options); err != nil {
+			return "", nil, nil, err
+		}
+	}
+	return tag, entries, options, nil
+}
+
+// unpack reads the entries of a packed forward (or compressed packed forward) message
+func unpack(packed []byte, options map[string]interface{}) ([]entry, error) {
+	if compressed, ok := options["compressed"].(string); ok && compressed == "gzip" {
+		reader, err := gzip.NewReader(bytes.NewReader(packed))
+		if err != nil {
+			return nil, err
+		}
+		if packed, err = ioutil.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	} else if ok {
+		return nil, errors.New("unsupported compression " + compressed)
+	}
+	entries := make([]entry, 0)
+	decoder := msgpack.NewDecoder(bytes.NewReader(packed))
+	for {
+		e, err := decodeEntry(decoder)
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	data, err := json.Marshal(toJSON(value))
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(string(data), "\"")
+}
+
+// toJSON converts values json can not write (e.g., bytes are base64 encoded by json) from records.
+func toJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case *forward.EventTime:
+		return v.Time
+	case map[string]interface{}:
+		values := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			values[key] = toJSON(item)
+		}
+		return values
+	case []interface{}:
+		values := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			values = append(values, toJSON(item))
+		}
+		return values
+	}
+	return value
+}
+
+func toInt(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case int8:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case uint8:
+		return int(v), true
+	case uint16:
+		return int(v), true
+	case uint32:
+		return int(v), true
+	case uint64:
+		return int(v), true
+	case string:
+		if i, ok := severities[strings.ToLower(v)]; ok {
+			return i, true
+		}
+		i, err := strconv.Atoi(v)
+		return i, err == nil
+	case []byte:
+		return toInt(string(v))
+	}
+	return 0, false
+}
+
+func (handler *HandlerForward) render(template string, tag string, record map[string]interface{}) string {
+	return fieldTemplate.ReplaceAllStringFunc(template, func(match string) string {
+		name := match[1 : len(match)-1]
+		if name == "tag" {
+			return tag
+		}
+		return toString(record[name])
+	})
+}
+
+func (handler *HandlerForward) message(record map[string]interface{}) string {
+	if handler.mapping.Message != "" {
+		return toString(record[handler.mapping.Message])
+	}
+	for _, field := range []string{"log", "message"} {
+		if value, ok := record[field]; ok {
+			return strings.TrimRight(toString(value), "\r\n")
+		}
+	}
+	data, err := json.Marshal(toJSON(record))
+	if err != nil {
+		debug.Errorf("[forward] Unable to convert record: %s\n", err.Error())
+		return ""
+	}
+	return string(data)
+}
+
+func (handler *HandlerForward) packet(tag string, e entry) syslog.Packet {
+	// records without a severity are treated as informational
+	severity, facility := 6, 0
+	if s, ok := toInt(e.record["severity"]); ok && s >= 0 && s < 8 {
+		severity = s
+	}
+	if f, ok := toInt(e.record["facility"]); ok && f >= 0 && f < 24 {
+		facility = f
+	}
+	return syslog.Packet{
+		Severity: syslog.Priority(severity),
+		Facility: syslog.Priority(facility),
+		Hostname: handler.render(handler.mapping.Hostname, tag, e.record),
+		Tag:      handler.render(handler.mapping.Tag, tag, e.record),
+		Time:     e.time,
+		Message:  handler.message(e.record),
+	}
+}
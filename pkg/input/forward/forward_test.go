@@ -0,0 +1,129 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/akkeris/logtrain/internal/forward"
+	. "github.com/smartystreets/goconvey/convey"
+	syslog2 "github.com/trevorlinton/remote_syslog2/syslog"
+	"github.com/vmihailenco/msgpack/v5"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func receive(packets chan syslog2.Packet) syslog2.Packet {
+	select {
+	case p := <-packets:
+		return p
+	case <-time.NewTimer(time.Second * 5).C:
+		log.Fatal("Did not receive the packet")
+	}
+	return syslog2.Packet{}
+}
+
+func packedEntries(entries ...[]interface{}) []byte {
+	var buffer bytes.Buffer
+	encoder := msgpack.NewEncoder(&buffer)
+	for _, e := range entries {
+		if err := encoder.Encode(e); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return buffer.Bytes()
+}
+
+func TestForwardInput(t *testing.T) {
+	var handler *HandlerForward
+	var err error
+	eventTime := &forward.EventTime{Time: time.Unix(1600000000, 250000000)}
+	record := map[string]interface{}{"ident": "web.1", "log": "Test Message\n", "severity": "err", "facility": 1}
+	Convey("Ensure we can start the forward input", t, func() {
+		handler, err = Create("127.0.0.1:0", Mapping{})
+		So(err, ShouldBeNil)
+		So(handler.mapping, ShouldResemble, DefaultMapping)
+		So(handler.Dial(), ShouldBeNil)
+		So(handler.Dial(), ShouldNotBeNil)
+		So(handler.Pools(), ShouldEqual, true)
+	})
+	Convey("Ensure we can receive each mode of the forward protocol", t, func() {
+		conn, err := net.Dial("tcp", handler.listener.Addr().String())
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		encoder := msgpack.NewEncoder(conn)
+		decoder := msgpack.NewDecoder(conn)
+
+		// message mode
+		So(encoder.Encode([]interface{}{"app.space", eventTime, record}), ShouldBeNil)
+		p := receive(handler.Packets())
+		So(p.Hostname, ShouldEqual, "app.space")
+		So(p.Tag, ShouldEqual, "web.1")
+		So(p.Message, ShouldEqual, "Test Message")
+		So(p.Severity, ShouldEqual, 3)
+		So(p.Facility, ShouldEqual, 1)
+		So(p.Time.UnixNano(), ShouldEqual, eventTime.UnixNano())
+
+		// forward mode, with integer times
+		So(encoder.Encode([]interface{}{"app.space", []interface{}{
+			[]interface{}{1600000001, map[string]interface{}{"message": "first"}},
+			[]interface{}{1600000002, map[string]interface{}{"user": "alice"}},
+		}}), ShouldBeNil)
+		p = receive(handler.Packets())
+		So(p.Message, ShouldEqual, "first")
+		So(p.Time.Unix(), ShouldEqual, 1600000001)
+		p = receive(handler.Packets())
+		So(p.Message, ShouldEqual, `{"user":"alice"}`)
+		So(p.Severity, ShouldEqual, 6)
+
+		// packed forward mode
+		entries := packedEntries([]interface{}{eventTime, map[string]interface{}{"log": "packed"}})
+		So(encoder.Encode([]interface{}{"app.space", entries}), ShouldBeNil)
+		So(receive(handler.Packets()).Message, ShouldEqual, "packed")
+
+		// compressed packed forward mode with an ack
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		writer.Write(packedEntries(
+			[]interface{}{eventTime, map[string]interface{}{"log": "compressed 1"}},
+			[]interface{}{eventTime, map[string]interface{}{"log": "compressed 2"}},
+		))
+		writer.Close()
+		So(encoder.Encode([]interface{}{"app.space", compressed.Bytes(), map[string]interface{}{"size": 2, "compressed": "gzip", "chunk": "abc123"}}), ShouldBeNil)
+		So(receive(handler.Packets()).Message, ShouldEqual, "compressed 1")
+		So(receive(handler.Packets()).Message, ShouldEqual, "compressed 2")
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		response, err := decoder.DecodeMap()
+		So(err, ShouldBeNil)
+		So(response["ack"], ShouldEqual, "abc123")
+	})
+	Convey("Ensure invalid messages are reported", t, func() {
+		conn, err := net.Dial("tcp", handler.listener.Addr().String())
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		So(msgpack.NewEncoder(conn).Encode([]interface{}{"app.space"}), ShouldBeNil)
+		select {
+		case err := <-handler.Errors():
+			So(err.Error(), ShouldContainSubstring, "invalid forward message")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive an error")
+		}
+	})
+	Convey("Ensure hostnames, tags and messages can be mapped from fields", t, func() {
+		in, err := Create("127.0.0.1:0", Mapping{Hostname: "{kubernetes_name}.{kubernetes_namespace}", Tag: "{tag}", Message: "msg"})
+		So(err, ShouldBeNil)
+		p := in.packet("kube.logs", entry{time: eventTime.Time, record: map[string]interface{}{
+			"kubernetes_name":      []byte("api"),
+			"kubernetes_namespace": "payments",
+			"msg":                  "hello",
+			"log":                  "ignored",
+		}})
+		So(p.Hostname, ShouldEqual, "api.payments")
+		So(p.Tag, ShouldEqual, "kube.logs")
+		So(p.Message, ShouldEqual, "hello")
+		So(in.Close(), ShouldBeNil)
+	})
+	Convey("Ensure we can close the forward input", t, func() {
+		So(handler.Close(), ShouldBeNil)
+	})
+}
@@ -13,5 +13,4 @@ type Input interface {
 	Pools() bool /* Whether the transport layer automatically pools or not. */
 }
 
-// TODO: input type "directory"...
 // TODO: special input type persistent s3 storage?...
@@ -5,9 +5,10 @@ import (
 	"errors"
 	"github.com/akkeris/logtrain/internal/debug"
 	"github.com/akkeris/logtrain/internal/storage"
+	"github.com/akkeris/logtrain/internal/tailer"
+	"github.com/akkeris/logtrain/pkg/input/multiline"
 	"github.com/fsnotify/fsnotify"
 	"github.com/json-iterator/go"
-	"github.com/influxdata/tail"
 	"github.com/trevorlinton/remote_syslog2/syslog"
 	"github.com/valyala/fastjson"
 	"io"
@@ -23,6 +24,21 @@ import (
 
 const kubeTime = "2006-01-02T15:04:05.000000000Z"
 
+// criTime is the timestamp layout written by containerd/CRI-O.
+const criTime = time.RFC3339Nano
+
+// maxCriPartialSize caps how much of a partial (P) CRI line we keep in memory
+// waiting for its final (F) line, anything beyond is flushed as-is.
+const maxCriPartialSize = 1024 * 1024
+
+type logFormat int
+
+const (
+	formatUnknown logFormat = iota
+	formatDocker
+	formatCri
+)
+
 type kubeLine struct {
 	Log    string `json:"log"`
 	Stream string `json:"stream"`
@@ -38,9 +54,9 @@ type kubeDetails struct {
 
 type fileWatcher struct {
 	errors   uint32
-	follower *tail.Tail
+	format   logFormat
 	hostname string
-	stop     chan struct{}
+	partial  string
 	tag      string
 }
 
@@ -50,14 +66,16 @@ type hostnameAndTag struct {
 }
 
 type Kubernetes struct {
-	kube           kubernetes.Interface
-	closing        bool
-	errors         chan error
-	followers      map[string]fileWatcher
-	followersMutex sync.Mutex
-	packets        chan syslog.Packet
-	path           string
-	watcher        *fsnotify.Watcher
+	kube            kubernetes.Interface
+	errors          chan error
+	packets         chan syslog.Packet
+	path            string
+	stop            chan struct{}
+	tailer          *tailer.Tailer
+	wait            sync.WaitGroup
+	watcher         *fsnotify.Watcher
+	useAkkerisHosts bool
+	jsonParser      string
 }
 
 func getTopLevelObject(kube kubernetes.Interface, obj api.Object) (api.Object, error) {
@@ -193,16 +211,16 @@ func dir(root string) []string {
 	return files
 }
 
+// Close stops following the log files, it waits for lines being sent before the packets
+// channel is closed.
 func (handler *Kubernetes) Close() error {
 	debug.Infof("[kubernetes/input]: Close was called\n")
-	handler.closing = true
-	handler.watcher.Close()
-	for _, v := range handler.followers {
-		select {
-		case v.stop <- struct{}{}:
-		default:
-		}
+	close(handler.stop)
+	if handler.watcher != nil {
+		handler.watcher.Close()
 	}
+	handler.wait.Wait()
+	handler.tailer.Close()
 	close(handler.packets)
 	close(handler.errors)
 	debug.Infof("[kubernetes/input]: Closed\n")
@@ -217,7 +235,8 @@ func (handler *Kubernetes) Dial() error {
 		/* Seek the end of the file if we've just started,
 		 * if say we're erroring and restarting frequently we
 		 * do not want to start from the beginning of the log file
-		 * and rebroadcast the entire log contents
+		 * and rebroadcast the entire log contents. If we have a
+		 * position recorded for the file add will resume from it.
 		 */
 		if err := handler.add(file, io.SeekEnd); err != nil {
 			debug.Errorf("[kubernetes/input]: Error watching file: %s, due to: %s\n", file, err.Error())
@@ -229,6 +248,7 @@ func (handler *Kubernetes) Dial() error {
 		return err
 	}
 	handler.watcher = watcher
+	handler.tailer.Start()
 	return nil
 }
 
@@ -244,6 +264,11 @@ func (handler *Kubernetes) Pools() bool {
 	return true
 }
 
+// JoinLines joins the lines of each container's log file, it's called by multiline.Create.
+func (handler *Kubernetes) JoinLines(config multiline.Config) {
+	handler.tailer.Join(config)
+}
+
 func kubeDetailsFromFileName(file string) (*kubeDetails, error) {
 	re := regexp.MustCompile(`(?P<pod_name>([a-z0-9][-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*)_(?P<namespace>[^_]+)_(?P<container_name>.+)-(?P<docker_id>[a-z0-9]{64})\.log$`)
 	file = filepath.Base(file)
@@ -262,152 +287,184 @@ func kubeDetailsFromFileName(file string) (*kubeDetails, error) {
 	return nil, errors.New("invalid filename, no match given")
 }
 
-func (handler *Kubernetes) parseWithStandardJson(file string, fw *fileWatcher, hostAndTag *hostnameAndTag) {
-	debug.Infof("[kubernetes/input] Watching (standard parser): %s (%s/%s)\n", file, hostAndTag.Hostname, hostAndTag.Tag)
-	for {
-		// TODO: investigate if this is better served by using a range instead of select such as in:
-		// https://github.com/trevorlinton/go-tail/blob/master/main.go#L53
-		select {
-		case line, ok := <-fw.follower.Lines:
-			if ok && line.Err == nil {
-				var data kubeLine
-				if err := json.Unmarshal([]byte(line.Text), &data); err != nil {
-					// track errors with the lines, but don't report anything.
-					// TODO: should we do more? we shouldnt report this on
-					// the kubernetes error handler as one corrupted file could make
-					// the entire input handler look broken. Brainstorm on this.
-					fw.errors++
-				} else {
-					t, err := time.Parse(kubeTime, data.Time)
-					if err != nil {
-						t = time.Now()
-					}
-					handler.Packets() <- syslog.Packet{
-						Severity: 0,
-						Facility: 0,
-						Time:     t,
-						Hostname: fw.hostname,
-						Tag:      fw.tag,
-						Message:  data.Log,
-					}
-				}
-			} else if ok && line.Err != nil {
-				debug.Errorf("[kubernetes/input]: Error following file %s: %s", file, line.Err.Error())
-				// track errors with the lines, but don't report anything.
-				// TODO: should we do more? we shouldnt report this on
-				// the kubernetes error handler as one corrupted file could make
-				// the entire input handler look broken. Brainstorm on this.
-				fw.errors++
-			} else if !ok {
-				debug.Debugf("[kubernetes/input]: Watcher was closed on  %s (%s/%s)\n", file, hostAndTag.Hostname, hostAndTag.Tag)
-				return
-			}
-		case <-fw.stop:
-			fw.follower.Stop()
-			fw.follower.Cleanup()
-			debug.Infof("[kubernetes/input]: Received message to stop watcher for %s.", file)
-			return
+// detectFormat determines if a line is in the docker json format
+// ({"log":...,"stream":...,"time":...}) or the CRI text format
+// (<time> <stream> <P|F> <log>) used by containerd and CRI-O.
+func detectFormat(text string) logFormat {
+	if strings.HasPrefix(strings.TrimSpace(text), "{") {
+		return formatDocker
+	}
+	if _, _, err := parseCriLine(text); err == nil {
+		return formatCri
+	}
+	return formatUnknown
+}
+
+// isCri returns true if the file being watched is in the CRI format, the
+// format is determined by the first recognizable line and kept thereafter.
+func (fw *fileWatcher) isCri(text string) bool {
+	if fw.format == formatUnknown {
+		fw.format = detectFormat(text)
+	}
+	return fw.format == formatCri
+}
+
+// parseCriLine parses a CRI log line, the returned boolean indicates if the
+// line is partial and should be joined with the lines that follow it.
+func parseCriLine(text string) (*kubeLine, bool, error) {
+	parts := strings.SplitN(text, " ", 4)
+	if len(parts) < 3 {
+		return nil, false, errors.New("invalid cri log line, too few parts")
+	}
+	if parts[1] != "stdout" && parts[1] != "stderr" {
+		return nil, false, errors.New("invalid cri log line, unknown stream " + parts[1])
+	}
+	// The tag may contain additional flags delimited by a colon, only the first is defined.
+	flag := strings.Split(parts[2], ":")[0]
+	if flag != "P" && flag != "F" {
+		return nil, false, errors.New("invalid cri log line, unknown tag " + parts[2])
+	}
+	var log string
+	if len(parts) == 4 {
+		log = parts[3]
+	}
+	return &kubeLine{
+		Log:    log,
+		Stream: parts[1],
+		Time:   parts[0],
+	}, flag == "P", nil
+}
+
+// severityFromStream maps the container stream onto a syslog severity, stderr is an error
+// and everything else is informational.
+func severityFromStream(stream string) syslog.Priority {
+	if stream == "stderr" {
+		return syslog.SevErr
+	}
+	return syslog.SevInfo
+}
+
+func (fw *fileWatcher) parseCri(text string) (syslog.Packet, bool) {
+	data, partial, err := parseCriLine(text)
+	if err != nil {
+		// see comments below on line errors in the json parsers.
+		fw.errors++
+		return syslog.Packet{}, false
+	}
+	if partial && len(fw.partial)+len(data.Log) < maxCriPartialSize {
+		fw.partial = fw.partial + data.Log
+		return syslog.Packet{}, false
+	}
+	message := fw.partial + data.Log
+	fw.partial = ""
+	t, err := time.Parse(criTime, data.Time)
+	if err != nil {
+		t = time.Now()
+	}
+	return syslog.Packet{
+		Severity: severityFromStream(data.Stream),
+		Facility: 0,
+		Time:     t,
+		Hostname: fw.hostname,
+		Tag:      fw.tag,
+		Message:  message,
+	}, true
+}
+
+// parseWithStandardJson returns a parser for the lines of a file using encoding/json for
+// docker json lines.
+func (fw *fileWatcher) parseWithStandardJson() tailer.Parser {
+	return func(text string, _ time.Time) (syslog.Packet, bool) {
+		if fw.isCri(text) {
+			return fw.parseCri(text)
 		}
+		var data kubeLine
+		if err := json.Unmarshal([]byte(text), &data); err != nil {
+			// track errors with the lines, but don't report anything.
+			// TODO: should we do more? we shouldnt report this on
+			// the kubernetes error handler as one corrupted file could make
+			// the entire input handler look broken. Brainstorm on this.
+			fw.errors++
+			return syslog.Packet{}, false
+		}
+		t, err := time.Parse(kubeTime, data.Time)
+		if err != nil {
+			t = time.Now()
+		}
+		return syslog.Packet{
+			Severity: severityFromStream(data.Stream),
+			Facility: 0,
+			Time:     t,
+			Hostname: fw.hostname,
+			Tag:      fw.tag,
+			Message:  data.Log,
+		}, true
 	}
 }
 
-func (handler *Kubernetes) parseWithJsonIterator(file string, fw *fileWatcher, hostAndTag *hostnameAndTag) {
-	debug.Infof("[kubernetes/input] Watching (json-iterator parser): %s (%s/%s)\n", file, hostAndTag.Hostname, hostAndTag.Tag)
+// parseWithJsonIterator returns a parser for the lines of a file using json-iterator for
+// docker json lines.
+func (fw *fileWatcher) parseWithJsonIterator() tailer.Parser {
 	var json = jsoniter.ConfigCompatibleWithStandardLibrary
-	for {
-		// TODO: investigate if this is better served by using a range instead of select such as in:
-		// https://github.com/trevorlinton/go-tail/blob/master/main.go#L53
-		select {
-		case line, ok := <-fw.follower.Lines:
-			if ok && line.Err == nil {
-				var data kubeLine
-				if err := json.Unmarshal([]byte(line.Text), &data); err != nil {
-					// track errors with the lines, but don't report anything.
-					// TODO: should we do more? we shouldnt report this on
-					// the kubernetes error handler as one corrupted file could make
-					// the entire input handler look broken. Brainstorm on this.
-					fw.errors++
-				} else {
-					t, err := time.Parse(kubeTime, data.Time)
-					if err != nil {
-						t = time.Now()
-					}
-					handler.Packets() <- syslog.Packet{
-						Severity: 0,
-						Facility: 0,
-						Time:     t,
-						Hostname: fw.hostname,
-						Tag:      fw.tag,
-						Message:  data.Log,
-					}
-				}
-			} else if ok && line.Err != nil {
-				debug.Errorf("[kubernetes/input]: Error following file %s: %s", file, line.Err.Error())
-				// track errors with the lines, but don't report anything.
-				// TODO: should we do more? we shouldnt report this on
-				// the kubernetes error handler as one corrupted file could make
-				// the entire input handler look broken. Brainstorm on this.
-				fw.errors++
-			} else if !ok {
-				debug.Debugf("[kubernetes/input]: Watcher was closed on  %s (%s/%s)\n", file, hostAndTag.Hostname, hostAndTag.Tag)
-				return
-			}
-		case <-fw.stop:
-			fw.follower.Stop()
-			fw.follower.Cleanup()
-			debug.Infof("[kubernetes/input]: Received message to stop watcher for %s.", file)
-			return
+	return func(text string, _ time.Time) (syslog.Packet, bool) {
+		if fw.isCri(text) {
+			return fw.parseCri(text)
+		}
+		var data kubeLine
+		if err := json.Unmarshal([]byte(text), &data); err != nil {
+			// see comments above on line errors.
+			fw.errors++
+			return syslog.Packet{}, false
 		}
+		t, err := time.Parse(kubeTime, data.Time)
+		if err != nil {
+			t = time.Now()
+		}
+		return syslog.Packet{
+			Severity: severityFromStream(data.Stream),
+			Facility: 0,
+			Time:     t,
+			Hostname: fw.hostname,
+			Tag:      fw.tag,
+			Message:  data.Log,
+		}, true
 	}
 }
 
-func (handler *Kubernetes) parseWithFastJson(file string, fw *fileWatcher, hostAndTag *hostnameAndTag) {
-	debug.Infof("[kubernetes/input] Watching (fastjson parser): %s (%s/%s)\n", file, hostAndTag.Hostname, hostAndTag.Tag)
+// parseWithFastJson returns a parser for the lines of a file using fastjson for docker
+// json lines, the fastjson parser is reused between the lines of the file.
+func (fw *fileWatcher) parseWithFastJson() tailer.Parser {
 	var parser fastjson.Parser
-	for {
-		// TODO: investigate if this is better served by using a range instead of select such as in:
-		// https://github.com/trevorlinton/go-tail/blob/master/main.go#L53
-		select {
-		case line, ok := <-fw.follower.Lines:
-			if ok && line.Err == nil {
-				v, err := parser.Parse(line.Text)
-				if err != nil {
-					// track errors with the lines, but don't report anything.
-					// TODO: should we do more? we shouldnt report this on
-					// the kubernetes error handler as one corrupted file could make
-					// the entire input handler look broken. Brainstorm on this.
-					fw.errors++
-				} else {
-					t, err := time.Parse(kubeTime, string(v.GetStringBytes("time")))
-					if err != nil {
-						t = time.Now()
-					}
-					handler.Packets() <- syslog.Packet{
-						Severity: 0,
-						Facility: 0,
-						Time:     t,
-						Hostname: fw.hostname,
-						Tag:      fw.tag,
-						Message:  string(v.GetStringBytes("log")),
-					}
-				}
-			} else if ok && line.Err != nil {
-				debug.Errorf("[kubernetes/input]: Error following file %s: %s", file, line.Err.Error())
-				// track errors with the lines, but don't report anything.
-				// TODO: should we do more? we shouldnt report this on
-				// the kubernetes error handler as one corrupted file could make
-				// the entire input handler look broken. Brainstorm on this.
-				fw.errors++
-			} else if !ok {
-				debug.Debugf("[kubernetes/input]: Watcher was closed on  %s (%s/%s)\n", file, hostAndTag.Hostname, hostAndTag.Tag)
-				return
-			}
-		case <-fw.stop:
-			fw.follower.Stop()
-			fw.follower.Cleanup()
-			debug.Infof("[kubernetes/input]: Received message to stop watcher for %s.", file)
-			return
+	return func(text string, _ time.Time) (syslog.Packet, bool) {
+		if fw.isCri(text) {
+			return fw.parseCri(text)
 		}
+		v, err := parser.Parse(text)
+		if err != nil {
+			// see comments above on line errors.
+			fw.errors++
+			return syslog.Packet{}, false
+		}
+		t, err := time.Parse(kubeTime, string(v.GetStringBytes("time")))
+		if err != nil {
+			t = time.Now()
+		}
+		return syslog.Packet{
+			Severity: severityFromStream(string(v.GetStringBytes("stream"))),
+			Facility: 0,
+			Time:     t,
+			Hostname: fw.hostname,
+			Tag:      fw.tag,
+			Message:  string(v.GetStringBytes("log")),
+		}, true
+	}
+}
+
+func (handler *Kubernetes) error(err error) {
+	select {
+	case <-handler.stop:
+	case handler.errors <- err:
+	default:
 	}
 }
 
@@ -417,50 +474,57 @@ func (handler *Kubernetes) add(file string, ioSeek int) error {
 	if err != nil {
 		return err
 	}
-
-	config := tail.Config{
-		Follow: true,
-		Location: &tail.SeekInfo{
-			Offset: 0,
-			Whence: ioSeek,
-		},
-		ReOpen: true,
-		Logger: debug.LoggerDebug,
+	if handler.tailer.Following(file) {
+		return nil
 	}
 
-	useAkkerisHosts := os.Getenv("AKKERIS") == "true"
-	hostAndTag := deriveHostnameFromPod(details.Pod, details.Namespace, useAkkerisHosts)
+	hostAndTag := deriveHostnameFromPod(details.Pod, details.Namespace, handler.useAkkerisHosts)
 	pod, err := handler.kube.CoreV1().Pods(details.Namespace).Get(details.Pod, api.GetOptions{})
 	if err != nil {
 		debug.Errorf("Unable to get pod details from kubernetes for pod %#+v due to %s\n", details, err.Error())
 	} else {
-		hostAndTag = getHostnameAndTagFromPod(handler.kube, pod, useAkkerisHosts)
+		hostAndTag = getHostnameAndTagFromPod(handler.kube, pod, handler.useAkkerisHosts)
 	}
-	proc, err := tail.TailFile(file, config)
-	if err != nil {
-		handler.Errors() <- err
-		return err
-	}
-	fw := fileWatcher{
-		follower: proc,
-		stop:     make(chan struct{}, 1),
+	fw := &fileWatcher{
 		hostname: hostAndTag.Hostname,
 		tag:      hostAndTag.Tag,
 		errors:   0,
 	}
-	handler.followersMutex.Lock()
-	handler.followers[file] = fw
-	handler.followersMutex.Unlock()
-	if os.Getenv("JSON_PARSER") == "fast" {
-		go handler.parseWithFastJson(file, &fw, hostAndTag)
-	} else if os.Getenv("JSON_PARSER") == "iterator" {
-		go handler.parseWithJsonIterator(file, &fw, hostAndTag)
+	var parser tailer.Parser
+	if handler.jsonParser == "fast" {
+		parser = fw.parseWithFastJson()
+	} else if handler.jsonParser == "iterator" {
+		parser = fw.parseWithJsonIterator()
 	} else {
-		go handler.parseWithStandardJson(file, &fw, hostAndTag)
+		parser = fw.parseWithStandardJson()
 	}
+	// A position recorded for the file takes precedence over ioSeek.
+	if err := handler.tailer.Follow(file, ioSeek, parser); err == tailer.ErrClosed {
+		return nil
+	} else if err != nil {
+		handler.error(err)
+		return err
+	}
+	debug.Infof("[kubernetes/input] Watching (%s parser): %s (%s/%s)\n", handler.parserName(), file, hostAndTag.Hostname, hostAndTag.Tag)
 	return nil
 }
 
+func (handler *Kubernetes) parserName() string {
+	if handler.jsonParser == "" {
+		return "standard"
+	}
+	return handler.jsonParser
+}
+
+// goAdd follows the file in the background, Close waits for it to finish.
+func (handler *Kubernetes) goAdd(file string, ioSeek int) {
+	handler.wait.Add(1)
+	go func() {
+		defer handler.wait.Done()
+		handler.add(file, ioSeek)
+	}()
+}
+
 func (handler *Kubernetes) watcherEventLoop() (*fsnotify.Watcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -472,69 +536,79 @@ func (handler *Kubernetes) watcherEventLoop() (*fsnotify.Watcher, error) {
 		debug.Errorf("[kubernetes/input] Cannot add [%s] path to file watcher: %s\n", handler.path, err.Error())
 		return nil, err
 	}
+	handler.wait.Add(1)
 	go func() {
+		defer handler.wait.Done()
 		for {
 			select {
 			case event, ok := <-watcher.Events:
 				if !ok {
+					select {
+					case <-handler.stop:
+						return
+					default:
+					}
 					debug.Errorf("[kubernetes/input] the watcher event channel was closed for %s\n", handler.path)
 					panic("watcher event channel was closed")
 				}
 				if event.Op&fsnotify.Create == fsnotify.Create {
 					debug.Debugf("[kubernetes/input] Watcher loop saw a new create event: %s\n", event.Name)
-					go handler.add(event.Name, io.SeekStart)
+					handler.goAdd(event.Name, io.SeekStart)
 				} else if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Chmod == fsnotify.Chmod || event.Op&fsnotify.Rename == fsnotify.Rename {
-					if _, ok := handler.followers[event.Name]; !ok {
+					if !handler.tailer.Following(event.Name) {
 						debug.Debugf("[kubernetes/input] Watcher loop saw a write/chmod/rename event for a new file: %s\n", event.Name)
-						go handler.add(event.Name, io.SeekStart)
+						handler.goAdd(event.Name, io.SeekStart)
 					}
 				} else if event.Op&fsnotify.Remove == fsnotify.Remove {
-					if follower, ok := handler.followers[event.Name]; ok {
+					if handler.tailer.Following(event.Name) {
 						debug.Debugf("[kubernetes/input] Watcher loop a remove event: %s\n", event.Name)
-						go func() {
-							select {
-							case follower.stop <- struct{}{}:
-							default:
-							}
-							handler.followersMutex.Lock()
-							delete(handler.followers, event.Name)
-							handler.followersMutex.Unlock()
-							debug.Debugf("[kubernetes/input] Successfully processed remove event: %s\n", event.Name)
-						}()
+						handler.tailer.Remove(event.Name)
+						debug.Debugf("[kubernetes/input] Successfully processed remove event: %s\n", event.Name)
 					} else {
 						debug.Debugf("[kubernetes/input] Watcher loop could not find follower %s to remove!\n", event.Name)
 					}
-					return
+					continue
 				}
 			case err, ok := <-watcher.Errors:
-				if !ok || handler.closing {
+				if !ok {
 					return
 				}
 				debug.Debugf("[kubernetes/input] Watcher loop encountered an error: %s\n", err.Error())
-				select {
-				case handler.Errors() <- err:
-				default:
-				}
+				handler.error(err)
 			}
 		}
 	}()
 	return watcher, nil
 }
 
-func Create(logpath string, kube kubernetes.Interface) (*Kubernetes, error) {
+// Create creates a kubernetes input watching logpath, if positionsPath is set the read
+// offset of each file is kept there so restarts resume where they left off. If useAkkerisHosts
+// is set hostnames are derived the way akkeris names apps, the jsonParser used for docker json
+// logs may be standard (the default), fast or iterator.
+func Create(logpath string, positionsPath string, kube kubernetes.Interface, useAkkerisHosts bool, jsonParser string) (*Kubernetes, error) {
 	if logpath == "" {
 		logpath = "/var/log/containers"
 	}
+	if jsonParser != "" && jsonParser != "standard" && jsonParser != "fast" && jsonParser != "iterator" {
+		return nil, errors.New("unknown json parser " + jsonParser + ", expected standard, fast or iterator")
+	}
 
 	// TODO: Check permissions of service account, and directory exists... before we run...
 
+	packets := make(chan syslog.Packet, 100)
+	t, err := tailer.Create("kubernetes/input", packets, positionsPath)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Kubernetes{
-		kube:           kube,
-		errors:         make(chan error, 1),
-		packets:        make(chan syslog.Packet, 100),
-		path:           logpath,
-		followers:      make(map[string]fileWatcher),
-		closing:        false,
-		followersMutex: sync.Mutex{},
+		kube:            kube,
+		errors:          make(chan error, 1),
+		packets:         packets,
+		path:            logpath,
+		stop:            make(chan struct{}),
+		tailer:          t,
+		useAkkerisHosts: useAkkerisHosts,
+		jsonParser:      jsonParser,
 	}, nil
 }
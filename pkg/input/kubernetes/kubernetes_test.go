@@ -1,9 +1,11 @@
 package kubernetes
 
 import (
+	"github.com/akkeris/logtrain/internal/positions"
 	"github.com/akkeris/logtrain/internal/storage"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/trevorlinton/remote_syslog2/syslog"
+	"io/ioutil"
 	apps "k8s.io/api/apps/v1"
 	core "k8s.io/api/core/v1"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -87,7 +89,7 @@ func TestKubernetesInput(t *testing.T) {
 	pod.SetName("alamotest2112-64cd4f4ff7-6bqb8")
 	pod.SetNamespace("default")
 	pod.SetOwnerReferences([]meta.OwnerReference{meta.OwnerReference{Kind: "replicaset", Name: "alamotest2112-64cd4f4ff7"}})
-	handler, err := Create("/tmp/kubernetes_test", fake.NewSimpleClientset(pod.DeepCopyObject(), replicaset.DeepCopyObject(), deployment.DeepCopyObject()))
+	handler, err := Create("/tmp/kubernetes_test", "", fake.NewSimpleClientset(pod.DeepCopyObject(), replicaset.DeepCopyObject(), deployment.DeepCopyObject()), false, "")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -174,7 +176,7 @@ func TestKubernetesInput(t *testing.T) {
 	})
 	Convey("Ensure we can receive messages", t, func() {
 		p := syslog.Packet{
-			Severity: 0,
+			Severity: syslog.SevInfo,
 			Facility: 0,
 			Message:  "line",
 			Tag:      "alamotest2112-64cd4f4ff7-6bqb8",
@@ -197,8 +199,134 @@ func TestKubernetesInput(t *testing.T) {
 		}
 
 	})
+	Convey("Ensure we can parse cri log lines", t, func() {
+		So(detectFormat("{\"log\":\"line\",\"stream\":\"stdout\",\"time\":\"2006-01-02T15:04:05.000000000Z\"}"), ShouldEqual, formatDocker)
+		So(detectFormat("2006-01-02T15:04:05.000000000Z stdout F line"), ShouldEqual, formatCri)
+		So(detectFormat("not a log line"), ShouldEqual, formatUnknown)
+		data, partial, err := parseCriLine("2006-01-02T15:04:05.000000000Z stderr P some partial line")
+		So(err, ShouldBeNil)
+		So(partial, ShouldEqual, true)
+		So(data.Stream, ShouldEqual, "stderr")
+		So(data.Log, ShouldEqual, "some partial line")
+		data, partial, err = parseCriLine("2006-01-02T15:04:05.000000000Z stdout F")
+		So(err, ShouldBeNil)
+		So(partial, ShouldEqual, false)
+		So(data.Log, ShouldEqual, "")
+		_, _, err = parseCriLine("2006-01-02T15:04:05.000000000Z stdin F line")
+		So(err, ShouldNotBeNil)
+		_, _, err = parseCriLine("2006-01-02T15:04:05.000000000Z stdout X line")
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Ensure we can receive cri formatted messages", t, func() {
+		// drain anything left over from the previous file.
+		<-time.NewTimer(time.Millisecond * 250).C
+		for len(handler.Packets()) > 0 {
+			<-handler.Packets()
+		}
+		f, err := os.Create("/tmp/kubernetes_test/alamotest2112-64cd4f4ff7-6bqb8_default_alamotest2112-b54517ce9ceb1e1d87fc41c263a3d7b95fd177a01b9acea61c643727a92306b1.log")
+		So(err, ShouldBeNil)
+		So(write(f, "2006-01-02T15:04:05.000000000Z stdout P first \n2006-01-02T15:04:05.000000000Z stdout P second \n2006-01-02T15:04:05.000000000Z stdout F third\n"), ShouldBeNil)
+		So(write(f, "2006-01-02T15:04:06.000000000Z stderr F an error\n"), ShouldBeNil)
+		So(f.Close(), ShouldBeNil)
+		select {
+		case message := <-handler.Packets():
+			So(message.Message, ShouldEqual, "first second third")
+			So(message.Hostname, ShouldEqual, "alamotest2112.default")
+			So(message.Tag, ShouldEqual, "alamotest2112-64cd4f4ff7-6bqb8")
+			So(message.Severity, ShouldEqual, syslog.SevInfo)
+			So(message.Time.Unix(), ShouldEqual, time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC).Unix())
+		case err := <-handler.Errors():
+			log.Fatal(err)
+		}
+		select {
+		case message := <-handler.Packets():
+			So(message.Message, ShouldEqual, "an error")
+			So(message.Severity, ShouldEqual, syslog.SevErr)
+		case err := <-handler.Errors():
+			log.Fatal(err)
+		}
+	})
+	Convey("Ensure new logs are received after a log is removed", t, func() {
+		So(os.Remove("/tmp/kubernetes_test/alamotest2112-64cd4f4ff7-6bqb8_default_alamotest2112-b54517ce9ceb1e1d87fc41c263a3d7b95fd177a01b9acea61c643727a92306b1.log"), ShouldBeNil)
+		<-time.NewTimer(time.Millisecond * 250).C
+		f, err := os.Create("/tmp/kubernetes_test/alamotest2112-64cd4f4ff7-6bqb8_default_alamotest2112-c54517ce9ceb1e1d87fc41c263a3d7b95fd177a01b9acea61c643727a92306b1.log")
+		So(err, ShouldBeNil)
+		So(write(f, "{\"log\":\"after remove\",\"stream\":\"stdout\",\"time\":\"2006-01-02T15:04:05.000000000Z\"}\n"), ShouldBeNil)
+		So(f.Close(), ShouldBeNil)
+		select {
+		case message := <-handler.Packets():
+			So(message.Message, ShouldEqual, "after remove")
+		case err := <-handler.Errors():
+			log.Fatal(err)
+		case <-time.NewTimer(time.Second * 5).C:
+			So(false, ShouldEqual, true)
+		}
+	})
 	Convey("Ensure we can close the connection", t, func() {
 		os.RemoveAll("/tmp/kubernetes_test")
 		So(handler.Close(), ShouldBeNil)
 	})
 }
+
+func TestKubernetesInputPositions(t *testing.T) {
+	if err := os.RemoveAll("/tmp/kubernetes_positions_test"); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll("/tmp/kubernetes_positions_test/logs", 0755); err != nil {
+		log.Fatal(err)
+	}
+	file := "/tmp/kubernetes_positions_test/logs/alamotest2112-64cd4f4ff7-6bqb8_default_alamotest2112-a54517ce9ceb1e1d87fc41c263a3d7b95fd177a01b9acea61c643727a92306b1.log"
+	first := "{\"log\":\"first\",\"stream\":\"stdout\",\"time\":\"2006-01-02T15:04:05.000000000Z\"}\n"
+	second := "{\"log\":\"second\",\"stream\":\"stdout\",\"time\":\"2006-01-02T15:04:05.000000000Z\"}\n"
+	if err := ioutil.WriteFile(file, []byte(first+second), 0644); err != nil {
+		log.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pos, err := positions.Open("/tmp/kubernetes_positions_test/positions.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	pos.Set(file, positions.Position{Inode: positions.Inode(info), Offset: int64(len(first))})
+	if err := pos.Save(); err != nil {
+		log.Fatal(err)
+	}
+
+	handler, err := Create("/tmp/kubernetes_positions_test/logs", "/tmp/kubernetes_positions_test/positions.json", fake.NewSimpleClientset(), false, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	Convey("Ensure we resume from the recorded position", t, func() {
+		So(handler.Dial(), ShouldBeNil)
+		select {
+		case message := <-handler.Packets():
+			So(message.Message, ShouldEqual, "second")
+		case <-time.NewTimer(time.Second * 2).C:
+			So(false, ShouldEqual, true)
+		}
+	})
+	Convey("Ensure we record positions when closing", t, func() {
+		So(handler.Close(), ShouldBeNil)
+		pos, err := positions.Open("/tmp/kubernetes_positions_test/positions.json")
+		So(err, ShouldBeNil)
+		p, ok := pos.Get(file)
+		So(ok, ShouldEqual, true)
+		So(p.Offset, ShouldEqual, len(first+second))
+		So(p.Inode, ShouldEqual, positions.Inode(info))
+		os.RemoveAll("/tmp/kubernetes_positions_test")
+	})
+}
+
+func TestKubernetesJsonParser(t *testing.T) {
+	Convey("Ensure an unknown json parser is rejected", t, func() {
+		_, err := Create("/tmp/kubernetes_test", "", fake.NewSimpleClientset(), false, "nope")
+		So(err, ShouldNotBeNil)
+		handler, err := Create("/tmp/kubernetes_test", "", fake.NewSimpleClientset(), true, "iterator")
+		So(err, ShouldBeNil)
+		So(handler.useAkkerisHosts, ShouldEqual, true)
+		So(handler.jsonParser, ShouldEqual, "iterator")
+	})
+}
@@ -0,0 +1,281 @@
+package multiline
+
+import (
+	"errors"
+	"github.com/akkeris/logtrain/pkg/input"
+	syslog "github.com/trevorlinton/remote_syslog2/syslog"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultMaxLines is the amount of lines joined into one message if MaxLines is not set.
+const DefaultMaxLines = 500
+
+// DefaultMaxWait is the longest a message is held waiting for more lines if MaxWait is not set.
+const DefaultMaxWait = time.Second
+
+// Config describes how lines are joined, if Start is set a line matching it begins a new
+// message and any other line is appended to the current message. If Continuation is set
+// a line matching it is appended to the current message and any other line begins a new
+// message. If both are set a line matching neither is sent on its own.
+type Config struct {
+	Start        *regexp.Regexp
+	Continuation *regexp.Regexp
+	MaxLines     int           // Messages are sent once they have this many lines.
+	MaxWait      time.Duration // Messages are sent once no line has been added for this long.
+}
+
+// Sourced is implemented by inputs that read many sources which may share a hostname and
+// tag (e.g. tailed files), these inputs join the lines of each source themselves.
+type Sourced interface {
+	JoinLines(config Config)
+}
+
+// Joiner joins the lines of a single source into messages.
+type Joiner struct {
+	config Config
+	packet syslog.Packet
+	lines  []string
+	last   time.Time // when the last line was added
+}
+
+// Multiline wraps an input and joins lines from the same hostname and tag (e.g. stack traces)
+// into a single packet before they're routed. If the input is Sourced it joins the lines of
+// each of its sources instead.
+type Multiline struct {
+	config  Config
+	input   input.Input
+	packets chan syslog.Packet
+	sourced bool
+	streams map[string]*Joiner
+	stop    chan struct{}
+	closing bool // set by the loop once it's stopping, packets are no longer waited on to be read
+	closed  bool
+}
+
+// Close closes the wrapped input, messages waiting for more lines are sent if possible.
+func (handler *Multiline) Close() error {
+	if handler.closed {
+		return errors.New("this input is already closed")
+	}
+	handler.closed = true
+	err := handler.input.Close()
+	handler.stop <- struct{}{}
+	return err
+}
+
+// Dial dials the wrapped input and begins joining its lines.
+func (handler *Multiline) Dial() error {
+	if err := handler.input.Dial(); err != nil {
+		return err
+	}
+	go handler.loop()
+	return nil
+}
+
+// Errors returns the errors of the wrapped input.
+func (handler *Multiline) Errors() chan error {
+	return handler.input.Errors()
+}
+
+// Packets returns a channel of joined packets.
+func (handler *Multiline) Packets() chan syslog.Packet {
+	return handler.packets
+}
+
+// Pools returns whether the wrapped input pools connections.
+func (handler *Multiline) Pools() bool {
+	return handler.input.Pools()
+}
+
+func (handler *Multiline) send(packets ...syslog.Packet) {
+	for _, packet := range packets {
+		if handler.closing {
+			select {
+			case handler.packets <- packet:
+			default:
+			}
+		} else {
+			handler.packets <- packet
+		}
+	}
+}
+
+// Add joins the packet with the current message or begins a new one, it returns the
+// messages that are complete.
+func (j *Joiner) Add(packet syslog.Packet, now time.Time) []syslog.Packet {
+	var continues bool
+	if j.config.Start != nil && j.config.Continuation != nil {
+		if j.config.Start.MatchString(packet.Message) {
+			continues = false
+		} else if j.config.Continuation.MatchString(packet.Message) {
+			continues = true
+		} else {
+			return append(j.Flush(), packet)
+		}
+	} else if j.config.Start != nil {
+		continues = !j.config.Start.MatchString(packet.Message)
+	} else {
+		continues = j.config.Continuation.MatchString(packet.Message)
+	}
+	complete := make([]syslog.Packet, 0)
+	if continues && j.lines != nil {
+		j.lines = append(j.lines, packet.Message)
+	} else {
+		complete = j.Flush()
+		j.packet = packet
+		j.lines = []string{packet.Message}
+	}
+	j.last = now
+	if len(j.lines) >= j.config.MaxLines {
+		complete = append(complete, j.Flush()...)
+	}
+	return complete
+}
+
+// Flush returns the current message (if there is one) even though more lines may follow.
+func (j *Joiner) Flush() []syslog.Packet {
+	if j.lines == nil {
+		return []syslog.Packet{}
+	}
+	packet := j.packet
+	packet.Message = strings.Join(j.lines, "\n")
+	j.lines = nil
+	return []syslog.Packet{packet}
+}
+
+// Pending returns true if lines are held waiting for the rest of their message.
+func (j *Joiner) Pending() bool {
+	return j.lines != nil
+}
+
+// Expired returns true if the current message has waited MaxWait for another line.
+func (j *Joiner) Expired(now time.Time) bool {
+	return j.lines != nil && now.Sub(j.last) >= j.config.MaxWait
+}
+
+// Interval is how often Expired should be checked.
+func (j *Joiner) Interval() time.Duration {
+	return interval(j.config)
+}
+
+func interval(config Config) time.Duration {
+	if config.MaxWait/4 < time.Millisecond {
+		return time.Millisecond
+	}
+	return config.MaxWait / 4
+}
+
+// add joins the packet with the current message of its hostname and tag or begins a new one.
+func (handler *Multiline) add(packet syslog.Packet) {
+	if handler.sourced {
+		handler.send(packet)
+		return
+	}
+	key := packet.Hostname + "\x00" + packet.Tag
+	j, ok := handler.streams[key]
+	if !ok {
+		j = &Joiner{config: handler.config}
+		handler.streams[key] = j
+	}
+	handler.send(j.Add(packet, time.Now())...)
+	if j.lines == nil {
+		delete(handler.streams, key)
+	}
+}
+
+func (handler *Multiline) expire(now time.Time) {
+	for key, j := range handler.streams {
+		if j.Expired(now) {
+			delete(handler.streams, key)
+			handler.send(j.Flush()...)
+		}
+	}
+}
+
+// closeStreams sends what's left of the wrapped input's packets and the messages waiting
+// for more lines, then closes the packets channel.
+func (handler *Multiline) closeStreams() {
+	handler.closing = true
+	for done := false; !done; {
+		select {
+		case packet, ok := <-handler.input.Packets():
+			if ok {
+				handler.add(packet)
+			} else {
+				done = true
+			}
+		default:
+			done = true
+		}
+	}
+	for key, j := range handler.streams {
+		delete(handler.streams, key)
+		handler.send(j.Flush()...)
+	}
+	close(handler.packets)
+}
+
+func (handler *Multiline) loop() {
+	ticker := time.NewTicker(interval(handler.config))
+	defer ticker.Stop()
+	for {
+		select {
+		case packet, ok := <-handler.input.Packets():
+			if !ok {
+				handler.closeStreams()
+				return
+			}
+			handler.add(packet)
+		case now := <-ticker.C:
+			handler.expire(now)
+		case <-handler.stop:
+			handler.closeStreams()
+			return
+		}
+	}
+}
+
+func withDefaults(config Config) (Config, error) {
+	if config.Start == nil && config.Continuation == nil {
+		return config, errors.New("a start or continuation pattern is required to join lines")
+	}
+	if config.MaxLines < 1 {
+		config.MaxLines = DefaultMaxLines
+	}
+	if config.MaxWait <= 0 {
+		config.MaxWait = DefaultMaxWait
+	}
+	return config, nil
+}
+
+// CreateJoiner creates a joiner for the lines of one source.
+func CreateJoiner(config Config) (*Joiner, error) {
+	config, err := withDefaults(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Joiner{config: config}, nil
+}
+
+// Create wraps an input so lines are joined according to the config.
+func Create(in input.Input, config Config) (*Multiline, error) {
+	config, err := withDefaults(config)
+	if err != nil {
+		return nil, err
+	}
+	source, sourced := in.(Sourced)
+	if sourced {
+		source.JoinLines(config)
+	}
+	return &Multiline{
+		config:  config,
+		input:   in,
+		packets: make(chan syslog.Packet, 100),
+		sourced: sourced,
+		streams: make(map[string]*Joiner),
+		stop:    make(chan struct{}, 1),
+		closed:  false,
+	}, nil
+}
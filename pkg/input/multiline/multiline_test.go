@@ -0,0 +1,136 @@
+package multiline
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	syslog "github.com/trevorlinton/remote_syslog2/syslog"
+	"regexp"
+	"testing"
+	"time"
+)
+
+type FakeInput struct {
+	errors  chan error
+	packets chan syslog.Packet
+}
+
+func (i *FakeInput) Close() error {
+	close(i.packets)
+	return nil
+}
+func (i *FakeInput) Dial() error {
+	return nil
+}
+func (i *FakeInput) Errors() chan error {
+	return i.errors
+}
+func (i *FakeInput) Packets() chan syslog.Packet {
+	return i.packets
+}
+func (i *FakeInput) Pools() bool {
+	return true
+}
+
+type FakeSourcedInput struct {
+	FakeInput
+	config *Config
+}
+
+func (i *FakeSourcedInput) JoinLines(config Config) {
+	i.config = &config
+}
+
+func receive(handler *Multiline) string {
+	select {
+	case packet := <-handler.Packets():
+		return packet.Message
+	case <-time.NewTimer(time.Second * 2).C:
+		return "timed out"
+	}
+}
+
+func send(in *FakeInput, tag string, lines ...string) {
+	for _, line := range lines {
+		in.packets <- syslog.Packet{Hostname: "app.default", Tag: tag, Message: line, Time: time.Now()}
+	}
+}
+
+func TestMultiline(t *testing.T) {
+	Convey("Ensure a pattern is required", t, func() {
+		_, err := Create(&FakeInput{}, Config{})
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Ensure lines are joined by a start pattern", t, func() {
+		in := &FakeInput{errors: make(chan error, 1), packets: make(chan syslog.Packet, 10)}
+		handler, err := Create(in, Config{Start: regexp.MustCompile(`^\d{4}-`), MaxWait: time.Minute})
+		So(err, ShouldBeNil)
+		So(handler.Dial(), ShouldBeNil)
+		So(handler.Pools(), ShouldEqual, true)
+		send(in, "web", "2020-01-01 Exception in thread main", "\tat com.example.Main(Main.java:10)", "\tat com.example.Main(Main.java:5)")
+		send(in, "worker", "2020-01-01 starting worker")
+		send(in, "web", "2020-01-01 next")
+		So(receive(handler), ShouldEqual, "2020-01-01 Exception in thread main\n\tat com.example.Main(Main.java:10)\n\tat com.example.Main(Main.java:5)")
+		So(handler.Close(), ShouldBeNil)
+		So(handler.Close(), ShouldNotBeNil)
+		remaining := []string{receive(handler), receive(handler)}
+		So(remaining, ShouldContain, "2020-01-01 starting worker")
+		So(remaining, ShouldContain, "2020-01-01 next")
+	})
+	Convey("Ensure lines are joined by a continuation pattern up to the max lines", t, func() {
+		in := &FakeInput{errors: make(chan error, 1), packets: make(chan syslog.Packet, 10)}
+		handler, err := Create(in, Config{Continuation: regexp.MustCompile(`^\s+File |^\s{4}`), MaxLines: 3, MaxWait: time.Minute})
+		So(err, ShouldBeNil)
+		So(handler.Dial(), ShouldBeNil)
+		send(in, "web", "Traceback (most recent call last):", "  File \"app.py\", line 1", "    main()", "  File \"app.py\", line 9", "ValueError: oops")
+		So(receive(handler), ShouldEqual, "Traceback (most recent call last):\n  File \"app.py\", line 1\n    main()")
+		So(receive(handler), ShouldEqual, "  File \"app.py\", line 9")
+		So(handler.Close(), ShouldBeNil)
+		So(receive(handler), ShouldEqual, "ValueError: oops")
+	})
+	Convey("Ensure lines matching neither pattern are sent alone", t, func() {
+		in := &FakeInput{errors: make(chan error, 1), packets: make(chan syslog.Packet, 10)}
+		handler, err := Create(in, Config{Start: regexp.MustCompile(`^ERROR`), Continuation: regexp.MustCompile(`^\s`), MaxWait: time.Minute})
+		So(err, ShouldBeNil)
+		So(handler.Dial(), ShouldBeNil)
+		send(in, "web", "ERROR failed", " detail", "plain line")
+		So(receive(handler), ShouldEqual, "ERROR failed\n detail")
+		So(receive(handler), ShouldEqual, "plain line")
+		So(handler.Close(), ShouldBeNil)
+	})
+	Convey("Ensure messages are sent after the max wait", t, func() {
+		in := &FakeInput{errors: make(chan error, 1), packets: make(chan syslog.Packet, 10)}
+		handler, err := Create(in, Config{Start: regexp.MustCompile(`^\S`), MaxWait: time.Millisecond * 100})
+		So(err, ShouldBeNil)
+		So(handler.Dial(), ShouldBeNil)
+		send(in, "web", "panic: oops", "  goroutine 1")
+		start := time.Now()
+		So(receive(handler), ShouldEqual, "panic: oops\n  goroutine 1")
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, time.Millisecond*50)
+		So(handler.Close(), ShouldBeNil)
+	})
+	Convey("Ensure the max wait is counted from the last line", t, func() {
+		j, err := CreateJoiner(Config{Start: regexp.MustCompile(`^\S`), MaxWait: time.Second})
+		So(err, ShouldBeNil)
+		start := time.Now()
+		So(j.Add(syslog.Packet{Message: "panic: oops"}, start), ShouldBeEmpty)
+		So(j.Add(syslog.Packet{Message: "  goroutine 1"}, start.Add(time.Millisecond*800)), ShouldBeEmpty)
+		So(j.Expired(start.Add(time.Millisecond*1500)), ShouldEqual, false)
+		So(j.Expired(start.Add(time.Millisecond*1800)), ShouldEqual, true)
+		packets := j.Flush()
+		So(len(packets), ShouldEqual, 1)
+		So(packets[0].Message, ShouldEqual, "panic: oops\n  goroutine 1")
+		So(j.Flush(), ShouldBeEmpty)
+		So(j.Expired(start.Add(time.Hour)), ShouldEqual, false)
+	})
+	Convey("Ensure inputs with many sources join the lines of each source", t, func() {
+		in := &FakeSourcedInput{FakeInput: FakeInput{errors: make(chan error, 1), packets: make(chan syslog.Packet, 10)}}
+		handler, err := Create(in, Config{Start: regexp.MustCompile(`^\S`)})
+		So(err, ShouldBeNil)
+		So(in.config, ShouldNotBeNil)
+		So(in.config.MaxLines, ShouldEqual, DefaultMaxLines)
+		So(handler.Dial(), ShouldBeNil)
+		send(&in.FakeInput, "web", "panic: oops\n  goroutine 1", "  already joined")
+		So(receive(handler), ShouldEqual, "panic: oops\n  goroutine 1")
+		So(receive(handler), ShouldEqual, "  already joined")
+		So(handler.Close(), ShouldBeNil)
+	})
+}
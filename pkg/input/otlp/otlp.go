@@ -0,0 +1,361 @@
+package otlp
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/akkeris/logtrain/internal/debug"
+	syslog "github.com/trevorlinton/remote_syslog2/syslog"
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	logs "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mapping sets how the hostname and tag of a log are created from its attributes, each is a
+// template where {name} is replaced with the value of the attribute name, e.g.
+// "{k8s.deployment.name}.{k8s.namespace.name}". Attributes on the log record are used before
+// attributes on the resource.
+type Mapping struct {
+	Hostname string
+	Tag      string
+}
+
+// OTLPServer receives logs from opentelemetry sdks and collectors over grpc (the otlp
+// LogsService) and http (otlp/http with protobuf or json payloads).
+type OTLPServer struct {
+	collogs.UnimplementedLogsServiceServer
+	address string
+	mapping Mapping
+	server  *grpc.Server
+	errors  chan error
+	packets chan syslog.Packet
+	mutex   sync.Mutex
+	wait    sync.WaitGroup
+	stop    chan struct{}
+}
+
+var _ collogs.LogsServiceServer = &OTLPServer{}
+
+// DefaultMapping uses the host.name as the hostname and service.name as the tag.
+var DefaultMapping = Mapping{Hostname: "{host.name}", Tag: "{service.name}"}
+
+var attributeTemplate = regexp.MustCompile(`\{([^{}]+)\}`)
+
+var severities = map[string]int{"emerg": 0, "alert": 1, "crit": 2, "err": 3, "warn": 4, "notice": 5, "info": 6, "debug": 7}
+
+// Create creates an otlp input, if the address is empty only the http handler is available.
+func Create(address string, mapping Mapping) (*OTLPServer, error) {
+	if mapping.Hostname == "" {
+		mapping.Hostname = DefaultMapping.Hostname
+	}
+	if mapping.Tag == "" {
+		mapping.Tag = DefaultMapping.Tag
+	}
+	return &OTLPServer{
+		address: address,
+		mapping: mapping,
+		server:  nil,
+		packets: make(chan syslog.Packet, 100),
+		errors:  make(chan error, 1),
+		stop:    make(chan struct{}),
+	}, nil
+}
+
+// Dial starts the grpc server
+func (s *OTLPServer) Dial() error {
+	if s.server != nil {
+		return errors.New("Dial may only be called once.")
+	}
+	s.server = grpc.NewServer()
+	if s.address == "" {
+		return nil
+	}
+	collogs.RegisterLogsServiceServer(s.server, s)
+	l, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+	go s.server.Serve(l)
+	return nil
+}
+
+// Close closes the otlp input, it waits for grpc and http requests being received before
+// the packets channel is closed.
+func (s *OTLPServer) Close() error {
+	s.mutex.Lock()
+	close(s.stop)
+	s.mutex.Unlock()
+	if s.server != nil {
+		s.server.Stop()
+	}
+	s.wait.Wait()
+	close(s.packets)
+	close(s.errors)
+	return nil
+}
+
+// Pools returns whether the input pools connections
+func (s *OTLPServer) Pools() bool {
+	return true
+}
+
+// Packets returns a channel where packets from the input are received
+func (s *OTLPServer) Packets() chan syslog.Packet {
+	return s.packets
+}
+
+// Errors returns a channel where errors from the input channel are recieved.
+func (s *OTLPServer) Errors() chan error {
+	return s.errors
+}
+
+// begin tracks a request so Close can wait for it, it returns false if the input is closed.
+func (s *OTLPServer) begin() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.stop:
+		return false
+	default:
+	}
+	s.wait.Add(1)
+	return true
+}
+
+// Export is part of the LogsService interface called by the grpc library
+func (s *OTLPServer) Export(ctx context.Context, request *collogs.ExportLogsServiceRequest) (*collogs.ExportLogsServiceResponse, error) {
+	if !s.begin() {
+		return nil, status.Error(codes.Unavailable, "the otlp input is closed")
+	}
+	defer s.wait.Done()
+	s.receive(request)
+	return &collogs.ExportLogsServiceResponse{}, nil
+}
+
+func (s *OTLPServer) httpError(response http.ResponseWriter, status int, err error) {
+	response.WriteHeader(status)
+	response.Write([]byte(http.StatusText(status)))
+	select {
+	case <-s.stop:
+	case s.errors <- err:
+	default:
+	}
+}
+
+// HandlerFunc handles otlp/http requests, payloads may be protobuf (application/x-protobuf)
+// or json (application/json) and may be gzip'd.
+func (s *OTLPServer) HandlerFunc(response http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if !s.begin() {
+		response.WriteHeader(http.StatusServiceUnavailable)
+		response.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+		return
+	}
+	defer s.wait.Done()
+	if req.Method != http.MethodPost {
+		s.httpError(response, http.StatusMethodNotAllowed, errors.New("otlp requests must be a POST"))
+		return
+	}
+	var body io.Reader = req.Body
+	if strings.ToLower(req.Header.Get("Content-Encoding")) == "gzip" {
+		reader, err := gzip.NewReader(req.Body)
+		if err != nil {
+			s.httpError(response, http.StatusBadRequest, err)
+			return
+		}
+		body = reader
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		s.httpError(response, http.StatusBadRequest, err)
+		return
+	}
+	var request collogs.ExportLogsServiceRequest
+	isJSON := strings.HasPrefix(strings.ToLower(req.Header.Get("Content-Type")), "application/json")
+	if isJSON {
+		err = protojson.Unmarshal(data, &request)
+	} else {
+		err = proto.Unmarshal(data, &request)
+	}
+	if err != nil {
+		s.httpError(response, http.StatusBadRequest, err)
+		return
+	}
+	s.receive(&request)
+	if isJSON {
+		response.Header().Set("Content-Type", "application/json")
+		response.WriteHeader(http.StatusOK)
+		response.Write([]byte("{}"))
+		return
+	}
+	response.Header().Set("Content-Type", "application/x-protobuf")
+	response.WriteHeader(http.StatusOK)
+}
+
+func (s *OTLPServer) receive(request *collogs.ExportLogsServiceRequest) {
+	for _, resourceLogs := range request.ResourceLogs {
+		var resourceAttributes []*common.KeyValue
+		if resourceLogs.Resource != nil {
+			resourceAttributes = resourceLogs.Resource.Attributes
+		}
+		for _, library := range resourceLogs.InstrumentationLibraryLogs {
+			for _, record := range library.Logs {
+				select {
+				case s.packets <- s.packet(record, resourceAttributes):
+				case <-s.stop:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *OTLPServer) packet(record *logs.LogRecord, resourceAttributes []*common.KeyValue) syslog.Packet {
+	t := time.Now()
+	if record.TimeUnixNano != 0 {
+		t = time.Unix(0, int64(record.TimeUnixNano))
+	}
+	var facility int64
+	if value := attribute("syslog.facility", record.Attributes, resourceAttributes); value != nil {
+		if v, ok := value.Value.(*common.AnyValue_IntValue); ok && v.IntValue >= 0 && v.IntValue < 24 {
+			facility = v.IntValue
+		}
+	}
+	return syslog.Packet{
+		Severity: syslog.Priority(severity(record)),
+		Facility: syslog.Priority(facility),
+		Hostname: s.render(s.mapping.Hostname, record.Attributes, resourceAttributes),
+		Tag:      s.render(s.mapping.Tag, record.Attributes, resourceAttributes),
+		Time:     t,
+		Message:  toString(record.Body),
+	}
+}
+
+func (s *OTLPServer) render(template string, recordAttributes []*common.KeyValue, resourceAttributes []*common.KeyValue) string {
+	return attributeTemplate.ReplaceAllStringFunc(template, func(match string) string {
+		return toString(attribute(match[1:len(match)-1], recordAttributes, resourceAttributes))
+	})
+}
+
+// attribute finds the value of the attribute in the record's attributes, then the resource's attributes
+func attribute(key string, recordAttributes []*common.KeyValue, resourceAttributes []*common.KeyValue) *common.AnyValue {
+	for _, attributes := range [][]*common.KeyValue{recordAttributes, resourceAttributes} {
+		for _, kv := range attributes {
+			if kv.Key == key {
+				return kv.Value
+			}
+		}
+	}
+	return nil
+}
+
+// severity maps the otlp severity number onto a syslog severity, if the severity number
+// isn't set the severity text is used. Logs without either are treated as info.
+func severity(record *logs.LogRecord) int {
+	switch n := record.SeverityNumber; {
+	case n >= logs.SeverityNumber_SEVERITY_NUMBER_FATAL4:
+		return 0
+	case n == logs.SeverityNumber_SEVERITY_NUMBER_FATAL3:
+		return 1
+	case n >= logs.SeverityNumber_SEVERITY_NUMBER_FATAL:
+		return 2
+	case n >= logs.SeverityNumber_SEVERITY_NUMBER_ERROR:
+		return 3
+	case n >= logs.SeverityNumber_SEVERITY_NUMBER_WARN:
+		return 4
+	case n >= logs.SeverityNumber_SEVERITY_NUMBER_INFO2:
+		return 5
+	case n == logs.SeverityNumber_SEVERITY_NUMBER_INFO:
+		return 6
+	case n >= logs.SeverityNumber_SEVERITY_NUMBER_TRACE:
+		return 7
+	}
+	text := strings.ToLower(record.SeverityText)
+	if value, ok := severities[text]; ok {
+		return value
+	}
+	switch {
+	case strings.HasPrefix(text, "fatal"), strings.HasPrefix(text, "crit"):
+		return 2
+	case strings.HasPrefix(text, "err"):
+		return 3
+	case strings.HasPrefix(text, "warn"):
+		return 4
+	case strings.HasPrefix(text, "info"):
+		return 6
+	case strings.HasPrefix(text, "debug"), strings.HasPrefix(text, "trace"):
+		return 7
+	}
+	return 6
+}
+
+// toString writes the value as a string, arrays and maps are written as json.
+func toString(value *common.AnyValue) string {
+	if value == nil {
+		return ""
+	}
+	switch v := value.Value.(type) {
+	case *common.AnyValue_StringValue:
+		return v.StringValue
+	case *common.AnyValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *common.AnyValue_IntValue:
+		return strconv.FormatInt(v.IntValue, 10)
+	case *common.AnyValue_DoubleValue:
+		return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+	}
+	data, err := json.Marshal(toInterface(value))
+	if err != nil {
+		debug.Errorf("[otlp] Unable to convert log body: %s\n", err.Error())
+		return ""
+	}
+	return string(data)
+}
+
+func toInterface(value *common.AnyValue) interface{} {
+	if value == nil {
+		return nil
+	}
+	switch v := value.Value.(type) {
+	case *common.AnyValue_StringValue:
+		return v.StringValue
+	case *common.AnyValue_BoolValue:
+		return v.BoolValue
+	case *common.AnyValue_IntValue:
+		return v.IntValue
+	case *common.AnyValue_DoubleValue:
+		return v.DoubleValue
+	case *common.AnyValue_ArrayValue:
+		values := make([]interface{}, 0)
+		if v.ArrayValue != nil {
+			for _, item := range v.ArrayValue.Values {
+				values = append(values, toInterface(item))
+			}
+		}
+		return values
+	case *common.AnyValue_KvlistValue:
+		values := make(map[string]interface{})
+		if v.KvlistValue != nil {
+			for _, kv := range v.KvlistValue.Values {
+				values[kv.Key] = toInterface(kv.Value)
+			}
+		}
+		return values
+	}
+	return nil
+}
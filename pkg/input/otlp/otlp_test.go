@@ -0,0 +1,203 @@
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	syslog2 "github.com/trevorlinton/remote_syslog2/syslog"
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	logs "go.opentelemetry.io/proto/otlp/logs/v1"
+	resource "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func stringValue(value string) *common.AnyValue {
+	return &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: value}}
+}
+
+func exportRequest() *collogs.ExportLogsServiceRequest {
+	return &collogs.ExportLogsServiceRequest{
+		ResourceLogs: []*logs.ResourceLogs{
+			{
+				Resource: &resource.Resource{
+					Attributes: []*common.KeyValue{
+						{Key: "host.name", Value: stringValue("app.space")},
+						{Key: "service.name", Value: stringValue("web")},
+					},
+				},
+				InstrumentationLibraryLogs: []*logs.InstrumentationLibraryLogs{
+					{
+						Logs: []*logs.LogRecord{
+							{
+								TimeUnixNano:   1600000000250000000,
+								SeverityNumber: logs.SeverityNumber_SEVERITY_NUMBER_ERROR,
+								Body:           stringValue("Test Message"),
+								Attributes: []*common.KeyValue{
+									{Key: "syslog.facility", Value: &common.AnyValue{Value: &common.AnyValue_IntValue{IntValue: 1}}},
+								},
+							},
+							{
+								SeverityText: "WARNING",
+								Body: &common.AnyValue{Value: &common.AnyValue_KvlistValue{KvlistValue: &common.KeyValueList{
+									Values: []*common.KeyValue{{Key: "user", Value: stringValue("alice")}},
+								}}},
+								Attributes: []*common.KeyValue{
+									{Key: "service.name", Value: stringValue("worker")},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func receive(packets chan syslog2.Packet) syslog2.Packet {
+	select {
+	case p := <-packets:
+		return p
+	case <-time.NewTimer(time.Second * 5).C:
+		log.Fatal("Did not receive the packet")
+	}
+	return syslog2.Packet{}
+}
+
+func TestOTLPInput(t *testing.T) {
+	var otlp *OTLPServer
+	var err error
+	Convey("Ensure we can start the otlp server", t, func() {
+		otlp, err = Create(":14317", Mapping{})
+		So(err, ShouldBeNil)
+		So(otlp.mapping, ShouldResemble, DefaultMapping)
+		So(otlp.Dial(), ShouldBeNil)
+		So(otlp.Dial(), ShouldNotBeNil)
+		So(otlp.Pools(), ShouldEqual, true)
+	})
+	Convey("Ensure we can receive logs over grpc", t, func() {
+		conn, err := grpc.Dial("localhost:14317", grpc.WithInsecure())
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		client := collogs.NewLogsServiceClient(conn)
+		_, err = client.Export(context.Background(), exportRequest())
+		So(err, ShouldBeNil)
+		p := receive(otlp.Packets())
+		So(p.Hostname, ShouldEqual, "app.space")
+		So(p.Tag, ShouldEqual, "web")
+		So(p.Severity, ShouldEqual, 3)
+		So(p.Facility, ShouldEqual, 1)
+		So(p.Time.UnixNano(), ShouldEqual, 1600000000250000000)
+		So(p.Message, ShouldEqual, "Test Message")
+		p = receive(otlp.Packets())
+		So(p.Hostname, ShouldEqual, "app.space")
+		So(p.Tag, ShouldEqual, "worker")
+		So(p.Severity, ShouldEqual, 4)
+		So(p.Message, ShouldEqual, `{"user":"alice"}`)
+	})
+	Convey("Ensure we can receive logs over http", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(otlp.HandlerFunc))
+		defer server.Close()
+		data, err := proto.Marshal(exportRequest())
+		So(err, ShouldBeNil)
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		writer.Write(data)
+		writer.Close()
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/logs", &compressed)
+		So(err, ShouldBeNil)
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(receive(otlp.Packets()).Message, ShouldEqual, "Test Message")
+		So(receive(otlp.Packets()).Tag, ShouldEqual, "worker")
+
+		body := `{"resourceLogs":[{"resource":{"attributes":[{"key":"host.name","value":{"stringValue":"api.space"}}]},` +
+			`"instrumentationLibraryLogs":[{"logs":[{"severityNumber":"SEVERITY_NUMBER_DEBUG","body":{"stringValue":"hello"}}]}]}]}`
+		resp, err = http.Post(server.URL+"/v1/logs", "application/json", strings.NewReader(body))
+		So(err, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		p := receive(otlp.Packets())
+		So(p.Hostname, ShouldEqual, "api.space")
+		So(p.Tag, ShouldEqual, "")
+		So(p.Severity, ShouldEqual, 7)
+		So(p.Message, ShouldEqual, "hello")
+
+		resp, err = http.Post(server.URL+"/v1/logs", "application/json", strings.NewReader("{"))
+		So(err, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		So(<-otlp.Errors(), ShouldNotBeNil)
+	})
+	Convey("Ensure hostnames and tags can be mapped from other attributes", t, func() {
+		in, err := Create("", Mapping{Hostname: "{k8s.deployment.name}.{k8s.namespace.name}", Tag: "{service.name}.{service.instance.id}"})
+		So(err, ShouldBeNil)
+		attributes := []*common.KeyValue{
+			{Key: "k8s.deployment.name", Value: stringValue("api")},
+			{Key: "k8s.namespace.name", Value: stringValue("payments")},
+			{Key: "service.name", Value: stringValue("web")},
+			{Key: "service.instance.id", Value: &common.AnyValue{Value: &common.AnyValue_IntValue{IntValue: 2}}},
+		}
+		p := in.packet(&logs.LogRecord{SeverityNumber: logs.SeverityNumber_SEVERITY_NUMBER_FATAL4}, attributes)
+		So(p.Hostname, ShouldEqual, "api.payments")
+		So(p.Tag, ShouldEqual, "web.2")
+		So(p.Severity, ShouldEqual, 0)
+		So(in.Close(), ShouldBeNil)
+	})
+	Convey("Ensure severities map onto syslog severities", t, func() {
+		So(severity(&logs.LogRecord{SeverityNumber: logs.SeverityNumber_SEVERITY_NUMBER_FATAL3}), ShouldEqual, 1)
+		So(severity(&logs.LogRecord{SeverityNumber: logs.SeverityNumber_SEVERITY_NUMBER_FATAL2}), ShouldEqual, 2)
+		So(severity(&logs.LogRecord{SeverityNumber: logs.SeverityNumber_SEVERITY_NUMBER_ERROR4}), ShouldEqual, 3)
+		So(severity(&logs.LogRecord{SeverityNumber: logs.SeverityNumber_SEVERITY_NUMBER_INFO3}), ShouldEqual, 5)
+		So(severity(&logs.LogRecord{SeverityNumber: logs.SeverityNumber_SEVERITY_NUMBER_INFO}), ShouldEqual, 6)
+		So(severity(&logs.LogRecord{SeverityNumber: logs.SeverityNumber_SEVERITY_NUMBER_TRACE}), ShouldEqual, 7)
+		So(severity(&logs.LogRecord{SeverityText: "notice"}), ShouldEqual, 5)
+		So(severity(&logs.LogRecord{SeverityText: "Error"}), ShouldEqual, 3)
+		So(severity(&logs.LogRecord{}), ShouldEqual, 6)
+	})
+	Convey("Ensure close waits for requests that are still sending packets", t, func() {
+		in, err := Create("", Mapping{})
+		So(err, ShouldBeNil)
+		records := make([]*logs.LogRecord, 0)
+		for i := 0; i < 150; i++ {
+			records = append(records, &logs.LogRecord{Body: stringValue("hello")})
+		}
+		data, err := proto.Marshal(&collogs.ExportLogsServiceRequest{
+			ResourceLogs: []*logs.ResourceLogs{{InstrumentationLibraryLogs: []*logs.InstrumentationLibraryLogs{{Logs: records}}}},
+		})
+		So(err, ShouldBeNil)
+		handled := make(chan struct{})
+		go func() {
+			in.HandlerFunc(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(data)))
+			close(handled)
+		}()
+		for len(in.Packets()) < cap(in.Packets()) {
+			time.Sleep(time.Millisecond * 10)
+		}
+		closed := make(chan error, 1)
+		go func() { closed <- in.Close() }()
+		select {
+		case err := <-closed:
+			So(err, ShouldBeNil)
+		case <-time.NewTimer(time.Second * 2).C:
+			So(false, ShouldEqual, true)
+		}
+		<-handled
+		So(len(in.Packets()), ShouldEqual, 100)
+		response := httptest.NewRecorder()
+		in.HandlerFunc(response, httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(data)))
+		So(response.Code, ShouldEqual, http.StatusServiceUnavailable)
+	})
+	Convey("Ensure we can close the otlp server", t, func() {
+		So(otlp.Close(), ShouldBeNil)
+	})
+}
@@ -7,7 +7,6 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -54,8 +53,9 @@ func toURL(endpoint string) string {
 	return strings.Replace(strings.Replace(endpoint, "elasticsearch://", "https://", 1), "es://", "https://", 1)
 }
 
-// Create a new elasticsearch endpoint
-func Create(endpoint string, errorsCh chan<- error) (*Syslog, error) {
+// Create a new elasticsearch endpoint, the node is added to each document as the logtrain
+// node it was sent from (defaults to logtrain) and akkeris adds the akkeris system tag.
+func Create(endpoint string, errorsCh chan<- error, node string, akkeris bool) (*Syslog, error) {
 	if Test(endpoint) == false {
 		return nil, errors.New("Invalid endpoint")
 	}
@@ -66,7 +66,6 @@ func Create(endpoint string, errorsCh chan<- error) (*Syslog, error) {
 	if strings.HasPrefix(u.Path, "/_bulk") == false {
 		u.Path = u.Path + "/_bulk"
 	}
-	node := os.Getenv("NODE") // TODO: pass this into create
 	if node == "" {
 		node = "logtrain"
 	}
@@ -79,7 +78,7 @@ func Create(endpoint string, errorsCh chan<- error) (*Syslog, error) {
 		packets:  make(chan syslog.Packet, 10),
 		errors:   errorsCh,
 		stop:     make(chan struct{}, 1),
-		akkeris:  os.Getenv("AKKERIS") == "true", // TODO: pass this in to Create for all outputs.
+		akkeris:  akkeris,
 	}, nil
 }
 
@@ -0,0 +1,339 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/akkeris/logtrain/internal/debug"
+	"github.com/akkeris/logtrain/internal/forward"
+	"github.com/google/uuid"
+	syslog "github.com/trevorlinton/remote_syslog2/syslog"
+	"github.com/vmihailenco/msgpack/v5"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Syslog fluent forward output struct
+type Syslog struct {
+	url          url.URL
+	endpoint     string
+	tag          string // template for the fluent tag
+	ack          bool
+	ackTimeout   time.Duration
+	compress     bool
+	batchSize    int
+	batchTimeout time.Duration
+	conn         net.Conn
+	decoder      *msgpack.Decoder
+	batch        []syslog.Packet
+	packets      chan syslog.Packet
+	errors       chan<- error
+	stop         chan struct{}
+	done         chan struct{}
+	closed       bool
+}
+
+// chunk is a packed forward message for one fluent tag
+type chunk struct {
+	tag     string
+	size    int
+	entries *bytes.Buffer
+	encoder *msgpack.Encoder
+}
+
+var syslogSchemas = []string{"forward://"}
+
+const defaultBatchSize = 500
+const defaultBatchTimeout = time.Second
+const defaultAckTimeout = 30 * time.Second
+
+// Test the schema to see if its a fluent forward schema
+func Test(endpoint string) bool {
+	for _, schema := range syslogSchemas {
+		if strings.HasPrefix(strings.ToLower(endpoint), schema) == true {
+			return true
+		}
+	}
+	return false
+}
+
+// Create a new fluent forward output, the endpoint is in the form of
+// forward://host:24224?[tag=]&[ack=true]&[ack_timeout=]&[compress=gzip]&[batch_size=]&[batch_timeout=]
+func Create(endpoint string, errorsCh chan<- error) (*Syslog, error) {
+	if Test(endpoint) == false {
+		return nil, errors.New("Invalid endpoint")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Port() == "" {
+		u.Host = u.Host + ":24224"
+	}
+	query := u.Query()
+	batchSize := defaultBatchSize
+	if query.Get("batch_size") != "" {
+		if batchSize, err = strconv.Atoi(query.Get("batch_size")); err != nil {
+			return nil, err
+		}
+	}
+	batchTimeout := defaultBatchTimeout
+	if query.Get("batch_timeout") != "" {
+		if batchTimeout, err = time.ParseDuration(query.Get("batch_timeout")); err != nil {
+			return nil, err
+		}
+	}
+	ackTimeout := defaultAckTimeout
+	if query.Get("ack_timeout") != "" {
+		if ackTimeout, err = time.ParseDuration(query.Get("ack_timeout")); err != nil {
+			return nil, err
+		}
+	}
+	if batchSize < 1 || batchTimeout <= 0 || ackTimeout <= 0 {
+		return nil, errors.New("batch_size, batch_timeout and ack_timeout must be more than 0")
+	}
+	compress := strings.ToLower(query.Get("compress"))
+	if compress != "" && compress != "none" && compress != "gzip" {
+		return nil, errors.New("unknown compression " + compress + ", expected gzip or none")
+	}
+	tag := query.Get("tag")
+	if tag == "" {
+		tag = "{hostname}"
+	}
+	return &Syslog{
+		endpoint:     endpoint,
+		url:          *u,
+		tag:          tag,
+		ack:          query.Get("ack") == "true",
+		ackTimeout:   ackTimeout,
+		compress:     compress == "gzip",
+		batchSize:    batchSize,
+		batchTimeout: batchTimeout,
+		batch:        make([]syslog.Packet, 0),
+		packets:      make(chan syslog.Packet, 10),
+		errors:       errorsCh,
+		stop:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		closed:       false,
+	}, nil
+}
+
+func (log *Syslog) connect() error {
+	conn, err := net.DialTimeout("tcp", log.url.Host, time.Second*4)
+	if err != nil {
+		return err
+	}
+	log.conn = conn
+	log.decoder = msgpack.NewDecoder(bufio.NewReader(conn))
+	return nil
+}
+
+// Dial connects to the fluent forward endpoint
+func (log *Syslog) Dial() error {
+	if err := log.connect(); err != nil {
+		return err
+	}
+	go log.loop()
+	return nil
+}
+
+// Close sends the packets waiting to be sent and closes the connection
+func (log *Syslog) Close() error {
+	if log.closed {
+		return errors.New("this output is already closed")
+	}
+	log.closed = true
+	if log.conn == nil {
+		return nil
+	}
+	close(log.stop)
+	<-log.done
+	return log.conn.Close()
+}
+
+// Pools returns whether the output pools connections
+func (log *Syslog) Pools() bool {
+	return true
+}
+
+// Packets returns a channel where packets can be sent to the fluent forward output handler
+func (log *Syslog) Packets() chan syslog.Packet {
+	return log.packets
+}
+
+func (log *Syslog) fluentTag(p syslog.Packet) string {
+	return strings.Replace(strings.Replace(log.tag, "{hostname}", p.Hostname, -1), "{tag}", p.Tag, -1)
+}
+
+// chunks groups the packets by their fluent tag into packed forward entries
+func (log *Syslog) chunks(packets []syslog.Packet) ([]*chunk, error) {
+	chunks := make([]*chunk, 0)
+	tags := make(map[string]*chunk)
+	for _, p := range packets {
+		tag := log.fluentTag(p)
+		c, ok := tags[tag]
+		if !ok {
+			c = &chunk{tag: tag, entries: bytes.NewBuffer([]byte{})}
+			c.encoder = msgpack.NewEncoder(c.entries)
+			tags[tag] = c
+			chunks = append(chunks, c)
+		}
+		t := p.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+		record := map[string]interface{}{
+			"host":     p.Hostname,
+			"ident":    p.Tag,
+			"message":  p.Message,
+			"severity": int(p.Severity),
+			"facility": int(p.Facility),
+		}
+		if err := c.encoder.Encode([]interface{}{&forward.EventTime{Time: t}, record}); err != nil {
+			return nil, err
+		}
+		c.size++
+	}
+	return chunks, nil
+}
+
+// message creates the packed forward (or compressed packed forward) message for the chunk
+func (log *Syslog) message(c *chunk, id string) ([]byte, error) {
+	entries := c.entries.Bytes()
+	options := map[string]interface{}{"size": c.size}
+	if log.compress {
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(entries); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		entries = buffer.Bytes()
+		options["compressed"] = "gzip"
+	}
+	if log.ack {
+		options["chunk"] = id
+	}
+	return msgpack.Marshal([]interface{}{c.tag, entries, options})
+}
+
+// write sends the message and waits for it to be acknowledged if acks are enabled
+func (log *Syslog) write(message []byte, id string) error {
+	if _, err := log.conn.Write(message); err != nil {
+		return err
+	}
+	if !log.ack {
+		return nil
+	}
+	log.conn.SetReadDeadline(time.Now().Add(log.ackTimeout))
+	defer log.conn.SetReadDeadline(time.Time{})
+	response, err := log.decoder.DecodeMap()
+	if err != nil {
+		return err
+	}
+	if ack, ok := response["ack"].(string); !ok || ack != id {
+		return errors.New("fluent forward endpoint did not acknowledge chunk " + id)
+	}
+	return nil
+}
+
+// sendChunk writes the chunk, if it can't be written the connection is re-established and
+// the chunk is written once more.
+func (log *Syslog) sendChunk(c *chunk) error {
+	id := uuid.New().String()
+	message, err := log.message(c, id)
+	if err != nil {
+		return err
+	}
+	if err := log.write(message, id); err != nil {
+		debug.Debugf("[forward/output]: Reconnecting to %s after error: %s\n", log.url.Host, err.Error())
+		log.conn.Close()
+		if err := log.connect(); err != nil {
+			return err
+		}
+		return log.write(message, id)
+	}
+	return nil
+}
+
+// send writes the packets waiting to be sent, every chunk is attempted even if an earlier
+// one fails and the failures are reported together.
+func (log *Syslog) send() error {
+	if len(log.batch) == 0 {
+		return nil
+	}
+	chunks, err := log.chunks(log.batch)
+	log.batch = make([]syslog.Packet, 0)
+	if err != nil {
+		return err
+	}
+	failed := make([]string, 0)
+	for _, c := range chunks {
+		if err := log.sendChunk(c); err != nil {
+			failed = append(failed, c.tag+": "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to send %d of %d chunks to %s (%s)", len(failed), len(chunks), log.url.Host, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// error reports the error unless the output is closed first.
+func (log *Syslog) error(err error) {
+	select {
+	case <-log.stop:
+	default:
+		select {
+		case log.errors <- err:
+		case <-log.stop:
+		}
+	}
+}
+
+func (log *Syslog) loop() {
+	ticker := time.NewTicker(log.batchTimeout)
+	defer ticker.Stop()
+	defer close(log.done)
+	for {
+		select {
+		case p, ok := <-log.packets:
+			if !ok {
+				return
+			}
+			log.batch = append(log.batch, p)
+			if len(log.batch) >= log.batchSize {
+				if err := log.send(); err != nil {
+					log.error(err)
+				}
+			}
+		case <-ticker.C:
+			if err := log.send(); err != nil {
+				log.error(err)
+			}
+		case <-log.stop:
+			for done := false; !done; {
+				select {
+				case p := <-log.packets:
+					log.batch = append(log.batch, p)
+				default:
+					done = true
+				}
+			}
+			if err := log.send(); err != nil {
+				select {
+				case log.errors <- err:
+				default:
+				}
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"github.com/akkeris/logtrain/internal/forward"
+	. "github.com/smartystreets/goconvey/convey"
+	syslog2 "github.com/trevorlinton/remote_syslog2/syslog"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+type fluentMessage struct {
+	Tag     string
+	Options map[string]interface{}
+	Entries [][]interface{}
+}
+
+// TestFluentServer is a fluent forward server that only understands packed forward messages
+type TestFluentServer struct {
+	listener  net.Listener
+	Incoming  chan fluentMessage
+	WrongAck  bool
+	RejectTag string
+}
+
+func (server *TestFluentServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.read(conn)
+	}
+}
+
+func (server *TestFluentServer) read(conn net.Conn) {
+	defer conn.Close()
+	decoder := msgpack.NewDecoder(bufio.NewReader(conn))
+	encoder := msgpack.NewEncoder(conn)
+	for {
+		var message []interface{}
+		if err := decoder.Decode(&message); err != nil {
+			return
+		}
+		options := message[2].(map[string]interface{})
+		var reader io.Reader = bytes.NewReader(message[1].([]byte))
+		if options["compressed"] == "gzip" {
+			gz, err := gzip.NewReader(reader)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			reader = gz
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		entries := make([][]interface{}, 0)
+		entryDecoder := msgpack.NewDecoder(bytes.NewReader(data))
+		for {
+			var e []interface{}
+			if err := entryDecoder.Decode(&e); err == io.EOF {
+				break
+			} else if err != nil {
+				log.Fatalln(err)
+			}
+			entries = append(entries, e)
+		}
+		server.Incoming <- fluentMessage{Tag: message[0].(string), Options: options, Entries: entries}
+		if chunk, ok := options["chunk"]; ok {
+			if server.WrongAck || message[0].(string) == server.RejectTag {
+				chunk = "wrong"
+			}
+			encoder.Encode(map[string]interface{}{"ack": chunk})
+		}
+	}
+}
+
+func TestForwardOutput(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer listener.Close()
+	server := TestFluentServer{listener: listener, Incoming: make(chan fluentMessage, 10)}
+	go server.serve()
+	host := listener.Addr().String()
+	packet := syslog2.Packet{
+		Severity: 3,
+		Facility: 1,
+		Hostname: "app.space",
+		Tag:      "web.1",
+		Time:     time.Unix(1600000000, 250000000),
+		Message:  "Test Message",
+	}
+
+	Convey("Ensure forward endpoints are validated", t, func() {
+		errorCh := make(chan error, 1)
+		_, err := Create("fluent://localhost:24224", errorCh)
+		So(err, ShouldNotBeNil)
+		_, err = Create("forward://localhost?compress=lz4", errorCh)
+		So(err, ShouldNotBeNil)
+		_, err = Create("forward://localhost?batch_size=0", errorCh)
+		So(err, ShouldNotBeNil)
+		out, err := Create("forward://localhost", errorCh)
+		So(err, ShouldBeNil)
+		So(out.url.Host, ShouldEqual, "localhost:24224")
+		So(out.tag, ShouldEqual, "{hostname}")
+		So(out.ack, ShouldEqual, false)
+		So(out.Pools(), ShouldEqual, true)
+	})
+	Convey("Ensure packets are sent as packed forward messages", t, func() {
+		errorCh := make(chan error, 1)
+		out, err := Create("forward://"+host+"?tag=logs.{hostname}&batch_timeout=10ms", errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		other := packet
+		other.Hostname = "api.space"
+		out.Packets() <- packet
+		out.Packets() <- other
+		out.Packets() <- packet
+		messages := make(map[string]fluentMessage)
+		for len(messages) < 2 {
+			select {
+			case message := <-server.Incoming:
+				messages[message.Tag] = message
+			case err := <-errorCh:
+				log.Fatal(err.Error())
+			case <-time.NewTimer(time.Second * 5).C:
+				log.Fatal("Did not receive the messages")
+			}
+		}
+		message := messages["logs.app.space"]
+		So(len(message.Entries), ShouldEqual, 2)
+		So(message.Options["chunk"], ShouldBeNil)
+		So(message.Entries[0][0].(*forward.EventTime).UnixNano(), ShouldEqual, packet.Time.UnixNano())
+		record := message.Entries[0][1].(map[string]interface{})
+		So(record["host"], ShouldEqual, "app.space")
+		So(record["ident"], ShouldEqual, "web.1")
+		So(record["message"], ShouldEqual, "Test Message")
+		So(record["severity"], ShouldEqual, 3)
+		So(len(messages["logs.api.space"].Entries), ShouldEqual, 1)
+		So(out.Close(), ShouldBeNil)
+		So(out.Close(), ShouldNotBeNil)
+	})
+	Convey("Ensure compressed chunks are acknowledged", t, func() {
+		errorCh := make(chan error, 1)
+		out, err := Create("forward://"+host+"?ack=true&compress=gzip&batch_size=1", errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		out.Packets() <- packet
+		message := <-server.Incoming
+		So(message.Tag, ShouldEqual, "app.space")
+		So(message.Options["compressed"], ShouldEqual, "gzip")
+		So(message.Options["chunk"], ShouldNotBeNil)
+		So(len(message.Entries), ShouldEqual, 1)
+		So(out.Close(), ShouldBeNil)
+
+		server.WrongAck = true
+		out, err = Create("forward://"+host+"?ack=true&batch_size=1", errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		out.Packets() <- packet
+		select {
+		case err := <-errorCh:
+			So(err.Error(), ShouldContainSubstring, "did not acknowledge")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive an error")
+		}
+		// the chunk is written once more after reconnecting
+		So(len((<-server.Incoming).Entries), ShouldEqual, 1)
+		So(len((<-server.Incoming).Entries), ShouldEqual, 1)
+		So(out.Close(), ShouldBeNil)
+		server.WrongAck = false
+	})
+	Convey("Ensure every chunk is attempted when one fails", t, func() {
+		rejecting, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer rejecting.Close()
+		server := TestFluentServer{listener: rejecting, Incoming: make(chan fluentMessage, 10), RejectTag: "api.space"}
+		go server.serve()
+		errorCh := make(chan error, 1)
+		out, err := Create("forward://"+rejecting.Addr().String()+"?ack=true&batch_size=2", errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		other := packet
+		other.Hostname = "api.space"
+		out.Packets() <- other
+		out.Packets() <- packet
+		select {
+		case err := <-errorCh:
+			So(err.Error(), ShouldContainSubstring, "unable to send 1 of 2 chunks")
+			So(err.Error(), ShouldContainSubstring, "api.space")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive an error")
+		}
+		tags := make([]string, 0)
+		for i := 0; i < 3; i++ {
+			tags = append(tags, (<-server.Incoming).Tag)
+		}
+		So(tags, ShouldResemble, []string{"api.space", "api.space", "app.space"})
+		So(out.Close(), ShouldBeNil)
+	})
+	Convey("Ensure we can close while errors are not read", t, func() {
+		rejecting, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer rejecting.Close()
+		server := TestFluentServer{listener: rejecting, Incoming: make(chan fluentMessage, 10), WrongAck: true}
+		go server.serve()
+		out, err := Create("forward://"+rejecting.Addr().String()+"?ack=true&batch_size=1", make(chan error))
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		out.Packets() <- packet
+		out.Packets() <- packet
+		<-time.NewTimer(time.Millisecond * 250).C
+		closed := make(chan error, 1)
+		go func() { closed <- out.Close() }()
+		select {
+		case err := <-closed:
+			So(err, ShouldBeNil)
+		case <-time.NewTimer(time.Second * 5).C:
+			So(false, ShouldEqual, true)
+		}
+	})
+}
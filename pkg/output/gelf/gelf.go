@@ -0,0 +1,356 @@
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"github.com/akkeris/logtrain/internal/debug"
+	syslog "github.com/trevorlinton/remote_syslog2/syslog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Syslog gelf output struct
+type Syslog struct {
+	url         url.URL
+	endpoint    string
+	transport   string // udp, tcp or http(s)
+	compression string // none, gzip or zlib
+	chunkSize   int
+	conn        net.Conn
+	client      *http.Client
+	packets     chan syslog.Packet
+	errors      chan<- error
+	stop        chan struct{}
+	mutex       sync.Mutex // guards conn and closed, the loop reconnects while Close may be called
+	closed      bool
+}
+
+// message is a GELF 1.1 message, see https://docs.graylog.org/en/latest/pages/gelf.html
+type message struct {
+	Version      string  `json:"version"`
+	Host         string  `json:"host"`
+	ShortMessage string  `json:"short_message"`
+	FullMessage  string  `json:"full_message,omitempty"`
+	Timestamp    float64 `json:"timestamp"`
+	Level        int     `json:"level"`
+	Tag          string  `json:"_tag,omitempty"`
+	Facility     int     `json:"_facility"`
+}
+
+var syslogSchemas = []string{"gelf+udp://", "gelf+tcp://", "gelf+http://", "gelf+https://"}
+
+const defaultChunkSize = 1420 // fits in the MTU of most networks
+const maxChunks = 128
+
+// Test the schema to see if its a gelf schema
+func Test(endpoint string) bool {
+	for _, schema := range syslogSchemas {
+		if strings.HasPrefix(strings.ToLower(endpoint), schema) == true {
+			return true
+		}
+	}
+	return false
+}
+
+// Create a new gelf output, the endpoint is in the form of gelf+udp://host:port?[compress=gzip|zlib|none]&[chunk_size=],
+// gelf+tcp://host:port or gelf+http(s)://host:port/gelf?[compress=gzip|zlib|none]
+func Create(endpoint string, errorsCh chan<- error) (*Syslog, error) {
+	if Test(endpoint) == false {
+		return nil, errors.New("Invalid endpoint")
+	}
+	u, err := url.Parse(endpoint[len("gelf+"):])
+	if err != nil {
+		return nil, err
+	}
+	transport := strings.ToLower(u.Scheme)
+	compression := strings.ToLower(u.Query().Get("compress"))
+	if compression == "" {
+		if transport == "udp" {
+			compression = "gzip"
+		} else {
+			compression = "none"
+		}
+	}
+	if compression != "none" && compression != "gzip" && compression != "zlib" {
+		return nil, errors.New("unknown compression " + compression + ", expected gzip, zlib or none")
+	}
+	if transport == "tcp" && compression != "none" {
+		return nil, errors.New("gelf over tcp does not support compression")
+	}
+	chunkSize := defaultChunkSize
+	if u.Query().Get("chunk_size") != "" {
+		if chunkSize, err = strconv.Atoi(u.Query().Get("chunk_size")); err != nil {
+			return nil, err
+		}
+		if chunkSize <= 12 {
+			return nil, errors.New("chunk_size must be more than 12 bytes")
+		}
+	}
+	if transport == "http" || transport == "https" {
+		query := u.Query()
+		query.Del("compress")
+		u.RawQuery = query.Encode()
+		if u.Path == "" {
+			u.Path = "/gelf"
+		}
+	}
+	return &Syslog{
+		endpoint:    endpoint,
+		url:         *u,
+		transport:   transport,
+		compression: compression,
+		chunkSize:   chunkSize,
+		client:      &http.Client{},
+		packets:     make(chan syslog.Packet, 10),
+		errors:      errorsCh,
+		stop:        make(chan struct{}, 1),
+		closed:      false,
+	}, nil
+}
+
+// Dial connects to the gelf endpoint
+func (log *Syslog) Dial() error {
+	if log.transport == "udp" || log.transport == "tcp" {
+		conn, err := net.DialTimeout(log.transport, log.url.Host, time.Second*4)
+		if err != nil {
+			return err
+		}
+		log.conn = conn
+	}
+	go log.loop()
+	return nil
+}
+
+// Close closes the gelf output
+func (log *Syslog) Close() error {
+	log.mutex.Lock()
+	if log.closed {
+		log.mutex.Unlock()
+		return errors.New("this output is already closed")
+	}
+	log.closed = true
+	conn := log.conn
+	log.mutex.Unlock()
+	log.stop <- struct{}{}
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+// isClosed returns whether Close has been called.
+func (log *Syslog) isClosed() bool {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.closed
+}
+
+// connection returns the current tcp or udp connection.
+func (log *Syslog) connection() net.Conn {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.conn
+}
+
+// Pools returns whether the output pools connections
+func (log *Syslog) Pools() bool {
+	return log.transport == "http" || log.transport == "https"
+}
+
+// Packets returns a channel where packets can be sent to the gelf output handler
+func (log *Syslog) Packets() chan syslog.Packet {
+	return log.packets
+}
+
+// convert creates a gelf message from the packet, the first line of the message is the
+// short message and multi line messages are kept whole in the full message.
+func convert(p syslog.Packet) message {
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	m := message{
+		Version:      "1.1",
+		Host:         p.Hostname,
+		ShortMessage: p.Message,
+		Timestamp:    float64(t.UnixNano()/int64(time.Millisecond)) / 1000,
+		Level:        int(p.Severity),
+		Tag:          p.Tag,
+		Facility:     int(p.Facility),
+	}
+	if i := strings.IndexAny(p.Message, "\r\n"); i > -1 {
+		m.ShortMessage = p.Message[:i]
+		m.FullMessage = p.Message
+	}
+	if m.Host == "" {
+		m.Host = "unknown"
+	}
+	if strings.TrimSpace(m.ShortMessage) == "" {
+		m.ShortMessage = "-"
+	}
+	return m
+}
+
+func (log *Syslog) compress(payload []byte) ([]byte, error) {
+	if log.compression == "none" {
+		return payload, nil
+	}
+	var buffer bytes.Buffer
+	var err error
+	if log.compression == "zlib" {
+		writer := zlib.NewWriter(&buffer)
+		if _, err = writer.Write(payload); err == nil {
+			err = writer.Close()
+		}
+	} else {
+		writer := gzip.NewWriter(&buffer)
+		if _, err = writer.Write(payload); err == nil {
+			err = writer.Close()
+		}
+	}
+	return buffer.Bytes(), err
+}
+
+// chunk splits the payload into gelf chunks if it does not fit in one datagram.
+func (log *Syslog) chunk(payload []byte) ([][]byte, error) {
+	if len(payload) <= log.chunkSize {
+		return [][]byte{payload}, nil
+	}
+	size := log.chunkSize - 12 // the chunk header is 12 bytes
+	count := (len(payload) + size - 1) / size
+	if count > maxChunks {
+		return nil, errors.New("message is too large to be sent over udp, it needs " + strconv.Itoa(count) + " chunks")
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	chunks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunk := make([]byte, 0, 12+end-i*size)
+		chunk = append(chunk, 0x1e, 0x0f)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, payload[i*size:end]...)
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+func (log *Syslog) send(p syslog.Packet) error {
+	payload, err := json.Marshal(convert(p))
+	if err != nil {
+		return err
+	}
+	switch log.transport {
+	case "tcp":
+		conn := log.connection()
+		if conn == nil {
+			return errors.New("not connected to " + log.url.Host)
+		}
+		_, err := conn.Write(append(payload, 0))
+		return err
+	case "udp":
+		compressed, err := log.compress(payload)
+		if err != nil {
+			return err
+		}
+		chunks, err := log.chunk(compressed)
+		if err != nil {
+			return err
+		}
+		conn := log.connection()
+		for _, chunk := range chunks {
+			if _, err := conn.Write(chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	compressed, err := log.compress(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, log.url.String(), bytes.NewReader(compressed))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if log.compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	} else if log.compression == "zlib" {
+		req.Header.Set("Content-Encoding", "deflate")
+	}
+	resp, err := log.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices || resp.StatusCode < http.StatusOK {
+		return errors.New("invalid response from endpoint: " + resp.Status)
+	}
+	return nil
+}
+
+// reconnect replaces a tcp connection that failed to write.
+func (log *Syslog) reconnect() {
+	debug.Debugf("[gelf/output]: Reconnecting to %s\n", log.url.Host)
+	log.mutex.Lock()
+	if log.closed {
+		log.mutex.Unlock()
+		return
+	}
+	if log.conn != nil {
+		log.conn.Close()
+		log.conn = nil
+	}
+	log.mutex.Unlock()
+	conn, err := net.DialTimeout(log.transport, log.url.Host, time.Second*4)
+	if err != nil {
+		debug.Debugf("[gelf/output]: Unable to reconnect to %s: %s\n", log.url.Host, err.Error())
+		return
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if log.closed {
+		// Close was called while dialing, do not leak the new connection.
+		conn.Close()
+		return
+	}
+	log.conn = conn
+}
+
+func (log *Syslog) loop() {
+	for {
+		select {
+		case p, ok := <-log.packets:
+			if !ok {
+				return
+			}
+			if err := log.send(p); err != nil {
+				if log.isClosed() {
+					return
+				}
+				log.errors <- err
+				if log.transport == "tcp" {
+					log.reconnect()
+				}
+			}
+		case <-log.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package gelf
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	syslog2 "github.com/trevorlinton/remote_syslog2/syslog"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type gelfRequest struct {
+	Path     string
+	Encoding string
+	Body     []byte
+}
+
+type TestGELFServer struct {
+	Incoming chan gelfRequest
+}
+
+func (server *TestGELFServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	req.Body.Close()
+	server.Incoming <- gelfRequest{Path: req.URL.Path, Encoding: req.Header.Get("Content-Encoding"), Body: body}
+	res.WriteHeader(http.StatusAccepted)
+}
+
+func decompress(data []byte) []byte {
+	var reader io.Reader
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		reader = r
+	} else if len(data) > 2 && data[0] == 0x78 {
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		reader = r
+	} else {
+		return data
+	}
+	result, err := ioutil.ReadAll(reader)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return result
+}
+
+// readUDP reads datagrams until a whole (possibly chunked) message is received.
+func readUDP(conn net.PacketConn) ([]byte, int) {
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	chunks := make(map[int][]byte)
+	for {
+		buffer := make([]byte, 65536)
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		datagram := buffer[:n]
+		if datagram[0] != 0x1e || datagram[1] != 0x0f {
+			return decompress(datagram), 0
+		}
+		chunks[int(datagram[10])] = datagram[12:]
+		if len(chunks) == int(datagram[11]) {
+			var payload []byte
+			for i := 0; i < len(chunks); i++ {
+				payload = append(payload, chunks[i]...)
+			}
+			return decompress(payload), len(chunks)
+		}
+	}
+}
+
+func TestGELFOutput(t *testing.T) {
+	packet := syslog2.Packet{
+		Severity: 3,
+		Facility: 1,
+		Hostname: "app.space",
+		Tag:      "web.1",
+		Time:     time.Unix(1600000000, 250000000),
+		Message:  "Test Message",
+	}
+
+	Convey("Ensure gelf endpoints are validated", t, func() {
+		errorCh := make(chan error, 1)
+		So(Test("gelf+udp://localhost:12201"), ShouldEqual, true)
+		So(Test("syslog+udp://localhost:12201"), ShouldEqual, false)
+		_, err := Create("syslog+udp://localhost:12201", errorCh)
+		So(err, ShouldNotBeNil)
+		_, err = Create("gelf+udp://localhost:12201?compress=lz4", errorCh)
+		So(err, ShouldNotBeNil)
+		_, err = Create("gelf+tcp://localhost:12201?compress=gzip", errorCh)
+		So(err, ShouldNotBeNil)
+		_, err = Create("gelf+udp://localhost:12201?chunk_size=12", errorCh)
+		So(err, ShouldNotBeNil)
+		out, err := Create("gelf+udp://localhost:12201", errorCh)
+		So(err, ShouldBeNil)
+		So(out.compression, ShouldEqual, "gzip")
+		So(out.chunkSize, ShouldEqual, defaultChunkSize)
+		So(out.Pools(), ShouldEqual, false)
+		out, err = Create("gelf+https://localhost:12201?compress=zlib", errorCh)
+		So(err, ShouldBeNil)
+		So(out.url.String(), ShouldEqual, "https://localhost:12201/gelf")
+		So(out.Pools(), ShouldEqual, true)
+	})
+	Convey("Ensure packets are converted to gelf messages", t, func() {
+		data, err := json.Marshal(convert(packet))
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `{"version":"1.1","host":"app.space","short_message":"Test Message","timestamp":1600000000.25,"level":3,"_tag":"web.1","_facility":1}`)
+		multiline := packet
+		multiline.Message = "Exception: failed\n  at main.go:10\n  at main.go:20"
+		m := convert(multiline)
+		So(m.ShortMessage, ShouldEqual, "Exception: failed")
+		So(m.FullMessage, ShouldEqual, multiline.Message)
+	})
+	Convey("Ensure packets are sent over udp and chunked", t, func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		errorCh := make(chan error, 1)
+		out, err := Create("gelf+udp://"+conn.LocalAddr().String()+"?compress=zlib", errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		out.Packets() <- packet
+		data, chunks := readUDP(conn)
+		So(chunks, ShouldEqual, 0)
+		So(string(data), ShouldContainSubstring, `"short_message":"Test Message"`)
+		So(out.Close(), ShouldBeNil)
+		So(out.Close(), ShouldNotBeNil)
+
+		out, err = Create("gelf+udp://"+conn.LocalAddr().String()+"?compress=none&chunk_size=100", errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		large := packet
+		large.Message = strings.Repeat("a", 500)
+		out.Packets() <- large
+		data, chunks = readUDP(conn)
+		So(chunks, ShouldBeGreaterThan, 1)
+		var m message
+		So(json.Unmarshal(data, &m), ShouldBeNil)
+		So(m.ShortMessage, ShouldEqual, large.Message)
+
+		large.Message = strings.Repeat("a", 100*maxChunks)
+		out.Packets() <- large
+		select {
+		case err := <-errorCh:
+			So(err.Error(), ShouldContainSubstring, "too large")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive an error")
+		}
+		So(out.Close(), ShouldBeNil)
+	})
+	Convey("Ensure packets are sent over tcp as null delimited messages", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		errorCh := make(chan error, 1)
+		out, err := Create("gelf+tcp://"+listener.Addr().String(), errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		conn, err := listener.Accept()
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		out.Packets() <- packet
+		out.Packets() <- packet
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		reader := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			data, err := reader.ReadBytes(0)
+			So(err, ShouldBeNil)
+			var m message
+			So(json.Unmarshal(data[:len(data)-1], &m), ShouldBeNil)
+			So(m.Host, ShouldEqual, "app.space")
+			So(m.Level, ShouldEqual, 3)
+		}
+		So(out.Close(), ShouldBeNil)
+	})
+	Convey("Ensure we can close while reconnecting over tcp", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+		errorCh := make(chan error, 10)
+		out, err := Create("gelf+tcp://"+listener.Addr().String(), errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		go func() {
+			for i := 0; i < 10; i++ {
+				out.Packets() <- packet
+				time.Sleep(time.Millisecond * 10)
+			}
+		}()
+		select {
+		case <-errorCh:
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive an error")
+		}
+		So(out.Close(), ShouldBeNil)
+	})
+	Convey("Ensure packets are sent over http", t, func() {
+		testServer := TestGELFServer{Incoming: make(chan gelfRequest, 10)}
+		server := httptest.NewServer(&testServer)
+		defer server.Close()
+		errorCh := make(chan error, 1)
+		out, err := Create("gelf+http://"+server.Listener.Addr().String()+"?compress=gzip", errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		out.Packets() <- packet
+		select {
+		case req := <-testServer.Incoming:
+			So(req.Path, ShouldEqual, "/gelf")
+			So(req.Encoding, ShouldEqual, "gzip")
+			So(string(decompress(req.Body)), ShouldContainSubstring, `"_tag":"web.1"`)
+		case err := <-errorCh:
+			log.Fatal(err.Error())
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive the message")
+		}
+		So(out.Close(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,387 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/Shopify/sarama"
+	"github.com/akkeris/logtrain/internal/debug"
+	syslog "github.com/trevorlinton/remote_syslog2/syslog"
+	"github.com/xdg/scram"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Syslog kafka output struct
+type Syslog struct {
+	endpoint string
+	topic    string
+	brokers  []string
+	key      string
+	format   string
+	config   *sarama.Config
+	producer sarama.AsyncProducer
+	packets  chan syslog.Packet
+	errors   chan<- error
+	stop     chan struct{}
+	done     chan struct{}
+	closed   bool
+}
+
+var syslogSchemas = []string{"kafka://", "kafka+tls://"}
+
+const defaultPort = "9092"
+const defaultBatchSize = 500
+const defaultBatchTimeout = time.Second
+
+// Test the schema to see if its a kafka schema
+func Test(endpoint string) bool {
+	for _, schema := range syslogSchemas {
+		if strings.HasPrefix(strings.ToLower(endpoint), schema) == true {
+			return true
+		}
+	}
+	return false
+}
+
+// parse splits a kafka://[user:password@]broker1[:port],broker2[:port]/topic[?options] endpoint,
+// url.Parse can't be used as it does not allow more than one host.
+func parse(endpoint string) (brokers []string, topic string, user *url.Userinfo, query url.Values, err error) {
+	rest := endpoint[strings.Index(endpoint, "://")+3:]
+	if i := strings.Index(rest, "?"); i > -1 {
+		if query, err = url.ParseQuery(rest[i+1:]); err != nil {
+			return nil, "", nil, nil, err
+		}
+		rest = rest[:i]
+	} else {
+		query = url.Values{}
+	}
+	i := strings.Index(rest, "/")
+	if i == -1 || strings.Trim(rest[i+1:], "/") == "" {
+		return nil, "", nil, nil, errors.New("a topic is required, e.g. kafka://broker/topic")
+	}
+	hosts := rest[:i]
+	if topic, err = url.PathUnescape(strings.Trim(rest[i+1:], "/")); err != nil {
+		return nil, "", nil, nil, err
+	}
+	if j := strings.LastIndex(hosts, "@"); j > -1 {
+		parts := strings.SplitN(hosts[:j], ":", 2)
+		username, err := url.PathUnescape(parts[0])
+		if err != nil {
+			return nil, "", nil, nil, err
+		}
+		if len(parts) == 2 {
+			password, err := url.PathUnescape(parts[1])
+			if err != nil {
+				return nil, "", nil, nil, err
+			}
+			user = url.UserPassword(username, password)
+		} else {
+			user = url.User(username)
+		}
+		hosts = hosts[j+1:]
+	}
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host == "" {
+			continue
+		}
+		if !strings.Contains(host, ":") {
+			host = host + ":" + defaultPort
+		}
+		brokers = append(brokers, host)
+	}
+	if len(brokers) == 0 {
+		return nil, "", nil, nil, errors.New("at least one broker is required, e.g. kafka://broker/topic")
+	}
+	return brokers, topic, user, query, nil
+}
+
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) (err error) {
+	if c.Client, err = c.HashGeneratorFcn.NewClient(userName, password, authzID); err != nil {
+		return err
+	}
+	c.ClientConversation = c.Client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.ClientConversation.Done()
+}
+
+// configure creates the producer config from the endpoint's options:
+//
+//	key=hostname|hostname+tag|none      how messages are assigned to partitions (default hostname)
+//	acks=all|leader|none                 acknowledgements required from brokers (default all)
+//	compression=none|gzip|snappy|lz4|zstd
+//	batch_size=500                       messages sent in one request
+//	batch_timeout=1s                     the longest messages wait before being sent
+//	version=2.1.0                        the kafka version of the brokers
+//	format=json|rfc5424                  how packets are written (default json)
+//	sasl=plain|scram-sha-256|scram-sha-512  used if a user is in the endpoint (default plain)
+//	ca=<base64 pem>, insecure=true       tls options for kafka+tls://
+func configure(endpoint string, user *url.Userinfo, query url.Values) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.ClientID = "logtrain"
+	config.Producer.Return.Successes = false
+	config.Producer.Return.Errors = true
+	config.Producer.Flush.Messages = defaultBatchSize
+	config.Producer.Flush.Frequency = defaultBatchTimeout
+
+	switch strings.ToLower(query.Get("acks")) {
+	case "", "all", "-1":
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	case "leader", "1":
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case "none", "0":
+		config.Producer.RequiredAcks = sarama.NoResponse
+	default:
+		return nil, errors.New("unknown acks " + query.Get("acks") + ", expected all, leader or none")
+	}
+
+	switch strings.ToLower(query.Get("compression")) {
+	case "", "none":
+		config.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		config.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		config.Producer.Compression = sarama.CompressionZSTD
+		config.Version = sarama.V2_1_0_0
+	default:
+		return nil, errors.New("unknown compression " + query.Get("compression"))
+	}
+
+	if query.Get("version") != "" {
+		version, err := sarama.ParseKafkaVersion(query.Get("version"))
+		if err != nil {
+			return nil, err
+		}
+		config.Version = version
+	}
+	if query.Get("batch_size") != "" {
+		size, err := strconv.Atoi(query.Get("batch_size"))
+		if err != nil {
+			return nil, err
+		}
+		config.Producer.Flush.Messages = size
+	}
+	if query.Get("batch_timeout") != "" {
+		timeout, err := time.ParseDuration(query.Get("batch_timeout"))
+		if err != nil {
+			return nil, err
+		}
+		config.Producer.Flush.Frequency = timeout
+	}
+
+	if strings.HasPrefix(strings.ToLower(endpoint), "kafka+tls://") {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if query.Get("ca") != "" {
+			decoded, err := base64.StdEncoding.DecodeString(query.Get("ca"))
+			if err != nil {
+				return nil, err
+			}
+			if ok := roots.AppendCertsFromPEM(decoded); ok == false {
+				return nil, errors.New("the ca provided was invalid")
+			}
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = &tls.Config{
+			RootCAs:            roots,
+			InsecureSkipVerify: query.Get("insecure") == "true",
+		}
+	}
+
+	if user != nil {
+		password, _ := user.Password()
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = user.Username()
+		config.Net.SASL.Password = password
+		switch strings.ToLower(query.Get("sasl")) {
+		case "", "plain":
+			config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case "scram-sha-256":
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{HashGeneratorFcn: scram.HashGeneratorFcn(sha256.New)}
+			}
+		case "scram-sha-512":
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{HashGeneratorFcn: scram.HashGeneratorFcn(sha512.New)}
+			}
+		default:
+			return nil, errors.New("unknown sasl mechanism " + query.Get("sasl") + ", expected plain, scram-sha-256 or scram-sha-512")
+		}
+	}
+
+	switch strings.ToLower(strings.ReplaceAll(query.Get("key"), " ", "+")) {
+	case "", "hostname", "hostname+tag":
+		config.Producer.Partitioner = sarama.NewHashPartitioner
+	case "none":
+		config.Producer.Partitioner = sarama.NewRoundRobinPartitioner
+	default:
+		return nil, errors.New("unknown key " + query.Get("key") + ", expected hostname, hostname+tag or none")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Create a new kafka output.
+func Create(endpoint string, errorsCh chan<- error) (*Syslog, error) {
+	if Test(endpoint) == false {
+		return nil, errors.New("Invalid endpoint")
+	}
+	brokers, topic, user, query, err := parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	config, err := configure(endpoint, user, query)
+	if err != nil {
+		return nil, err
+	}
+	format := strings.ToLower(query.Get("format"))
+	if format != "" && format != "json" && format != "rfc5424" {
+		return nil, errors.New("unknown format " + format + ", expected json or rfc5424")
+	}
+	return &Syslog{
+		endpoint: endpoint,
+		topic:    topic,
+		brokers:  brokers,
+		key:      strings.ToLower(strings.ReplaceAll(query.Get("key"), " ", "+")),
+		format:   format,
+		config:   config,
+		packets:  make(chan syslog.Packet, 10),
+		errors:   errorsCh,
+		stop:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		closed:   false,
+	}, nil
+}
+
+// Dial connects to the kafka brokers
+func (log *Syslog) Dial() error {
+	debug.Debugf("[kafka/output]: Dial called for %s\n", log.topic)
+	producer, err := sarama.NewAsyncProducer(log.brokers, log.config)
+	if err != nil {
+		debug.Debugf("[kafka/output]: Dial encountered an error on %s: %s\n", log.topic, err.Error())
+		return err
+	}
+	log.producer = producer
+	go log.errorLoop()
+	go log.loop()
+	return nil
+}
+
+// Close flushes the messages waiting to be sent and closes the connections to the brokers
+func (log *Syslog) Close() error {
+	if log.closed {
+		return errors.New("this output is already closed")
+	}
+	log.closed = true
+	close(log.stop)
+	if log.producer == nil {
+		return nil
+	}
+	// the loop must not send on the input of a closed producer.
+	<-log.done
+	return log.producer.Close()
+}
+
+// Pools returns whether the output pools connections
+func (log *Syslog) Pools() bool {
+	return true
+}
+
+// Packets returns a channel where packets can be sent to the kafka output handler
+func (log *Syslog) Packets() chan syslog.Packet {
+	return log.packets
+}
+
+// message converts the packet to a kafka message keyed for its partition.
+func (log *Syslog) message(p syslog.Packet) (*sarama.ProducerMessage, error) {
+	msg := sarama.ProducerMessage{Topic: log.topic, Timestamp: p.Time}
+	if log.format == "rfc5424" {
+		msg.Value = sarama.StringEncoder(p.Generate(0))
+	} else {
+		payload, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		msg.Value = sarama.ByteEncoder(payload)
+	}
+	switch log.key {
+	case "", "hostname":
+		msg.Key = sarama.StringEncoder(p.Hostname)
+	case "hostname+tag":
+		msg.Key = sarama.StringEncoder(p.Hostname + "/" + p.Tag)
+	}
+	return &msg, nil
+}
+
+// errorLoop reports the errors of the producer until it's closed, errors are dropped
+// once Close is called as nobody may be reading them.
+func (log *Syslog) errorLoop() {
+	for err := range log.producer.Errors() {
+		log.error(err)
+	}
+}
+
+// error reports the error unless the output is closed first.
+func (log *Syslog) error(err error) {
+	select {
+	case <-log.stop:
+	default:
+		select {
+		case log.errors <- err:
+		case <-log.stop:
+		}
+	}
+}
+
+func (log *Syslog) loop() {
+	defer close(log.done)
+	for {
+		select {
+		case p, ok := <-log.packets:
+			if !ok {
+				return
+			}
+			msg, err := log.message(p)
+			if err != nil {
+				log.error(err)
+				continue
+			}
+			select {
+			case log.producer.Input() <- msg:
+			case <-log.stop:
+				return
+			}
+		case <-log.stop:
+			return
+		}
+	}
+}
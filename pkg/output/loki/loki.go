@@ -0,0 +1,350 @@
+package loki
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/golang/snappy"
+	syslog "github.com/trevorlinton/remote_syslog2/syslog"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Syslog loki output struct
+type Syslog struct {
+	url          url.URL
+	endpoint     string
+	format       string
+	tenant       string
+	auth         string
+	labels       map[string]string
+	batchSize    int
+	batchTimeout time.Duration
+	client       *http.Client
+	streams      map[string]*stream
+	size         int
+	packets      chan syslog.Packet
+	errors       chan<- error
+	stop         chan struct{}
+	closed       bool
+}
+
+type entry struct {
+	time time.Time
+	line string
+}
+
+type stream struct {
+	labels  string
+	values  map[string]string
+	entries []entry
+}
+
+var syslogSchemas = []string{"loki+https://", "loki+http://"}
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+var severities = []string{"emerg", "alert", "crit", "err", "warn", "notice", "info", "debug"}
+
+const defaultBatchSize = 1024 * 1024
+const defaultBatchTimeout = time.Second
+
+// Test the schema to see if its a loki schema
+func Test(endpoint string) bool {
+	for _, schema := range syslogSchemas {
+		if strings.HasPrefix(strings.ToLower(endpoint), schema) == true {
+			return true
+		}
+	}
+	return false
+}
+
+func toURL(endpoint string) string {
+	if strings.HasPrefix(strings.ToLower(endpoint), "loki+http://") {
+		return "http://" + endpoint[len("loki+http://"):]
+	}
+	return "https://" + endpoint[len("loki+https://"):]
+}
+
+// Create a new loki output, the endpoint is in the form of
+// loki+https://[user:password@]host/loki/api/v1/push?[format=protobuf|json]&[tenant=]&[labels=name=value,...]&[auth=basic|bearer]&[batch_size=]&[batch_timeout=]
+func Create(endpoint string, errorsCh chan<- error) (*Syslog, error) {
+	if Test(endpoint) == false {
+		return nil, errors.New("Invalid endpoint")
+	}
+	u, err := url.Parse(toURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	format := strings.ToLower(query.Get("format"))
+	if format == "" {
+		format = "protobuf"
+	}
+	if format != "protobuf" && format != "json" {
+		return nil, errors.New("unknown format " + format + ", expected protobuf or json")
+	}
+	labels := make(map[string]string)
+	if query.Get("labels") != "" {
+		for _, label := range strings.Split(query.Get("labels"), ",") {
+			parts := strings.SplitN(label, "=", 2)
+			if len(parts) != 2 || !labelName.MatchString(strings.TrimSpace(parts[0])) {
+				return nil, errors.New("invalid label " + label + ", expected <name>=<value>")
+			}
+			labels[strings.TrimSpace(parts[0])] = parts[1]
+		}
+	}
+	batchSize := defaultBatchSize
+	if query.Get("batch_size") != "" {
+		if batchSize, err = strconv.Atoi(query.Get("batch_size")); err != nil {
+			return nil, err
+		}
+	}
+	batchTimeout := defaultBatchTimeout
+	if query.Get("batch_timeout") != "" {
+		if batchTimeout, err = time.ParseDuration(query.Get("batch_timeout")); err != nil {
+			return nil, err
+		}
+	}
+	if batchSize < 1 || batchTimeout <= 0 {
+		return nil, errors.New("batch_size and batch_timeout must be more than 0")
+	}
+	tenant, auth := query.Get("tenant"), strings.ToLower(query.Get("auth"))
+	if auth != "" && auth != "basic" && auth != "bearer" {
+		return nil, errors.New("unknown auth " + auth + ", expected basic or bearer")
+	}
+	for _, option := range []string{"format", "tenant", "labels", "auth", "batch_size", "batch_timeout"} {
+		query.Del(option)
+	}
+	u.RawQuery = query.Encode()
+	return &Syslog{
+		endpoint:     endpoint,
+		url:          *u,
+		format:       format,
+		tenant:       tenant,
+		auth:         auth,
+		labels:       labels,
+		batchSize:    batchSize,
+		batchTimeout: batchTimeout,
+		client:       &http.Client{},
+		streams:      make(map[string]*stream),
+		packets:      make(chan syslog.Packet, 10),
+		errors:       errorsCh,
+		stop:         make(chan struct{}, 1),
+		closed:       false,
+	}, nil
+}
+
+// Dial begins sending packets to loki
+func (log *Syslog) Dial() error {
+	go log.loop()
+	return nil
+}
+
+// Close stops sending packets to loki, packets waiting to be sent are sent first
+func (log *Syslog) Close() error {
+	if log.closed {
+		return errors.New("this output is already closed")
+	}
+	log.closed = true
+	log.stop <- struct{}{}
+	return nil
+}
+
+// Pools returns whether the output pools connections
+func (log *Syslog) Pools() bool {
+	return true
+}
+
+// Packets returns a channel where packets can be sent to the loki output handler
+func (log *Syslog) Packets() chan syslog.Packet {
+	return log.packets
+}
+
+// streamLabels returns the labels of the stream the packet belongs to.
+func (log *Syslog) streamLabels(p syslog.Packet) map[string]string {
+	labels := make(map[string]string, len(log.labels)+3)
+	for name, value := range log.labels {
+		labels[name] = value
+	}
+	labels["hostname"] = p.Hostname
+	labels["tag"] = p.Tag
+	if int(p.Severity) < len(severities) {
+		labels["severity"] = severities[p.Severity]
+	}
+	return labels
+}
+
+// formatLabels writes labels the way loki expects them in push requests, {name="value", ...}
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(labels[name]))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+func (log *Syslog) add(p syslog.Packet) {
+	labels := log.streamLabels(p)
+	key := formatLabels(labels)
+	s, ok := log.streams[key]
+	if !ok {
+		s = &stream{labels: key, values: labels, entries: make([]entry, 0)}
+		log.streams[key] = s
+	}
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	s.entries = append(s.entries, entry{time: t, line: p.Message})
+	log.size += len(p.Message)
+}
+
+// encodeProtobuf encodes the streams as a logproto.PushRequest.
+func encodeProtobuf(streams map[string]*stream) []byte {
+	var request []byte
+	for _, s := range streams {
+		var body []byte
+		body = protowire.AppendTag(body, 1, protowire.BytesType)
+		body = protowire.AppendString(body, s.labels)
+		for _, e := range s.entries {
+			var timestamp []byte
+			timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(e.time.Unix()))
+			timestamp = protowire.AppendTag(timestamp, 2, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(e.time.Nanosecond()))
+			var en []byte
+			en = protowire.AppendTag(en, 1, protowire.BytesType)
+			en = protowire.AppendBytes(en, timestamp)
+			en = protowire.AppendTag(en, 2, protowire.BytesType)
+			en = protowire.AppendString(en, e.line)
+			body = protowire.AppendTag(body, 2, protowire.BytesType)
+			body = protowire.AppendBytes(body, en)
+		}
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, body)
+	}
+	return request
+}
+
+type jsonStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][]string        `json:"values"`
+}
+
+type jsonPushRequest struct {
+	Streams []jsonStream `json:"streams"`
+}
+
+func encodeJSON(streams map[string]*stream) ([]byte, error) {
+	request := jsonPushRequest{Streams: make([]jsonStream, 0, len(streams))}
+	for _, s := range streams {
+		values := make([][]string, 0, len(s.entries))
+		for _, e := range s.entries {
+			values = append(values, []string{strconv.FormatInt(e.time.UnixNano(), 10), e.line})
+		}
+		request.Streams = append(request.Streams, jsonStream{Stream: s.values, Values: values})
+	}
+	return json.Marshal(request)
+}
+
+// push sends the streams waiting to be sent to loki.
+func (log *Syslog) push() error {
+	if len(log.streams) == 0 {
+		return nil
+	}
+	streams := log.streams
+	log.streams = make(map[string]*stream)
+	log.size = 0
+
+	var body []byte
+	var contentType string
+	if log.format == "json" {
+		payload, err := encodeJSON(streams)
+		if err != nil {
+			return err
+		}
+		body = payload
+		contentType = "application/json"
+	} else {
+		body = snappy.Encode(nil, encodeProtobuf(streams))
+		contentType = "application/x-protobuf"
+	}
+	req, err := http.NewRequest(http.MethodPost, log.url.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if log.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", log.tenant)
+	}
+	if pwd, ok := log.url.User.Password(); ok {
+		if log.auth == "bearer" {
+			req.Header.Set("Authorization", "Bearer "+pwd)
+		} else {
+			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(log.url.User.Username()+":"+pwd)))
+		}
+	}
+	resp, err := log.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices || resp.StatusCode < http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("invalid response from endpoint: " + resp.Status + " " + string(message))
+	}
+	return nil
+}
+
+func (log *Syslog) loop() {
+	ticker := time.NewTicker(log.batchTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case p, ok := <-log.packets:
+			if !ok {
+				return
+			}
+			log.add(p)
+			if log.size >= log.batchSize {
+				if err := log.push(); err != nil {
+					log.errors <- err
+				}
+			}
+		case <-ticker.C:
+			if err := log.push(); err != nil {
+				log.errors <- err
+			}
+		case <-log.stop:
+			for done := false; !done; {
+				select {
+				case p := <-log.packets:
+					log.add(p)
+				default:
+					done = true
+				}
+			}
+			if err := log.push(); err != nil {
+				select {
+				case log.errors <- err:
+				default:
+				}
+			}
+			return
+		}
+	}
+}
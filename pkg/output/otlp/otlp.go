@@ -0,0 +1,446 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"github.com/akkeris/logtrain/internal/debug"
+	syslog "github.com/trevorlinton/remote_syslog2/syslog"
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	logs "go.opentelemetry.io/proto/otlp/logs/v1"
+	resource "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Syslog opentelemetry (otlp) logs output struct
+type Syslog struct {
+	url          url.URL
+	endpoint     string
+	transport    string // grpc or http
+	serviceName  string // if empty the tag is used as the service.name
+	auth         string // the authorization header, if any
+	tlsConfig    *tls.Config
+	maxRetries   int
+	batchSize    int
+	batchTimeout time.Duration
+	conn         *grpc.ClientConn
+	client       collogs.LogsServiceClient
+	httpClient   *http.Client
+	batch        []syslog.Packet
+	packets      chan syslog.Packet
+	errors       chan<- error
+	stop         chan struct{}
+	done         chan struct{}
+	closed       bool
+}
+
+var syslogSchemas = []string{"otlp+grpc://", "otlp+http://", "otlp+https://"}
+
+var severities = []string{"emerg", "alert", "crit", "err", "warn", "notice", "info", "debug"}
+
+// severityNumbers maps syslog severities to otlp severity numbers
+var severityNumbers = []logs.SeverityNumber{
+	logs.SeverityNumber_SEVERITY_NUMBER_FATAL4,
+	logs.SeverityNumber_SEVERITY_NUMBER_FATAL3,
+	logs.SeverityNumber_SEVERITY_NUMBER_FATAL,
+	logs.SeverityNumber_SEVERITY_NUMBER_ERROR,
+	logs.SeverityNumber_SEVERITY_NUMBER_WARN,
+	logs.SeverityNumber_SEVERITY_NUMBER_INFO2,
+	logs.SeverityNumber_SEVERITY_NUMBER_INFO,
+	logs.SeverityNumber_SEVERITY_NUMBER_DEBUG,
+}
+
+// retryableCodes are the grpc status codes the otlp specification allows to be retried
+var retryableCodes = map[codes.Code]bool{
+	codes.Canceled:          true,
+	codes.DeadlineExceeded:  true,
+	codes.ResourceExhausted: true,
+	codes.Aborted:           true,
+	codes.OutOfRange:        true,
+	codes.Unavailable:       true,
+	codes.DataLoss:          true,
+}
+
+// retryableStatuses are the http status codes the otlp specification allows to be retried
+var retryableStatuses = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+const defaultBatchSize = 512
+const defaultBatchTimeout = time.Second
+const defaultMaxRetries = 3
+const exportTimeout = 10 * time.Second
+
+// retryDelay is how long the first retry waits, each retry after waits twice as long.
+var retryDelay = 500 * time.Millisecond
+
+// maxRetryWait is the longest a retry waits, even if the endpoint asks for longer with Retry-After.
+const maxRetryWait = time.Minute
+
+// Test the schema to see if its an otlp schema
+func Test(endpoint string) bool {
+	for _, schema := range syslogSchemas {
+		if strings.HasPrefix(strings.ToLower(endpoint), schema) == true {
+			return true
+		}
+	}
+	return false
+}
+
+// Create a new otlp output, the endpoint is in the form of
+// otlp+grpc://[user:password@]host:4317?[tls=true]&[ca=]&[insecure=true]&[service_name=]&[auth=basic|bearer]&[max_retries=]&[batch_size=]&[batch_timeout=]
+// or otlp+https://[user:password@]host:4318/v1/logs with the same options.
+func Create(endpoint string, errorsCh chan<- error) (*Syslog, error) {
+	if Test(endpoint) == false {
+		return nil, errors.New("Invalid endpoint")
+	}
+	u, err := url.Parse(endpoint[len("otlp+"):])
+	if err != nil {
+		return nil, err
+	}
+	transport := strings.ToLower(u.Scheme)
+	if transport == "https" {
+		transport = "http"
+	}
+	query := u.Query()
+	batchSize := defaultBatchSize
+	if query.Get("batch_size") != "" {
+		if batchSize, err = strconv.Atoi(query.Get("batch_size")); err != nil {
+			return nil, err
+		}
+	}
+	batchTimeout := defaultBatchTimeout
+	if query.Get("batch_timeout") != "" {
+		if batchTimeout, err = time.ParseDuration(query.Get("batch_timeout")); err != nil {
+			return nil, err
+		}
+	}
+	if batchSize < 1 || batchTimeout <= 0 {
+		return nil, errors.New("batch_size and batch_timeout must be more than 0")
+	}
+	maxRetries := defaultMaxRetries
+	if query.Get("max_retries") != "" {
+		if maxRetries, err = strconv.Atoi(query.Get("max_retries")); err != nil {
+			return nil, err
+		}
+	}
+	var auth string
+	if u.User != nil {
+		password, _ := u.User.Password()
+		switch strings.ToLower(query.Get("auth")) {
+		case "", "basic":
+			auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+		case "bearer":
+			auth = "Bearer " + password
+		default:
+			return nil, errors.New("unknown auth " + query.Get("auth") + ", expected basic or bearer")
+		}
+	}
+	var tlsConfig *tls.Config
+	if u.Scheme == "https" || query.Get("tls") == "true" || query.Get("ca") != "" || query.Get("insecure") == "true" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if query.Get("ca") != "" {
+			decoded, err := base64.StdEncoding.DecodeString(query.Get("ca"))
+			if err != nil {
+				return nil, err
+			}
+			if ok := roots.AppendCertsFromPEM(decoded); ok == false {
+				return nil, errors.New("the ca provided was invalid")
+			}
+		}
+		tlsConfig = &tls.Config{
+			RootCAs:            roots,
+			InsecureSkipVerify: query.Get("insecure") == "true",
+		}
+	}
+	serviceName := query.Get("service_name")
+	for _, option := range []string{"tls", "ca", "insecure", "service_name", "auth", "max_retries", "batch_size", "batch_timeout"} {
+		query.Del(option)
+	}
+	u.RawQuery = query.Encode()
+	u.User = nil
+	if transport == "http" {
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/logs"
+		}
+	}
+	return &Syslog{
+		endpoint:     endpoint,
+		url:          *u,
+		transport:    transport,
+		serviceName:  serviceName,
+		auth:         auth,
+		tlsConfig:    tlsConfig,
+		maxRetries:   maxRetries,
+		batchSize:    batchSize,
+		batchTimeout: batchTimeout,
+		batch:        make([]syslog.Packet, 0),
+		packets:      make(chan syslog.Packet, 10),
+		errors:       errorsCh,
+		stop:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		closed:       false,
+	}, nil
+}
+
+// Dial creates the grpc or http client and begins sending packets
+func (log *Syslog) Dial() error {
+	if log.transport == "grpc" {
+		option := grpc.WithInsecure()
+		if log.tlsConfig != nil {
+			option = grpc.WithTransportCredentials(credentials.NewTLS(log.tlsConfig))
+		}
+		conn, err := grpc.Dial(log.url.Host, option)
+		if err != nil {
+			return err
+		}
+		log.conn = conn
+		log.client = collogs.NewLogsServiceClient(conn)
+	} else {
+		log.httpClient = &http.Client{Timeout: exportTimeout}
+		if log.tlsConfig != nil {
+			log.httpClient.Transport = &http.Transport{TLSClientConfig: log.tlsConfig}
+		}
+	}
+	go log.loop()
+	return nil
+}
+
+// Close sends the packets waiting to be sent and stops the output
+func (log *Syslog) Close() error {
+	if log.closed {
+		return errors.New("this output is already closed")
+	}
+	log.closed = true
+	if log.conn == nil && log.httpClient == nil {
+		return nil
+	}
+	close(log.stop)
+	<-log.done
+	if log.conn != nil {
+		return log.conn.Close()
+	}
+	return nil
+}
+
+// Pools returns whether the output pools connections
+func (log *Syslog) Pools() bool {
+	return true
+}
+
+// Packets returns a channel where packets can be sent to the otlp output handler
+func (log *Syslog) Packets() chan syslog.Packet {
+	return log.packets
+}
+
+func stringAttribute(key string, value string) *common.KeyValue {
+	return &common.KeyValue{Key: key, Value: &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: value}}}
+}
+
+func (log *Syslog) record(p syslog.Packet) *logs.LogRecord {
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	record := &logs.LogRecord{
+		TimeUnixNano: uint64(t.UnixNano()),
+		Body:         &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: p.Message}},
+		Attributes: []*common.KeyValue{
+			{Key: "syslog.facility", Value: &common.AnyValue{Value: &common.AnyValue_IntValue{IntValue: int64(p.Facility)}}},
+		},
+	}
+	if int(p.Severity) < len(severityNumbers) {
+		record.SeverityNumber = severityNumbers[p.Severity]
+		record.SeverityText = severities[p.Severity]
+	}
+	if log.serviceName != "" {
+		record.Attributes = append(record.Attributes, stringAttribute("syslog.tag", p.Tag))
+	}
+	return record
+}
+
+// request groups the packets into resources by hostname (host.name) and tag (service.name)
+func (log *Syslog) request(packets []syslog.Packet) *collogs.ExportLogsServiceRequest {
+	request := &collogs.ExportLogsServiceRequest{ResourceLogs: make([]*logs.ResourceLogs, 0)}
+	resources := make(map[string]*logs.InstrumentationLibraryLogs)
+	for _, p := range packets {
+		service := log.serviceName
+		if service == "" {
+			service = p.Tag
+		}
+		key := p.Hostname + "\n" + service
+		library, ok := resources[key]
+		if !ok {
+			library = &logs.InstrumentationLibraryLogs{
+				InstrumentationLibrary: &common.InstrumentationLibrary{Name: "logtrain"},
+				Logs:                   make([]*logs.LogRecord, 0),
+			}
+			resources[key] = library
+			request.ResourceLogs = append(request.ResourceLogs, &logs.ResourceLogs{
+				Resource: &resource.Resource{
+					Attributes: []*common.KeyValue{stringAttribute("host.name", p.Hostname), stringAttribute("service.name", service)},
+				},
+				InstrumentationLibraryLogs: []*logs.InstrumentationLibraryLogs{library},
+			})
+		}
+		library.Logs = append(library.Logs, log.record(p))
+	}
+	return request
+}
+
+// exportGRPC sends the request and returns whether a failure may be retried
+func (log *Syslog) exportGRPC(request *collogs.ExportLogsServiceRequest) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	if log.auth != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", log.auth)
+	}
+	if _, err := log.client.Export(ctx, request); err != nil {
+		return retryableCodes[status.Code(err)], 0, err
+	}
+	return false, 0, nil
+}
+
+// exportHTTP sends the request and returns whether a failure may be retried and how long
+// the endpoint asked to wait before retrying (if it did).
+func (log *Syslog) exportHTTP(request *collogs.ExportLogsServiceRequest) (bool, time.Duration, error) {
+	body, err := proto.Marshal(request)
+	if err != nil {
+		return false, 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, log.url.String(), bytes.NewReader(body))
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if log.auth != "" {
+		req.Header.Set("Authorization", log.auth)
+	}
+	resp, err := log.httpClient.Do(req)
+	if err != nil {
+		return true, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices || resp.StatusCode < http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		var wait time.Duration
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(seconds) * time.Second
+		}
+		return retryableStatuses[resp.StatusCode], wait, errors.New("invalid response from endpoint: " + resp.Status + " " + string(message))
+	}
+	return false, 0, nil
+}
+
+// send exports the packets waiting to be sent, retrying with an exponential backoff
+// if the endpoint returns a retryable error.
+func (log *Syslog) send() error {
+	if len(log.batch) == 0 {
+		return nil
+	}
+	request := log.request(log.batch)
+	log.batch = make([]syslog.Packet, 0)
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		var retryable bool
+		var wait time.Duration
+		var err error
+		if log.transport == "grpc" {
+			retryable, wait, err = log.exportGRPC(request)
+		} else {
+			retryable, wait, err = log.exportHTTP(request)
+		}
+		if err == nil {
+			return nil
+		}
+		if retryable == false || attempt >= log.maxRetries {
+			return err
+		}
+		if wait == 0 {
+			wait = delay
+		}
+		if wait > maxRetryWait {
+			wait = maxRetryWait
+		}
+		debug.Debugf("[otlp/output]: Retrying export to %s in %s: %s\n", log.url.Host, wait, err.Error())
+		select {
+		case <-time.NewTimer(wait).C:
+		case <-log.stop:
+			return err
+		}
+		delay = delay * 2
+	}
+}
+
+// error reports the error unless the output is closed first.
+func (log *Syslog) error(err error) {
+	select {
+	case <-log.stop:
+	default:
+		select {
+		case log.errors <- err:
+		case <-log.stop:
+		}
+	}
+}
+
+func (log *Syslog) loop() {
+	ticker := time.NewTicker(log.batchTimeout)
+	defer ticker.Stop()
+	defer close(log.done)
+	for {
+		select {
+		case p, ok := <-log.packets:
+			if !ok {
+				return
+			}
+			log.batch = append(log.batch, p)
+			if len(log.batch) >= log.batchSize {
+				if err := log.send(); err != nil {
+					log.error(err)
+				}
+			}
+		case <-ticker.C:
+			if err := log.send(); err != nil {
+				log.error(err)
+			}
+		case <-log.stop:
+			for done := false; !done; {
+				select {
+				case p := <-log.packets:
+					log.batch = append(log.batch, p)
+				default:
+					done = true
+				}
+			}
+			if err := log.send(); err != nil {
+				select {
+				case log.errors <- err:
+				default:
+				}
+			}
+			return
+		}
+	}
+}
@@ -3,8 +3,15 @@ package output
 import (
 	"errors"
 	elasticsearch "github.com/akkeris/logtrain/pkg/output/elasticsearch"
+	forward "github.com/akkeris/logtrain/pkg/output/forward"
+	gelf "github.com/akkeris/logtrain/pkg/output/gelf"
 	http "github.com/akkeris/logtrain/pkg/output/http"
+	kafka "github.com/akkeris/logtrain/pkg/output/kafka"
+	loki "github.com/akkeris/logtrain/pkg/output/loki"
 	memory "github.com/akkeris/logtrain/pkg/output/memory"
+	otlp "github.com/akkeris/logtrain/pkg/output/otlp"
+	s3 "github.com/akkeris/logtrain/pkg/output/s3"
+	splunk "github.com/akkeris/logtrain/pkg/output/splunk"
 	sysloghttp "github.com/akkeris/logtrain/pkg/output/sysloghttp"
 	syslogtcp "github.com/akkeris/logtrain/pkg/output/syslogtcp"
 	syslogtls "github.com/akkeris/logtrain/pkg/output/syslogtls"
@@ -26,15 +33,28 @@ func TestEndpoint(endpoint string) error {
 		syslogudp.Test(endpoint) == false &&
 		sysloghttp.Test(endpoint) == false &&
 		memory.Test(endpoint) == false &&
+		kafka.Test(endpoint) == false &&
+		s3.Test(endpoint) == false &&
+		loki.Test(endpoint) == false &&
+		splunk.Test(endpoint) == false &&
+		gelf.Test(endpoint) == false &&
+		otlp.Test(endpoint) == false &&
+		forward.Test(endpoint) == false &&
 		http.Test(endpoint) == false {
 		return errors.New("Unrecognized schema type")
 	}
 	return nil
 }
 
-func Create(endpoint string, errorsCh chan<- error) (Output, error) {
+// Options are settings applied to every output
+type Options struct {
+	Node    string // The name of the node logs are sent from (elasticsearch)
+	Akkeris bool   // Whether logs are tagged as akkeris logs (elasticsearch)
+}
+
+func Create(endpoint string, errorsCh chan<- error, options Options) (Output, error) {
 	if elasticsearch.Test(endpoint) == true {
-		return elasticsearch.Create(endpoint, errorsCh)
+		return elasticsearch.Create(endpoint, errorsCh, options.Node, options.Akkeris)
 	} else if http.Test(endpoint) == true {
 		return http.Create(endpoint, errorsCh)
 	} else if sysloghttp.Test(endpoint) == true {
@@ -47,6 +67,20 @@ func Create(endpoint string, errorsCh chan<- error) (Output, error) {
 		return syslogudp.Create(endpoint, errorsCh)
 	} else if memory.Test(endpoint) == true {
 		return memory.Create(endpoint, errorsCh)
+	} else if kafka.Test(endpoint) == true {
+		return kafka.Create(endpoint, errorsCh)
+	} else if s3.Test(endpoint) == true {
+		return s3.Create(endpoint, errorsCh)
+	} else if loki.Test(endpoint) == true {
+		return loki.Create(endpoint, errorsCh)
+	} else if splunk.Test(endpoint) == true {
+		return splunk.Create(endpoint, errorsCh)
+	} else if gelf.Test(endpoint) == true {
+		return gelf.Create(endpoint, errorsCh)
+	} else if otlp.Test(endpoint) == true {
+		return otlp.Create(endpoint, errorsCh)
+	} else if forward.Test(endpoint) == true {
+		return forward.Create(endpoint, errorsCh)
 	}
 	return nil, errors.New("Unrecognized endpoint " + endpoint)
 }
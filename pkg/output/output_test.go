@@ -14,70 +14,122 @@ func TestOutput(t *testing.T) {
 		So(TestEndpoint("es://localhost"), ShouldBeNil)
 		So(TestEndpoint("es+http://localhost"), ShouldBeNil)
 		So(TestEndpoint("es+https://localhost"), ShouldBeNil)
-		out, err := Create("elasticsearch://localhost", errorCh)
+		out, err := Create("elasticsearch://localhost", errorCh, Options{})
 		So(err, ShouldBeNil)
 		So(out, ShouldNotBeNil)
-		out, err = Create("elasticsearch+https://localhost", errorCh)
+		out, err = Create("elasticsearch+https://localhost", errorCh, Options{})
 		So(err, ShouldBeNil)
 		So(out, ShouldNotBeNil)
-		out, err = Create("elasticsearch+http://localhost", errorCh)
+		out, err = Create("elasticsearch+http://localhost", errorCh, Options{})
 		So(err, ShouldBeNil)
 		So(out, ShouldNotBeNil)
-		out, err = Create("es://localhost", errorCh)
+		out, err = Create("es://localhost", errorCh, Options{})
 		So(err, ShouldBeNil)
 		So(out, ShouldNotBeNil)
-		out, err = Create("es+https://localhost", errorCh)
+		out, err = Create("es+https://localhost", errorCh, Options{})
 		So(err, ShouldBeNil)
 		So(out, ShouldNotBeNil)
-		out, err = Create("es+http://localhost", errorCh)
+		out, err = Create("es+http://localhost", errorCh, Options{})
 		So(err, ShouldBeNil)
 		So(out, ShouldNotBeNil)
 	})
 	Convey("Ensure testing syslog+http(s) endpoint returns an item", t, func() {
 		So(TestEndpoint("syslog+http://localhost"), ShouldBeNil)
 		So(TestEndpoint("syslog+https://localhost"), ShouldBeNil)
-		out, err := Create("syslog+https://localhost", errorCh)
+		out, err := Create("syslog+https://localhost", errorCh, Options{})
 		So(err, ShouldBeNil)
 		So(out, ShouldNotBeNil)
-		out, err = Create("syslog+http://localhost", errorCh)
+		out, err = Create("syslog+http://localhost", errorCh, Options{})
 		So(err, ShouldBeNil)
 		So(out, ShouldNotBeNil)
 	})
 	Convey("Ensure testing http(s) endpoint returns an item", t, func() {
 		So(TestEndpoint("http://localhost"), ShouldBeNil)
 		So(TestEndpoint("https://localhost"), ShouldBeNil)
-		out, err := Create("https://localhost", errorCh)
+		out, err := Create("https://localhost", errorCh, Options{})
 		So(err, ShouldBeNil)
 		So(out, ShouldNotBeNil)
-		out, err = Create("http://localhost", errorCh)
+		out, err = Create("http://localhost", errorCh, Options{})
 		So(err, ShouldBeNil)
 		So(out, ShouldNotBeNil)
 	})
 	Convey("Ensure testing syslog, syslog+udp endpoint returns an item", t, func() {
 		So(TestEndpoint("syslog://localhost"), ShouldBeNil)
 		So(TestEndpoint("syslog+udp://localhost"), ShouldBeNil)
-		out, err := Create("syslog://localhost", errorCh)
+		out, err := Create("syslog://localhost", errorCh, Options{})
 		So(err, ShouldBeNil)
 		So(out, ShouldNotBeNil)
-		out, err = Create("syslog+udp://localhost", errorCh)
+		out, err = Create("syslog+udp://localhost", errorCh, Options{})
 		So(err, ShouldBeNil)
 		So(out, ShouldNotBeNil)
 	})
 	Convey("Ensure testing syslog+tcp endpoint returns an item", t, func() {
 		So(TestEndpoint("syslog+tcp://localhost"), ShouldBeNil)
-		out, err := Create("syslog+tcp://localhost", errorCh)
+		out, err := Create("syslog+tcp://localhost", errorCh, Options{})
 		So(err, ShouldBeNil)
 		So(out, ShouldNotBeNil)
 	})
 	Convey("Ensure testing syslog+tls endpoint returns an item", t, func() {
 		So(TestEndpoint("syslog+tls://localhost"), ShouldBeNil)
-		out, err := Create("syslog+tls://localhost", errorCh)
+		out, err := Create("syslog+tls://localhost", errorCh, Options{})
+		So(err, ShouldBeNil)
+		So(out, ShouldNotBeNil)
+	})
+	Convey("Ensure testing kafka endpoint returns an item", t, func() {
+		So(TestEndpoint("kafka://localhost/logs"), ShouldBeNil)
+		So(TestEndpoint("kafka+tls://localhost/logs"), ShouldBeNil)
+		out, err := Create("kafka://localhost:9092,localhost:9093/logs", errorCh, Options{})
+		So(err, ShouldBeNil)
+		So(out, ShouldNotBeNil)
+		out, err = Create("kafka+tls://localhost/logs", errorCh, Options{})
+		So(err, ShouldBeNil)
+		So(out, ShouldNotBeNil)
+	})
+	Convey("Ensure testing s3 endpoint returns an item", t, func() {
+		So(TestEndpoint("s3://bucket/prefix"), ShouldBeNil)
+		out, err := Create("s3://bucket/prefix?region=us-west-2", errorCh, Options{})
+		So(err, ShouldBeNil)
+		So(out, ShouldNotBeNil)
+	})
+	Convey("Ensure testing loki endpoint returns an item", t, func() {
+		So(TestEndpoint("loki+http://localhost/loki/api/v1/push"), ShouldBeNil)
+		So(TestEndpoint("loki+https://localhost/loki/api/v1/push"), ShouldBeNil)
+		out, err := Create("loki+https://localhost/loki/api/v1/push", errorCh, Options{})
+		So(err, ShouldBeNil)
+		So(out, ShouldNotBeNil)
+		out, err = Create("loki+http://localhost/loki/api/v1/push", errorCh, Options{})
+		So(err, ShouldBeNil)
+		So(out, ShouldNotBeNil)
+	})
+	Convey("Ensure testing splunk endpoint returns an item", t, func() {
+		So(TestEndpoint("splunk+https://token@localhost:8088"), ShouldBeNil)
+		out, err := Create("splunk+https://token@localhost:8088?index=main", errorCh, Options{})
+		So(err, ShouldBeNil)
+		So(out, ShouldNotBeNil)
+	})
+	Convey("Ensure testing gelf endpoint returns an item", t, func() {
+		So(TestEndpoint("gelf+udp://localhost:12201"), ShouldBeNil)
+		So(TestEndpoint("gelf+tcp://localhost:12201"), ShouldBeNil)
+		out, err := Create("gelf+http://localhost:12201/gelf?compress=gzip", errorCh, Options{})
+		So(err, ShouldBeNil)
+		So(out, ShouldNotBeNil)
+	})
+	Convey("Ensure testing otlp endpoint returns an item", t, func() {
+		So(TestEndpoint("otlp+grpc://localhost:4317"), ShouldBeNil)
+		So(TestEndpoint("otlp+https://localhost:4318/v1/logs"), ShouldBeNil)
+		out, err := Create("otlp+http://localhost:4318?service_name=payments", errorCh, Options{})
+		So(err, ShouldBeNil)
+		So(out, ShouldNotBeNil)
+	})
+	Convey("Ensure testing forward endpoint returns an item", t, func() {
+		So(TestEndpoint("forward://localhost:24224"), ShouldBeNil)
+		out, err := Create("forward://localhost:24224?ack=true", errorCh, Options{})
 		So(err, ShouldBeNil)
 		So(out, ShouldNotBeNil)
 	})
 	Convey("Ensure unrecognized schemas are not allowed", t, func() {
 		So(TestEndpoint("foobar://fee"), ShouldNotBeNil)
-		_, err := Create("foobar://localhost", errorCh)
+		_, err := Create("foobar://localhost", errorCh, Options{})
 		So(err, ShouldNotBeNil)
 	})
 }
@@ -0,0 +1,344 @@
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"github.com/akkeris/logtrain/internal/debug"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	s3api "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	syslog "github.com/trevorlinton/remote_syslog2/syslog"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Syslog s3 archive output struct, packets are buffered per hostname and hour and
+// written as gzip'd objects under <prefix>/<hostname>/yyyy/mm/dd/hh/.
+type Syslog struct {
+	endpoint string
+	bucket   string
+	prefix   string
+	format   string
+	maxSize  int
+	maxAge   time.Duration
+	config   *aws.Config
+	client   *s3api.S3
+	objects  map[string]*object
+	pending  []*object // archives that failed to upload, retried until maxPending is reached
+	retried  time.Time
+	packets  chan syslog.Packet
+	errors   chan<- error
+	stop     chan struct{}
+	done     chan struct{}
+	closed   bool
+}
+
+// object is an archive being filled before it's uploaded.
+type object struct {
+	key     string
+	name    string // set once the archive is complete
+	buffer  *bytes.Buffer
+	writer  *gzip.Writer
+	size    int // uncompressed
+	created time.Time
+}
+
+var syslogSchemas = []string{"s3://"}
+
+const defaultMaxSize = 16 * 1024 * 1024 // uncompressed bytes
+const defaultMaxAge = 5 * time.Minute
+const maxPending = 64
+const retryInterval = 30 * time.Second
+
+// Test the schema to see if its an s3 schema
+func Test(endpoint string) bool {
+	for _, schema := range syslogSchemas {
+		if strings.HasPrefix(strings.ToLower(endpoint), schema) == true {
+			return true
+		}
+	}
+	return false
+}
+
+// Create a new s3 archive output, the endpoint is in the form of
+// s3://[access_key:secret_key@]bucket/prefix?region=&endpoint=&format=json|rfc5424&max_size=&max_age=
+// if no keys are given the default aws credentials are used. Set endpoint to use
+// an s3 compatible service such as MinIO.
+func Create(endpoint string, errorsCh chan<- error) (*Syslog, error) {
+	if Test(endpoint) == false {
+		return nil, errors.New("Invalid endpoint")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("a bucket is required, e.g. s3://bucket/prefix")
+	}
+	query := u.Query()
+	format := strings.ToLower(query.Get("format"))
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "rfc5424" {
+		return nil, errors.New("unknown format " + format + ", expected json or rfc5424")
+	}
+	maxSize := defaultMaxSize
+	if query.Get("max_size") != "" {
+		if maxSize, err = strconv.Atoi(query.Get("max_size")); err != nil {
+			return nil, err
+		}
+	}
+	maxAge := defaultMaxAge
+	if query.Get("max_age") != "" {
+		if maxAge, err = time.ParseDuration(query.Get("max_age")); err != nil {
+			return nil, err
+		}
+	}
+	if maxSize < 1 || maxAge <= 0 {
+		return nil, errors.New("max_size and max_age must be more than 0")
+	}
+	config := aws.NewConfig()
+	if query.Get("region") != "" {
+		config = config.WithRegion(query.Get("region"))
+	} else {
+		config = config.WithRegion("us-east-1")
+	}
+	if query.Get("endpoint") != "" {
+		config = config.WithEndpoint(query.Get("endpoint")).WithS3ForcePathStyle(true)
+	}
+	if u.User != nil {
+		secret, _ := u.User.Password()
+		config = config.WithCredentials(credentials.NewStaticCredentials(u.User.Username(), secret, ""))
+	}
+	return &Syslog{
+		endpoint: endpoint,
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		format:   format,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		config:   config,
+		objects:  make(map[string]*object),
+		pending:  make([]*object, 0),
+		packets:  make(chan syslog.Packet, 10),
+		errors:   errorsCh,
+		stop:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		closed:   false,
+	}, nil
+}
+
+// Dial creates the s3 client and begins archiving
+func (log *Syslog) Dial() error {
+	sess, err := session.NewSession(log.config)
+	if err != nil {
+		return err
+	}
+	log.client = s3api.New(sess)
+	go log.loop()
+	return nil
+}
+
+// Close uploads the archives waiting to be written and stops the output
+func (log *Syslog) Close() error {
+	if log.closed {
+		return errors.New("this output is already closed")
+	}
+	log.closed = true
+	if log.client == nil {
+		return nil
+	}
+	close(log.stop)
+	<-log.done
+	return nil
+}
+
+// Pools returns whether the output pools connections
+func (log *Syslog) Pools() bool {
+	return true
+}
+
+// Packets returns a channel where packets can be sent to the s3 output handler
+func (log *Syslog) Packets() chan syslog.Packet {
+	return log.packets
+}
+
+// partition returns the directory of the object for the packet, <prefix>/<hostname>/yyyy/mm/dd/hh
+func (log *Syslog) partition(p syslog.Packet) string {
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	hostname := strings.ReplaceAll(p.Hostname, "/", "_")
+	if hostname == "" {
+		hostname = "unknown"
+	}
+	return path.Join(log.prefix, hostname, t.UTC().Format("2006/01/02/15"))
+}
+
+func (log *Syslog) line(p syslog.Packet) ([]byte, error) {
+	if log.format == "rfc5424" {
+		return []byte(p.Generate(0) + "\n"), nil
+	}
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return append(payload, '\n'), nil
+}
+
+func (log *Syslog) write(p syslog.Packet) error {
+	line, err := log.line(p)
+	if err != nil {
+		return err
+	}
+	partition := log.partition(p)
+	o, ok := log.objects[partition]
+	if !ok {
+		buffer := bytes.NewBuffer([]byte{})
+		o = &object{
+			key:     partition,
+			buffer:  buffer,
+			writer:  gzip.NewWriter(buffer),
+			created: time.Now(),
+		}
+		log.objects[partition] = o
+	}
+	if _, err := o.writer.Write(line); err != nil {
+		return err
+	}
+	o.size += len(line)
+	if o.size >= log.maxSize {
+		return log.upload(partition)
+	}
+	return nil
+}
+
+// upload completes the archive for the partition and writes it to s3, if it can't be
+// written it's kept to be retried.
+func (log *Syslog) upload(partition string) error {
+	o := log.objects[partition]
+	delete(log.objects, partition)
+	if err := o.writer.Close(); err != nil {
+		return err
+	}
+	extension := ".json.gz"
+	if log.format == "rfc5424" {
+		extension = ".log.gz"
+	}
+	o.name = path.Join(o.key, o.created.UTC().Format("20060102T150405Z")+"-"+uuid.New().String()+extension)
+	if err := log.put(o); err != nil {
+		if len(log.pending) >= maxPending {
+			debug.Errorf("[s3/output]: Too many archives failed to upload to %s, dropping %s\n", log.bucket, log.pending[0].name)
+			log.pending = log.pending[1:]
+		}
+		log.pending = append(log.pending, o)
+		return err
+	}
+	return nil
+}
+
+func (log *Syslog) put(o *object) error {
+	debug.Debugf("[s3/output]: Uploading %d bytes to %s/%s\n", o.buffer.Len(), log.bucket, o.name)
+	_, err := log.client.PutObject(&s3api.PutObjectInput{
+		Bucket:      aws.String(log.bucket),
+		Key:         aws.String(o.name),
+		Body:        bytes.NewReader(o.buffer.Bytes()),
+		ContentType: aws.String("application/gzip"),
+	})
+	return err
+}
+
+// retry uploads the archives that previously failed, it stops at the first failure.
+func (log *Syslog) retry() error {
+	for len(log.pending) > 0 {
+		if err := log.put(log.pending[0]); err != nil {
+			return err
+		}
+		log.pending = log.pending[1:]
+	}
+	return nil
+}
+
+// error reports the error unless the output is closed first.
+func (log *Syslog) error(err error) {
+	select {
+	case <-log.stop:
+	default:
+		select {
+		case log.errors <- err:
+		case <-log.stop:
+		}
+	}
+}
+
+func (log *Syslog) expire(now time.Time) {
+	if len(log.pending) > 0 && now.Sub(log.retried) >= retryInterval {
+		log.retried = now
+		if err := log.retry(); err != nil {
+			log.error(err)
+			return
+		}
+	}
+	for partition, o := range log.objects {
+		if now.Sub(o.created) >= log.maxAge {
+			if err := log.upload(partition); err != nil {
+				log.error(err)
+			}
+		}
+	}
+}
+
+func (log *Syslog) flush() {
+	for partition := range log.objects {
+		log.upload(partition)
+	}
+	if err := log.retry(); err != nil {
+		debug.Errorf("[s3/output]: Unable to upload %d archives to %s: %s\n", len(log.pending), log.bucket, err.Error())
+	}
+}
+
+func (log *Syslog) loop() {
+	interval := log.maxAge / 4
+	if interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(log.done)
+	for {
+		select {
+		case p, ok := <-log.packets:
+			if !ok {
+				log.flush()
+				return
+			}
+			if err := log.write(p); err != nil {
+				log.error(err)
+			}
+		case now := <-ticker.C:
+			log.expire(now)
+		case <-log.stop:
+			for done := false; !done; {
+				select {
+				case p := <-log.packets:
+					if err := log.write(p); err != nil {
+						debug.Errorf("[s3/output]: Unable to archive packet for %s: %s\n", p.Hostname, err.Error())
+					}
+				default:
+					done = true
+				}
+			}
+			log.flush()
+			return
+		}
+	}
+}
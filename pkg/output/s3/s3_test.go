@@ -0,0 +1,173 @@
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	. "github.com/smartystreets/goconvey/convey"
+	syslog2 "github.com/trevorlinton/remote_syslog2/syslog"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+type uploadedObject struct {
+	Path string
+	Body string
+}
+
+type TestS3Server struct {
+	Incoming    chan uploadedObject
+	ReturnError bool
+}
+
+func (server *TestS3Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	req.Body.Close()
+	if server.ReturnError || req.Method != http.MethodPut {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	uncompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	server.Incoming <- uploadedObject{Path: req.URL.Path, Body: string(uncompressed)}
+	res.WriteHeader(http.StatusOK)
+}
+
+func packet(hostname string, message string) syslog2.Packet {
+	return syslog2.Packet{
+		Severity: 0,
+		Facility: 0,
+		Hostname: hostname,
+		Tag:      "S3ChannelTest",
+		Time:     time.Date(2020, 6, 7, 8, 9, 10, 0, time.UTC),
+		Message:  message,
+	}
+}
+
+func TestS3Output(t *testing.T) {
+	testServer := TestS3Server{Incoming: make(chan uploadedObject, 10)}
+	server := httptest.NewServer(&testServer)
+	defer server.Close()
+
+	Convey("Ensure s3 endpoints are validated", t, func() {
+		errorCh := make(chan error, 1)
+		_, err := Create("http://bucket/logs", errorCh)
+		So(err, ShouldNotBeNil)
+		_, err = Create("s3:///logs", errorCh)
+		So(err, ShouldNotBeNil)
+		_, err = Create("s3://bucket/logs?format=xml", errorCh)
+		So(err, ShouldNotBeNil)
+		_, err = Create("s3://bucket/logs?max_age=0s", errorCh)
+		So(err, ShouldNotBeNil)
+		out, err := Create("s3://bucket/archive/logs/?region=us-west-2", errorCh)
+		So(err, ShouldBeNil)
+		So(out.bucket, ShouldEqual, "bucket")
+		So(out.prefix, ShouldEqual, "archive/logs")
+		So(*out.config.Region, ShouldEqual, "us-west-2")
+		So(out.Pools(), ShouldEqual, true)
+		So(out.partition(packet("app.space", "")), ShouldEqual, "archive/logs/app.space/2020/06/07/08")
+	})
+	Convey("Ensure archives are written per hostname once they're too old", t, func() {
+		errorCh := make(chan error, 1)
+		out, err := Create("s3://key:secret@bucket/logs?endpoint="+server.URL+"&max_age=50ms", errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		out.Packets() <- packet("app1.space", "Test Message 1")
+		out.Packets() <- packet("app1.space", "Test Message 2")
+		out.Packets() <- packet("app2.space", "Test Message 3")
+		received := make(map[string]string)
+		for i := 0; i < 2; i++ {
+			select {
+			case object := <-testServer.Incoming:
+				received[regexp.MustCompile(`^/bucket/logs/([^/]+)/2020/06/07/08/[0-9TZ]+-[0-9a-f-]+\.json\.gz$`).FindStringSubmatch(object.Path)[1]] = object.Body
+			case err := <-errorCh:
+				log.Fatal(err.Error())
+			case <-time.NewTimer(time.Second * 5).C:
+				log.Fatal("Did not receive the archives")
+			}
+		}
+		So(received["app1.space"], ShouldContainSubstring, "\"message\":\"Test Message 1\"}\n{")
+		So(received["app1.space"], ShouldContainSubstring, "\"message\":\"Test Message 2\"}\n")
+		So(received["app2.space"], ShouldContainSubstring, "\"message\":\"Test Message 3\"}\n")
+		So(out.Close(), ShouldBeNil)
+		So(out.Close(), ShouldNotBeNil)
+	})
+	Convey("Ensure archives are written once they're too large or the output is closed", t, func() {
+		errorCh := make(chan error, 1)
+		out, err := Create("s3://key:secret@bucket/logs?endpoint="+server.URL+"&format=rfc5424&max_size=100", errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		out.Packets() <- packet("app.space", "Test Message 1")
+		out.Packets() <- packet("app.space", "Test Message 2")
+		select {
+		case object := <-testServer.Incoming:
+			So(object.Path, ShouldEndWith, ".log.gz")
+			So(object.Body, ShouldEqual, "<0>1 2020-06-07T08:09:10Z app.space S3ChannelTest - - - Test Message 1\n<0>1 2020-06-07T08:09:10Z app.space S3ChannelTest - - - Test Message 2\n")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive the archive")
+		}
+		out.Packets() <- packet("app.space", "Test Message 3")
+		So(out.Close(), ShouldBeNil)
+		select {
+		case object := <-testServer.Incoming:
+			So(object.Body, ShouldContainSubstring, "Test Message 3")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive the archive")
+		}
+	})
+	Convey("Ensure archives that fail to upload are retried", t, func() {
+		errorCh := make(chan error, 1)
+		testServer.ReturnError = true
+		out, err := Create("s3://key:secret@bucket/logs?endpoint="+server.URL+"&max_size=1", errorCh)
+		So(err, ShouldBeNil)
+		out.config.MaxRetries = new(int)
+		So(out.Dial(), ShouldBeNil)
+		out.Packets() <- packet("app.space", "Test Message 1")
+		select {
+		case err := <-errorCh:
+			So(err, ShouldNotBeNil)
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive an error")
+		}
+		testServer.ReturnError = false
+		So(out.Close(), ShouldBeNil)
+		select {
+		case object := <-testServer.Incoming:
+			So(object.Body, ShouldContainSubstring, "Test Message 1")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive the archive")
+		}
+	})
+	Convey("Ensure we can close while errors are not read", t, func() {
+		testServer.ReturnError = true
+		out, err := Create("s3://key:secret@bucket/logs?endpoint="+server.URL+"&max_size=1", make(chan error))
+		So(err, ShouldBeNil)
+		out.config.MaxRetries = new(int)
+		So(out.Dial(), ShouldBeNil)
+		out.Packets() <- packet("app.space", "Test Message 1")
+		out.Packets() <- packet("app.space", "Test Message 2")
+		<-time.NewTimer(time.Millisecond * 250).C
+		closed := make(chan error, 1)
+		go func() { closed <- out.Close() }()
+		select {
+		case err := <-closed:
+			So(err, ShouldBeNil)
+		case <-time.NewTimer(time.Second * 5).C:
+			So(false, ShouldEqual, true)
+		}
+		testServer.ReturnError = false
+	})
+}
@@ -0,0 +1,335 @@
+package splunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	syslog "github.com/trevorlinton/remote_syslog2/syslog"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Syslog splunk http event collector output struct
+type Syslog struct {
+	url          url.URL
+	endpoint     string
+	token        string
+	index        string
+	sourcetype   string
+	channel      string // set when indexer acknowledgement is enabled
+	ackTimeout   time.Duration
+	acks         map[int64]time.Time // ack ids waiting to be acknowledged and when they were sent
+	batchSize    int
+	batchTimeout time.Duration
+	client       *http.Client
+	batch        *bytes.Buffer
+	packets      chan syslog.Packet
+	errors       chan<- error
+	stop         chan struct{}
+	closed       bool
+}
+
+type event struct {
+	Time       json.Number       `json:"time"`
+	Host       string            `json:"host,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	Sourcetype string            `json:"sourcetype,omitempty"`
+	Index      string            `json:"index,omitempty"`
+	Event      string            `json:"event"`
+	Fields     map[string]string `json:"fields"`
+}
+
+type response struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId,omitempty"`
+}
+
+type ackResponse struct {
+	Acks map[string]bool `json:"acks"`
+}
+
+var syslogSchemas = []string{"splunk+https://", "splunk+http://"}
+
+var severities = []string{"emerg", "alert", "crit", "err", "warn", "notice", "info", "debug"}
+
+const defaultBatchSize = 1024 * 1024
+const defaultBatchTimeout = time.Second
+const defaultAckTimeout = time.Minute
+
+// Test the schema to see if its a splunk schema
+func Test(endpoint string) bool {
+	for _, schema := range syslogSchemas {
+		if strings.HasPrefix(strings.ToLower(endpoint), schema) == true {
+			return true
+		}
+	}
+	return false
+}
+
+func toURL(endpoint string) string {
+	if strings.HasPrefix(strings.ToLower(endpoint), "splunk+http://") {
+		return "http://" + endpoint[len("splunk+http://"):]
+	}
+	return "https://" + endpoint[len("splunk+https://"):]
+}
+
+// Create a new splunk output, the endpoint is in the form of
+// splunk+https://token@host:8088?[index=]&[sourcetype=]&[ack=true]&[ack_timeout=]&[batch_size=]&[batch_timeout=]
+func Create(endpoint string, errorsCh chan<- error) (*Syslog, error) {
+	if Test(endpoint) == false {
+		return nil, errors.New("Invalid endpoint")
+	}
+	u, err := url.Parse(toURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("a token is required, e.g. splunk+https://token@host:8088")
+	}
+	query := u.Query()
+	batchSize := defaultBatchSize
+	if query.Get("batch_size") != "" {
+		if batchSize, err = strconv.Atoi(query.Get("batch_size")); err != nil {
+			return nil, err
+		}
+	}
+	batchTimeout := defaultBatchTimeout
+	if query.Get("batch_timeout") != "" {
+		if batchTimeout, err = time.ParseDuration(query.Get("batch_timeout")); err != nil {
+			return nil, err
+		}
+	}
+	ackTimeout := defaultAckTimeout
+	if query.Get("ack_timeout") != "" {
+		if ackTimeout, err = time.ParseDuration(query.Get("ack_timeout")); err != nil {
+			return nil, err
+		}
+	}
+	if batchSize < 1 || batchTimeout <= 0 || ackTimeout <= 0 {
+		return nil, errors.New("batch_size, batch_timeout and ack_timeout must be more than 0")
+	}
+	var channel string
+	if query.Get("ack") == "true" {
+		channel = uuid.New().String()
+	}
+	token := u.User.Username()
+	u.User = nil
+	u.RawQuery = ""
+	u.Path = "/services/collector/event"
+	return &Syslog{
+		endpoint:     endpoint,
+		url:          *u,
+		token:        token,
+		index:        query.Get("index"),
+		sourcetype:   query.Get("sourcetype"),
+		channel:      channel,
+		ackTimeout:   ackTimeout,
+		acks:         make(map[int64]time.Time),
+		batchSize:    batchSize,
+		batchTimeout: batchTimeout,
+		client:       &http.Client{},
+		batch:        bytes.NewBuffer([]byte{}),
+		packets:      make(chan syslog.Packet, 10),
+		errors:       errorsCh,
+		stop:         make(chan struct{}, 1),
+		closed:       false,
+	}, nil
+}
+
+// Dial begins sending packets to splunk
+func (log *Syslog) Dial() error {
+	go log.loop()
+	return nil
+}
+
+// Close stops sending packets to splunk, packets waiting to be sent are sent first
+func (log *Syslog) Close() error {
+	if log.closed {
+		return errors.New("this output is already closed")
+	}
+	log.closed = true
+	log.stop <- struct{}{}
+	return nil
+}
+
+// Pools returns whether the output pools connections
+func (log *Syslog) Pools() bool {
+	return true
+}
+
+// Packets returns a channel where packets can be sent to the splunk output handler
+func (log *Syslog) Packets() chan syslog.Packet {
+	return log.packets
+}
+
+func (log *Syslog) add(p syslog.Packet) error {
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	e := event{
+		Time:       json.Number(strconv.FormatFloat(float64(t.UnixNano())/float64(time.Second), 'f', 3, 64)),
+		Host:       p.Hostname,
+		Source:     p.Tag,
+		Sourcetype: log.sourcetype,
+		Index:      log.index,
+		Event:      p.Message,
+		Fields:     map[string]string{"facility": strconv.Itoa(int(p.Facility))},
+	}
+	if int(p.Severity) < len(severities) {
+		e.Fields["severity"] = severities[p.Severity]
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	log.batch.Write(payload)
+	log.batch.WriteString("\n")
+	return nil
+}
+
+// post sends the body to the collector and returns its response, errors from the collector
+// are returned as "splunk hec error <code>: <text>".
+func (log *Syslog) post(u url.URL, body []byte, out interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Splunk "+log.token)
+	if log.channel != "" {
+		req.Header.Set("X-Splunk-Request-Channel", log.channel)
+	}
+	resp, err := log.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices || resp.StatusCode < http.StatusOK {
+		var r response
+		if err := json.Unmarshal(data, &r); err == nil && r.Text != "" {
+			return fmt.Errorf("splunk hec error %d: %s", r.Code, r.Text)
+		}
+		return errors.New("invalid response from endpoint: " + resp.Status)
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// send posts the events waiting to be sent, if acknowledgement is enabled the ack id is
+// kept until the events are acknowledged.
+func (log *Syslog) send() error {
+	if log.batch.Len() == 0 {
+		return nil
+	}
+	body := log.batch.Bytes()
+	log.batch = bytes.NewBuffer([]byte{})
+	var r response
+	if err := log.post(log.url, body, &r); err != nil {
+		return err
+	}
+	if r.Code != 0 {
+		return fmt.Errorf("splunk hec error %d: %s", r.Code, r.Text)
+	}
+	if log.channel != "" && r.AckID != nil {
+		log.acks[*r.AckID] = time.Now()
+	}
+	return nil
+}
+
+// checkAcks asks the collector which events have been indexed, events that have not
+// been indexed within the ack timeout are reported as errors.
+func (log *Syslog) checkAcks(now time.Time) error {
+	if len(log.acks) == 0 {
+		return nil
+	}
+	ids := make([]int64, 0, len(log.acks))
+	for id := range log.acks {
+		ids = append(ids, id)
+	}
+	body, err := json.Marshal(map[string][]int64{"acks": ids})
+	if err != nil {
+		return err
+	}
+	u := log.url
+	u.Path = "/services/collector/ack"
+	u.RawQuery = url.Values{"channel": []string{log.channel}}.Encode()
+	var r ackResponse
+	if err := log.post(u, body, &r); err != nil {
+		return err
+	}
+	for key, acked := range r.Acks {
+		id, err := strconv.ParseInt(key, 10, 64)
+		if err == nil && acked {
+			delete(log.acks, id)
+		}
+	}
+	expired := 0
+	for id, sent := range log.acks {
+		if now.Sub(sent) >= log.ackTimeout {
+			delete(log.acks, id)
+			expired++
+		}
+	}
+	if expired > 0 {
+		return fmt.Errorf("splunk hec did not acknowledge %d batches of events within %s", expired, log.ackTimeout)
+	}
+	return nil
+}
+
+func (log *Syslog) loop() {
+	ticker := time.NewTicker(log.batchTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case p, ok := <-log.packets:
+			if !ok {
+				return
+			}
+			if err := log.add(p); err != nil {
+				log.errors <- err
+			}
+			if log.batch.Len() >= log.batchSize {
+				if err := log.send(); err != nil {
+					log.errors <- err
+				}
+			}
+		case now := <-ticker.C:
+			if err := log.send(); err != nil {
+				log.errors <- err
+			}
+			if err := log.checkAcks(now); err != nil {
+				log.errors <- err
+			}
+		case <-log.stop:
+			for done := false; !done; {
+				select {
+				case p := <-log.packets:
+					log.add(p)
+				default:
+					done = true
+				}
+			}
+			if err := log.send(); err != nil {
+				select {
+				case log.errors <- err:
+				default:
+				}
+			}
+			return
+		}
+	}
+}
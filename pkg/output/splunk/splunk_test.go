@@ -0,0 +1,194 @@
+package splunk
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	syslog2 "github.com/trevorlinton/remote_syslog2/syslog"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type hecRequest struct {
+	Path   string
+	Header http.Header
+	Body   string
+}
+
+type TestHECServer struct {
+	Incoming    chan hecRequest
+	ReturnError bool
+	Acknowledge bool
+	mutex       sync.Mutex
+	ackID       int64
+}
+
+func (server *TestHECServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	req.Body.Close()
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if req.Header.Get("Authorization") != "Splunk secret-token" {
+		res.WriteHeader(http.StatusForbidden)
+		res.Write([]byte(`{"text":"Invalid token","code":4}`))
+		return
+	}
+	if server.ReturnError {
+		res.WriteHeader(http.StatusBadRequest)
+		res.Write([]byte(`{"text":"Incorrect index","code":7,"invalid-event-number":0}`))
+		return
+	}
+	if req.URL.Path == "/services/collector/ack" {
+		var acks struct {
+			Acks []int64 `json:"acks"`
+		}
+		if err := json.Unmarshal(body, &acks); err != nil {
+			log.Fatalln(err)
+		}
+		result := make(map[string]bool)
+		for _, id := range acks.Acks {
+			result[formatID(id)] = server.Acknowledge
+		}
+		data, _ := json.Marshal(map[string]map[string]bool{"acks": result})
+		res.Write(data)
+		return
+	}
+	server.Incoming <- hecRequest{Path: req.URL.Path, Header: req.Header, Body: string(body)}
+	if req.Header.Get("X-Splunk-Request-Channel") != "" {
+		res.Write([]byte(`{"text":"Success","code":0,"ackId":` + formatID(server.ackID) + `}`))
+		server.ackID++
+		return
+	}
+	res.Write([]byte(`{"text":"Success","code":0}`))
+}
+
+func formatID(i int64) string {
+	data, _ := json.Marshal(i)
+	return string(data)
+}
+
+func TestSplunkOutput(t *testing.T) {
+	testServer := TestHECServer{Incoming: make(chan hecRequest, 10)}
+	server := httptest.NewServer(&testServer)
+	defer server.Close()
+	host := server.Listener.Addr().String()
+	packet := syslog2.Packet{
+		Severity: 3,
+		Facility: 1,
+		Hostname: "app.space",
+		Tag:      "web.1",
+		Time:     time.Unix(1600000000, 250000000),
+		Message:  "Test Message",
+	}
+
+	Convey("Ensure splunk endpoints are validated", t, func() {
+		errorCh := make(chan error, 1)
+		_, err := Create("https://token@localhost:8088", errorCh)
+		So(err, ShouldNotBeNil)
+		_, err = Create("splunk+https://localhost:8088", errorCh)
+		So(err, ShouldNotBeNil)
+		_, err = Create("splunk+https://token@localhost:8088?batch_size=0", errorCh)
+		So(err, ShouldNotBeNil)
+		out, err := Create("splunk+https://token@localhost:8088?index=main&sourcetype=logtrain", errorCh)
+		So(err, ShouldBeNil)
+		So(out.url.String(), ShouldEqual, "https://localhost:8088/services/collector/event")
+		So(out.token, ShouldEqual, "token")
+		So(out.channel, ShouldEqual, "")
+		So(out.Pools(), ShouldEqual, true)
+	})
+	Convey("Ensure packets are sent as HEC events", t, func() {
+		errorCh := make(chan error, 1)
+		out, err := Create("splunk+http://secret-token@"+host+"?index=main&sourcetype=logtrain&batch_timeout=10ms", errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		out.Packets() <- packet
+		out.Packets() <- packet
+		var events []string
+		for len(events) < 2 {
+			select {
+			case req := <-testServer.Incoming:
+				So(req.Path, ShouldEqual, "/services/collector/event")
+				So(req.Header.Get("X-Splunk-Request-Channel"), ShouldEqual, "")
+				events = append(events, strings.Split(strings.TrimSpace(req.Body), "\n")...)
+			case err := <-errorCh:
+				log.Fatal(err.Error())
+			case <-time.NewTimer(time.Second * 5).C:
+				log.Fatal("Did not receive the events")
+			}
+		}
+		So(events[0], ShouldEqual, `{"time":1600000000.250,"host":"app.space","source":"web.1","sourcetype":"logtrain","index":"main","event":"Test Message","fields":{"facility":"1","severity":"err"}}`)
+		So(out.Close(), ShouldBeNil)
+		So(out.Close(), ShouldNotBeNil)
+	})
+	Convey("Ensure events are acknowledged when indexer acknowledgement is enabled", t, func() {
+		errorCh := make(chan error, 1)
+		testServer.Acknowledge = true
+		out, err := Create("splunk+http://secret-token@"+host+"?ack=true&batch_size=1&batch_timeout=10ms", errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		out.Packets() <- packet
+		select {
+		case req := <-testServer.Incoming:
+			So(req.Header.Get("X-Splunk-Request-Channel"), ShouldNotEqual, "")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive the events")
+		}
+		select {
+		case err := <-errorCh:
+			log.Fatal(err.Error())
+		case <-time.NewTimer(time.Millisecond * 100).C:
+		}
+		So(out.Close(), ShouldBeNil)
+		So(len(out.acks), ShouldEqual, 0)
+
+		testServer.Acknowledge = false
+		out, err = Create("splunk+http://secret-token@"+host+"?ack=true&ack_timeout=20ms&batch_size=1&batch_timeout=10ms", errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		out.Packets() <- packet
+		<-testServer.Incoming
+		select {
+		case err := <-errorCh:
+			So(err.Error(), ShouldContainSubstring, "did not acknowledge 1 batches")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive an error")
+		}
+		So(out.Close(), ShouldBeNil)
+	})
+	Convey("Ensure HEC errors are reported", t, func() {
+		errorCh := make(chan error, 1)
+		out, err := Create("splunk+http://wrong-token@"+host+"?batch_size=1", errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		out.Packets() <- packet
+		select {
+		case err := <-errorCh:
+			So(err.Error(), ShouldEqual, "splunk hec error 4: Invalid token")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive an error")
+		}
+		So(out.Close(), ShouldBeNil)
+
+		testServer.ReturnError = true
+		out, err = Create("splunk+http://secret-token@"+host+"?batch_size=1", errorCh)
+		So(err, ShouldBeNil)
+		So(out.Dial(), ShouldBeNil)
+		out.Packets() <- packet
+		select {
+		case err := <-errorCh:
+			So(err.Error(), ShouldEqual, "splunk hec error 7: Incorrect index")
+		case <-time.NewTimer(time.Second * 5).C:
+			log.Fatal("Did not receive an error")
+		}
+		So(out.Close(), ShouldBeNil)
+		testServer.ReturnError = false
+	})
+}
@@ -0,0 +1,194 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/trevorlinton/remote_syslog2/syslog"
+	"regexp"
+	"strings"
+)
+
+// Processor transforms packets between the inputs and the drains. A processor may return
+// the packet (modified or not), no packets to drop it or more than one packet to split it.
+type Processor interface {
+	Process(packet syslog.Packet) []syslog.Packet
+}
+
+// Chain is a list of processors where the packets from one processor are passed to the next.
+type Chain []Processor
+
+// Process runs the packet through every processor in the chain.
+func (chain Chain) Process(packet syslog.Packet) []syslog.Packet {
+	packets := []syslog.Packet{packet}
+	for _, processor := range chain {
+		next := make([]syslog.Packet, 0, len(packets))
+		for _, p := range packets {
+			next = append(next, processor.Process(p)...)
+		}
+		if len(next) == 0 {
+			return next
+		}
+		packets = next
+	}
+	return packets
+}
+
+// Drop drops packets with messages matching the regular expression.
+type Drop struct {
+	Pattern *regexp.Regexp
+}
+
+// Process drops the packet if its message matches.
+func (drop *Drop) Process(packet syslog.Packet) []syslog.Packet {
+	if drop.Pattern.MatchString(packet.Message) {
+		return nil
+	}
+	return []syslog.Packet{packet}
+}
+
+// Prefix adds static text to the start of messages.
+type Prefix struct {
+	Text string
+}
+
+// Process prefixes the message of the packet.
+func (prefix *Prefix) Process(packet syslog.Packet) []syslog.Packet {
+	packet.Message = prefix.Text + packet.Message
+	return []syslog.Packet{packet}
+}
+
+// RewriteHostname replaces matches of the regular expression in the hostname with the
+// replacement, the replacement may reference groups in the expression ($1).
+type RewriteHostname struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// Process rewrites the hostname of the packet.
+func (rewrite *RewriteHostname) Process(packet syslog.Packet) []syslog.Packet {
+	packet.Hostname = rewrite.Pattern.ReplaceAllString(packet.Hostname, rewrite.Replacement)
+	return []syslog.Packet{packet}
+}
+
+// RewriteTag replaces matches of the regular expression in the tag with the replacement,
+// the replacement may reference groups in the expression ($1).
+type RewriteTag struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// Process rewrites the tag of the packet.
+func (rewrite *RewriteTag) Process(packet syslog.Packet) []syslog.Packet {
+	packet.Tag = rewrite.Pattern.ReplaceAllString(packet.Tag, rewrite.Replacement)
+	return []syslog.Packet{packet}
+}
+
+// RenameField renames a field in messages that are JSON objects, other messages are untouched.
+type RenameField struct {
+	From string
+	To   string
+}
+
+// Process renames the field in the message of the packet.
+func (rename *RenameField) Process(packet syslog.Packet) []syslog.Packet {
+	if !strings.HasPrefix(strings.TrimSpace(packet.Message), "{") {
+		return []syslog.Packet{packet}
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(packet.Message), &fields); err != nil {
+		return []syslog.Packet{packet}
+	}
+	value, ok := fields[rename.From]
+	if !ok {
+		return []syslog.Packet{packet}
+	}
+	delete(fields, rename.From)
+	fields[rename.To] = value
+	var message bytes.Buffer
+	encoder := json.NewEncoder(&message)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(fields); err != nil {
+		return []syslog.Packet{packet}
+	}
+	packet.Message = strings.TrimSuffix(message.String(), "\n")
+	return []syslog.Packet{packet}
+}
+
+// splitReplacement splits an argument in the form of <regex>=<replacement> or <from>=<to>.
+func splitReplacement(argument string) (string, string, error) {
+	i := strings.LastIndex(argument, "=")
+	if i < 1 {
+		return "", "", errors.New("expected an argument in the form of <match>=<replacement>")
+	}
+	return argument[:i], argument[i+1:], nil
+}
+
+// Create returns the processor described by the spec, a spec is the name of the processor
+// and its argument separated by a colon:
+//
+//	drop:<regex>                     drop packets with messages matching the regex
+//	prefix:<text>                    add text to the start of every message
+//	hostname:<regex>=<replacement>   rewrite the hostname
+//	tag:<regex>=<replacement>        rewrite the tag
+//	rename:<from>=<to>               rename a field in JSON messages
+//	redact:<redactions>              mask authorization, jwt, aws, cards, email or all (comma separated)
+//	redact:/<regex>/                 mask values matching the regex
+func Create(spec string) (Processor, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("invalid processor " + spec + ", expected <name>:<argument>")
+	}
+	name, argument := strings.ToLower(strings.TrimSpace(parts[0])), parts[1]
+	switch name {
+	case "drop":
+		re, err := regexp.Compile(argument)
+		if err != nil {
+			return nil, err
+		}
+		return &Drop{Pattern: re}, nil
+	case "prefix":
+		return &Prefix{Text: argument}, nil
+	case "hostname", "tag":
+		match, replacement, err := splitReplacement(argument)
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(match)
+		if err != nil {
+			return nil, err
+		}
+		if name == "hostname" {
+			return &RewriteHostname{Pattern: re, Replacement: replacement}, nil
+		}
+		return &RewriteTag{Pattern: re, Replacement: replacement}, nil
+	case "rename":
+		from, to, err := splitReplacement(argument)
+		if err != nil {
+			return nil, err
+		}
+		return &RenameField{From: from, To: to}, nil
+	case "redact":
+		if len(argument) > 1 && strings.HasPrefix(argument, "/") && strings.HasSuffix(argument, "/") {
+			return CreateRedact([]string{}, []string{argument[1 : len(argument)-1]})
+		}
+		return CreateRedact(strings.Split(argument, ","), []string{})
+	}
+	return nil, errors.New("unknown processor " + name)
+}
+
+// CreateChain returns a chain of the processors described by the specs in order, see Create.
+func CreateChain(specs []string) (Chain, error) {
+	chain := make(Chain, 0, len(specs))
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		processor, err := Create(spec)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, processor)
+	}
+	return chain, nil
+}
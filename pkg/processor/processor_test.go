@@ -0,0 +1,81 @@
+package processor
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/trevorlinton/remote_syslog2/syslog"
+	"testing"
+)
+
+type split struct{}
+
+func (s *split) Process(packet syslog.Packet) []syslog.Packet {
+	second := packet
+	second.Message = packet.Message + " (again)"
+	return []syslog.Packet{packet, second}
+}
+
+func TestProcessors(t *testing.T) {
+	packet := syslog.Packet{
+		Hostname: "api-prod.payments",
+		Tag:      "web.1234",
+		Message:  `{"msg":"hello <there>","level":"info"}`,
+	}
+	Convey("Ensure invalid specs are rejected", t, func() {
+		_, err := Create("drop")
+		So(err, ShouldNotBeNil)
+		_, err = Create("explode:now")
+		So(err, ShouldNotBeNil)
+		_, err = Create("drop:(")
+		So(err, ShouldNotBeNil)
+		_, err = Create("hostname:api")
+		So(err, ShouldNotBeNil)
+		_, err = Create("rename:=message")
+		So(err, ShouldNotBeNil)
+		_, err = CreateChain([]string{"prefix:ok", "tag:("})
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Ensure packets can be dropped", t, func() {
+		p, err := Create("drop:^\\{\"msg\":\"hello")
+		So(err, ShouldBeNil)
+		So(len(p.Process(packet)), ShouldEqual, 0)
+		p, err = Create("drop:healthz")
+		So(err, ShouldBeNil)
+		So(p.Process(packet), ShouldResemble, []syslog.Packet{packet})
+	})
+	Convey("Ensure messages can be prefixed", t, func() {
+		p, err := Create("prefix:[payments] ")
+		So(err, ShouldBeNil)
+		So(p.Process(packet)[0].Message, ShouldEqual, `[payments] {"msg":"hello <there>","level":"info"}`)
+	})
+	Convey("Ensure hostnames and tags can be rewritten", t, func() {
+		p, err := Create("hostname:^([a-z]+)-prod\\.(.*)$=$1.$2")
+		So(err, ShouldBeNil)
+		So(p.Process(packet)[0].Hostname, ShouldEqual, "api.payments")
+		p, err = Create("tag:\\.[0-9]+$=")
+		So(err, ShouldBeNil)
+		So(p.Process(packet)[0].Tag, ShouldEqual, "web")
+	})
+	Convey("Ensure fields in JSON messages can be renamed", t, func() {
+		p, err := Create("rename:msg=message")
+		So(err, ShouldBeNil)
+		So(p.Process(packet)[0].Message, ShouldEqual, `{"level":"info","message":"hello <there>"}`)
+		other := packet
+		other.Message = "not json"
+		So(p.Process(other)[0].Message, ShouldEqual, "not json")
+	})
+	Convey("Ensure chains apply processors in order", t, func() {
+		chain, err := CreateChain([]string{"prefix:a", "", "prefix:b"})
+		So(err, ShouldBeNil)
+		So(len(chain), ShouldEqual, 2)
+		So(chain.Process(packet)[0].Message, ShouldStartWith, "ba{")
+		chain = append(Chain{&split{}}, chain...)
+		packets := chain.Process(packet)
+		So(len(packets), ShouldEqual, 2)
+		So(packets[1].Message, ShouldEndWith, "(again)")
+		So(packets[1].Message, ShouldStartWith, "ba{")
+		drop, err := Create("drop:.*")
+		So(err, ShouldBeNil)
+		So(len(append(chain, drop).Process(packet)), ShouldEqual, 0)
+		So(Chain{}.Process(packet), ShouldResemble, []syslog.Packet{packet})
+	})
+}
@@ -0,0 +1,229 @@
+package processor
+
+import (
+	"errors"
+	"github.com/trevorlinton/remote_syslog2/syslog"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Mask replaces redacted values in messages.
+const Mask = "[REDACTED]"
+
+type detector struct {
+	pattern *regexp.Regexp
+	keep    bool                       // keep the first group of the match (e.g. the header name) before the mask
+	mask    func(string) (string, int) // optional, masks the values within a match instead of the whole match
+}
+
+// Redact masks secrets and personal information in messages, it keeps count of how many
+// values it has masked per hostname.
+type Redact struct {
+	detectors []detector
+	counts    map[string]uint64
+	mutex     *sync.Mutex
+}
+
+var detectors = map[string]detector{
+	"authorization": {
+		pattern: regexp.MustCompile(`(?i)(\bauthorization"?\s*[:=]\s*"?)(?:(?:bearer|basic|digest|token)\s+)?[^\s",;]+`),
+		keep:    true,
+	},
+	"jwt": {
+		pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+	},
+	"aws": {
+		pattern: regexp.MustCompile(`\b(?:AKIA|ASIA|AGPA|AIDA|AROA|ANPA|ANVA|AIPA)[A-Z0-9]{16}\b|(?i)(\baws_?secret_?access_?key"?\s*[:=]\s*"?)[A-Za-z0-9/+]{40}`),
+		keep:    true,
+	},
+	"cards": {
+		pattern: regexp.MustCompile(`\b\d(?:[ -]?\d){12,}\b`),
+		mask:    maskCards,
+	},
+	"email": {
+		pattern: regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`),
+	},
+}
+
+// detectorOrder is the order built-in detectors are applied in, authorization headers go
+// first as they often contain JWTs.
+var detectorOrder = []string{"authorization", "jwt", "aws", "cards", "email"}
+
+// luhn returns true if the digits (ignoring spaces and dashes) look like a card number and
+// pass the luhn checksum. Card numbers start with 2 to 6, which leaves out millisecond timestamps.
+func luhn(number string) bool {
+	digits := strings.NewReplacer(" ", "", "-", "").Replace(number)
+	if len(digits) < 13 || len(digits) > 19 || digits[0] < '2' || digits[0] > '6' {
+		return false
+	}
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d = d * 2
+			if d > 9 {
+				d = d - 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// maskCards masks the card numbers in a run of digits separated by spaces or dashes. The run
+// may hold other numbers next to the card (e.g. "4111111111111111 12"), so each span of whole
+// digit groups that has the length of a card is checked, the longest span found first is masked.
+func maskCards(match string) (string, int) {
+	groups := make([][2]int, 0)
+	for i := 0; i < len(match); i++ {
+		if match[i] == ' ' || match[i] == '-' {
+			continue
+		}
+		if i == 0 || match[i-1] == ' ' || match[i-1] == '-' {
+			groups = append(groups, [2]int{i, i + 1})
+		} else {
+			groups[len(groups)-1][1] = i + 1
+		}
+	}
+	var masked strings.Builder
+	count, last := 0, 0
+	for i := 0; i < len(groups); i++ {
+		// spans longer than a card are never checked, this keeps long runs of numbers linear.
+		found, digits := -1, 0
+		for j := i; j < len(groups); j++ {
+			digits += groups[j][1] - groups[j][0]
+			if digits > 19 {
+				break
+			}
+			if digits >= 13 && luhn(match[groups[i][0]:groups[j][1]]) {
+				found = j
+			}
+		}
+		if found == -1 {
+			continue
+		}
+		masked.WriteString(match[last:groups[i][0]])
+		masked.WriteString(Mask)
+		last = groups[found][1]
+		count++
+		i = found
+	}
+	masked.WriteString(match[last:])
+	return masked.String(), count
+}
+
+func (d *detector) redact(message string) (string, int) {
+	count := 0
+	redacted := d.pattern.ReplaceAllStringFunc(message, func(match string) string {
+		if d.mask != nil {
+			masked, n := d.mask(match)
+			count += n
+			return masked
+		}
+		count++
+		if d.keep {
+			if groups := d.pattern.FindStringSubmatch(match); len(groups) > 1 {
+				return groups[1] + Mask
+			}
+		}
+		return Mask
+	})
+	return redacted, count
+}
+
+// CreateRedact returns a processor that redacts values found by the named built-in detectors
+// (authorization, jwt, aws, cards, email or all) and by the regular expressions in patterns.
+func CreateRedact(names []string, patterns []string) (*Redact, error) {
+	redact := Redact{
+		detectors: make([]detector, 0),
+		counts:    make(map[string]uint64),
+		mutex:     &sync.Mutex{},
+	}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "all" {
+			redact.detectors = redact.detectors[:0]
+			for _, n := range detectorOrder {
+				redact.detectors = append(redact.detectors, detectors[n])
+			}
+			break
+		}
+		d, ok := detectors[name]
+		if !ok {
+			return nil, errors.New("unknown redaction " + name)
+		}
+		redact.detectors = append(redact.detectors, d)
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		redact.detectors = append(redact.detectors, detector{pattern: re})
+	}
+	if len(redact.detectors) == 0 {
+		return nil, errors.New("nothing to redact was specified")
+	}
+	return &redact, nil
+}
+
+// Process masks the values found in the message of the packet.
+func (redact *Redact) Process(packet syslog.Packet) []syslog.Packet {
+	var total = 0
+	for i := range redact.detectors {
+		message, count := redact.detectors[i].redact(packet.Message)
+		if count > 0 {
+			packet.Message = message
+			total += count
+		}
+	}
+	if total > 0 {
+		redact.mutex.Lock()
+		redact.counts[packet.Hostname] += uint64(total)
+		redact.mutex.Unlock()
+	}
+	return []syslog.Packet{packet}
+}
+
+// Redactions returns how many values have been masked per hostname.
+func (redact *Redact) Redactions() map[string]uint64 {
+	redact.mutex.Lock()
+	defer redact.mutex.Unlock()
+	counts := make(map[string]uint64, len(redact.counts))
+	for host, count := range redact.counts {
+		counts[host] = count
+	}
+	return counts
+}
+
+// ResetRedactions sets the counts of masked values back to zero.
+func (redact *Redact) ResetRedactions() {
+	redact.mutex.Lock()
+	redact.counts = make(map[string]uint64)
+	redact.mutex.Unlock()
+}
+
+// Redactions returns how many values the redact processors in the chain have masked per hostname.
+func (chain Chain) Redactions() map[string]uint64 {
+	counts := make(map[string]uint64)
+	for _, processor := range chain {
+		if redact, ok := processor.(*Redact); ok {
+			for host, count := range redact.Redactions() {
+				counts[host] += count
+			}
+		}
+	}
+	return counts
+}
+
+// ResetRedactions resets the counts of the redact processors in the chain.
+func (chain Chain) ResetRedactions() {
+	for _, processor := range chain {
+		if redact, ok := processor.(*Redact); ok {
+			redact.ResetRedactions()
+		}
+	}
+}
@@ -1,12 +1,17 @@
 package router
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"github.com/akkeris/logtrain/internal/debug"
+	"github.com/akkeris/logtrain/internal/queue"
 	"github.com/akkeris/logtrain/pkg/output"
 	"github.com/trevorlinton/remote_syslog2/syslog"
 	"hash/crc32"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -50,6 +55,12 @@ type Drain struct {
 	transportPools bool
 	pressureTrend  float64
 	scaling        bool
+	queue          *queue.Queue   // optional, absorbs packets when the input buffer is full
+	options        output.Options // passed to the outputs the drain creates
+	paused         uint32         // set to 1 while the drain is paused because of errors
+	replayStop     chan struct{}
+	closed         bool           // set once Close is called, a closed drain can not be dialed
+	loops          sync.WaitGroup // the write loop started by Dial, Close waits for it
 }
 
 // Create a new drain
@@ -77,6 +88,7 @@ func Create(endpoint string, maxconnections uint32, sticky bool) (*Drain, error)
 		stop:           make(chan struct{}, 1),
 		pressureTrend:  0,
 		scaling:        false,
+		replayStop:     make(chan struct{}, 1),
 	}
 
 	if err := output.TestEndpoint(endpoint); err != nil {
@@ -92,31 +104,133 @@ func (drain *Drain) MaxConnections() uint32 {
 
 // OpenConnections returns the open connections
 func (drain *Drain) OpenConnections() uint32 {
+	drain.mutex.Lock()
+	defer drain.mutex.Unlock()
 	return drain.open
 }
 
 // Pressure returns a value between 0-1 represent the percent of full buffers
 func (drain *Drain) Pressure() float64 {
+	drain.mutex.Lock()
+	defer drain.mutex.Unlock()
 	return drain.pressure
 }
 
 // Sent returns the amount of packets sent since inception or the last time ResetMetrics was fired
 func (drain *Drain) Sent() uint32 {
+	drain.mutex.Lock()
+	defer drain.mutex.Unlock()
 	return drain.sent
 }
 
+// Paused returns true if the drain is paused because the endpoint returned too many errors
+func (drain *Drain) Paused() bool {
+	return atomic.LoadUint32(&drain.paused) == 1
+}
+
 // Errors returns the amount of errors that has occured on the drain
 func (drain *Drain) Errors() uint32 {
+	drain.mutex.Lock()
+	defer drain.mutex.Unlock()
 	return drain.errors
 }
 
-// ResetMetrics sets the sent and errors values to zero
+// QueuedBytes returns the size of the packets waiting in the disk buffer
+func (drain *Drain) QueuedBytes() int64 {
+	if drain.queue == nil {
+		return 0
+	}
+	return drain.queue.Bytes()
+}
+
+// Evicted returns the amount of packets removed from the disk buffer before they were sent because it was full
+func (drain *Drain) Evicted() uint64 {
+	if drain.queue == nil {
+		return 0
+	}
+	return drain.queue.Evicted()
+}
+
+// ResetMetrics sets the sent, errors and evicted values to zero
 func (drain *Drain) ResetMetrics() {
+	drain.mutex.Lock()
 	drain.sent = 0
 	drain.errors = 0
+	drain.mutex.Unlock()
+	if drain.queue != nil {
+		drain.queue.ResetEvicted()
+	}
+}
+
+// Buffer adds a disk buffer to the drain in a directory for the endpoint under path, packets
+// that do not fit in memory are written to it and sent in order once the endpoint catches up.
+// Packets left in the buffer by a previous drain to the same endpoint are sent first. This must
+// be called before Dial.
+func (drain *Drain) Buffer(path string, maxBytes int64) error {
+	if drain.queue != nil {
+		return errors.New("the drain already has a buffer")
+	}
+	hash := sha1.Sum([]byte(drain.Endpoint))
+	q, err := queue.Open(filepath.Join(path, hex.EncodeToString(hash[:])), maxBytes)
+	if err != nil {
+		return err
+	}
+	drain.queue = q
+	return nil
+}
+
+// Send queues the packet to be sent, if the drain is backed up the packet is written to its
+// disk buffer. Send returns false if the packet was dropped.
+func (drain *Drain) Send(packet syslog.Packet) bool {
+	if drain.queue == nil {
+		select {
+		case drain.Input <- packet:
+			return true
+		default:
+			return false
+		}
+	}
+	// Once packets are in the buffer new packets go behind them to keep them in order.
+	if drain.queue.Bytes() == 0 {
+		select {
+		case drain.Input <- packet:
+			return true
+		default:
+		}
+	}
+	if err := drain.queue.Push(packet); err != nil {
+		debug.Errorf("[drains] Unable to write to the buffer for %s: %s\n", drain.Endpoint, err.Error())
+		return false
+	}
+	return true
+}
+
+// replay moves packets from the disk buffer to the input as it has room for them.
+func (drain *Drain) replay() {
+	for {
+		packet, ok, err := drain.queue.Peek()
+		if err != nil {
+			debug.Errorf("[drains] Unable to read from the buffer for %s: %s\n", drain.Endpoint, err.Error())
+		}
+		if !ok {
+			select {
+			case <-drain.queue.Ready():
+				continue
+			case <-drain.replayStop:
+				return
+			}
+		}
+		select {
+		case drain.Input <- packet:
+			drain.queue.Next()
+		case <-drain.replayStop:
+			return
+		}
+	}
 }
 
-// Dial connects to the endpoint via the specified schema
+// Dial connects to the endpoint via the specified schema, if it fails Dial may be called again
+// to retry. Packets sent in the mean time are kept in the input and disk buffer.
 func (drain *Drain) Dial() error {
 	debug.Infof("[drains] Dailing drain %s...\n", drain.Endpoint)
 	if drain.open != 0 {
@@ -127,6 +241,7 @@ func (drain *Drain) Dial() error {
 		return err
 	}
 
+	drain.loops.Add(1)
 	if drain.transportPools == true {
 		go drain.loopTransportPools()
 	} else if drain.sticky == true {
@@ -134,6 +249,9 @@ func (drain *Drain) Dial() error {
 	} else {
 		go drain.loopRoundRobin()
 	}
+	if drain.queue != nil {
+		go drain.replay()
+	}
 	return nil
 }
 
@@ -141,9 +259,18 @@ func (drain *Drain) Dial() error {
 func (drain *Drain) Close() error {
 	debug.Infof("[drains] Closing all connections in drain to %s\n", drain.Endpoint)
 	drain.stop <- struct{}{}
+	// the connections must not be closed while the write loop is sending on them.
+	drain.loops.Wait()
 	drain.mutex.Lock()
 	defer drain.mutex.Unlock()
+	drain.closed = true
 	var err error
+	if drain.queue != nil {
+		drain.replayStop <- struct{}{}
+		if err = drain.queue.Close(); err != nil {
+			debug.Debugf("[drains] Received error trying to close the buffer for %s: %s\n", drain.Endpoint, err.Error())
+		}
+	}
 	for _, conn := range drain.connections {
 		debug.Debugf("[drains] Closing connection to %s\n", drain.Endpoint)
 		if err = conn.Close(); err != nil {
@@ -159,11 +286,14 @@ func (drain *Drain) connect() error {
 	drain.mutex.Lock()
 	defer drain.mutex.Unlock()
 	defer func() { drain.scaling = false }()
+	if drain.closed {
+		return errors.New("the drain is closed")
+	}
 	if drain.open >= drain.maxconnections {
 		return nil
 	}
 	debug.Debugf("[drains] Drain %s connecting...\n", drain.Endpoint)
-	conn, err := output.Create(drain.Endpoint, drain.Error)
+	conn, err := output.Create(drain.Endpoint, drain.Error, drain.options)
 	if err != nil {
 		debug.Errorf("[drains] Received an error attempting to create endpoint %s: %s\n", drain.Endpoint, err.Error())
 		return err
@@ -211,6 +341,7 @@ func (drain *Drain) disconnect(force bool) error {
  */
 
 func (drain *Drain) loopRoundRobin() {
+	defer drain.loops.Done()
 	var maxPackets = cap(drain.Input)
 	for {
 		select {
@@ -219,6 +350,11 @@ func (drain *Drain) loopRoundRobin() {
 				return
 			}
 			drain.mutex.Lock()
+			if drain.open == 0 {
+				// the drain was closed as the packet was read.
+				drain.mutex.Unlock()
+				continue
+			}
 			drain.sent++
 			drain.connections[drain.sent%drain.open].Packets() <- packet
 			newPressure := (drain.pressure + (float64(len(drain.Input)) / float64(maxPackets))) / float64(2)
@@ -240,6 +376,7 @@ func (drain *Drain) loopRoundRobin() {
 
 // Potentially look at the previous pressure see if its a downward trend.
 func (drain *Drain) loopSticky() {
+	defer drain.loops.Done()
 	var maxPackets = cap(drain.Input)
 	for {
 		select {
@@ -248,6 +385,11 @@ func (drain *Drain) loopSticky() {
 				return
 			}
 			drain.mutex.Lock()
+			if drain.open == 0 {
+				// the drain was closed as the packet was read.
+				drain.mutex.Unlock()
+				continue
+			}
 			drain.sent++
 			drain.connections[uint32(crc32.ChecksumIEEE([]byte(packet.Hostname+packet.Tag))%drain.open)].Packets() <- packet
 			newPressure := (drain.pressure + (float64(len(drain.Input)) / float64(maxPackets))) / float64(2)
@@ -265,14 +407,23 @@ func (drain *Drain) loopSticky() {
 			if !ok {
 				return
 			}
-			if err != nil && drain.errors < drainErrorThreshold {
+			drain.mutex.Lock()
+			errors, sent := drain.errors, drain.sent
+			drain.errors++
+			drain.mutex.Unlock()
+			if err != nil && errors < drainErrorThreshold {
 				debug.Errorf("[drains] An error occured on endpoint %s: %s", drain.Endpoint, err.Error())
 			}
-			if float64(drain.errors) > (float64(drain.sent)*drainErrorPercentage) && drain.errors < drainErrorThreshold {
+			if float64(errors) > (float64(sent)*drainErrorPercentage) && errors < drainErrorThreshold {
 				debug.Errorf("[drains] Pausing drain %s as it has incurred too many errors.\n", drain.Endpoint)
-				<-time.NewTimer(time.Minute * drainErrorTimeoutInMins).C
+				atomic.StoreUint32(&drain.paused, 1)
+				select {
+				case <-time.NewTimer(time.Minute * drainErrorTimeoutInMins).C:
+				case <-drain.stop:
+					return
+				}
+				atomic.StoreUint32(&drain.paused, 0)
 			}
-			drain.errors++
 		case <-drain.stop:
 			return
 		}
@@ -280,6 +431,7 @@ func (drain *Drain) loopSticky() {
 }
 
 func (drain *Drain) loopTransportPools() {
+	defer drain.loops.Done()
 	var maxPackets = cap(drain.Input)
 	for {
 		select {
@@ -288,6 +440,11 @@ func (drain *Drain) loopTransportPools() {
 				return
 			}
 			drain.mutex.Lock()
+			if drain.open == 0 {
+				// the drain was closed as the packet was read.
+				drain.mutex.Unlock()
+				continue
+			}
 			drain.sent++
 			drain.connections[0].Packets() <- packet
 			drain.pressure = (drain.pressure + (float64(len(drain.Input)) / float64(maxPackets))) / float64(2)
@@ -296,14 +453,23 @@ func (drain *Drain) loopTransportPools() {
 			if !ok {
 				return
 			}
-			if drain.errors < drainErrorThreshold {
+			drain.mutex.Lock()
+			errors, sent := drain.errors, drain.sent
+			drain.errors++
+			drain.mutex.Unlock()
+			if errors < drainErrorThreshold {
 				debug.Errorf("[drains] An error occured on endpoint %s: %s", drain.Endpoint, err.Error())
 			}
-			if float64(drain.errors) > (float64(drain.sent)*drainErrorPercentage) && drain.errors < drainErrorThreshold {
+			if float64(errors) > (float64(sent)*drainErrorPercentage) && errors < drainErrorThreshold {
 				debug.Errorf("[drains] Pausing drain %s as it has incurred too many errors.\n", drain.Endpoint)
-				<-time.NewTimer(time.Minute * drainErrorTimeoutInMins).C
+				atomic.StoreUint32(&drain.paused, 1)
+				select {
+				case <-time.NewTimer(time.Minute * drainErrorTimeoutInMins).C:
+				case <-drain.stop:
+					return
+				}
+				atomic.StoreUint32(&drain.paused, 0)
 			}
-			drain.errors++
 		case <-drain.stop:
 			return
 		}
@@ -9,8 +9,10 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -47,7 +49,7 @@ type SudoSyslogServer struct {
 }
 
 func (server *SudoSyslogServer) Listen() {
-	var connections = 0
+	var connections int32 = 0
 	for {
 		conn, err := server.listener.Accept()
 		if err != nil {
@@ -55,10 +57,8 @@ func (server *SudoSyslogServer) Listen() {
 			server.stop <- struct{}{}
 			return
 		}
+		connIndex := int(atomic.AddInt32(&connections, 1) - 1)
 		go func() {
-			var connIndex = connections
-			connections++
-			var written int64 = 0
 			buffer := bytes.NewBuffer([]byte{})
 			go func() {
 				select {
@@ -68,10 +68,10 @@ func (server *SudoSyslogServer) Listen() {
 				}
 			}()
 			for {
-				written, err = io.CopyN(buffer, conn, 1)
+				written, err := io.CopyN(buffer, conn, 1)
 				if err != nil {
 					conn.Close()
-					connections--
+					atomic.AddInt32(&connections, -1)
 					return
 				}
 				b := buffer.Bytes()
@@ -84,7 +84,7 @@ func (server *SudoSyslogServer) Listen() {
 				}
 				if written == 0 {
 					conn.Close()
-					connections--
+					atomic.AddInt32(&connections, -1)
 					return
 				}
 			}
@@ -230,6 +230,40 @@ func TestDrains(t *testing.T) {
 		}
 		drain.Close()
 	})
+	Convey("Ensure a drain can be closed while packets are flowing", t, func() {
+		flowing, err := CreateSudoSyslogServer("10525")
+		So(err, ShouldBeNil)
+		go flowing.Listen()
+		go func() {
+			for range flowing.Received {
+			}
+		}()
+		for attempt := 0; attempt < 20; attempt++ {
+			drain, err := Create("syslog+tcp://localhost:10525", 1024, true)
+			So(err, ShouldBeNil)
+			So(drain.Dial(), ShouldBeNil)
+			stop := make(chan struct{})
+			go func() {
+				for i := 0; ; i++ {
+					select {
+					case drain.Input <- syslog2.Packet{
+						Time:     time.Now(),
+						Hostname: "localhost",
+						Tag:      "CloseTest" + strconv.Itoa(i%10),
+						Message:  "Test Message " + strconv.Itoa(i),
+					}:
+					case <-stop:
+						return
+					}
+				}
+			}()
+			<-time.NewTimer(time.Millisecond * 10).C
+			So(drain.Close(), ShouldBeNil)
+			close(stop)
+			So(drain.OpenConnections(), ShouldEqual, 0)
+		}
+		flowing.Close()
+	})
 	Convey("Ensure drain with transport specific pooling works", t, func() {
 		testHttpServer := TestHttpServer{
 			Incoming:    make(chan string, 1),
@@ -280,6 +314,39 @@ func TestDrains(t *testing.T) {
 		drain.Close() // ensure calling it twice does not error out.
 		s.Close()
 	})
+	Convey("Ensure drain with a buffer keeps packets that overflow and sends them in order", t, func() {
+		So(os.RemoveAll("/tmp/drains_test"), ShouldBeNil)
+		var testAmount = bufferSize + 500
+		drain, err := Create("syslog+tcp://localhost:10512", 1, false)
+		So(drain, ShouldNotBeNil)
+		So(err, ShouldBeNil)
+		So(drain.Buffer("/tmp/drains_test", 1024*1024), ShouldBeNil)
+		So(drain.Buffer("/tmp/drains_test", 1024*1024), ShouldNotBeNil)
+		for i := 0; i < testAmount; i++ {
+			drain.Send(syslog2.Packet{
+				Severity: 0,
+				Facility: 0,
+				Time:     time.Now(),
+				Hostname: "localhost",
+				Tag:      "BufferTest",
+				Message:  "Test Message " + strconv.Itoa(i),
+			})
+		}
+		So(drain.QueuedBytes(), ShouldBeGreaterThan, 0)
+		So(drain.Evicted(), ShouldEqual, 0)
+		So(drain.Dial(), ShouldBeNil)
+		for i := 0; i < testAmount; i++ {
+			select {
+			case message := <-server.Received:
+				So(message.Message, ShouldEndWith, " Test Message "+strconv.Itoa(i)+"\n")
+			case <-time.NewTimer(time.Second * 5).C:
+				log.Fatalf("Did not receive all of the logs, only %d out of %d\n", i, testAmount)
+			}
+		}
+		So(drain.QueuedBytes(), ShouldEqual, 0)
+		drain.Close()
+		So(os.RemoveAll("/tmp/drains_test"), ShouldBeNil)
+	})
 	Convey("Ensure we clean up.", t, func() {
 		server.Close()
 	})
@@ -0,0 +1,97 @@
+package router
+
+import (
+	"errors"
+	"github.com/akkeris/logtrain/internal/storage"
+	"github.com/akkeris/logtrain/pkg/output"
+	"github.com/akkeris/logtrain/pkg/processor"
+	"github.com/trevorlinton/remote_syslog2/syslog"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// filteredRoute is a storage.LogRoute with its filters and processors compiled so they can be
+// evaluated on every packet.
+type filteredRoute struct {
+	storage.LogRoute
+	severity   syslog.Priority
+	include    *regexp.Regexp
+	exclude    *regexp.Regexp
+	processors processor.Chain
+}
+
+// ParseSeverity returns the severity for a name (emerg, alert, crit, err, warn, notice, info, debug)
+// or its number, error and warning are accepted as well.
+func ParseSeverity(name string) (syslog.Priority, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "error" {
+		name = "err"
+	} else if name == "warning" {
+		name = "warn"
+	}
+	if n, err := strconv.Atoi(name); err == nil && n >= int(syslog.SevEmerg) && n <= int(syslog.SevDebug) {
+		return syslog.Priority(n), nil
+	}
+	return syslog.Severity(name)
+}
+
+func compileRoute(r storage.LogRoute) (filteredRoute, error) {
+	compiled := filteredRoute{
+		LogRoute: r,
+		severity: syslog.SevDebug,
+	}
+	var err error
+	if r.Severity != "" {
+		if compiled.severity, err = ParseSeverity(r.Severity); err != nil {
+			return compiled, err
+		}
+	}
+	if r.Include != "" {
+		if compiled.include, err = regexp.Compile(r.Include); err != nil {
+			return compiled, err
+		}
+	}
+	if r.Exclude != "" {
+		if compiled.exclude, err = regexp.Compile(r.Exclude); err != nil {
+			return compiled, err
+		}
+	}
+	if compiled.processors, err = processor.CreateChain(r.Processors); err != nil {
+		return compiled, err
+	}
+	return compiled, nil
+}
+
+// ValidateRoute returns an error if the endpoint, hostname pattern, filters or processors
+// of the route are invalid.
+func ValidateRoute(r storage.LogRoute) error {
+	if r.Hostname == "" {
+		return errors.New("the route must have a hostname")
+	}
+	if err := output.TestEndpoint(r.Endpoint); err != nil {
+		return err
+	}
+	if IsHostnamePattern(r.Hostname) {
+		if _, err := CompileHostnamePattern(r.Hostname); err != nil {
+			return err
+		}
+	}
+	_, err := compileRoute(r)
+	return err
+}
+
+// Matches returns true if the packet passes the tag and filters of the route. Lower severities
+// are more severe, so a packet matches if its severity is at or below the minimum severity.
+func (r *filteredRoute) Matches(packet syslog.Packet) bool {
+	if !r.MatchesTag(packet.Tag) || packet.Severity > r.severity {
+		return false
+	}
+	if r.include != nil && !r.include.MatchString(packet.Message) {
+		return false
+	}
+	if r.exclude != nil && r.exclude.MatchString(packet.Message) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package router
+
+import (
+	"github.com/akkeris/logtrain/internal/storage"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/trevorlinton/remote_syslog2/syslog"
+	"log"
+	"testing"
+)
+
+func compileRoutes(routes ...storage.LogRoute) []filteredRoute {
+	compiled := make([]filteredRoute, 0)
+	for _, r := range routes {
+		c, err := compileRoute(r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled
+}
+
+func endpointsForPacket(routes []filteredRoute, packet syslog.Packet) []string {
+	endpoints := make([]string, 0)
+	for _, route := range routesForPacket(routes, packet) {
+		endpoints = append(endpoints, route.Endpoint)
+	}
+	return endpoints
+}
+
+func TestFilters(t *testing.T) {
+	Convey("Ensure severities are parsed", t, func() {
+		sev, err := ParseSeverity("err")
+		So(err, ShouldBeNil)
+		So(sev, ShouldEqual, syslog.SevErr)
+		sev, err = ParseSeverity("Warning")
+		So(err, ShouldBeNil)
+		So(sev, ShouldEqual, syslog.SevWarning)
+		sev, err = ParseSeverity("6")
+		So(err, ShouldBeNil)
+		So(sev, ShouldEqual, syslog.SevInfo)
+		_, err = ParseSeverity("8")
+		So(err, ShouldNotBeNil)
+		_, err = ParseSeverity("loud")
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Ensure invalid filters are rejected", t, func() {
+		_, err := compileRoute(storage.LogRoute{Endpoint: "syslog://localhost:123", Severity: "loud"})
+		So(err, ShouldNotBeNil)
+		_, err = compileRoute(storage.LogRoute{Endpoint: "syslog://localhost:123", Include: "("})
+		So(err, ShouldNotBeNil)
+		_, err = compileRoute(storage.LogRoute{Endpoint: "syslog://localhost:123", Exclude: "("})
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Ensure routes are validated", t, func() {
+		So(ValidateRoute(storage.LogRoute{Endpoint: "syslog://localhost:123", Hostname: "app.space", Severity: "err"}), ShouldBeNil)
+		So(ValidateRoute(storage.LogRoute{Endpoint: "syslog://localhost:123"}), ShouldNotBeNil)
+		So(ValidateRoute(storage.LogRoute{Endpoint: "nope://localhost:123", Hostname: "app.space"}), ShouldNotBeNil)
+		So(ValidateRoute(storage.LogRoute{Endpoint: "syslog://localhost:123", Hostname: "/^app-(/"}), ShouldNotBeNil)
+		So(ValidateRoute(storage.LogRoute{Endpoint: "syslog://localhost:123", Hostname: "app.space", Processors: []string{"nope"}}), ShouldNotBeNil)
+	})
+	Convey("Ensure packets are filtered by severity and message", t, func() {
+		routes := compileRoutes(
+			storage.LogRoute{Endpoint: "https://pager.example.com/", Hostname: "app.filters", Severity: "err"},
+			storage.LogRoute{Endpoint: "https://search.example.com/", Hostname: "app.filters", Include: "^GET ", Exclude: "/healthz"},
+			storage.LogRoute{Endpoint: "https://archive.example.com/", Hostname: "app.filters"},
+		)
+		So(endpointsForPacket(routes, syslog.Packet{Severity: syslog.SevCrit, Message: "out of memory"}), ShouldResemble,
+			[]string{"https://pager.example.com/", "https://archive.example.com/"})
+		So(endpointsForPacket(routes, syslog.Packet{Severity: syslog.SevInfo, Message: "GET /users 200"}), ShouldResemble,
+			[]string{"https://search.example.com/", "https://archive.example.com/"})
+		So(endpointsForPacket(routes, syslog.Packet{Severity: syslog.SevInfo, Message: "GET /healthz 200"}), ShouldResemble,
+			[]string{"https://archive.example.com/"})
+		So(endpointsForPacket(routes[:2], syslog.Packet{Severity: syslog.SevWarning, Message: "POST /users 500"}), ShouldResemble,
+			[]string{})
+	})
+}
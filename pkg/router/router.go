@@ -5,11 +5,28 @@ import (
 	"github.com/akkeris/logtrain/internal/debug"
 	"github.com/akkeris/logtrain/internal/storage"
 	"github.com/akkeris/logtrain/pkg/input"
+	"github.com/akkeris/logtrain/pkg/output"
+	"github.com/akkeris/logtrain/pkg/processor"
 	"github.com/trevorlinton/remote_syslog2/syslog"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// maxHostnameCacheSize is the amount of hostnames resolved through hostname patterns we keep
+// before starting over, this prevents an unbounded cache if hostnames are random.
+const maxHostnameCacheSize = 10000
+
+// redialMinBackoff and redialMaxBackoff bound how long the router waits between attempts to
+// connect a drain to an endpoint that is down, the wait doubles after each failed attempt.
+const redialMinBackoff = time.Second
+const redialMaxBackoff = time.Minute
+
 /*
  * Responsibilities:
  * - A single point for incoming packets from various inputs.
@@ -24,24 +41,51 @@ import (
  * - The router and drains have a 1-many relationship, yet tightly dependent/coupled.
  */
 
+// Reasons a packet is dropped, see Router.Drops.
+const (
+	DropNoRoute         = "no_route"          // no route matched the packet
+	DropBufferFull      = "buffer_full"       // the drain could not keep up with the packets sent to it
+	DropFailedToConnect = "failed_to_connect" // the drain could not be created or could not connect
+	DropPaused          = "paused"            // the drain is paused because its endpoint returned too many errors
+	DropFiltered        = "filtered"          // a route filter or processor dropped the packet on purpose, these are not dead lettered
+)
+
+// DropKey identifies dropped packets by the reason they were dropped and where they were going,
+// the endpoint is empty for packets with no route.
+type DropKey struct {
+	Reason   string
+	Hostname string
+	Endpoint string
+}
+
 type Metric struct {
 	MaxConnections uint32
 	Connections    uint32
 	Pressure       float64
 	Sent           uint32
 	Errors         uint32
+	QueuedBytes    int64
+	Evicted        uint64
 }
 
 type Router struct {
 	datasources           []storage.DataSource
-	deadPacket            int
+	deadLetter            *Drain // Optional, receives dropped packets
+	drops                 map[DropKey]uint64
 	drainByEndpoint       map[string]*Drain
-	drainsFailedToConnect map[string]bool
-	endpointsByHost       map[string][]string // Used to find defined endpoints by hostname (but may or may not be open)
+	drainsFailedToConnect map[string]bool            // Endpoints being reconnected in the background
+	routesByHost          map[string][]filteredRoute // Used to find defined routes by hostname (their drains may or may not be open)
+	routesByHostCache     map[string][]filteredRoute // Used to find routes (exact and pattern) for hostnames when patterns are defined
+	hostnamePatterns      map[string]*regexp.Regexp
 	inputs                map[string]input.Input
+	inputPackets          map[string]*uint64 // The amount of packets received from each input, accessed atomically
+	processors            processor.Chain    // Applied to every packet before it's routed
 	stickyPools           bool
 	maxConnections        uint32
-	mutex                 *sync.Mutex
+	bufferPath            string // Drains are given a disk buffer in this directory if set
+	bufferMaxBytes        int64
+	outputOptions         output.Options // Passed to the outputs of every drain
+	mutex                 *sync.RWMutex
 	stop                  chan struct{}
 	reloop                chan struct{}
 	running               bool
@@ -50,14 +94,18 @@ type Router struct {
 func NewRouter(datasources []storage.DataSource, stickyPools bool, maxConnections uint32) (*Router, error) {
 	router := Router{
 		datasources:           datasources,
-		deadPacket:            0,
+		drops:                 make(map[DropKey]uint64),
 		drainByEndpoint:       make(map[string]*Drain),
 		drainsFailedToConnect: make(map[string]bool),
-		endpointsByHost:       make(map[string][]string),
+		routesByHost:          make(map[string][]filteredRoute),
+		routesByHostCache:     make(map[string][]filteredRoute),
+		hostnamePatterns:      make(map[string]*regexp.Regexp),
 		inputs:                make(map[string]input.Input, 0),
+		inputPackets:          make(map[string]*uint64, 0),
+		processors:            make(processor.Chain, 0),
 		stickyPools:           stickyPools,
 		maxConnections:        maxConnections,
-		mutex:                 &sync.Mutex{},
+		mutex:                 &sync.RWMutex{},
 		stop:                  make(chan struct{}, 1),
 		reloop:                make(chan struct{}, 1),
 		running:               false,
@@ -103,45 +151,234 @@ func (router *Router) Dial() error {
 	return nil
 }
 
+func drainMetric(drain *Drain) Metric {
+	return Metric{
+		MaxConnections: drain.MaxConnections(),
+		Connections:    drain.OpenConnections(),
+		Pressure:       drain.Pressure(),
+		Sent:           drain.Sent(),
+		Errors:         drain.Errors(),
+		QueuedBytes:    drain.QueuedBytes(),
+		Evicted:        drain.Evicted(),
+	}
+}
+
 func (router *Router) Metrics() map[string]Metric {
-	router.mutex.Lock()
-	defer router.mutex.Unlock()
+	router.mutex.RLock()
+	defer router.mutex.RUnlock()
 	metrics := make(map[string]Metric, 0)
-	for host, endpoints := range router.endpointsByHost {
-		for _, endpoint := range endpoints {
-			if drain, ok := router.drainByEndpoint[endpoint]; ok {
-				metrics[host+"->"+drain.Endpoint] = Metric{
-					MaxConnections: drain.MaxConnections(),
-					Connections:    drain.OpenConnections(),
-					Pressure:       drain.Pressure(),
-					Sent:           drain.Sent(),
-					Errors:         drain.Errors(),
-				}
+	for host, routes := range router.routesByHost {
+		for _, route := range routes {
+			if drain, ok := router.drainByEndpoint[route.Endpoint]; ok {
+				metrics[host+"->"+drain.Endpoint] = drainMetric(drain)
 			}
 		}
 	}
 	return metrics
 }
 
+// Drains returns the metrics of each open drain by its endpoint.
+func (router *Router) Drains() map[string]Metric {
+	router.mutex.RLock()
+	defer router.mutex.RUnlock()
+	drains := make(map[string]Metric, len(router.drainByEndpoint))
+	for endpoint, drain := range router.drainByEndpoint {
+		drains[endpoint] = drainMetric(drain)
+	}
+	return drains
+}
+
+// CloseDrain closes the drain to the endpoint, a new drain is opened when the next packet
+// is sent to the endpoint.
+func (router *Router) CloseDrain(endpoint string) error {
+	router.mutex.Lock()
+	drain, ok := router.drainByEndpoint[endpoint]
+	delete(router.drainByEndpoint, endpoint)
+	delete(router.drainsFailedToConnect, endpoint)
+	router.mutex.Unlock()
+	if !ok {
+		return errors.New("there is no open drain to " + endpoint)
+	}
+	debug.Debugf("[router] Closing drain to %s\n", endpoint)
+	return drain.Close()
+}
+
+// ReopenDrain closes the drain to the endpoint and opens a new one in its place.
+func (router *Router) ReopenDrain(endpoint string) error {
+	if err := router.CloseDrain(endpoint); err != nil {
+		return err
+	}
+	drain, err := router.openDrain(endpoint)
+	if err != nil {
+		if drain != nil {
+			drain.Close()
+		}
+		return err
+	}
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	if _, ok := router.drainByEndpoint[endpoint]; ok {
+		// a packet was sent to the endpoint while we were reopening it, keep the drain it opened.
+		return drain.Close()
+	}
+	router.drainByEndpoint[endpoint] = drain
+	return nil
+}
+
+// Routes returns the routes from every datasource sorted by hostname, routes with invalid
+// hostname patterns or filters are left out.
+func (router *Router) Routes() []storage.LogRoute {
+	router.mutex.RLock()
+	defer router.mutex.RUnlock()
+	routes := make([]storage.LogRoute, 0)
+	for _, rs := range router.routesByHost {
+		for _, route := range rs {
+			routes = append(routes, route.LogRoute)
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Hostname != routes[j].Hostname {
+			return routes[i].Hostname < routes[j].Hostname
+		}
+		if routes[i].Endpoint != routes[j].Endpoint {
+			return routes[i].Endpoint < routes[j].Endpoint
+		}
+		return routes[i].Tag < routes[j].Tag
+	})
+	return routes
+}
+
+// DataSources returns the datasources the router receives routes from.
+func (router *Router) DataSources() []storage.DataSource {
+	return router.datasources
+}
+
+// Inputs returns the amount of packets received from each input by its id.
+func (router *Router) Inputs() map[string]uint64 {
+	router.mutex.RLock()
+	defer router.mutex.RUnlock()
+	inputs := make(map[string]uint64, len(router.inputPackets))
+	for id, packets := range router.inputPackets {
+		inputs[id] = atomic.LoadUint64(packets)
+	}
+	return inputs
+}
+
+// Redactions returns how many values the redact processors (global and per route) have masked per hostname.
+func (router *Router) Redactions() map[string]uint64 {
+	router.mutex.RLock()
+	defer router.mutex.RUnlock()
+	redactions := router.processors.Redactions()
+	for _, routes := range router.routesByHost {
+		for _, route := range routes {
+			for host, count := range route.processors.Redactions() {
+				redactions[host] += count
+			}
+		}
+	}
+	return redactions
+}
+
+// DeadPackets returns the amount of packets dropped because no route matched them.
 func (router *Router) DeadPackets() int {
-	return router.deadPacket
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	var dead uint64
+	for key, count := range router.drops {
+		if key.Reason == DropNoRoute {
+			dead += count
+		}
+	}
+	return int(dead)
+}
+
+// Drops returns the amount of packets dropped by reason, hostname and endpoint.
+func (router *Router) Drops() map[DropKey]uint64 {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	drops := make(map[DropKey]uint64, len(router.drops))
+	for key, count := range router.drops {
+		drops[key] = count
+	}
+	return drops
+}
+
+// SetDeadLetter sends packets that are dropped to the endpoint with the reason they were
+// dropped added to the start of the message, e.g. "[dropped: buffer_full] ...". Packets
+// that can't be sent to the dead letter endpoint are only counted.
+func (router *Router) SetDeadLetter(endpoint string) error {
+	drain, err := Create(endpoint, router.maxConnections, router.stickyPools)
+	if err != nil {
+		return err
+	}
+	router.mutex.Lock()
+	bufferPath, bufferMaxBytes := router.bufferPath, router.bufferMaxBytes
+	drain.options = router.outputOptions
+	router.mutex.Unlock()
+	if bufferPath != "" {
+		// kept apart from the buffer of a route to the same endpoint
+		if err := drain.Buffer(filepath.Join(bufferPath, "deadletter"), bufferMaxBytes); err != nil {
+			return err
+		}
+	}
+	if err := drain.Dial(); err != nil {
+		drain.Close()
+		return err
+	}
+	router.mutex.Lock()
+	previous := router.deadLetter
+	router.deadLetter = drain
+	router.mutex.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	debug.Debugf("[router] Sending dropped packets to %s\n", endpoint)
+	return nil
+}
+
+// drop counts the dropped packet and sends it to the dead letter endpoint if there is one,
+// filtered packets are only counted.
+func (router *Router) drop(reason string, endpoint string, packet syslog.Packet) {
+	router.mutex.Lock()
+	router.drops[DropKey{Reason: reason, Hostname: packet.Hostname, Endpoint: endpoint}]++
+	deadLetter := router.deadLetter
+	router.mutex.Unlock()
+	if deadLetter == nil || deadLetter.Endpoint == endpoint || reason == DropFiltered {
+		return
+	}
+	packet.Message = "[dropped: " + reason + "] " + packet.Message
+	if !deadLetter.Send(packet) {
+		reason = DropBufferFull
+		if deadLetter.Paused() {
+			reason = DropPaused
+		}
+		router.mutex.Lock()
+		router.drops[DropKey{Reason: reason, Hostname: packet.Hostname, Endpoint: deadLetter.Endpoint}]++
+		router.mutex.Unlock()
+	}
 }
 
 func (router *Router) ResetMetrics() {
 	router.mutex.Lock()
 	defer router.mutex.Unlock()
-	for _, endpoints := range router.endpointsByHost {
-		for _, endpoint := range endpoints {
-			if drain, ok := router.drainByEndpoint[endpoint]; ok {
+	for _, routes := range router.routesByHost {
+		for _, route := range routes {
+			if drain, ok := router.drainByEndpoint[route.Endpoint]; ok {
 				drain.ResetMetrics()
 			}
+			route.processors.ResetRedactions()
 		}
 	}
-	router.deadPacket = 0
+	router.processors.ResetRedactions()
+	router.drops = make(map[DropKey]uint64)
 }
 
 func (router *Router) Close() error {
 	debug.Debugf("[router] Closing router...\n")
+	router.mutex.Lock()
+	// stops drains from being reconnected in the background.
+	router.drainsFailedToConnect = make(map[string]bool)
+	router.mutex.Unlock()
 	router.stop <- struct{}{}
 	close(router.stop)
 	close(router.reloop)
@@ -152,7 +389,10 @@ func (router *Router) AddInput(in input.Input, id string) error {
 	if _, ok := router.inputs[id]; ok {
 		return errors.New("This input id already exists.")
 	}
+	router.mutex.Lock()
 	router.inputs[id] = in
+	router.inputPackets[id] = new(uint64)
+	router.mutex.Unlock()
 	router.reloop <- struct{}{}
 	debug.Debugf("[router] Adding input to router %s...\n", id)
 	return nil
@@ -160,58 +400,186 @@ func (router *Router) AddInput(in input.Input, id string) error {
 
 func (router *Router) RemoveInput(id string) error {
 	if _, ok := router.inputs[id]; ok {
+		router.mutex.Lock()
 		delete(router.inputs, id)
+		delete(router.inputPackets, id)
+		router.mutex.Unlock()
 		router.reloop <- struct{}{}
 	}
 	debug.Debugf("[router] Removing input from router %s...\n", id)
 	return nil
 }
 
+// SetProcessors sets the processors applied to every packet before it's routed, routes
+// may have their own processors which are applied afterwards.
+func (router *Router) SetProcessors(processors processor.Chain) {
+	router.mutex.Lock()
+	router.processors = processors
+	router.mutex.Unlock()
+	if router.running {
+		select {
+		case router.reloop <- struct{}{}:
+		default:
+		}
+	}
+	debug.Debugf("[router] Setting %d processors...\n", len(processors))
+}
+
+// SetDrainBuffer gives drains created from now on a disk buffer of up to maxBytes in a
+// directory under path, packets that would otherwise be dropped while an endpoint is slow
+// or down are written to it and replayed in order once it recovers.
+func (router *Router) SetDrainBuffer(path string, maxBytes int64) error {
+	if maxBytes < 1 {
+		return errors.New("the maximum size of the drain buffer must be more than 0")
+	}
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	router.bufferPath = path
+	router.bufferMaxBytes = maxBytes
+	return nil
+}
+
+// SetOutputOptions sets the options given to the outputs of drains created from now on.
+func (router *Router) SetOutputOptions(options output.Options) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	router.outputOptions = options
+}
+
+// IsHostnamePattern returns true if the hostname of a route is a glob (*.payments)
+// or a regular expression surrounded by slashes (/^api-.*-prod$/).
+func IsHostnamePattern(hostname string) bool {
+	return (len(hostname) > 1 && strings.HasPrefix(hostname, "/") && strings.HasSuffix(hostname, "/")) ||
+		strings.ContainsAny(hostname, "*?")
+}
+
+// CompileHostnamePattern compiles a hostname pattern into a regular expression, in
+// globs a * matches any amount of characters and a ? matches one character.
+func CompileHostnamePattern(hostname string) (*regexp.Regexp, error) {
+	if len(hostname) > 1 && strings.HasPrefix(hostname, "/") && strings.HasSuffix(hostname, "/") {
+		return regexp.Compile(hostname[1 : len(hostname)-1])
+	}
+	glob := strings.ReplaceAll(strings.ReplaceAll(regexp.QuoteMeta(hostname), "\\*", ".*"), "\\?", ".")
+	return regexp.Compile("^" + glob + "$")
+}
+
+// routesForHost returns the routes a packet from the hostname could be sent through. Exact
+// hostnames are a map lookup, if patterns are defined the result of matching them is cached
+// per hostname so patterns are not evaluated on every packet. Only a cache miss takes the
+// write lock.
+func (router *Router) routesForHost(hostname string) ([]filteredRoute, bool) {
+	router.mutex.RLock()
+	if len(router.hostnamePatterns) == 0 {
+		routes, ok := router.routesByHost[hostname]
+		router.mutex.RUnlock()
+		return routes, ok
+	}
+	routes, ok := router.routesByHostCache[hostname]
+	router.mutex.RUnlock()
+	if ok {
+		return routes, len(routes) > 0
+	}
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	routes = make([]filteredRoute, 0)
+	routes = append(routes, router.routesByHost[hostname]...)
+	for pattern, re := range router.hostnamePatterns {
+		if re.MatchString(hostname) {
+			routes = append(routes, router.routesByHost[pattern]...)
+		}
+	}
+	if len(router.routesByHostCache) >= maxHostnameCacheSize {
+		router.routesByHostCache = make(map[string][]filteredRoute)
+	}
+	router.routesByHostCache[hostname] = routes
+	return routes, len(routes) > 0
+}
+
+// routesForPacket returns the routes the packet should be sent through, only the first
+// matching route is returned if more than one route matching the packet points to an endpoint.
+func routesForPacket(routes []filteredRoute, packet syslog.Packet) []*filteredRoute {
+	matched := make([]*filteredRoute, 0, len(routes))
+	for i := range routes {
+		route := &routes[i]
+		if !route.Matches(packet) {
+			continue
+		}
+		var found = false
+		for _, m := range matched {
+			if m.Endpoint == route.Endpoint {
+				found = true
+			}
+		}
+		if !found {
+			matched = append(matched, route)
+		}
+	}
+	return matched
+}
+
 func (router *Router) addRoute(r storage.LogRoute) {
-	debug.Debugf("[router] addRoute called %s->%s...\n", r.Hostname, r.Endpoint)
+	debug.Debugf("[router] addRoute called %s->%s (tag: %s)...\n", r.Hostname, r.Endpoint, r.Tag)
 	router.mutex.Lock()
 	defer router.mutex.Unlock()
-	if endpoints, ok := router.endpointsByHost[r.Hostname]; ok {
+	if IsHostnamePattern(r.Hostname) {
+		if _, ok := router.hostnamePatterns[r.Hostname]; !ok {
+			re, err := CompileHostnamePattern(r.Hostname)
+			if err != nil {
+				debug.Errorf("[router] addRoute called with an invalid hostname pattern %s->%s: %s\n", r.Hostname, r.Endpoint, err.Error())
+				return
+			}
+			router.hostnamePatterns[r.Hostname] = re
+		}
+	}
+	compiled, err := compileRoute(r)
+	if err != nil {
+		debug.Errorf("[router] addRoute called with an invalid filter %s->%s: %s\n", r.Hostname, r.Endpoint, err.Error())
+		return
+	}
+	router.routesByHostCache = make(map[string][]filteredRoute)
+	if routes, ok := router.routesByHost[r.Hostname]; ok {
 		var found = false
-		for _, endpoint := range endpoints {
-			if r.Endpoint == endpoint {
+		for _, route := range routes {
+			if storage.SameRoute(r, route.LogRoute) {
 				found = true
 			}
 		}
 		if !found {
-			router.endpointsByHost[r.Hostname] = append(router.endpointsByHost[r.Hostname], r.Endpoint)
+			router.routesByHost[r.Hostname] = append(router.routesByHost[r.Hostname], compiled)
 		} else {
-			debug.Debugf("[router] addRoute called but route already exists %s->%s\n", r.Hostname, r.Endpoint)
+			debug.Debugf("[router] addRoute called but route already exists %s->%s (tag: %s)\n", r.Hostname, r.Endpoint, r.Tag)
 		}
 	} else {
-		router.endpointsByHost[r.Hostname] = make([]string, 0)
-		router.endpointsByHost[r.Hostname] = append(router.endpointsByHost[r.Hostname], r.Endpoint)
+		router.routesByHost[r.Hostname] = make([]filteredRoute, 0)
+		router.routesByHost[r.Hostname] = append(router.routesByHost[r.Hostname], compiled)
 	}
 }
 
 func (router *Router) removeRoute(r storage.LogRoute) {
-	debug.Debugf("[router] removeRoute called %s->%s...\n", r.Hostname, r.Endpoint)
+	debug.Debugf("[router] removeRoute called %s->%s (tag: %s)...\n", r.Hostname, r.Endpoint, r.Tag)
 	router.mutex.Lock()
 	defer router.mutex.Unlock()
-	if endpoints, ok := router.endpointsByHost[r.Hostname]; ok {
-		eps := make([]string, 0)
-		for _, e := range endpoints {
-			if e != r.Endpoint {
-				eps = append(eps, e)
+	if routes, ok := router.routesByHost[r.Hostname]; ok {
+		rs := make([]filteredRoute, 0)
+		for _, route := range routes {
+			if !storage.SameRoute(r, route.LogRoute) {
+				rs = append(rs, route)
 			}
 		}
-		if len(eps) > 0 {
-			router.endpointsByHost[r.Hostname] = eps
+		if len(rs) > 0 {
+			router.routesByHost[r.Hostname] = rs
 		} else {
-			delete(router.endpointsByHost, r.Hostname)
+			delete(router.routesByHost, r.Hostname)
+			delete(router.hostnamePatterns, r.Hostname)
 		}
+		router.routesByHostCache = make(map[string][]filteredRoute)
 	} else {
-		debug.Debugf("[router] Remove route was called but route didn't exist in endpointsByHost %s->%s...\n", r.Hostname, r.Endpoint)
+		debug.Debugf("[router] Remove route was called but route didn't exist in routesByHost %s->%s...\n", r.Hostname, r.Endpoint)
 	}
 	var foundUnusedEndpoint = true
-	for _, endpoints := range router.endpointsByHost {
-		for _, endpoint := range endpoints {
-			if endpoint == r.Endpoint {
+	for _, routes := range router.routesByHost {
+		for _, route := range routes {
+			if route.Endpoint == r.Endpoint {
 				foundUnusedEndpoint = false
 			}
 		}
@@ -221,6 +589,9 @@ func (router *Router) removeRoute(r storage.LogRoute) {
 		drain.Close()
 		delete(router.drainByEndpoint, r.Endpoint)
 	}
+	if foundUnusedEndpoint {
+		delete(router.drainsFailedToConnect, r.Endpoint)
+	}
 }
 
 func (router *Router) refreshRoutes() error {
@@ -237,9 +608,9 @@ func (router *Router) refreshRoutes() error {
 	}
 	for _, route := range routes {
 		var found = false
-		for k, v := range router.endpointsByHost {
+		for _, v := range router.routesByHost {
 			for _, z := range v {
-				if z == route.Endpoint && k == route.Hostname {
+				if storage.SameRoute(z.LogRoute, route) {
 					found = true
 				}
 			}
@@ -248,16 +619,175 @@ func (router *Router) refreshRoutes() error {
 			router.removeRoute(route)
 		}
 	}
-	debug.Debugf("[router] refreshRoutes finished with %d routes\n", len(router.endpointsByHost))
+	debug.Debugf("[router] refreshRoutes finished with %d routes\n", len(router.routesByHost))
 	return nil
 }
 
+// route sends the packet to the drains of the routes it matches.
+func (router *Router) route(packet syslog.Packet) {
+	routes, ok := router.routesForHost(packet.Hostname)
+	if !ok {
+		router.drop(DropNoRoute, "", packet)
+		return
+	}
+	matched := routesForPacket(routes, packet)
+	if len(matched) == 0 {
+		for i := range routes {
+			if routes[i].MatchesTag(packet.Tag) {
+				router.drop(DropFiltered, "", packet)
+				return
+			}
+		}
+		router.drop(DropNoRoute, "", packet)
+		return
+	}
+	for _, route := range matched {
+		if len(route.processors) == 0 {
+			router.send(route.Endpoint, packet)
+		} else {
+			processed := route.processors.Process(packet)
+			if len(processed) == 0 {
+				router.drop(DropFiltered, route.Endpoint, packet)
+			}
+			for _, p := range processed {
+				router.send(route.Endpoint, p)
+			}
+		}
+	}
+}
+
+// send hands the packet to the drain for the endpoint, creating the drain if needed.
+func (router *Router) send(endpoint string, packet syslog.Packet) {
+	router.mutex.RLock()
+	drain, ok := router.drainByEndpoint[endpoint]
+	failed := router.drainsFailedToConnect[endpoint]
+	router.mutex.RUnlock()
+	if ok {
+		if !drain.Send(packet) {
+			if drain.Paused() {
+				router.drop(DropPaused, endpoint, packet)
+			} else if failed {
+				router.drop(DropFailedToConnect, endpoint, packet)
+			} else {
+				router.drop(DropBufferFull, endpoint, packet)
+			}
+		}
+	} else if failed {
+		// the drain is being reconnected in the background, rather than dialing on every packet.
+		router.drop(DropFailedToConnect, endpoint, packet)
+	} else {
+		debug.Debugf("[router] Creating new drain to %s, using it for host %s\n", endpoint, packet.Hostname)
+		drain, err := router.openDrain(endpoint)
+		if err != nil {
+			debug.Errorf("[router] Error creating new drain to %s, for host %s: %s\n", endpoint, packet.Hostname, err.Error())
+			router.mutex.Lock()
+			router.drainsFailedToConnect[endpoint] = true
+			if drain != nil && drain.queue != nil {
+				// keep the drain so packets are written to its buffer until the endpoint is back.
+				router.drainByEndpoint[endpoint] = drain
+			} else {
+				drain = nil
+			}
+			router.mutex.Unlock()
+			go router.redial(endpoint, drain)
+			if drain == nil || !drain.Send(packet) {
+				router.drop(DropFailedToConnect, endpoint, packet)
+			}
+		} else {
+			debug.Errorf("[router] Successfully created new drain to %s, for host %s\n", endpoint, packet.Hostname)
+			router.mutex.Lock()
+			router.drainByEndpoint[endpoint] = drain
+			router.mutex.Unlock()
+			if !drain.Send(packet) {
+				router.drop(DropBufferFull, endpoint, packet)
+			}
+		}
+	}
+}
+
+// redial connects the drain to the endpoint in the background, waiting longer after each failed
+// attempt. If the drain is nil a new drain is opened on each attempt. It stops once the drain is
+// closed, the endpoint is no longer routed to or the router is closed.
+func (router *Router) redial(endpoint string, drain *Drain) {
+	backoff := redialMinBackoff
+	for {
+		<-time.NewTimer(backoff).C
+		router.mutex.RLock()
+		failed := router.drainsFailedToConnect[endpoint]
+		current, ok := router.drainByEndpoint[endpoint]
+		router.mutex.RUnlock()
+		if !failed || (drain != nil && current != drain) || (drain == nil && ok) {
+			return
+		}
+		var err error
+		if drain == nil {
+			var opened *Drain
+			if opened, err = router.openDrain(endpoint); err == nil {
+				router.mutex.Lock()
+				if _, ok := router.drainByEndpoint[endpoint]; ok || !router.drainsFailedToConnect[endpoint] {
+					router.mutex.Unlock()
+					opened.Close()
+					return
+				}
+				router.drainByEndpoint[endpoint] = opened
+				delete(router.drainsFailedToConnect, endpoint)
+				router.mutex.Unlock()
+			} else if opened != nil {
+				opened.Close()
+			}
+		} else if err = drain.Dial(); err == nil {
+			router.mutex.Lock()
+			if router.drainByEndpoint[endpoint] == drain {
+				delete(router.drainsFailedToConnect, endpoint)
+			}
+			router.mutex.Unlock()
+		}
+		if err == nil {
+			debug.Infof("[router] Reconnected drain to %s\n", endpoint)
+			return
+		}
+		debug.Debugf("[router] Unable to reconnect drain to %s, trying again in %s: %s\n", endpoint, backoff*2, err.Error())
+		if backoff = backoff * 2; backoff > redialMaxBackoff {
+			backoff = redialMaxBackoff
+		}
+	}
+}
+
+// openDrain creates and dials a drain to the endpoint, with a disk buffer if one is set. If only
+// dialing fails the drain is returned with the error, it may be dialed again or must be closed.
+func (router *Router) openDrain(endpoint string) (*Drain, error) {
+	drain, err := Create(endpoint, router.maxConnections, router.stickyPools)
+	if err != nil {
+		return nil, err
+	}
+	router.mutex.Lock()
+	bufferPath, bufferMaxBytes := router.bufferPath, router.bufferMaxBytes
+	drain.options = router.outputOptions
+	router.mutex.Unlock()
+	if bufferPath != "" {
+		if err := drain.Buffer(bufferPath, bufferMaxBytes); err != nil {
+			debug.Errorf("[router] Unable to create a buffer for the drain to %s, continuing without one: %s\n", endpoint, err.Error())
+		}
+	}
+	if err := drain.Dial(); err != nil {
+		return drain, err
+	}
+	return drain, nil
+}
+
 func (router *Router) writeLoop() {
 	for {
-		chans := make([]chan syslog.Packet, len(router.inputs))
-		for _, in := range router.inputs {
+		router.mutex.Lock()
+		processors := router.processors
+		router.mutex.Unlock()
+		chans := make([]chan syslog.Packet, 0, len(router.inputs))
+		counts := make([]*uint64, 0, len(router.inputs))
+		router.mutex.Lock()
+		for id, in := range router.inputs {
 			chans = append(chans, in.Packets())
+			counts = append(counts, router.inputPackets[id])
 		}
+		router.mutex.Unlock()
 		inputs := make([]reflect.SelectCase, 0)
 		// THIS MUST BE ENTRY 0, DO NOT MOVE.
 		inputs = append(inputs, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(router.stop)})
@@ -277,38 +807,17 @@ func (router *Router) writeLoop() {
 				continue
 			}
 			if packet, ok := value.Interface().(syslog.Packet); ok {
-				if endpoints, ok := router.endpointsByHost[packet.Hostname]; ok {
-					for _, endpoint := range endpoints {
-						if drain, ok := router.drainByEndpoint[endpoint]; ok {
-							select {
-							case drain.Input <- packet:
-							default:
-							}
-						} else {
-							debug.Debugf("[router] Creating new drain to %s, using it for host %s\n", endpoint, packet.Hostname)
-							drain, err := Create(endpoint, router.maxConnections, router.stickyPools)
-							if err != nil {
-								debug.Errorf("[router] Error creating new drain to %s, for host %s: %s\n", endpoint, packet.Hostname, err.Error())
-								router.drainsFailedToConnect[endpoint] = true
-							} else {
-								if err := drain.Dial(); err != nil {
-									debug.Errorf("[router] Error dailing new drain to %s, for host %s: %s\n", endpoint, packet.Hostname, err.Error())
-									router.drainsFailedToConnect[endpoint] = true
-								} else {
-									debug.Errorf("[router] Successfully created new drain to %s, for host %s\n", endpoint, packet.Hostname)
-									router.mutex.Lock()
-									router.drainByEndpoint[endpoint] = drain
-									router.mutex.Unlock()
-									select {
-									case drain.Input <- packet:
-									default:
-									}
-								}
-							}
-						}
-					}
+				atomic.AddUint64(counts[chosen-2], 1)
+				if len(processors) == 0 {
+					router.route(packet)
 				} else {
-					router.deadPacket++
+					processed := processors.Process(packet)
+					if len(processed) == 0 {
+						router.drop(DropFiltered, "", packet)
+					}
+					for _, p := range processed {
+						router.route(p)
+					}
 				}
 			} else if chosen == 0 /* stop */ {
 				debug.Debugf("[router] writeLoop exiting.\n")
@@ -2,9 +2,18 @@ package router
 
 import (
 	"github.com/akkeris/logtrain/internal/storage"
+	"github.com/akkeris/logtrain/pkg/input/forward"
+	"github.com/akkeris/logtrain/pkg/input/otlp"
+	"github.com/akkeris/logtrain/pkg/processor"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/trevorlinton/remote_syslog2/syslog"
+	"github.com/vmihailenco/msgpack/v5"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -143,7 +152,9 @@ func TestRouter(t *testing.T) {
 			So(false, ShouldEqual, true)
 		}
 
+		So(router.Inputs()["someid"], ShouldEqual, 5)
 		So(router.RemoveInput("someid"), ShouldBeNil)
+		So(router.Inputs(), ShouldBeEmpty)
 	})
 	Convey("Ensure we can get metrics", t, func() {
 		metrics := router.Metrics()
@@ -156,3 +167,525 @@ func TestRouter(t *testing.T) {
 		server.Close()
 	})
 }
+
+func TestRouterHostnamePatterns(t *testing.T) {
+	Convey("Ensure hostname patterns are recognized and compiled", t, func() {
+		So(IsHostnamePattern("app.payments"), ShouldEqual, false)
+		So(IsHostnamePattern("*.payments"), ShouldEqual, true)
+		So(IsHostnamePattern("app-?.payments"), ShouldEqual, true)
+		So(IsHostnamePattern("/^api-.*-prod$/"), ShouldEqual, true)
+		So(IsHostnamePattern("/"), ShouldEqual, false)
+		re, err := CompileHostnamePattern("*.payments")
+		So(err, ShouldBeNil)
+		So(re.MatchString("app.payments"), ShouldEqual, true)
+		So(re.MatchString("app.payments.other"), ShouldEqual, false)
+		So(re.MatchString("apppayments"), ShouldEqual, false)
+		re, err = CompileHostnamePattern("app-?.payments")
+		So(err, ShouldBeNil)
+		So(re.MatchString("app-1.payments"), ShouldEqual, true)
+		So(re.MatchString("app-12.payments"), ShouldEqual, false)
+		re, err = CompileHostnamePattern("/^api-.*-prod$/")
+		So(err, ShouldBeNil)
+		So(re.MatchString("api-orders-prod"), ShouldEqual, true)
+		So(re.MatchString("api-orders-dev"), ShouldEqual, false)
+		_, err = CompileHostnamePattern("/^api-(.*-prod$/")
+		So(err, ShouldNotBeNil)
+	})
+
+	server, err := CreateSudoSyslogServer("10514")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go server.Listen()
+	ds := storage.CreateMemoryDataSource()
+	ds.EmitNewRoute(storage.LogRoute{
+		Endpoint: "syslog+tcp://localhost:10514/",
+		Hostname: "*.payments",
+	})
+	input := FakeInput{
+		errors:  make(chan error, 1),
+		packets: make(chan syslog.Packet, 1),
+	}
+	router, err := NewRouter([]storage.DataSource{ds}, true, 40)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	Convey("Ensure hostnames are resolved to exact and pattern routes", t, func() {
+		router.addRoute(storage.LogRoute{Endpoint: "syslog+tcp://localhost:10599/", Hostname: "app.payments"})
+		router.addRoute(storage.LogRoute{Endpoint: "syslog+tcp://localhost:10599/", Hostname: "/^app\\./"})
+		router.addRoute(storage.LogRoute{Endpoint: "syslog+tcp://localhost:10598/", Hostname: "/^app-(/"})
+		routes, ok := router.routesForHost("app.payments")
+		So(ok, ShouldEqual, true)
+		So(len(endpointsForPacket(routes, syslog.Packet{})), ShouldEqual, 2)
+		routes, ok = router.routesForHost("other.payments")
+		So(ok, ShouldEqual, true)
+		So(endpointsForPacket(routes, syslog.Packet{}), ShouldResemble, []string{"syslog+tcp://localhost:10514/"})
+		_, ok = router.routesForHost("other.orders")
+		So(ok, ShouldEqual, false)
+		So(len(router.routesByHostCache), ShouldEqual, 3)
+		router.removeRoute(storage.LogRoute{Endpoint: "syslog+tcp://localhost:10599/", Hostname: "/^app\\./"})
+		router.removeRoute(storage.LogRoute{Endpoint: "syslog+tcp://localhost:10599/", Hostname: "app.payments"})
+		So(len(router.routesByHostCache), ShouldEqual, 0)
+		So(len(router.hostnamePatterns), ShouldEqual, 1)
+		routes, ok = router.routesForHost("app.payments")
+		So(ok, ShouldEqual, true)
+		So(endpointsForPacket(routes, syslog.Packet{}), ShouldResemble, []string{"syslog+tcp://localhost:10514/"})
+	})
+	Convey("Ensure routes can change while hostnames are resolved", t, func() {
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 100; i++ {
+				router.addRoute(storage.LogRoute{Endpoint: "syslog+tcp://localhost:10599/", Hostname: "api-?.payments"})
+				router.removeRoute(storage.LogRoute{Endpoint: "syslog+tcp://localhost:10599/", Hostname: "api-?.payments"})
+			}
+			close(done)
+		}()
+		for finished := false; !finished; {
+			select {
+			case <-done:
+				finished = true
+			default:
+				_, ok := router.routesForHost("api-1.payments")
+				So(ok, ShouldEqual, true)
+			}
+		}
+	})
+	Convey("Ensure packets are routed through hostname patterns", t, func() {
+		So(router.AddInput(&input, "someid"), ShouldBeNil)
+		So(router.Dial(), ShouldBeNil)
+		input.Packets() <- syslog.Packet{
+			Severity: 0,
+			Facility: 0,
+			Message:  "Oh hello pattern",
+			Tag:      "test-tag",
+			Hostname: "app.payments",
+			Time:     time.Now(),
+		}
+		select {
+		case message := <-server.Received:
+			So(message.Message, ShouldContainSubstring, "Oh hello pattern")
+		case <-time.NewTimer(time.Second * 2).C:
+			So(false, ShouldEqual, true)
+		}
+		metrics := router.Metrics()
+		_, ok := metrics["*.payments->syslog+tcp://localhost:10514/"]
+		So(ok, ShouldEqual, true)
+	})
+	Convey("Ensure we clean up the pattern router.", t, func() {
+		So(router.Close(), ShouldBeNil)
+		server.Close()
+	})
+}
+
+// TestRouterInputSeverities feeds the router packets created by real inputs, logs that do not
+// say how severe they are must pass an info filter but not an err filter.
+func TestRouterInputSeverities(t *testing.T) {
+	infoServer, err := CreateSudoSyslogServer("10521")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go infoServer.Listen()
+	errServer, err := CreateSudoSyslogServer("10522")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go errServer.Listen()
+	ds := storage.CreateMemoryDataSource()
+	ds.EmitNewRoute(storage.LogRoute{Endpoint: "syslog+tcp://localhost:10521/", Hostname: "app.severity", Severity: "info"})
+	router, err := NewRouter([]storage.DataSource{ds}, true, 40)
+	if err != nil {
+		log.Fatal(err)
+	}
+	otlpInput, err := otlp.Create("", otlp.Mapping{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	forwardInput, err := forward.Create("127.0.0.1:10523", forward.Mapping{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	expect := func(server *SudoSyslogServer, message string) {
+		select {
+		case received := <-server.Received:
+			So(received.Message, ShouldContainSubstring, message)
+		case <-time.NewTimer(time.Second * 2).C:
+			So("no message", ShouldEqual, message)
+		}
+	}
+
+	Convey("Ensure logs without a severity from inputs pass an info filter", t, func() {
+		So(otlpInput.Dial(), ShouldBeNil)
+		So(forwardInput.Dial(), ShouldBeNil)
+		So(router.Dial(), ShouldBeNil)
+		So(router.AddInput(otlpInput, "otlp"), ShouldBeNil)
+		So(router.AddInput(forwardInput, "forward"), ShouldBeNil)
+		ds.EmitNewRoute(storage.LogRoute{Endpoint: "syslog+tcp://localhost:10522/", Hostname: "app.severity", Severity: "err"})
+		for routes, _ := router.routesForHost("app.severity"); len(routes) < 2; routes, _ = router.routesForHost("app.severity") {
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		body := `{"resourceLogs":[{"resource":{"attributes":[{"key":"host.name","value":{"stringValue":"app.severity"}}]},` +
+			`"instrumentationLibraryLogs":[{"logs":[{"body":{"stringValue":"otlp without severity"}}]}]}]}`
+		request := httptest.NewRequest(http.MethodPost, "/v1/logs", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		response := httptest.NewRecorder()
+		otlpInput.HandlerFunc(response, request)
+		So(response.Code, ShouldEqual, http.StatusOK)
+		expect(infoServer, "otlp without severity")
+
+		conn, err := net.Dial("tcp", "127.0.0.1:10523")
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		encoder := msgpack.NewEncoder(conn)
+		So(encoder.Encode([]interface{}{"app.severity", time.Now().Unix(), map[string]interface{}{"log": "forward without severity"}}), ShouldBeNil)
+		expect(infoServer, "forward without severity")
+		So(encoder.Encode([]interface{}{"app.severity", time.Now().Unix(), map[string]interface{}{"log": "forward debug", "severity": "debug"}}), ShouldBeNil)
+		So(encoder.Encode([]interface{}{"app.severity", time.Now().Unix(), map[string]interface{}{"log": "forward error", "severity": "err"}}), ShouldBeNil)
+		expect(infoServer, "forward error")
+		// the first log the err route sees is the error, the others were filtered
+		expect(errServer, "forward error")
+	})
+	Convey("Ensure we clean up the severity router.", t, func() {
+		So(router.Close(), ShouldBeNil)
+		So(otlpInput.Close(), ShouldBeNil)
+		So(forwardInput.Close(), ShouldBeNil)
+		infoServer.Close()
+		errServer.Close()
+	})
+}
+
+func TestRouterTags(t *testing.T) {
+	Convey("Ensure routes only match their tags", t, func() {
+		routes := compileRoutes(
+			storage.LogRoute{Endpoint: "syslog+tcp://localhost:10599/", Hostname: "app.tags", Tag: "web.*"},
+			storage.LogRoute{Endpoint: "syslog+tcp://localhost:10599/", Hostname: "app.tags", Tag: "web.1"},
+			storage.LogRoute{Endpoint: "syslog+tcp://localhost:10598/", Hostname: "app.tags", Tag: "worker"},
+			storage.LogRoute{Endpoint: "syslog+tcp://localhost:10597/", Hostname: "app.tags"},
+		)
+		So(endpointsForPacket(routes, syslog.Packet{Tag: "web.1"}), ShouldResemble, []string{"syslog+tcp://localhost:10599/", "syslog+tcp://localhost:10597/"})
+		So(endpointsForPacket(routes, syslog.Packet{Tag: "worker"}), ShouldResemble, []string{"syslog+tcp://localhost:10598/", "syslog+tcp://localhost:10597/"})
+		So(endpointsForPacket(routes, syslog.Packet{Tag: "worker.1"}), ShouldResemble, []string{"syslog+tcp://localhost:10597/"})
+		So(endpointsForPacket(routes[:3], syslog.Packet{Tag: "release"}), ShouldResemble, []string{})
+	})
+
+	server, err := CreateSudoSyslogServer("10515")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go server.Listen()
+	ds := storage.CreateMemoryDataSource()
+	ds.EmitNewRoute(storage.LogRoute{
+		Endpoint: "syslog+tcp://localhost:10515/",
+		Hostname: "app.tags",
+		Tag:      "web.*",
+	})
+	input := FakeInput{
+		errors:  make(chan error, 1),
+		packets: make(chan syslog.Packet, 1),
+	}
+	router, err := NewRouter([]storage.DataSource{ds}, true, 40)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	Convey("Ensure packets are only routed when their tag matches", t, func() {
+		So(router.AddInput(&input, "someid"), ShouldBeNil)
+		So(router.Dial(), ShouldBeNil)
+		input.Packets() <- syslog.Packet{
+			Message:  "Oh hello worker",
+			Tag:      "worker.1",
+			Hostname: "app.tags",
+			Time:     time.Now(),
+		}
+		input.Packets() <- syslog.Packet{
+			Message:  "Oh hello web",
+			Tag:      "web.1",
+			Hostname: "app.tags",
+			Time:     time.Now(),
+		}
+		select {
+		case message := <-server.Received:
+			So(message.Message, ShouldContainSubstring, "Oh hello web")
+		case <-time.NewTimer(time.Second * 2).C:
+			So(false, ShouldEqual, true)
+		}
+		So(router.DeadPackets(), ShouldEqual, 1)
+	})
+	Convey("Ensure removing a route requires the same tag", t, func() {
+		router.removeRoute(storage.LogRoute{Endpoint: "syslog+tcp://localhost:10515/", Hostname: "app.tags"})
+		_, ok := router.routesForHost("app.tags")
+		So(ok, ShouldEqual, true)
+		router.removeRoute(storage.LogRoute{Endpoint: "syslog+tcp://localhost:10515/", Hostname: "app.tags", Tag: "web.*"})
+		_, ok = router.routesForHost("app.tags")
+		So(ok, ShouldEqual, false)
+	})
+	Convey("Ensure we clean up the tag router.", t, func() {
+		So(router.Close(), ShouldBeNil)
+		server.Close()
+	})
+}
+
+func TestRouterProcessors(t *testing.T) {
+	server, err := CreateSudoSyslogServer("10516")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go server.Listen()
+	ds := storage.CreateMemoryDataSource()
+	ds.EmitNewRoute(storage.LogRoute{
+		Endpoint:   "syslog+tcp://localhost:10516/",
+		Hostname:   "app.processors",
+		Processors: []string{"prefix:[web] ", "redact:email"},
+	})
+	input := FakeInput{
+		errors:  make(chan error, 1),
+		packets: make(chan syslog.Packet, 1),
+	}
+	router, err := NewRouter([]storage.DataSource{ds}, true, 40)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	Convey("Ensure global and route processors are applied", t, func() {
+		processors, err := processor.CreateChain([]string{"drop:healthz", "hostname:^app-prod$=app.processors"})
+		So(err, ShouldBeNil)
+		router.SetProcessors(processors)
+		So(router.AddInput(&input, "someid"), ShouldBeNil)
+		So(router.Dial(), ShouldBeNil)
+		input.Packets() <- syslog.Packet{
+			Message:  "GET /healthz",
+			Tag:      "web.1",
+			Hostname: "app-prod",
+			Time:     time.Now(),
+		}
+		input.Packets() <- syslog.Packet{
+			Message:  "Oh hello processors from jane@example.com",
+			Tag:      "web.1",
+			Hostname: "app-prod",
+			Time:     time.Now(),
+		}
+		select {
+		case message := <-server.Received:
+			So(message.Message, ShouldContainSubstring, "[web] Oh hello processors from [REDACTED]")
+			So(message.Message, ShouldContainSubstring, " app.processors ")
+		case <-time.NewTimer(time.Second * 2).C:
+			So(false, ShouldEqual, true)
+		}
+		So(router.DeadPackets(), ShouldEqual, 0)
+		So(router.Redactions(), ShouldResemble, map[string]uint64{"app.processors": 1})
+		router.ResetMetrics()
+		So(len(router.Redactions()), ShouldEqual, 0)
+	})
+	Convey("Ensure routes with invalid processors are ignored", t, func() {
+		router.addRoute(storage.LogRoute{Endpoint: "syslog+tcp://localhost:10599/", Hostname: "app.invalid", Processors: []string{"explode:now"}})
+		_, ok := router.routesForHost("app.invalid")
+		So(ok, ShouldEqual, false)
+	})
+	Convey("Ensure we clean up the processor router.", t, func() {
+		So(router.Close(), ShouldBeNil)
+		server.Close()
+	})
+}
+
+func TestRouterDeadLetter(t *testing.T) {
+	server, err := CreateSudoSyslogServer("10517")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go server.Listen()
+	ds := storage.CreateMemoryDataSource()
+	ds.EmitNewRoute(storage.LogRoute{
+		Endpoint: "syslog+tcp://localhost:10597/",
+		Hostname: "app.unreachable",
+	})
+	input := FakeInput{
+		errors:  make(chan error, 1),
+		packets: make(chan syslog.Packet, 1),
+	}
+	router, err := NewRouter([]storage.DataSource{ds}, true, 40)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	Convey("Ensure dropped packets are counted and sent to the dead letter endpoint", t, func() {
+		So(router.SetDeadLetter("invalid://localhost"), ShouldNotBeNil)
+		So(router.SetDeadLetter("syslog+tcp://localhost:10517/"), ShouldBeNil)
+		So(router.AddInput(&input, "someid"), ShouldBeNil)
+		So(router.Dial(), ShouldBeNil)
+		ds.EmitNewRoute(storage.LogRoute{Endpoint: "syslog+tcp://localhost:10597/", Hostname: "app.filtered", Include: "^keep"})
+		for _, ok := router.routesForHost("app.filtered"); !ok; _, ok = router.routesForHost("app.filtered") {
+			time.Sleep(time.Millisecond * 10)
+		}
+		input.Packets() <- syslog.Packet{
+			Message:  "Oh hello filtered",
+			Tag:      "web.1",
+			Hostname: "app.filtered",
+			Time:     time.Now(),
+		}
+		input.Packets() <- syslog.Packet{
+			Message:  "Oh hello nobody",
+			Tag:      "web.1",
+			Hostname: "app.noroute",
+			Time:     time.Now(),
+		}
+		select {
+		case message := <-server.Received:
+			So(message.Message, ShouldContainSubstring, "[dropped: no_route] Oh hello nobody")
+		case <-time.NewTimer(time.Second * 2).C:
+			So(false, ShouldEqual, true)
+		}
+		input.Packets() <- syslog.Packet{
+			Message:  "Oh hello unreachable",
+			Tag:      "web.1",
+			Hostname: "app.unreachable",
+			Time:     time.Now(),
+		}
+		select {
+		case message := <-server.Received:
+			So(message.Message, ShouldContainSubstring, "[dropped: failed_to_connect] Oh hello unreachable")
+		case <-time.NewTimer(time.Second * 2).C:
+			So(false, ShouldEqual, true)
+		}
+		So(router.DeadPackets(), ShouldEqual, 1)
+		So(router.Drops(), ShouldResemble, map[DropKey]uint64{
+			DropKey{Reason: DropNoRoute, Hostname: "app.noroute", Endpoint: ""}:                                          1,
+			DropKey{Reason: DropFiltered, Hostname: "app.filtered", Endpoint: ""}:                                        1,
+			DropKey{Reason: DropFailedToConnect, Hostname: "app.unreachable", Endpoint: "syslog+tcp://localhost:10597/"}: 1,
+		})
+		router.ResetMetrics()
+		So(len(router.Drops()), ShouldEqual, 0)
+	})
+	Convey("Ensure we clean up the dead letter router.", t, func() {
+		So(router.Close(), ShouldBeNil)
+		server.Close()
+	})
+}
+
+func TestRouterReconnect(t *testing.T) {
+	ds := storage.CreateMemoryDataSource()
+	ds.EmitNewRoute(storage.LogRoute{
+		Endpoint: "syslog+tcp://localhost:10524/",
+		Hostname: "app.down",
+	})
+	input := FakeInput{
+		errors:  make(chan error, 1),
+		packets: make(chan syslog.Packet, 1),
+	}
+	router, err := NewRouter([]storage.DataSource{ds}, true, 40)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	Convey("Ensure packets to an endpoint that is down are buffered and sent once it is back", t, func() {
+		So(os.RemoveAll("/tmp/router_reconnect_test"), ShouldBeNil)
+		So(router.SetDrainBuffer("/tmp/router_reconnect_test", 1024*1024), ShouldBeNil)
+		So(router.AddInput(&input, "someid"), ShouldBeNil)
+		So(router.Dial(), ShouldBeNil)
+		input.Packets() <- syslog.Packet{
+			Message:  "Oh hello while down",
+			Hostname: "app.down",
+			Time:     time.Now(),
+		}
+		input.Packets() <- syslog.Packet{
+			Message:  "Oh hello again while down",
+			Hostname: "app.down",
+			Time:     time.Now(),
+		}
+		time.Sleep(time.Millisecond * 100)
+		So(router.Drops(), ShouldBeEmpty)
+		So(router.Drains(), ShouldContainKey, "syslog+tcp://localhost:10524/")
+
+		server, err := CreateSudoSyslogServer("10524")
+		So(err, ShouldBeNil)
+		go server.Listen()
+		for _, expected := range []string{"Oh hello while down", "Oh hello again while down"} {
+			select {
+			case message := <-server.Received:
+				So(message.Message, ShouldContainSubstring, expected)
+			case <-time.NewTimer(time.Second * 5).C:
+				So(false, ShouldEqual, true)
+			}
+		}
+		So(router.Close(), ShouldBeNil)
+		server.Close()
+		So(os.RemoveAll("/tmp/router_reconnect_test"), ShouldBeNil)
+	})
+}
+
+func TestRouterDrains(t *testing.T) {
+	server, err := CreateSudoSyslogServer("10519")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go server.Listen()
+	route := storage.LogRoute{
+		Endpoint: "syslog+tcp://localhost:10519/",
+		Hostname: "app.space",
+	}
+	other := storage.LogRoute{
+		Endpoint: "syslog+tcp://localhost:10519/",
+		Hostname: "api.space",
+		Tag:      "web.*",
+	}
+	ds := storage.CreateMemoryDataSource()
+	ds.EmitNewRoute(route)
+	otherDs := storage.CreateMemoryDataSource()
+	otherDs.EmitNewRoute(other)
+	input := FakeInput{
+		errors:  make(chan error, 1),
+		packets: make(chan syslog.Packet, 1),
+	}
+	router, err := NewRouter([]storage.DataSource{ds, otherDs}, true, 40)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	Convey("Ensure routes from all datasources are listed", t, func() {
+		So(router.Routes(), ShouldResemble, []storage.LogRoute{other, route})
+		So(len(router.DataSources()), ShouldEqual, 2)
+	})
+	Convey("Ensure drains can be listed, closed and reopened", t, func() {
+		So(router.AddInput(&input, "someid"), ShouldBeNil)
+		So(router.Dial(), ShouldBeNil)
+		So(router.Drains(), ShouldBeEmpty)
+		input.Packets() <- syslog.Packet{
+			Message:  "Oh hello",
+			Hostname: "app.space",
+			Time:     time.Now(),
+		}
+		select {
+		case message := <-server.Received:
+			So(message.Message, ShouldContainSubstring, "Oh hello")
+		case <-time.NewTimer(time.Second * 2).C:
+			So(false, ShouldEqual, true)
+		}
+		So(router.Inputs(), ShouldResemble, map[string]uint64{"someid": 1})
+		So(router.Drains(), ShouldContainKey, "syslog+tcp://localhost:10519/")
+		So(router.ReopenDrain("syslog+tcp://localhost:10519/"), ShouldBeNil)
+		So(router.Drains(), ShouldContainKey, "syslog+tcp://localhost:10519/")
+		So(router.CloseDrain("syslog+tcp://localhost:10519/"), ShouldBeNil)
+		So(router.Drains(), ShouldBeEmpty)
+		So(router.CloseDrain("syslog+tcp://localhost:10519/"), ShouldNotBeNil)
+		So(router.ReopenDrain("syslog+tcp://localhost:10519/"), ShouldNotBeNil)
+
+		// the drain is opened again by the next packet
+		input.Packets() <- syslog.Packet{
+			Message:  "Oh hello again",
+			Hostname: "app.space",
+			Time:     time.Now(),
+		}
+		select {
+		case message := <-server.Received:
+			So(message.Message, ShouldContainSubstring, "Oh hello again")
+		case <-time.NewTimer(time.Second * 2).C:
+			So(false, ShouldEqual, true)
+		}
+		So(router.RemoveInput("someid"), ShouldBeNil)
+		So(router.Inputs(), ShouldBeEmpty)
+	})
+	Convey("Ensure we clean up the drains router.", t, func() {
+		So(router.Close(), ShouldBeNil)
+		server.Close()
+	})
+}